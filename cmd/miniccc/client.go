@@ -11,6 +11,7 @@ import (
 	"os"
 	"runtime"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/sandia-minimega/minimega/v2/internal/ron"
@@ -24,8 +25,38 @@ var client struct {
 
 	Processes map[int]*Process
 
+	// processes currently executing, keyed by command ID, so that a kill
+	// for a command can find the process it started
+	running map[int]*runningProcess
+
+	// message version advertised by the server in the handshake ACK, empty
+	// for servers that predate versioned messages
+	serverVersion string
+
+	// compress is non-zero once the server is known to support compressed
+	// payloads, accessed atomically since senders may hold the client lock
+	compress int32
+
+	// heartbeatRate is the check-in interval in nanoseconds, accessed
+	// atomically. Defaults to HeartbeatRate and may be changed by the
+	// server at handshake or at runtime.
+	heartbeatRate int64
+
+	// clockOffset is the server's clock minus ours in nanoseconds, accessed
+	// atomically. Measured from the server timestamp on heartbeats and used
+	// to correct absolute schedule times (see ron.Command.At).
+	clockOffset int64
+
+	// schedules stores cancellation channels for scheduled commands, keyed
+	// by command ID
+	schedules map[int]chan struct{}
+
 	lastHeartbeat time.Time
 
+	// lastInventory is when the inventory snapshot was last refreshed, see
+	// updateInventory
+	lastInventory time.Time
+
 	writeMu sync.Mutex
 
 	conn io.ReadWriteCloser
@@ -37,11 +68,40 @@ var client struct {
 }
 
 type Process struct {
+	// ID is assigned by the client when the process starts, see nextProcessID
+	ID int
+
 	PID     int
 	Command []string
+	Started time.Time
+
+	// Exited and ExitCode are set when the process exits on its own; the
+	// process is reported in one more check-in and then forgotten
+	Exited   bool
+	ExitCode int
+
 	process *os.Process
 }
 
+// processCounter generates client-assigned process IDs. Must be accessed with
+// the client lock held.
+var processCounter int
+
+// nextProcessID returns the next client-assigned process ID. Must be called
+// with the client lock held.
+func nextProcessID() int {
+	processCounter++
+	return processCounter
+}
+
+type runningProcess struct {
+	process *os.Process
+
+	// killed records that the process was killed at the server's request so
+	// the exit disposition can say so
+	killed bool
+}
+
 func NewClient() {
 	client.UUID = getUUID()
 	client.Arch = runtime.GOARCH
@@ -49,12 +109,19 @@ func NewClient() {
 	client.Version = version.Revision
 
 	client.Processes = make(map[int]*Process)
+	client.running = make(map[int]*runningProcess)
+	client.schedules = make(map[int]chan struct{})
+	client.heartbeatRate = int64(HeartbeatRate)
 
 	client.commandChan = make(chan map[int]*ron.Command, 1024)
 	client.fileChan = make(chan *ron.Message, 1024)
 }
 
 func sendMessage(m *ron.Message) error {
+	if atomic.LoadInt32(&client.compress) != 0 {
+		m.Compress()
+	}
+
 	client.writeMu.Lock()
 	defer client.writeMu.Unlock()
 
@@ -73,6 +140,80 @@ func appendResponse(r *ron.Response) {
 	client.Responses = append(client.Responses, r)
 }
 
+// serverVersion returns the message version the server advertised during the
+// handshake.
+func serverVersion() string {
+	client.Lock()
+	defer client.Unlock()
+
+	return client.serverVersion
+}
+
+// registerRunning records the process started for a command so that a kill
+// for the command can find it.
+func registerRunning(id int, p *os.Process) {
+	client.Lock()
+	defer client.Unlock()
+
+	client.running[id] = &runningProcess{process: p}
+}
+
+// unregisterRunning removes the process record for a command once it has
+// exited and reports whether it was killed at the server's request.
+func unregisterRunning(id int) bool {
+	client.Lock()
+	defer client.Unlock()
+
+	killed := client.running[id] != nil && client.running[id].killed
+	delete(client.running, id)
+
+	return killed
+}
+
+// clockOffset returns the measured difference between the server's clock and
+// ours.
+func clockOffset() time.Duration {
+	return time.Duration(atomic.LoadInt64(&client.clockOffset))
+}
+
+// setClockOffset records the skew between the server's clock and ours from a
+// server timestamp. Zero times come from servers that predate schedules and
+// are ignored.
+func setClockOffset(t time.Time) {
+	if t.IsZero() {
+		return
+	}
+
+	atomic.StoreInt64(&client.clockOffset, int64(time.Until(t)))
+}
+
+// killCommand kills the process started by the given command, if it is still
+// running, and cancels any pending scheduled runs.
+func killCommand(id int) {
+	client.Lock()
+	defer client.Unlock()
+
+	if cancel, ok := client.schedules[id]; ok {
+		log.Info("cancelling schedule for command %v", id)
+
+		close(cancel)
+		delete(client.schedules, id)
+	}
+
+	if rp, ok := client.running[id]; ok {
+		log.Info("killing command %v", id)
+
+		rp.killed = true
+		if err := killProcessGroup(rp.process); err != nil {
+			log.Errorln(err)
+		}
+
+		return
+	}
+
+	log.Debug("kill for command %v, which is not running", id)
+}
+
 func addTag(k, v string) {
 	log.Debug("tag: %v %v", k, v)
 
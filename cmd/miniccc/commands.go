@@ -8,10 +8,13 @@ import (
 	"bufio"
 	"bytes"
 	"fmt"
+	"io"
 	"net"
 	"net/url"
+	"os"
 	"os/exec"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"time"
 
@@ -28,7 +31,7 @@ func processCommand(cmd *ron.Command) {
 
 	// get any files needed for the command
 	if len(cmd.FilesSend) != 0 {
-		recvFiles(cmd.FilesSend)
+		recvFiles(cmd)
 	}
 
 	// kill processes before starting new ones
@@ -38,6 +41,9 @@ func processCommand(cmd *ron.Command) {
 	if cmd.KillAll != "" {
 		killAll(cmd.KillAll)
 	}
+	if cmd.KillCID != 0 {
+		killCommand(cmd.KillCID)
+	}
 
 	// adjust the log level, if a new level is provided
 	if cmd.Level != nil {
@@ -45,8 +51,17 @@ func processCommand(cmd *ron.Command) {
 		log.SetLevelAll(*cmd.Level)
 	}
 
+	// start, adjust, or stop forwarding our logs to the server
+	if cmd.LogForward != nil {
+		setLogForward(cmd.LogForward)
+	}
+
 	if len(cmd.Command) != 0 {
-		resp.Stdout, resp.Stderr = runCommand(cmd.Stdin, cmd.Stdout, cmd.Stderr, cmd.Command, cmd.Background)
+		if cmd.Scheduled() {
+			scheduleCommand(cmd)
+		} else {
+			runCommand(cmd, resp)
+		}
 	}
 
 	if cmd.ConnTest != nil {
@@ -54,12 +69,76 @@ func processCommand(cmd *ron.Command) {
 	}
 
 	if len(cmd.FilesRecv) != 0 {
-		sendFiles(cmd.ID, cmd.FilesRecv)
+		sendFiles(cmd, resp)
 	}
 
 	appendResponse(resp)
 }
 
+// scheduleCommand runs a command at its scheduled start time, repeating it
+// at its interval until the run count is reached or the schedule is
+// cancelled by a kill for the command. Each run reports its own response
+// with an increasing run number.
+func scheduleCommand(cmd *ron.Command) {
+	cancel := make(chan struct{})
+
+	client.Lock()
+	if _, ok := client.schedules[cmd.ID]; ok {
+		// already scheduled by an earlier delivery of the command
+		client.Unlock()
+		return
+	}
+	client.schedules[cmd.ID] = cancel
+	client.Unlock()
+
+	delay := cmd.After
+	if !cmd.At.IsZero() {
+		// At is in the server's clock; correct for skew with the offset
+		// measured from the server's timestamps
+		delay = time.Until(cmd.At.Add(-clockOffset()))
+	}
+
+	log.Info("scheduling command %v in %v", cmd.ID, delay)
+
+	go func() {
+		defer func() {
+			client.Lock()
+			delete(client.schedules, cmd.ID)
+			client.Unlock()
+		}()
+
+		if delay > 0 {
+			t := time.NewTimer(delay)
+			select {
+			case <-t.C:
+			case <-cancel:
+				t.Stop()
+				log.Info("schedule for command %v cancelled", cmd.ID)
+				return
+			}
+		}
+
+		for run := 1; ; run++ {
+			resp := &ron.Response{ID: cmd.ID, Run: run}
+			runCommand(cmd, resp)
+			appendResponse(resp)
+
+			if cmd.Interval <= 0 || (cmd.Count > 0 && run >= cmd.Count) {
+				return
+			}
+
+			t := time.NewTimer(cmd.Interval)
+			select {
+			case <-t.C:
+			case <-cancel:
+				t.Stop()
+				log.Info("schedule for command %v cancelled", cmd.ID)
+				return
+			}
+		}
+	}()
+}
+
 // lookPath wraps exec.LookPath to check $PATH and the files path
 func lookPath(file string) (string, error) {
 	path, err := exec.LookPath(file)
@@ -76,33 +155,88 @@ func lookPath(file string) (string, error) {
 	return exec.LookPath(file)
 }
 
-func runCommand(stdin, stdout, stderr string, command []string, background bool) (string, string) {
+func runCommand(cmd *ron.Command, resp *ron.Response) {
 	done := make(chan struct{})
 	var bufout, buferr bytes.Buffer
 
-	path, err := lookPath(command[0])
+	// receives the write result once input has been delivered to stdin
+	var inputDone chan bool
+
+	// stream output from foreground commands back to the server as it is
+	// produced, in addition to buffering it for the final response. Output
+	// from periodic commands is recorded per run instead of streamed.
+	var st *streamer
+	if !cmd.Background && cmd.Interval <= 0 {
+		st = &streamer{id: cmd.ID}
+	}
+
+	// relative command paths resolve inside the working directory, when the
+	// command sets one
+	name := cmd.Command[0]
+	if cmd.Dir != "" && !filepath.IsAbs(name) && strings.Contains(name, "/") {
+		name = filepath.Join(cmd.Dir, name)
+	}
+
+	path, err := lookPath(name)
 	if err != nil {
 		log.Errorln(err)
 		close(done)
-		return "", err.Error()
+		resp.Stderr = err.Error()
+		return
 	}
 
-	cmd := &exec.Cmd{
+	p := &exec.Cmd{
 		Path: path,
-		Args: command,
+		Args: cmd.Command,
+		Dir:  cmd.Dir,
+	}
+	resp.Dir = cmd.Dir
+
+	// run the command in its own process group so that a timeout or kill
+	// takes out any children it spawns too
+	setupProcessGroup(p)
+
+	// switching users must work or the command must not run at all
+	if cmd.User != "" {
+		if err := setupUser(p, cmd.User); err != nil {
+			err = fmt.Errorf("cannot run as user %v: %v", cmd.User, err)
+			log.Errorln(err)
+			close(done)
+			resp.Stderr = err.Error()
+			return
+		}
+
+		resp.User = cmd.User
+	}
+
+	if len(cmd.Env) > 0 {
+		// layer the command's environment over our own, dropping any of our
+		// values it overrides
+		for _, e := range os.Environ() {
+			parts := strings.SplitN(e, "=", 2)
+			if _, ok := cmd.Env[parts[0]]; ok {
+				continue
+			}
+
+			p.Env = append(p.Env, e)
+		}
+
+		for k, v := range cmd.Env {
+			p.Env = append(p.Env, k+"="+v)
+		}
 	}
 
-	if stdin != "" {
-		pStdin, err := cmd.StdinPipe()
+	if cmd.Stdin != "" {
+		pStdin, err := p.StdinPipe()
 		if err != nil {
 			log.Errorln(err)
-			return "", ""
+			return
 		}
 
-		cStdin, err := NewPlumberReader(stdin)
+		cStdin, err := NewPlumberReader(cmd.Stdin)
 		if err != nil {
 			log.Errorln(err)
-			return "", ""
+			return
 		}
 
 		go func() {
@@ -120,21 +254,41 @@ func runCommand(stdin, stdout, stderr string, command []string, background bool)
 			}
 			pStdin.Close()
 		}()
+	} else if cmd.Input != "" {
+		pStdin, err := p.StdinPipe()
+		if err != nil {
+			log.Errorln(err)
+			close(done)
+			return
+		}
+
+		// write the input and then close stdin so programs that read until
+		// EOF terminate
+		inputDone = make(chan bool, 1)
+		input := cmd.Input
+		go func() {
+			_, err := io.WriteString(pStdin, input)
+			if err != nil {
+				log.Errorln(err)
+			}
+			pStdin.Close()
+			inputDone <- err == nil
+		}()
 	}
 
-	if stdout != "" {
-		pStdout, err := cmd.StdoutPipe()
+	if cmd.Stdout != "" {
+		pStdout, err := p.StdoutPipe()
 		if err != nil {
 			log.Errorln(err)
 			close(done)
-			return "", ""
+			return
 		}
 
-		cStdout, err := NewPlumberWriter(stdout)
+		cStdout, err := NewPlumberWriter(cmd.Stdout)
 		if err != nil {
 			log.Errorln(err)
 			close(done)
-			return "", ""
+			return
 		}
 
 		go func() {
@@ -152,23 +306,25 @@ func runCommand(stdin, stdout, stderr string, command []string, background bool)
 				return
 			}
 		}()
+	} else if st != nil {
+		p.Stdout = io.MultiWriter(&bufout, st.stdout())
 	} else {
-		cmd.Stdout = &bufout
+		p.Stdout = &bufout
 	}
 
-	if stderr != "" {
-		pStderr, err := cmd.StderrPipe()
+	if cmd.Stderr != "" {
+		pStderr, err := p.StderrPipe()
 		if err != nil {
 			log.Errorln(err)
 			close(done)
-			return "", ""
+			return
 		}
 
-		cStderr, err := NewPlumberWriter(stderr)
+		cStderr, err := NewPlumberWriter(cmd.Stderr)
 		if err != nil {
 			log.Errorln(err)
 			close(done)
-			return "", ""
+			return
 		}
 
 		go func() {
@@ -186,32 +342,49 @@ func runCommand(stdin, stdout, stderr string, command []string, background bool)
 				return
 			}
 		}()
+	} else if st != nil {
+		p.Stderr = io.MultiWriter(&buferr, st.stderr())
 	} else {
-		cmd.Stderr = &buferr
+		p.Stderr = &buferr
 	}
 
-	log.Info("executing: %v", command)
+	log.Info("executing: %v", cmd.Command)
 
-	if background {
+	if cmd.Background {
 		log.Debug("starting in background")
-		if err := cmd.Start(); err != nil {
+		if err := p.Start(); err != nil {
+			// a command that can't start (e.g. a bad working directory)
+			// reports why instead of failing silently
 			log.Errorln(err)
-			return "", buferr.String()
+			resp.Stderr = err.Error()
+			return
 		}
 
-		pid := cmd.Process.Pid
+		pid := p.Process.Pid
+
+		registerRunning(cmd.ID, p.Process)
 
 		client.Lock()
 		defer client.Unlock()
 		client.Processes[pid] = &Process{
+			ID:      nextProcessID(),
 			PID:     pid,
-			Command: command,
-			process: cmd.Process,
+			Command: cmd.Command,
+			Started: time.Now(),
+			process: p.Process,
 		}
 
 		go func() {
-			cmd.Wait()
-			log.Info("command exited: %v", command)
+			if cmd.Timeout > 0 {
+				t := time.AfterFunc(cmd.Timeout, func() {
+					log.Info("command %v timed out", cmd.ID)
+					killProcessGroup(p.Process)
+				})
+				defer t.Stop()
+			}
+
+			p.Wait()
+			log.Info("command exited: %v", cmd.Command)
 			if bufout.Len() > 0 {
 				log.Info(bufout.String())
 			}
@@ -219,18 +392,83 @@ func runCommand(stdin, stdout, stderr string, command []string, background bool)
 				log.Info(buferr.String())
 			}
 
+			unregisterRunning(cmd.ID)
+
 			client.Lock()
 			defer client.Unlock()
-			delete(client.Processes, pid)
+
+			// mark the process as exited rather than deleting it so that the
+			// exit code is reported in the next check-in (see heartbeat)
+			if proc, ok := client.Processes[pid]; ok {
+				proc.Exited = true
+				if p.ProcessState != nil {
+					proc.ExitCode = p.ProcessState.ExitCode()
+				}
+			}
 		}()
 
-		return "", ""
+		// input delivery happens asynchronously; report that it was wired up
+		resp.InputSent = cmd.Input != ""
+		return
 	}
 
-	if err := cmd.Run(); err != nil {
+	if err := p.Start(); err != nil {
+		// a command that can't start (e.g. a bad working directory) reports
+		// why instead of failing silently
 		log.Errorln(err)
+		resp.Stderr = err.Error()
+		return
+	}
+
+	registerRunning(cmd.ID, p.Process)
+
+	wait := make(chan error, 1)
+	go func() {
+		wait <- p.Wait()
+	}()
+
+	var timer <-chan time.Time
+	if cmd.Timeout > 0 {
+		timer = time.After(cmd.Timeout)
 	}
-	return bufout.String(), buferr.String()
+
+	var timedout bool
+
+	select {
+	case err = <-wait:
+	case <-timer:
+		log.Info("command %v timed out", cmd.ID)
+		timedout = true
+		killProcessGroup(p.Process)
+		err = <-wait
+	}
+
+	killed := unregisterRunning(cmd.ID)
+
+	if err != nil {
+		log.Errorln(err)
+	}
+
+	switch {
+	case timedout:
+		resp.Exit = "timeout"
+	case killed:
+		resp.Exit = "killed"
+	case p.ProcessState != nil:
+		resp.Exit = strconv.Itoa(p.ProcessState.ExitCode())
+	}
+
+	if inputDone != nil {
+		select {
+		case ok := <-inputDone:
+			resp.InputSent = ok
+		default:
+			// the command exited without reading all of its input
+		}
+	}
+
+	resp.Stdout = bufout.String()
+	resp.Stderr = buferr.String()
 }
 
 func kill(pid int) {
@@ -250,7 +488,7 @@ func kill(pid int) {
 	}
 
 	log.Info("killing PID %v", pid)
-	if p, ok := client.Processes[pid]; ok {
+	if p, ok := client.Processes[pid]; ok && !p.Exited {
 		if err := p.process.Kill(); err != nil {
 			log.Errorln(err)
 		}
@@ -258,6 +496,18 @@ func kill(pid int) {
 		return
 	}
 
+	// fall back to matching the client-assigned process ID
+	for _, p := range client.Processes {
+		if p.ID == pid && !p.Exited {
+			log.Info("killing process ID %v (PID %v)", p.ID, p.PID)
+			if err := p.process.Kill(); err != nil {
+				log.Errorln(err)
+			}
+
+			return
+		}
+	}
+
 	log.Error("no such process: %v", pid)
 }
 
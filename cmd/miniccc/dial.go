@@ -1,6 +1,7 @@
 package main
 
 import (
+	"crypto/tls"
 	"encoding/gob"
 	"fmt"
 	"io"
@@ -37,7 +38,22 @@ func dial() error {
 				log.Fatal("invalid ron dial network family: %v", *f_family)
 			}
 
-			client.conn, err = net.Dial(*f_family, addr)
+			var conn net.Conn
+			conn, err = net.Dial(*f_family, addr)
+
+			// layer TLS over the connection if we have a client certificate;
+			// the handshake happens on the first write
+			if err == nil && *f_cert != "" {
+				config, err := ron.NewTLSConfig(*f_cert, *f_key, *f_ca, false)
+				if err != nil {
+					// bad credentials won't get better with retries
+					log.Fatal("tls config: %v", err)
+				}
+
+				conn = tls.Client(conn, config)
+			}
+
+			client.conn = conn
 		} else {
 			err = timeout(ron.CLIENT_RECONNECT_RATE*time.Second, func() (err error) {
 				client.conn, err = dialSerial(*f_serial)
@@ -5,94 +5,224 @@
 package main
 
 import (
+	"errors"
+	"fmt"
 	"os"
 	"path/filepath"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/sandia-minimega/minimega/v2/internal/ron"
 	log "github.com/sandia-minimega/minimega/v2/pkg/minilog"
 )
 
-// sendFiles reads the files and sends them in multiple chunks to the server.
-func sendFiles(ID int, files []string) {
-	// expand and try to read each of the files
-	for _, f := range files {
-		log.Info("sending file %v", f)
+// limits for file retrieval when the server doesn't set its own (see
+// ron.Command.RecvMaxFiles and ron.Command.RecvMaxBytes)
+const (
+	defaultRecvMaxFiles = 1000
+	defaultRecvMaxBytes = 100 << 20 // 100 MB
+)
+
+// errRecvLimit aborts expansion once a retrieval limit has been hit
+var errRecvLimit = errors.New("retrieval limit reached")
+
+// sendFiles expands the command's file patterns and sends each match to the
+// server in multiple chunks. Directories are walked recursively, preserving
+// their relative structure on the server. At most maxFiles files and maxBytes
+// total bytes are sent per command; anything skipped, including symlinks,
+// which are recorded but never followed, is noted in the response.
+func sendFiles(cmd *ron.Command, resp *ron.Response) {
+	maxFiles := cmd.RecvMaxFiles
+	if maxFiles <= 0 {
+		maxFiles = defaultRecvMaxFiles
+	}
+
+	maxBytes := cmd.RecvMaxBytes
+	if maxBytes <= 0 {
+		maxBytes = defaultRecvMaxBytes
+	}
+
+	var sent int
+	var size int64
+	var notes []string
 
+	skip := func(format string, arg ...interface{}) {
+		s := fmt.Sprintf(format, arg...)
+		log.Info("%v", s)
+		notes = append(notes, s)
+	}
+
+	sendOne := func(name string, fi os.FileInfo) error {
+		if sent >= maxFiles {
+			skip("max files (%v) reached at %v, skipping remaining matches", maxFiles, name)
+			return errRecvLimit
+		}
+		if size+fi.Size() > maxBytes {
+			skip("max bytes (%v) reached at %v, skipping remaining matches", maxBytes, name)
+			return errRecvLimit
+		}
+
+		log.Info("sending file %v", name)
+
+		if err := sendFile(cmd.ID, name); err != nil {
+			log.Errorln(err)
+			return nil
+		}
+
+		sent++
+		size += fi.Size()
+		return nil
+	}
+
+expand:
+	for _, f := range cmd.FilesRecv {
 		names, err := filepath.Glob(f)
 		if err != nil {
 			log.Errorln(err)
 			continue
 		}
 
+		if len(names) == 0 {
+			skip("no matches for %v", f)
+			continue
+		}
+
 		for _, name := range names {
-			if err := sendFile(ID, name); err != nil {
+			err := filepath.Walk(name, func(path string, info os.FileInfo, err error) error {
+				if err != nil {
+					skip("skipping %v: %v", path, err)
+					return nil
+				}
+
+				// record symlinks rather than following them so that the
+				// walk cannot escape the requested tree
+				if info.Mode()&os.ModeSymlink != 0 {
+					target, err := os.Readlink(path)
+					if err != nil {
+						target = err.Error()
+					}
+					skip("skipping symlink %v -> %v", path, target)
+					return nil
+				}
+
+				if info.IsDir() {
+					return nil
+				}
+
+				return sendOne(path, info)
+			})
+
+			if err == errRecvLimit {
+				break expand
+			} else if err != nil {
 				log.Errorln(err)
-				continue
 			}
 		}
 	}
+
+	// surface what was skipped alongside any command output
+	if len(notes) > 0 {
+		if resp.Stderr != "" {
+			resp.Stderr += "\n"
+		}
+		resp.Stderr += strings.Join(notes, "\n") + "\n"
+	}
 }
 
 func sendFile(ID int, filename string) error {
 	log.Debug("sendFile: %v for command %v", filename, ID)
 
-	// TODO: Change PART_SIZE based on memory size?
-	return ron.SendFile("/", filename, ID, ron.PART_SIZE, sendMessage)
+	return ron.SendFile("/", filename, ID, 0, *f_chunk, sendMessage)
 }
 
-// recvFiles retrieves a list of files from the ron server by requesting each
-// one individually.
-func recvFiles(files []string) {
+// fileManifest remembers the hashes of previously received files so
+// identical re-sends can be skipped, created on first use once flags have
+// been parsed
+var (
+	fileManifest     *manifest
+	fileManifestOnce sync.Once
+)
+
+// recvFiles retrieves the files a command sends to the client, requesting
+// each one individually. Files whose content hash matches a previously
+// received copy are acknowledged without a transfer; local copies that fail
+// the hash check, including partial or corrupt ones, are fetched again in
+// full.
+func recvFiles(cmd *ron.Command) {
+	fileManifestOnce.Do(func() {
+		fileManifest = openManifest(filepath.Join(*f_path, "files.manifest"))
+	})
+
 	start := time.Now()
 	var size int64
 
-	for _, v := range files {
+	for _, v := range cmd.FilesSend {
 		log.Info("requesting file %v", v)
 
 		dst := filepath.Join(*f_path, "files", v)
+		expected := cmd.FilesSendHashes[v]
 
 		if _, err := os.Stat(dst); err == nil {
-			// file exists (TODO: overwrite?)
-			log.Info("skipping %v -- already exists", dst)
-			continue
-		}
+			if expected == "" {
+				// file exists and the server didn't hash it; keep what we have
+				log.Info("skipping %v -- already exists", dst)
+				continue
+			}
 
-		m := &ron.Message{
-			Type: ron.MESSAGE_FILE,
-			UUID: client.UUID,
-			File: &ron.File{
-				Name: v,
-			},
-		}
+			if fileManifest.Verify(v, dst, expected) {
+				// acknowledge the skip so the server can report cache hits
+				log.Info("skipping %v -- cached copy matches", dst)
+
+				m := &ron.Message{
+					Type: ron.MESSAGE_FILE,
+					UUID: client.UUID,
+					File: &ron.File{
+						ID:     cmd.ID,
+						Name:   v,
+						Hash:   expected,
+						Cached: true,
+					},
+				}
 
-		if err := sendMessage(m); err != nil {
-			log.Error("send failed: %v", err)
-			return
+				if err := sendMessage(m); err != nil {
+					log.Error("send failed: %v", err)
+					return
+				}
+
+				continue
+			}
+
+			// the local copy is corrupt or stale -- fetch in full
+			log.Info("local copy of %v failed hash check, fetching again", dst)
+			os.Remove(dst)
+			os.Remove(dst + ".partial")
 		}
 
-		// recv all parts of this file
-		for {
-			resp := <-client.fileChan
-			if resp.File.Name != v {
-				log.Error("filename mismatch: %v != %v", resp.File.Name, v)
+		// a transfer that completes but fails the hash check gets one more
+		// attempt from scratch
+		for attempt := 0; ; attempt++ {
+			n, err := fetchFile(v, dst)
+			size += n
+			if err != nil {
+				log.Errorln(err)
 				break
 			}
 
-			// unable to retrieve this file
-			if resp.Error != "" {
-				log.Error("%v", resp.Error)
+			if expected == "" {
 				break
 			}
 
-			if err := resp.File.Recv(dst); err != nil {
-				log.Errorln(err)
+			hash, err := ron.HashFile(dst)
+			if err == nil && hash == expected {
+				fileManifest.Record(v, dst, hash)
 				break
 			}
 
-			size += int64(len(resp.File.Data))
+			log.Error("received %v does not match expected hash", dst)
+			os.Remove(dst)
 
-			if resp.File.EOF {
+			if attempt > 0 {
 				break
 			}
 		}
@@ -102,6 +232,53 @@ func recvFiles(files []string) {
 	rate := (float64(size) / 1024 / d.Seconds())
 
 	log.Debug("received %v bytes in %v (%v KBps)", size, d, rate)
+}
 
-	return
+// fetchFile transfers one file from the server to dst, resuming a partial
+// transfer when possible, and returns the number of payload bytes received.
+func fetchFile(v, dst string) (int64, error) {
+	// resume an interrupted transfer where it left off if the server
+	// understands resume offsets, otherwise request the whole file again
+	var offset int64
+	if fi, err := os.Stat(dst + ".partial"); err == nil && ron.SupportsResume(serverVersion()) {
+		offset = fi.Size()
+		log.Info("resuming %v at offset %v", dst, offset)
+	}
+
+	m := &ron.Message{
+		Type: ron.MESSAGE_FILE,
+		UUID: client.UUID,
+		File: &ron.File{
+			Name:   v,
+			Offset: offset,
+		},
+	}
+
+	if err := sendMessage(m); err != nil {
+		return 0, fmt.Errorf("send failed: %v", err)
+	}
+
+	// recv all parts of this file
+	var size int64
+	for {
+		resp := <-client.fileChan
+		if resp.File.Name != v {
+			return size, fmt.Errorf("filename mismatch: %v != %v", resp.File.Name, v)
+		}
+
+		// unable to retrieve this file
+		if resp.Error != "" {
+			return size, errors.New(resp.Error)
+		}
+
+		if err := resp.File.Recv(dst); err != nil {
+			return size, err
+		}
+
+		size += int64(len(resp.File.Data))
+
+		if resp.File.EOF {
+			return size, nil
+		}
+	}
 }
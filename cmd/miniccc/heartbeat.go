@@ -5,6 +5,7 @@
 package main
 
 import (
+	"sync/atomic"
 	"time"
 
 	"github.com/sandia-minimega/minimega/v2/internal/ron"
@@ -14,22 +15,42 @@ import (
 
 const HeartbeatRate = 5 * time.Second
 
+// heartbeatRate returns the current check-in interval, which the server may
+// have changed from the default.
+func heartbeatRate() time.Duration {
+	return time.Duration(atomic.LoadInt64(&client.heartbeatRate))
+}
+
+// setHeartbeatRate records a check-in interval pushed by the server. Servers
+// that predate configurable rates send zero, which is ignored.
+func setHeartbeatRate(d time.Duration) {
+	if d <= 0 || d == heartbeatRate() {
+		return
+	}
+
+	log.Info("heartbeat rate is now %v", d)
+
+	atomic.StoreInt64(&client.heartbeatRate, int64(d))
+}
+
 // periodically send the client heartbeat.
 func periodic(done chan struct{}) {
 	for {
-		t := time.NewTimer(HeartbeatRate)
+		rate := heartbeatRate()
+
+		t := time.NewTimer(rate)
 
 		select {
 		case <-t.C:
 			log.Debug("periodic")
 
 			now := time.Now()
-			if now.Sub(client.lastHeartbeat) > HeartbeatRate {
+			if now.Sub(client.lastHeartbeat) > rate {
 				// issue a heartbeat
 				heartbeat()
 			}
 
-			sleep := HeartbeatRate - now.Sub(client.lastHeartbeat)
+			sleep := rate - now.Sub(client.lastHeartbeat)
 			// time.Sleep(sleep)
 			t.Reset(sleep)
 		case <-done:
@@ -50,6 +71,7 @@ func heartbeat() {
 	defer client.Unlock()
 
 	updateNetworkInfo()
+	updateInventory()
 
 	log.Debug("sending heartbeat")
 
@@ -62,13 +84,24 @@ func heartbeat() {
 		MACs:          client.MACs,
 		LastCommandID: client.LastCommandID,
 		Version:       version.Revision,
+		Streaming:     true,
+		Inventory:     client.Inventory,
 		Processes:     make(map[int]*ron.Process),
 	}
 
 	for k, v := range client.Processes {
 		c.Processes[k] = &ron.Process{
-			PID:     v.PID,
-			Command: v.Command,
+			ID:       v.ID,
+			PID:      v.PID,
+			Command:  v.Command,
+			Started:  v.Started,
+			Exited:   v.Exited,
+			ExitCode: v.ExitCode,
+		}
+
+		// exited processes are reported exactly once
+		if v.Exited {
+			delete(client.Processes, k)
 		}
 	}
 
@@ -81,7 +114,7 @@ func heartbeat() {
 		Type:    ron.MESSAGE_CLIENT,
 		UUID:    c.UUID,
 		Client:  c,
-		Version: "v1",
+		Version: ron.MessageVersion,
 	}
 
 	if err := sendMessage(m); err != nil {
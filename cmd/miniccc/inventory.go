@@ -0,0 +1,34 @@
+// Copyright 2015-2021 National Technology & Engineering Solutions of Sandia, LLC (NTESS).
+// Under the terms of Contract DE-NA0003525 with NTESS, the U.S. Government retains certain
+// rights in this software.
+
+package main
+
+import (
+	"time"
+
+	"github.com/sandia-minimega/minimega/v2/internal/ron"
+)
+
+// InventoryRate is how often the client refreshes its inventory. The fields
+// change slowly so there is no need to probe them on every heartbeat.
+const InventoryRate = time.Minute
+
+// updateInventory refreshes the client's inventory snapshot if it is stale.
+// Probes that fail leave their field empty. Assumes that the client lock is
+// held.
+func updateInventory() {
+	if client.Inventory != nil && time.Since(client.lastInventory) < InventoryRate {
+		return
+	}
+
+	client.lastInventory = time.Now()
+
+	client.Inventory = &ron.Inventory{
+		OSVersion: osVersion(),
+		Kernel:    kernelVersion(),
+		Uptime:    uptime(),
+		Users:     loggedInUsers(),
+		DiskFree:  diskFree(*f_path),
+	}
+}
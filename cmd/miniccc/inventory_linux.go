@@ -0,0 +1,103 @@
+// Copyright 2015-2021 National Technology & Engineering Solutions of Sandia, LLC (NTESS).
+// Under the terms of Contract DE-NA0003525 with NTESS, the U.S. Government retains certain
+// rights in this software.
+
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"io/ioutil"
+	"os/exec"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	log "github.com/sandia-minimega/minimega/v2/pkg/minilog"
+)
+
+// osVersion returns the distribution's PRETTY_NAME from os-release.
+func osVersion() string {
+	for _, path := range []string{"/etc/os-release", "/usr/lib/os-release"} {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			continue
+		}
+
+		for _, line := range strings.Split(string(data), "\n") {
+			if strings.HasPrefix(line, "PRETTY_NAME=") {
+				return strings.Trim(strings.TrimPrefix(line, "PRETTY_NAME="), `"`)
+			}
+		}
+	}
+
+	return ""
+}
+
+// kernelVersion returns the running kernel release.
+func kernelVersion() string {
+	data, err := ioutil.ReadFile("/proc/sys/kernel/osrelease")
+	if err != nil {
+		log.Debug("kernel version: %v", err)
+		return ""
+	}
+
+	return strings.TrimSpace(string(data))
+}
+
+// uptime returns the time since boot.
+func uptime() time.Duration {
+	data, err := ioutil.ReadFile("/proc/uptime")
+	if err != nil {
+		log.Debug("uptime: %v", err)
+		return 0
+	}
+
+	fields := strings.Fields(string(data))
+	if len(fields) == 0 {
+		return 0
+	}
+
+	v, err := strconv.ParseFloat(fields[0], 64)
+	if err != nil {
+		return 0
+	}
+
+	return (time.Duration(v) * time.Second).Truncate(time.Second)
+}
+
+// loggedInUsers returns the distinct logged-in users.
+func loggedInUsers() []string {
+	// first line of `who -q` is the space-separated user list
+	out, err := exec.Command("who", "-q").Output()
+	if err != nil {
+		log.Debug("who: %v", err)
+		return nil
+	}
+
+	var users []string
+	seen := map[string]bool{}
+
+	for _, v := range strings.Fields(strings.SplitN(string(out), "\n", 2)[0]) {
+		if !seen[v] {
+			seen[v] = true
+			users = append(users, v)
+		}
+	}
+
+	return users
+}
+
+// diskFree returns the free bytes on the volume holding path.
+func diskFree(path string) uint64 {
+	var fs syscall.Statfs_t
+
+	if err := syscall.Statfs(path, &fs); err != nil {
+		log.Debug("statfs %v: %v", path, err)
+		return 0
+	}
+
+	return fs.Bavail * uint64(fs.Bsize)
+}
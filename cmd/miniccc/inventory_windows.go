@@ -0,0 +1,98 @@
+// Copyright 2015-2021 National Technology & Engineering Solutions of Sandia, LLC (NTESS).
+// Under the terms of Contract DE-NA0003525 with NTESS, the U.S. Government retains certain
+// rights in this software.
+
+//go:build windows
+// +build windows
+
+package main
+
+import (
+	"os/exec"
+	"strings"
+	"time"
+
+	log "github.com/sandia-minimega/minimega/v2/pkg/minilog"
+	"golang.org/x/sys/windows"
+	"golang.org/x/sys/windows/registry"
+)
+
+// currentVersion reads a string value from the Windows version registry key.
+func currentVersion(name string) string {
+	k, err := registry.OpenKey(registry.LOCAL_MACHINE, `SOFTWARE\Microsoft\Windows NT\CurrentVersion`, registry.QUERY_VALUE)
+	if err != nil {
+		log.Debug("open CurrentVersion: %v", err)
+		return ""
+	}
+	defer k.Close()
+
+	v, _, err := k.GetStringValue(name)
+	if err != nil {
+		log.Debug("read %v: %v", name, err)
+		return ""
+	}
+
+	return v
+}
+
+// osVersion returns the Windows product name.
+func osVersion() string {
+	return currentVersion("ProductName")
+}
+
+// kernelVersion returns the Windows build number.
+func kernelVersion() string {
+	return currentVersion("CurrentBuildNumber")
+}
+
+// uptime returns the time since boot.
+func uptime() time.Duration {
+	return windows.DurationSinceBoot().Truncate(time.Second)
+}
+
+// loggedInUsers returns the distinct logged-in users.
+func loggedInUsers() []string {
+	out, err := exec.Command("quser").Output()
+	if err != nil {
+		log.Debug("quser: %v", err)
+		return nil
+	}
+
+	var users []string
+	seen := map[string]bool{}
+
+	// skip the header; the username is the first field, prefixed with ">"
+	// for the current session
+	lines := strings.Split(string(out), "\n")
+	for i, line := range lines {
+		fields := strings.Fields(line)
+		if i == 0 || len(fields) == 0 {
+			continue
+		}
+
+		v := strings.TrimPrefix(fields[0], ">")
+		if !seen[v] {
+			seen[v] = true
+			users = append(users, v)
+		}
+	}
+
+	return users
+}
+
+// diskFree returns the free bytes on the volume holding path.
+func diskFree(path string) uint64 {
+	p, err := windows.UTF16PtrFromString(path)
+	if err != nil {
+		return 0
+	}
+
+	var free, total, totalFree uint64
+
+	if err := windows.GetDiskFreeSpaceEx(p, &free, &total, &totalFree); err != nil {
+		log.Debug("disk free %v: %v", path, err)
+		return 0
+	}
+
+	return free
+}
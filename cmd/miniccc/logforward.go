@@ -0,0 +1,129 @@
+// Copyright 2015-2021 National Technology & Engineering Solutions of Sandia, LLC (NTESS).
+// Under the terms of Contract DE-NA0003525 with NTESS, the U.S. Government retains certain
+// rights in this software.
+
+package main
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sandia-minimega/minimega/v2/internal/ron"
+	log "github.com/sandia-minimega/minimega/v2/pkg/minilog"
+)
+
+const (
+	// logForwardBuffer bounds how many log records may be queued between
+	// flushes; records beyond it are dropped and counted rather than
+	// blocking the logger
+	logForwardBuffer = 512
+
+	// logForwardRate is how often queued records are flushed to the server
+	logForwardRate = time.Second
+)
+
+// logForwarder ships the client's own minilog output to the server over the
+// cc channel. It is registered with minilog as an extra logger so it sees the
+// same records the client's other outputs do, filtered to the requested
+// level. Writes never block: records are queued and flushed in batches, and a
+// full queue drops records, reporting the count to the server in place of the
+// lost lines.
+type logForwarder struct {
+	lines   chan string
+	dropped int64 // updated atomically
+	done    chan struct{}
+}
+
+var (
+	logForward     *logForwarder
+	logForwardLock sync.Mutex
+)
+
+// Write implements io.Writer for minilog. It must not log, directly or
+// indirectly, as that would feed back into this logger.
+func (l *logForwarder) Write(p []byte) (int, error) {
+	select {
+	case l.lines <- string(p):
+	default:
+		atomic.AddInt64(&l.dropped, 1)
+	}
+
+	return len(p), nil
+}
+
+func (l *logForwarder) run() {
+	for {
+		select {
+		case <-l.done:
+			return
+		case <-time.After(logForwardRate):
+			l.flush()
+		}
+	}
+}
+
+// flush drains the queue and sends whatever accumulated since the last flush
+// as a single message, including a count of any dropped records.
+func (l *logForwarder) flush() {
+	var lines []string
+
+	for {
+		select {
+		case v := <-l.lines:
+			lines = append(lines, v)
+			continue
+		default:
+		}
+
+		break
+	}
+
+	dropped := atomic.SwapInt64(&l.dropped, 0)
+
+	if len(lines) == 0 && dropped == 0 {
+		return
+	}
+
+	m := &ron.Message{
+		Type:       ron.MESSAGE_LOG,
+		UUID:       client.UUID,
+		Log:        lines,
+		LogDropped: dropped,
+	}
+
+	// nothing useful to do on error -- logging it here would just queue more
+	// records for a channel that can't take them
+	sendMessage(m)
+}
+
+// setLogForward starts, adjusts, or stops log forwarding as the server
+// requested.
+func setLogForward(f *ron.LogForward) {
+	logForwardLock.Lock()
+	defer logForwardLock.Unlock()
+
+	if f.Stop {
+		if logForward != nil {
+			log.DelLogger("forward")
+			close(logForward.done)
+			logForward = nil
+		}
+
+		return
+	}
+
+	if logForward != nil {
+		// already forwarding, just adjust the level
+		log.SetLevel("forward", f.Level)
+		return
+	}
+
+	logForward = &logForwarder{
+		lines: make(chan string, logForwardBuffer),
+		done:  make(chan struct{}),
+	}
+
+	log.AddLogger("forward", logForward, f.Level, false)
+	go logForward.run()
+}
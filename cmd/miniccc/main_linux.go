@@ -17,8 +17,10 @@ import (
 	"os/signal"
 	"path/filepath"
 	"strconv"
+	"sync/atomic"
 	"syscall"
 
+	"github.com/sandia-minimega/minimega/v2/internal/ron"
 	"github.com/sandia-minimega/minimega/v2/internal/version"
 	log "github.com/sandia-minimega/minimega/v2/pkg/minilog"
 )
@@ -32,6 +34,10 @@ var (
 	f_family  = flag.String("family", "tcp", "[tcp,unix] family to dial on")
 	f_tag     = flag.Bool("tag", false, "add a key value tag in minimega for this vm")
 	f_pipe    = flag.String("pipe", "", "read/write to or from a named pipe")
+	f_chunk   = flag.Int64("chunksize", ron.PART_SIZE, "file transfer chunk size in bytes")
+	f_cert    = flag.String("cert", "", "client certificate; enables TLS to the parent")
+	f_key     = flag.String("key", "", "key for the client certificate")
+	f_ca      = flag.String("ca", "", "CA certificate to verify the parent against")
 )
 
 const banner = `miniccc, Copyright (2014) Sandia Corporation.
@@ -141,6 +147,11 @@ func resetClient() {
 		client.conn = nil
 	}
 
+	// renegotiate capabilities with whatever server we connect to next
+	atomic.StoreInt32(&client.compress, 0)
+	atomic.StoreInt64(&client.heartbeatRate, int64(HeartbeatRate))
+	atomic.StoreInt64(&client.clockOffset, 0)
+
 	if err := dial(); err != nil {
 		log.Fatal("unable to connect: %v", err)
 	}
@@ -16,6 +16,7 @@ import (
 	"syscall"
 	"time"
 
+	"github.com/sandia-minimega/minimega/v2/internal/ron"
 	"github.com/sandia-minimega/minimega/v2/internal/version"
 	log "github.com/sandia-minimega/minimega/v2/pkg/minilog"
 
@@ -32,6 +33,10 @@ var (
 	f_serial  = flag.String("serial", "", "use serial device instead of tcp")
 	f_family  = flag.String("family", "tcp", "[tcp,unix] family to dial on")
 	f_pipe    = flag.String("pipe", "", "read/write to or from a named pipe")
+	f_chunk   = flag.Int64("chunksize", ron.PART_SIZE, "file transfer chunk size in bytes")
+	f_cert    = flag.String("cert", "", "client certificate; enables TLS to the parent")
+	f_key     = flag.String("key", "", "key for the client certificate")
+	f_ca      = flag.String("ca", "", "CA certificate to verify the parent against")
 	f_install = flag.String("install", "", "install as Windows service ('manual-start' or 'auto-start')")
 )
 
@@ -0,0 +1,148 @@
+// Copyright 2015-2021 National Technology & Engineering Solutions of Sandia, LLC (NTESS).
+// Under the terms of Contract DE-NA0003525 with NTESS, the U.S. Government retains certain
+// rights in this software.
+
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/sandia-minimega/minimega/v2/internal/ron"
+	log "github.com/sandia-minimega/minimega/v2/pkg/minilog"
+)
+
+// manifestMax bounds how many received files the manifest remembers; the
+// least recently used entries are evicted beyond that and their files are
+// simply rehashed if the server sends them again.
+const manifestMax = 64
+
+// manifestEntry records the verified hash of one received file, along with
+// the size and mtime it had when hashed so the hash can be trusted without
+// rereading an unchanged file.
+type manifestEntry struct {
+	Hash    string
+	Size    int64
+	ModTime time.Time
+	Used    time.Time
+}
+
+// manifest remembers the content hashes of files previously received from
+// the server so identical re-sends can be acknowledged without a transfer.
+// It is persisted as JSON alongside the files directory and survives client
+// restarts; a lost or corrupt manifest only costs rehashing.
+type manifest struct {
+	mu      sync.Mutex
+	path    string
+	entries map[string]*manifestEntry
+}
+
+// openManifest loads the manifest at path, starting empty if it is missing
+// or unreadable.
+func openManifest(path string) *manifest {
+	m := &manifest{
+		path:    path,
+		entries: make(map[string]*manifestEntry),
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Error("could not read manifest %v: %v", path, err)
+		}
+		return m
+	}
+
+	if err := json.Unmarshal(data, &m.entries); err != nil {
+		log.Error("could not parse manifest %v: %v", path, err)
+		m.entries = make(map[string]*manifestEntry)
+	}
+
+	return m
+}
+
+// save writes the manifest back to disk, best effort.
+func (m *manifest) save() {
+	data, err := json.Marshal(m.entries)
+	if err != nil {
+		log.Errorln(err)
+		return
+	}
+
+	if err := ioutil.WriteFile(m.path, data, os.FileMode(0660)); err != nil {
+		log.Error("could not write manifest %v: %v", m.path, err)
+	}
+}
+
+// Verify reports whether the file at fpath matches the expected hash. The
+// recorded hash is trusted when the file's size and mtime are unchanged since
+// it was taken; otherwise the file is rehashed, so a corrupt or partially
+// written copy fails the check. A fresh hash that matches is recorded.
+func (m *manifest) Verify(name, fpath, expected string) bool {
+	fi, err := os.Stat(fpath)
+	if err != nil {
+		return false
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if e, ok := m.entries[name]; ok {
+		if e.Hash == expected && e.Size == fi.Size() && e.ModTime.Equal(fi.ModTime()) {
+			e.Used = time.Now()
+			m.save()
+			return true
+		}
+	}
+
+	hash, err := ron.HashFile(fpath)
+	if err != nil || hash != expected {
+		return false
+	}
+
+	m.record(name, fi, hash)
+	return true
+}
+
+// Record remembers the hash of a freshly received and verified file.
+func (m *manifest) Record(name, fpath, hash string) {
+	fi, err := os.Stat(fpath)
+	if err != nil {
+		return
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.record(name, fi, hash)
+}
+
+// record updates an entry and evicts the least recently used entries past
+// the bound. Must be called with the lock held.
+func (m *manifest) record(name string, fi os.FileInfo, hash string) {
+	m.entries[name] = &manifestEntry{
+		Hash:    hash,
+		Size:    fi.Size(),
+		ModTime: fi.ModTime(),
+		Used:    time.Now(),
+	}
+
+	for len(m.entries) > manifestMax {
+		var oldest string
+		var when time.Time
+
+		for k, e := range m.entries {
+			if when.IsZero() || e.Used.Before(when) {
+				oldest = k
+				when = e.Used
+			}
+		}
+
+		delete(m.entries, oldest)
+	}
+
+	m.save()
+}
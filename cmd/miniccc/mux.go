@@ -10,6 +10,7 @@ import (
 	"math"
 	"net"
 	"sort"
+	"sync/atomic"
 	"time"
 
 	"github.com/sandia-minimega/minimega/v2/internal/minitunnel"
@@ -64,14 +65,33 @@ func mux(done chan struct{}) {
 
 		log.Debug("new message: %v", m.Type)
 
+		if m.Compressed {
+			if _, _, err := m.Decompress(); err != nil {
+				log.Error("decompress: %v", err)
+				continue
+			}
+		}
+
 		switch m.Type {
 		case ron.MESSAGE_CLIENT:
 			// ACK of the handshake
-			log.Info("handshake complete")
+			log.Info("handshake complete, server version: %v", m.Version)
+
+			client.Lock()
+			client.serverVersion = m.Version
+			client.Unlock()
+
+			if ron.SupportsCompression(m.Version) {
+				atomic.StoreInt32(&client.compress, 1)
+			}
+
+			setHeartbeatRate(m.HeartbeatRate)
+			setClockOffset(m.ServerTime)
 
 			go periodic(done)
 			go commandHandler(done)
 		case ron.MESSAGE_COMMAND:
+			ackCommands(m.Commands)
 			client.commandChan <- m.Commands
 		case ron.MESSAGE_FILE:
 			client.fileChan <- &m
@@ -82,9 +102,13 @@ func mux(done chan struct{}) {
 		case ron.MESSAGE_UFS:
 			ufsMessage(&m)
 		case ron.MESSAGE_HEARTBEAT:
-			// Don't need to do anything with these... they just get sent by the
-			// server on a known frequency so the client can detect a loss of
-			// connection when using the virtual serial port.
+			// These get sent by the server on a known frequency so the client
+			// can detect a loss of connection when using the virtual serial
+			// port. They also carry the check-in rate so runtime changes
+			// reach connected clients, and the server's clock for scheduled
+			// commands.
+			setHeartbeatRate(m.HeartbeatRate)
+			setClockOffset(m.ServerTime)
 		default:
 			err = fmt.Errorf("unknown message type: %v", m.Type)
 		}
@@ -93,6 +117,31 @@ func mux(done chan struct{}) {
 	log.Info("mux exit: %v", err)
 }
 
+// ackCommands explicitly acknowledges receipt of commands, ahead of any
+// response, so the server can distinguish clients that got a command and went
+// silent from clients that never received it.
+func ackCommands(commands map[int]*ron.Command) {
+	if len(commands) == 0 {
+		return
+	}
+
+	var ids []int
+	for k := range commands {
+		ids = append(ids, k)
+	}
+	sort.Ints(ids)
+
+	m := &ron.Message{
+		Type:       ron.MESSAGE_COMMAND,
+		UUID:       client.UUID,
+		CommandAck: ids,
+	}
+
+	if err := sendMessage(m); err != nil {
+		log.Error("unable to ack commands: %v", err)
+	}
+}
+
 func commandHandler(done chan struct{}) {
 	for {
 		select {
@@ -26,6 +26,18 @@ var (
 	plumber     *miniplumber.Plumber
 	readerCount map[string]int
 	writerCount map[string]int
+
+	// writerCredits gates upstream pipe writes on the window the server
+	// grants, one gate per pipe shared by all local writers. Only populated
+	// when the server supports pipe flow control.
+	writerCredits map[string]*ron.PipeSender
+
+	// readerQueues buffers incoming pipe data between the mux and the
+	// plumber, one bounded queue per pipe, so a slow local reader doesn't
+	// stall the whole connection. Only populated when the server supports
+	// pipe flow control.
+	readerQueues map[string]chan string
+
 	plumberLock sync.Mutex
 )
 
@@ -33,21 +45,35 @@ func init() {
 	plumber = miniplumber.New(nil)
 	readerCount = make(map[string]int)
 	writerCount = make(map[string]int)
+	writerCredits = make(map[string]*ron.PipeSender)
+	readerQueues = make(map[string]chan string)
 }
 
 func pipeMessage(m *ron.Message) {
 	plumberLock.Lock()
 	defer plumberLock.Unlock()
 
-	// incoming messages can be data writes or read closers
+	// incoming messages can be data writes, read closers, or credit grants
 	switch m.PipeMode {
 	case ron.PIPE_DATA:
-		plumber.Write(m.Pipe, m.PipeData)
+		// deliver via the bounded queue when the server grants credit, see
+		// NewPlumberReader
+		if q, ok := readerQueues[m.Pipe]; ok {
+			q <- m.PipeData
+		} else {
+			plumber.Write(m.Pipe, m.PipeData)
+		}
 	case ron.PIPE_CLOSE_READER:
 		err := plumber.PipeDelete(m.Pipe)
 		if err != nil {
 			log.Errorln(err)
 		}
+	case ron.PIPE_CREDIT:
+		if ps, ok := writerCredits[m.Pipe]; ok {
+			ps.Grant(m.PipeCredit)
+		} else {
+			log.Debug("credit for unknown pipe: %v", m.Pipe)
+		}
 	default:
 		log.Error("invalid message type: %v", m.PipeMode)
 	}
@@ -70,6 +96,23 @@ func NewPlumberReader(pipe string) (*miniplumber.Reader, error) {
 		return nil, err
 	}
 
+	// on the first reader, grant the server a receive window. Data lands in
+	// a bounded queue and credit is replenished as local readers drain it,
+	// so the server stops sending when we fall behind.
+	if readerCount[pipe] == 0 && ron.SupportsPipeCredits(serverVersion()) {
+		q := make(chan string, ron.PIPE_WINDOW)
+		readerQueues[pipe] = q
+
+		go func() {
+			for v := range q {
+				plumber.Write(pipe, v)
+				sendCredit(pipe, 1)
+			}
+		}()
+
+		sendCredit(pipe, ron.PIPE_WINDOW)
+	}
+
 	readerCount[pipe]++
 	go func() {
 		<-r.Done
@@ -78,6 +121,10 @@ func NewPlumberReader(pipe string) (*miniplumber.Reader, error) {
 		readerCount[pipe]--
 		if readerCount[pipe] == 0 {
 			delete(readerCount, pipe)
+			if q, ok := readerQueues[pipe]; ok {
+				close(q)
+				delete(readerQueues, pipe)
+			}
 			closeUpstreamReader(pipe)
 		}
 	}()
@@ -102,11 +149,27 @@ func NewPlumberWriter(pipe string) (chan<- string, error) {
 		return nil, err
 	}
 
+	// the server answers the first writer with a window of credit when it
+	// supports pipe flow control; writes block once the window is exhausted
+	// and resume as the server's readers drain
+	var ps *ron.PipeSender
+	if ron.SupportsPipeCredits(serverVersion()) {
+		if _, ok := writerCredits[pipe]; !ok {
+			writerCredits[pipe] = ron.NewPipeSender()
+		}
+		ps = writerCredits[pipe]
+	}
+
 	writerCount[pipe]++
 
 	ww := make(chan string)
 	go func() {
 		for v := range ww {
+			if ps != nil && !ps.Acquire() {
+				// the pipe was closed out from under us
+				continue
+			}
+
 			err := pipeForward(pipe, v)
 			if err != nil {
 				log.Errorln(err)
@@ -118,6 +181,10 @@ func NewPlumberWriter(pipe string) (chan<- string, error) {
 		writerCount[pipe]--
 		if writerCount[pipe] == 0 {
 			delete(writerCount, pipe)
+			if ps != nil {
+				ps.Close()
+				delete(writerCredits, pipe)
+			}
 			closeUpstreamWriter(pipe)
 		}
 	}()
@@ -149,6 +216,19 @@ func closeUpstreamWriter(pipe string) {
 	}
 }
 
+func sendCredit(pipe string, n int) {
+	m := &ron.Message{
+		Type:       ron.MESSAGE_PIPE,
+		Pipe:       pipe,
+		PipeMode:   ron.PIPE_CREDIT,
+		PipeCredit: n,
+	}
+
+	if err := sendMessage(m); err != nil {
+		log.Errorln(err)
+	}
+}
+
 func pipeForward(pipe, data string) error {
 	m := &ron.Message{
 		Type:     ron.MESSAGE_PIPE,
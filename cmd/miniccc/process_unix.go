@@ -9,8 +9,11 @@ package main
 
 import (
 	"os"
+	"os/exec"
+	"os/user"
 	"path/filepath"
 	"strconv"
+	"syscall"
 )
 
 func processExists(pid int) bool {
@@ -18,3 +21,48 @@ func processExists(pid int) bool {
 	_, err := os.Stat(fname)
 	return os.IsExist(err)
 }
+
+// setupProcessGroup puts the command in its own process group so that
+// killProcessGroup can take out any children it spawns too.
+func setupProcessGroup(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+}
+
+// setupUser arranges for the command to run as the named user by looking up
+// its uid and gid and setting process credentials. Requires the client to
+// run with permission to switch users (i.e. as root).
+func setupUser(cmd *exec.Cmd, username string) error {
+	u, err := user.Lookup(username)
+	if err != nil {
+		return err
+	}
+
+	uid, err := strconv.Atoi(u.Uid)
+	if err != nil {
+		return err
+	}
+
+	gid, err := strconv.Atoi(u.Gid)
+	if err != nil {
+		return err
+	}
+
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.Credential = &syscall.Credential{
+		Uid: uint32(uid),
+		Gid: uint32(gid),
+	}
+
+	return nil
+}
+
+// killProcessGroup kills the process and its process group.
+func killProcessGroup(p *os.Process) error {
+	if err := syscall.Kill(-p.Pid, syscall.SIGKILL); err == nil {
+		return nil
+	}
+
+	return p.Kill()
+}
@@ -7,7 +7,47 @@
 
 package main
 
+import (
+	"os"
+	"os/exec"
+	"strings"
+	"syscall"
+)
+
 func processExists(pid int) bool {
 	// doesn't matter, not used
 	return false
 }
+
+// setupProcessGroup is a no-op on Windows.
+func setupProcessGroup(cmd *exec.Cmd) {}
+
+// setupUser arranges for the command to run as the named user by wrapping it
+// in a runas invocation. runas cannot take a password on the command line, so
+// this relies on credentials previously saved for the user with
+// "runas /savecred".
+func setupUser(cmd *exec.Cmd, username string) error {
+	runas, err := exec.LookPath("runas")
+	if err != nil {
+		return err
+	}
+
+	// runas takes the command as a single string, so quote each element
+	// before joining to keep paths and arguments with spaces intact
+	quoted := make([]string, len(cmd.Args))
+	for i, arg := range cmd.Args {
+		quoted[i] = syscall.EscapeArg(arg)
+	}
+
+	args := []string{runas, "/user:" + username, "/savecred", strings.Join(quoted, " ")}
+	cmd.Path = runas
+	cmd.Args = args
+
+	return nil
+}
+
+// killProcessGroup kills the process. Windows has no process groups in the
+// POSIX sense, so children are left to the mercy of the OS.
+func killProcessGroup(p *os.Process) error {
+	return p.Kill()
+}
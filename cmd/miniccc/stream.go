@@ -0,0 +1,71 @@
+// Copyright 2015-2021 National Technology & Engineering Solutions of Sandia, LLC (NTESS).
+// Under the terms of Contract DE-NA0003525 with NTESS, the U.S. Government retains certain
+// rights in this software.
+
+package main
+
+import (
+	"io"
+	"sync"
+
+	"github.com/sandia-minimega/minimega/v2/internal/ron"
+	log "github.com/sandia-minimega/minimega/v2/pkg/minilog"
+)
+
+// streamer sends command output chunks to the ron server as they are
+// produced so the server can serve the output live (see "cc log follow" in
+// minimega). The final response still carries the complete output, so nothing
+// is lost if the server predates streaming and drops the chunks.
+type streamer struct {
+	mu  sync.Mutex
+	id  int
+	seq int
+}
+
+// send emits a single chunk with the next sequence number.
+func (s *streamer) send(stdout, stderr string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.seq++
+
+	m := &ron.Message{
+		Type: ron.MESSAGE_COMMAND,
+		UUID: client.UUID,
+		Client: &ron.Client{
+			UUID: client.UUID,
+			Responses: []*ron.Response{
+				&ron.Response{
+					ID:     s.id,
+					Seq:    s.seq,
+					Stdout: stdout,
+					Stderr: stderr,
+				},
+			},
+		},
+		Version: ron.MessageVersion,
+	}
+
+	if err := sendMessage(m); err != nil {
+		log.Error("streaming chunk for command %v: %v", s.id, err)
+	}
+}
+
+// stdout and stderr return writers that send each write as a chunk.
+func (s *streamer) stdout() io.Writer { return &chunkWriter{s: s} }
+func (s *streamer) stderr() io.Writer { return &chunkWriter{s: s, stderr: true} }
+
+type chunkWriter struct {
+	s      *streamer
+	stderr bool
+}
+
+func (w *chunkWriter) Write(p []byte) (int, error) {
+	if w.stderr {
+		w.s.send("", string(p))
+	} else {
+		w.s.send(string(p), "")
+	}
+
+	return len(p), nil
+}
@@ -5,10 +5,14 @@
 package main
 
 import (
+	"fmt"
 	"net"
 	"os"
+	"path"
 	"path/filepath"
 	"runtime"
+	"sync"
+	"time"
 
 	"github.com/sandia-minimega/minimega/v2/internal/ron"
 	log "github.com/sandia-minimega/minimega/v2/pkg/minilog"
@@ -23,10 +27,169 @@ var rootFS struct {
 
 	running bool
 
+	// writable is the mode the current server was built for, see auditFS
+	writable bool
+
 	// active connection, set when running
 	remote, local net.Conn
 }
 
+// auditFS wraps the ninep file server. In read-only mode it rejects any
+// operation that would modify the filesystem. In writable mode it appends a
+// record of each write-class operation to an audit log so there is a per-VM
+// account of what was changed through UFS.
+type auditFS struct {
+	*ufs.FileServer
+
+	writable bool
+
+	// mu guards names; requests from concurrent writers through the mount
+	// may be interleaved
+	mu sync.Mutex
+
+	// names tracks the path each FID refers to, mirroring the walks the
+	// embedded server performs, so the audit log can name what was touched
+	names map[protocol.FID]string
+}
+
+var errReadOnly = fmt.Errorf("filesystem is read-only")
+
+// audit records a write-class operation both in the miniccc log and in an
+// append-only log file alongside the client's other state.
+func (fs *auditFS) audit(op, name string) {
+	log.Info("ufs %v: %v", op, name)
+
+	line := fmt.Sprintf("%v %v %v\n", time.Now().Format(time.RFC3339), op, name)
+
+	f, err := os.OpenFile(filepath.Join(*f_path, "ufs_audit.log"), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		log.Error("ufs audit log: %v", err)
+		return
+	}
+	defer f.Close()
+
+	if _, err := f.WriteString(line); err != nil {
+		log.Error("ufs audit log: %v", err)
+	}
+}
+
+func (fs *auditFS) name(fid protocol.FID) string {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	return fs.names[fid]
+}
+
+func (fs *auditFS) Rattach(fid protocol.FID, afid protocol.FID, uname string, aname string) (protocol.QID, error) {
+	q, err := fs.FileServer.Rattach(fid, afid, uname, aname)
+	if err == nil {
+		fs.mu.Lock()
+		fs.names[fid] = path.Join("/", aname)
+		fs.mu.Unlock()
+	}
+
+	return q, err
+}
+
+func (fs *auditFS) Rwalk(fid protocol.FID, newfid protocol.FID, paths []string) ([]protocol.QID, error) {
+	q, err := fs.FileServer.Rwalk(fid, newfid, paths)
+	if err == nil && len(q) == len(paths) {
+		// newfid is only valid when the full walk succeeded
+		fs.mu.Lock()
+		fs.names[newfid] = path.Join(append([]string{fs.names[fid]}, paths...)...)
+		fs.mu.Unlock()
+	}
+
+	return q, err
+}
+
+func (fs *auditFS) Rclunk(fid protocol.FID) error {
+	err := fs.FileServer.Rclunk(fid)
+
+	fs.mu.Lock()
+	delete(fs.names, fid)
+	fs.mu.Unlock()
+
+	return err
+}
+
+func (fs *auditFS) Ropen(fid protocol.FID, mode protocol.Mode) (protocol.QID, protocol.MaxSize, error) {
+	// OTRUNC and ORCLOSE modify the file even when the access mode is read
+	writes := mode&3 == protocol.OWRITE || mode&3 == protocol.ORDWR ||
+		mode&protocol.OTRUNC != 0 || mode&protocol.ORCLOSE != 0
+
+	if writes {
+		if !fs.writable {
+			return protocol.QID{}, 0, errReadOnly
+		}
+
+		fs.audit("open-write", fs.name(fid))
+	}
+
+	return fs.FileServer.Ropen(fid, mode)
+}
+
+func (fs *auditFS) Rcreate(fid protocol.FID, name string, perm protocol.Perm, mode protocol.Mode) (protocol.QID, protocol.MaxSize, error) {
+	if !fs.writable {
+		return protocol.QID{}, 0, errReadOnly
+	}
+
+	op := "create"
+	if perm&protocol.Perm(protocol.DMDIR) != 0 {
+		op = "mkdir"
+	}
+
+	n := path.Join(fs.name(fid), name)
+
+	q, iounit, err := fs.FileServer.Rcreate(fid, name, perm, mode)
+	if err == nil {
+		fs.audit(op, n)
+
+		// the FID now refers to the created file
+		fs.mu.Lock()
+		fs.names[fid] = n
+		fs.mu.Unlock()
+	}
+
+	return q, iounit, err
+}
+
+func (fs *auditFS) Rwrite(fid protocol.FID, o protocol.Offset, b []byte) (protocol.Count, error) {
+	// unreachable without a writable open or create, but don't rely on it
+	if !fs.writable {
+		return -1, errReadOnly
+	}
+
+	return fs.FileServer.Rwrite(fid, o, b)
+}
+
+func (fs *auditFS) Rwstat(fid protocol.FID, b []byte) error {
+	// wstat covers truncate, chmod, and rename
+	if !fs.writable {
+		return errReadOnly
+	}
+
+	fs.audit("wstat", fs.name(fid))
+
+	return fs.FileServer.Rwstat(fid, b)
+}
+
+func (fs *auditFS) Rremove(fid protocol.FID) error {
+	if !fs.writable {
+		return errReadOnly
+	}
+
+	fs.audit("remove", fs.name(fid))
+
+	err := fs.FileServer.Rremove(fid)
+
+	fs.mu.Lock()
+	delete(fs.names, fid)
+	fs.mu.Unlock()
+
+	return err
+}
+
 // ufsMessage handles a message from the server and relays it to UFS
 func ufsMessage(m *ron.Message) {
 	switch m.UfsMode {
@@ -36,8 +199,8 @@ func ufsMessage(m *ron.Message) {
 			return
 		}
 
-		if rootFS.Server == nil {
-			log.Info("init rootFS")
+		if rootFS.Server == nil || rootFS.writable != m.UfsWritable {
+			log.Info("init rootFS, writable: %v", m.UfsWritable)
 			root := "/"
 			if runtime.GOOS == "windows" {
 				// TODO: what if there is more that one volume?
@@ -50,12 +213,19 @@ func ufsMessage(m *ron.Message) {
 				return
 			}
 
-			ps, err := protocol.NewServer(fs, protocol.Trace(log.Debug))
+			wrapped := &auditFS{
+				FileServer: fs,
+				writable:   m.UfsWritable,
+				names:      make(map[protocol.FID]string),
+			}
+
+			ps, err := protocol.NewServer(wrapped, protocol.Trace(log.Debug))
 			if err != nil {
 				log.Error("unable to create ninep server: %v", err)
 				return
 			}
 			rootFS.Server = ps
+			rootFS.writable = m.UfsWritable
 
 			log.Info("init'd rootFS")
 		}
@@ -9,8 +9,10 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io/ioutil"
 	"net"
 	"os"
+	"path"
 	"path/filepath"
 	"sort"
 	"strconv"
@@ -30,6 +32,8 @@ type ccMount struct {
 	Addr string
 	// Path where the filesystem is mounted
 	Path string
+	// Writable is set when the mount was requested read-write
+	Writable bool
 }
 
 var ccCLIHandlers = []minicli.Handler{
@@ -45,7 +49,37 @@ send a file 'foo' and display the contents on a remote VM:
 	cc exec cat foo
 
 Files to be sent must be in the filepath directory, as set by the -filepath
-flag when launching minimega.
+flag when launching minimega. Files move over the cc channel in chunks; "cc
+transfers" lists transfers currently in flight with their progress and "cc
+chunk-size" displays or sets the chunk size in bytes.
+
+Sent files are content-hashed when the command is queued. Clients keep a small
+manifest of previously received files and acknowledge a send without any
+transfer when the hash matches their local copy; partial or corrupt copies
+fail the check and are fetched again in full. The "cached" column of "cc
+commands" counts how many sends were satisfied this way.
+
+"cc recv" accepts glob patterns, which are expanded on each client, and
+directories, which are retrieved recursively with their relative structure
+preserved under the per-client response directory. Clients send at most 1000
+files and 100 MB per command by default; "cc recv-limit <max files> <max
+bytes>" sets the limits for subsequently queued commands and zero restores the
+client default. Anything skipped, including symlinks, which are recorded but
+never followed, is noted in the response's stderr.
+
+The server separately enforces quotas on what it accepts from clients, so a
+buggy or malicious guest can't fill the host filesystem under the responses
+directory: 100 MB per file and 1 GB per client by default. A transfer over
+quota is rejected as it streams in -- reassembly stops early, any partial
+file is removed, and the rejection is logged and counted. "cc recv-quota"
+shows the quotas and the rejection count; "cc recv-quota <per-file> <per-
+client>" adjusts them at runtime for legitimately large collections, with
+zero meaning unlimited.
+
+Large payloads (file data, pipe data, and command output) are transparently
+compressed on the wire for clients that support it; older clients continue to
+work uncompressed. "cc stats" shows payload bytes before and after compression
+in each direction.
 
 Executed commands can have their stdio tied to pipes used by the plumb and pipe
 APIs. To use named pipes, simply specify stdin, stdout, or stderr as a
@@ -54,10 +88,42 @@ key=value pair. For example:
 	cc exec stderr=foo cat server.log
 	cc background stdin=foo stdout=bar /usr/bin/program
 
+Commands can also be supplied data on standard input with the input key:
+
+	cc exec input=s3cret sudo -S whoami
+	cc exec input=answers.txt /opt/installer
+
+If the value names a file in the filepath directory, that file's contents are
+sent; otherwise the value itself is sent, with a trailing newline appended if
+missing. Stdin is closed once the data has been written so programs that read
+until EOF terminate. Responses include a "stdin" file alongside stdout and
+stderr when the input was delivered.
+
+A working directory and user may be set the same way:
+
+	cc exec dir=/opt/app user=testuser ./run.sh
+
+Relative commands and paths then resolve inside the working directory. On
+Linux the client switches to the user's uid and gid before running the
+command; on Windows it wraps the command in a runas invocation using saved
+credentials. A user the client cannot switch to fails the command rather than
+running it as the client's own user. The effective dir and user are recorded
+in a "context" file alongside the response output. These keys compose with
+"cc filter" and "cc env" like any other queued command settings.
+
 Responses are organized in a structure within <filepath>/miniccc_responses, and
 include subdirectories for each client response named by the client's UUID.
 Responses can also be displayed on the command line with the 'responses'
-command.
+command. Recent clients stream stdout and stderr from foreground commands
+while they run; see "cc log follow" to tail the output live.
+
+With many clients most responses to a command are identical. "cc responses
+<id> group" collapses them into one row per distinct stdout/stderr/exit
+combination with the client count and a sample of the clients that produced
+it, served from an index maintained as responses arrive. "cc responses <id>
+group expand <n>" shows the full output and complete client list for the nth
+row of that table. Appending "normalize" to either form folds together outputs
+that differ only in timestamps.
 
 Filters may be set to limit which clients may execute a posted command.  For
 example, to filter on VMs that are running windows and have a specific IP.
@@ -81,6 +147,123 @@ Users can also filter by any column in "vm info" using a similar syntax:
 
 "vm info" columns take precedance over tags when both define the same key.
 
+In a multi-host namespace, "cc filter host=node5" limits a command to clients
+attached to a particular minimega host -- those whose VMs are scheduled there,
+with clients connected directly over the network matching on the source host
+of their connection instead. Host patterns may be globs. When the pattern
+names at least one namespace host, posting a command skips the mesh send to
+hosts that can't match; "cc preview count" shows how many clients match per
+host.
+
+Hostname filters may be globs (e.g. "cc filter hostname=web-*"). The
+inventory-backed keys osversion, kernel, and user match against the client's
+reported inventory, also with globs (e.g. "cc filter osversion=Ubuntu*" or "cc
+filter user=admin"). All set fields must match for a client to process a
+command (AND semantics). "cc
+preview" lists the currently known clients that match the filter; clients that
+check in later are matched as they arrive.
+
+Environment variables may be set for subsequently queued commands, mirroring
+how "cc filter" applies to new commands:
+
+	cc env set KEY value
+	cc exec env
+
+Variables are layered over the client's own environment. The environment in
+effect for each command is recorded and shown in the "cc commands" table. "cc
+env clear" with an optional key removes one or all variables.
+
+A timeout may be set for subsequently queued commands, specified as a Go
+duration string:
+
+	cc timeout 30s
+	cc exec /opt/flaky-test
+
+When the timeout expires, the client kills the command's process group and
+reports an exit disposition of "timeout". A running command can also be killed
+on demand with "cc kill" and its command ID. Exit codes and dispositions are
+recorded in an "exit" file alongside each response's stdout and stderr.
+
+Commands may be scheduled rather than run immediately. "cc schedule" settings
+apply to subsequently queued commands, mirroring "cc filter":
+
+	cc schedule after 10m
+	cc schedule at 2030-06-01T12:00:00Z
+	cc schedule every 60s 10
+
+"after" delays execution relative to when each client receives the command,
+"at" starts at an absolute time (RFC3339) with clients correcting for clock
+skew using the server's timestamp, and "every" repeats at an interval with an
+optional run count (zero repeats until the command is deleted). "cc schedule"
+with no arguments shows the pending schedule and "cc commands" lists each
+command's schedule and next fire time. Each run of a periodic command is
+recorded under a numbered subdirectory of the response directory so runs don't
+clobber each other. Deleting a scheduled command cancels future runs on
+clients; "cc kill" cancels the schedule on clients that are still running it.
+
+Queued commands are resent to clients that reconnect with fresh state, such as
+a VM that reboots or is re-imaged, so late arrivals still run everything. To
+run a command at most once per client regardless of reconnects, prefix exec or
+background with "once":
+
+	cc once exec /opt/setup.sh
+
+The "cc commands" table shows, per command, how many clients it has been
+delivered to and how many have acknowledged receipt, alongside the number of
+responses. "cc commands status <id>" breaks delivery down per client: each
+client is queued (matched but delivery failed, pending retry), sent, acked
+(recent clients acknowledge explicitly on receipt, ahead of any response),
+responded, failed (delivery abandoned after repeated send failures), or
+expired (the command aged out before the client received it). Appending a
+state name lists the clients currently in that state, making it easy to find
+clients stuck partway. Redelivery to reconnecting clients is automatic and
+bounded.
+
+Queued commands are durable: a client that disconnects briefly receives, in
+order, everything queued while it was away, and the active command list is
+persisted under the namespace run path so it survives a minimega restart
+(including which clients a "once" command already reached). Commands older
+than an hour are not delivered to clients that never saw them; such clients
+show as expired in the status table. "clear cc commands" discards the
+persisted copy along with the live list.
+
+Clients check in every five seconds by default. "cc heartbeat" displays or
+sets the check-in interval, which is pushed to clients at handshake and again
+at runtime when it changes -- useful to quiet very large experiments or to
+tighten liveness detection. "cc clients" shows the time since each client's
+last check-in, and "cc clients stale <duration>" lists only clients that have
+been quiet for at least that long. When a VM's client misses several check-ins
+the "cc_stale" tag is set on the VM with the time it went quiet.
+
+Serial backchannel connections are redialed automatically, with backoff, when
+a guest reboots or the qemu process is relaunched, so clients reattach without
+operator intervention. Queued commands are redelivered on reattach per the
+rules above (run-once commands are not repeated). The "reconnects" column of
+"cc clients" counts how many times each client has reattached after its first
+connection.
+
+Clients also report a structured inventory -- OS version, kernel, uptime,
+logged-in users, and free disk in bytes -- refreshed about once a minute
+rather than every heartbeat. "cc clients detail" renders it as a wide table
+and "cc clients summary" counts clients by OS and architecture. Inventory
+fields from failed probes are empty rather than errors.
+
+A misbehaving client can be debugged by forwarding its own logs over the cc
+channel. "cc log client <vm> debug" ships that client's log output at the
+given level; repeating the command with a different level adjusts verbosity
+and omitting the level stops forwarding. Forwarded lines are recorded under
+<filepath>/miniccc_logs/<uuid>.log, rotated by size with one previous
+generation kept. Forwarding is rate-limited on the client -- a log-spamming
+client drops lines rather than drowning the channel, and a marker noting how
+many were dropped is recorded in their place. "cc log level" continues to set
+the local log level on all clients matching the current filter.
+
+Backgrounded processes are reported in each client's check-in and shown by "cc
+process list" with a client-assigned ID, PID, and start time. When one exits
+on its own it appears in the listing exactly once more, with its exit code,
+and then disappears. "cc process kill" matches either a PID or the
+client-assigned ID; "cc process killall" matches by name.
+
 "cc mount" allows direct access to a guest's filesystem over the command and
 control connection. When given a VM uuid or name and a path, the VM's
 filesystem is mounted to the local machine at the provided path. "cc mount"
@@ -88,6 +271,23 @@ without arguments displays the existing mounts. Users can use "clear cc mount"
 to unmount the filesystem of one or all VMs. This should be done before killing
 or stopping the VM ("clear namespace <name>" will handle this automatically).
 
+Mounts are read-only by default; the client rejects writes and the local mount
+is made with MS_RDONLY. Adding "rw" after the uuid or name (e.g. "cc mount
+server rw /mnt") mounts read-write, allowing files to be written, created,
+truncated, and removed in the guest. Operations that the guest denies (e.g.
+permission errors) are reported back through the mount.
+Recent clients append a record of each write to <path>/ufs_audit.log in the
+guest, where <path> is miniccc's -path directory; older clients serve the
+filesystem writable without the audit log.
+
+"cc tunnel" forwards a local port to a host and port reachable from the guest,
+similar to ssh -L, and "cc rtunnel" forwards a port on clients matching the
+current filter back to a host and port reachable from the minimega host. Both
+forward TCP by default; adding "udp" (e.g. "cc rtunnel udp 53 10.0.0.1 53")
+forwards datagrams instead. Replies are delivered back to the source that sent
+the original datagram. Datagrams too large for the tunnel are dropped, not
+fragmented.
+
 "cc test-conn" allows users to test network connectivity from a guest to the
 given IP or domain name and port. The wait timeout should be specified as a Go
 duration string (e.g. 5s, 1m). If "udp" is used, a "base64 udp packet" that will
@@ -105,38 +305,78 @@ If it fails, STDOUT will instead contain the following:
 
 	10.0.0.68:443 | fail
 
+"cc tls-listen" accepts TLS connections with mutual authentication on the
+given port. Certificates are read from the supplied directory (server.pem,
+server-key.pem, ca.pem) or generated for the namespace on first use, along
+with a client certificate pair to bake into images or deliver over
+virtio-serial (miniccc's -cert, -key, and -ca flags). Plain and TLS listeners
+can run on separate ports at the same time for mixed deployments; the
+transport each client connected over is shown by "cc clients". Serial and
+virtio connections are unaffected.
+
 For more documentation, see the article "Command and Control API Tutorial".`,
 		Patterns: []string{
 			"cc",
 			"cc <listen,> <port>",
+			"cc <tls-listen,> <port> [cert dir]",
 			"cc <clients,>",
+			"cc <clients,> <detail,>",
+			"cc <clients,> <summary,>",
+			"cc <clients,> <stale,> <duration>",
 			"cc <filter,> [filter]...",
+			"cc <preview,>",
+			"cc <preview,> <count,>",
+			"cc <env,>",
+			"cc <env,> <set,> <key> <value>",
+			"cc <env,> <clear,> [key]",
 			"cc <commands,>",
+			"cc <commands,> <status,> <id> [state]",
+			"cc <transfers,>",
+			"cc <chunk-size,> [size]",
+			"cc <stats,>",
 
 			"cc <prefix,> [prefix]",
+			"cc <timeout,> [timeout]",
+			"cc <heartbeat,> [interval]",
+
+			"cc <schedule,>",
+			"cc <schedule,> <after,> <delay>",
+			"cc <schedule,> <at,> <time>",
+			"cc <schedule,> <every,> <interval> [count]",
 
 			"cc <send,> <file>...",
 			"cc <recv,> <file>...",
+			"cc <recv-limit,>",
+			"cc <recv-limit,> <files> <bytes>",
+			"cc <recv-quota,>",
+			"cc <recv-quota,> <per-file bytes> <per-client bytes>",
 			"cc <exec,> <command>...",
+			"cc <once,> <exec,> <command>...",
 			"cc <background,> <command>...",
+			"cc <once,> <background,> <command>...",
 
 			"cc <process,> <list,> <vm name, uuid or all>",
 			"cc <process,> <kill,> <pid or all>",
 			"cc <process,> <killall,> <name>",
 
 			"cc <log,> level <debug,info,warn,error,fatal>",
+			"cc <log,> <client,> <vm name or uuid> [level]",
 
 			"cc <responses,> <id or prefix or all> [raw,]",
+			"cc <responses,> <id> <group,> [normalize,]",
+			"cc <responses,> <id> <group,> <expand,> <index> [normalize,]",
 
 			"cc <tunnel,> <vm name or uuid> <src port> <host> <dst port>",
+			"cc <tunnel,> <vm name or uuid> <udp,> <src port> <host> <dst port>",
 			"cc <rtunnel,> <src port> <host> <dst port>",
+			"cc <rtunnel,> <udp,> <src port> <host> <dst port>",
 
 			"cc <delete,> <command,> <id or prefix or all>",
 			"cc <delete,> <response,> <id or prefix or all>",
 
 			"cc <test-conn,> <tcp,udp> <ip or fqdn> <port> wait <timeout> [base64 udp packet]",
 		},
-		Call: wrapBroadcastCLI(cliCC),
+		Call: ccBroadcastCLI,
 	},
 	{ // cc mount
 		HelpShort: "list mounted filesystems",
@@ -149,9 +389,39 @@ For more documentation, see the article "Command and Control API Tutorial".`,
 		HelpShort: "mount VM filesystem",
 		Patterns: []string{
 			"cc mount <uuid or name> [path]",
+			"cc mount <uuid or name> <rw,> <path>",
 		},
 		Call: cliCCMountUUID,
 	},
+	{ // cc log follow
+		HelpShort: "follow command output as it arrives",
+		HelpLong: `
+Tail the output of a command posted with "cc exec" as it arrives, rather than
+waiting for clients to finish and reading the responses. Clients running a
+recent miniccc stream stdout and stderr while the command runs; output from
+older clients that don't stream shows up when their final response is
+recorded. The follow returns once at least one client has responded and no
+clients are still streaming, or when the command is deleted.
+
+Only responses recorded by this minimega instance are followed.`,
+		Patterns: []string{
+			"cc log follow <id>",
+		},
+		Call: cliCCLogFollow,
+	},
+	{ // cc kill
+		HelpShort: "kill a command on clients still running it",
+		HelpLong: `
+Kill the process started by the given command on any clients that are still
+running it. The kill carries the original command's filter; clients that have
+already completed the command ignore it. Killed commands report an exit
+disposition of "killed" in their responses. To kill a process by PID instead,
+see "cc process kill".`,
+		Patterns: []string{
+			"cc kill <id>",
+		},
+		Call: wrapBroadcastCLI(cliCCKill),
+	},
 	{ // clear cc
 		HelpShort: "reset command and control state",
 		HelpLong: `
@@ -160,9 +430,13 @@ See "help cc" for more information.`,
 		Patterns: []string{
 			"clear cc",
 			"clear cc <commands,>",
+			"clear cc <env,>",
 			"clear cc <filter,>",
 			"clear cc <prefix,>",
+			"clear cc <recv-limit,>",
+			"clear cc <schedule,>",
 			"clear cc <responses,>",
+			"clear cc <timeout,>",
 		},
 		Call: wrapSimpleCLI(cliCCClear),
 	},
@@ -178,23 +452,100 @@ See "help cc" for more information.`,
 // Functions pointers to the various handlers for the subcommands
 var ccCliSubHandlers = map[string]wrappedCLIFunc{
 	"background": cliCCBackground,
+	"chunk-size": cliCCChunkSize,
 	"clients":    cliCCClients,
 	"commands":   cliCCCommand,
 	"delete":     cliCCDelete,
+	"env":        cliCCEnv,
 	"exec":       cliCCExec,
 	"filter":     cliCCFilter,
 	"log":        cliCCLog,
 	"prefix":     cliCCPrefix,
+	"preview":    cliCCPreview,
 	"process":    cliCCProcess,
 	"recv":       cliCCFileRecv,
+	"recv-limit": cliCCRecvLimit,
+	"recv-quota": cliCCRecvQuota,
 	"responses":  cliCCResponses,
 	"rtunnel":    cliCCTunnel,
+	"schedule":   cliCCSchedule,
+	"stats":      cliCCStats,
+	"timeout":    cliCCTimeout,
+	"heartbeat":  cliCCHeartbeat,
 	"send":       cliCCFileSend,
+	"transfers":  cliCCTransfers,
 	"tunnel":     cliCCTunnel,
 	"listen":     cliCCListen,
+	"tls-listen": cliCCTLSListen,
 	"test-conn":  cliCCTestConn,
 }
 
+// ccLocalCLI is the `local` behavior for ccBroadcastCLI.
+var ccLocalCLI = wrapSimpleCLI(cliCC)
+
+// ccBroadcastCLI mirrors wrapBroadcastCLI for the cc API with host-aware
+// fan-out: when the cc filter pins a host (see "cc filter host=") and the
+// subcommand posts a command to clients, the mesh send skips namespace hosts
+// whose names can't match, since no client attached there can process it.
+func ccBroadcastCLI(c *minicli.Command, respChan chan<- minicli.Responses) {
+	ns := GetNamespace()
+
+	// see wrapBroadcastCLI for how the source field distinguishes the `fan
+	// out` and `local` phases
+	if c.Source != "" {
+		ccLocalCLI(c, respChan)
+		return
+	}
+
+	res := minicli.Responses{}
+
+	for resps := range runCommands(namespaceCommandsFiltered(ns, c, ccHostInclude(ns, c))...) {
+		for _, resp := range resps {
+			res = append(res, resp)
+		}
+	}
+
+	respChan <- res
+}
+
+// ccHostInclude returns the host predicate for fanning out a cc command, or
+// nil to broadcast to the whole namespace.
+func ccHostInclude(ns *Namespace, c *minicli.Command) func(string) bool {
+	// only subcommands that queue a command for clients benefit from
+	// skipping hosts; queries still need every host's view
+	posts := false
+	for _, k := range []string{"exec", "background", "send", "recv", "test-conn"} {
+		if c.BoolArgs[k] {
+			posts = true
+			break
+		}
+	}
+
+	if !posts || ns.ccFilter == nil || ns.ccFilter.Host == "" {
+		return nil
+	}
+
+	match := func(host string) bool {
+		if ok, err := path.Match(ns.ccFilter.Host, host); err == nil {
+			return ok
+		}
+
+		// invalid patterns fall back to an exact match
+		return ns.ccFilter.Host == host
+	}
+
+	// only prune when the pattern names at least one namespace host --
+	// otherwise it may be a network client's source host, which could be
+	// attached to any of them
+	for host := range ns.Hosts {
+		if match(host) {
+			return match
+		}
+	}
+
+	return nil
+}
+
 func cliCC(ns *Namespace, c *minicli.Command, resp *minicli.Response) error {
 	// Dispatcher for a sub handler
 	if len(c.BoolArgs) > 0 {
@@ -219,6 +570,16 @@ func cliCC(ns *Namespace, c *minicli.Command, resp *minicli.Response) error {
 	return nil
 }
 
+// ccStaleHandler is called by the ron server when a VM's client misses
+// several check-ins in a row, see ron.Server.StaleHandler. The time is
+// recorded in the VM's tags so experiments can react to guest agent death via
+// "vm info" or cc filters.
+func ccStaleHandler(vm ron.VM) {
+	log.Warn("cc client for %v has gone stale", vm.GetUUID())
+
+	vm.SetTag("cc_stale", time.Now().Format(time.RFC3339))
+}
+
 // tunnel
 func cliCCTunnel(ns *Namespace, c *minicli.Command, resp *minicli.Response) error {
 	src, err := strconv.Atoi(c.StringArgs["src"])
@@ -232,6 +593,15 @@ func cliCCTunnel(ns *Namespace, c *minicli.Command, resp *minicli.Response) erro
 	}
 
 	host := c.StringArgs["host"]
+	udp := c.BoolArgs["udp"]
+
+	if c.BoolArgs["rtunnel"] {
+		if udp {
+			return ns.ccServer.ReverseUDP(ns.ccFilter, src, host, dst)
+		}
+
+		return ns.ccServer.Reverse(ns.ccFilter, src, host, dst)
+	}
 
 	v := c.StringArgs["vm"]
 
@@ -243,6 +613,10 @@ func cliCCTunnel(ns *Namespace, c *minicli.Command, resp *minicli.Response) erro
 	log.Debug("got vm: %v %v", vm.GetID(), vm.GetName())
 	uuid := vm.GetUUID()
 
+	if udp {
+		return ns.ccServer.ForwardUDP(uuid, src, host, dst)
+	}
+
 	return ns.ccServer.Forward(uuid, src, host, dst)
 }
 
@@ -251,6 +625,10 @@ func cliCCResponses(ns *Namespace, c *minicli.Command, resp *minicli.Response) e
 	s := c.StringArgs["id"]
 	raw := c.BoolArgs["raw"]
 
+	if c.BoolArgs["group"] {
+		return cliCCResponseGroups(ns, c, resp)
+	}
+
 	if s == Wildcard {
 		r, err := ns.ccServer.GetResponses(raw)
 		if err == nil {
@@ -288,6 +666,72 @@ func cliCCResponses(ns *Namespace, c *minicli.Command, resp *minicli.Response) e
 	return nil
 }
 
+// cliCCResponseGroups renders a command's responses grouped by distinct
+// output, or expands one group in full.
+func cliCCResponseGroups(ns *Namespace, c *minicli.Command, resp *minicli.Response) error {
+	id, err := strconv.Atoi(c.StringArgs["id"])
+	if err != nil {
+		return fmt.Errorf("invalid command id: `%v`", c.StringArgs["id"])
+	}
+
+	normalize := c.BoolArgs["normalize"]
+
+	if c.BoolArgs["expand"] {
+		group, err := strconv.Atoi(c.StringArgs["index"])
+		if err != nil {
+			return fmt.Errorf("invalid group: `%v`", c.StringArgs["index"])
+		}
+
+		r, err := ns.ccServer.ExpandResponseGroup(id, group, normalize)
+		if err == nil {
+			resp.Response = r
+		}
+		return err
+	}
+
+	groups, err := ns.ccServer.GetResponseGroups(id, normalize)
+	if err != nil {
+		return err
+	}
+
+	resp.Header = []string{"group", "count", "exit", "stdout", "stderr", "sample"}
+
+	for i, g := range groups {
+		resp.Tabular = append(resp.Tabular, []string{
+			strconv.Itoa(i + 1),
+			strconv.Itoa(g.Count),
+			g.Exit,
+			responsePreview(g.Stdout, g.Truncated),
+			responsePreview(g.Stderr, g.Truncated),
+			strings.Join(g.Sample, ", "),
+		})
+	}
+
+	return nil
+}
+
+// responsePreview flattens representative output to a single line for the
+// grouped response table; "cc responses <id> group expand" shows it in full.
+func responsePreview(out string, truncated bool) string {
+	out = strings.TrimRight(out, "\n")
+
+	if i := strings.IndexByte(out, '\n'); i != -1 {
+		out = out[:i]
+		truncated = true
+	}
+
+	if len(out) > 60 {
+		out = out[:60]
+		truncated = true
+	}
+
+	if truncated {
+		out += "..."
+	}
+
+	return out
+}
+
 // prefix
 func cliCCPrefix(ns *Namespace, c *minicli.Command, resp *minicli.Response) error {
 	if prefix, ok := c.StringArgs["prefix"]; ok {
@@ -299,6 +743,203 @@ func cliCCPrefix(ns *Namespace, c *minicli.Command, resp *minicli.Response) erro
 	return nil
 }
 
+// timeout
+func cliCCTimeout(ns *Namespace, c *minicli.Command, resp *minicli.Response) error {
+	if timeout, ok := c.StringArgs["timeout"]; ok {
+		v, err := time.ParseDuration(timeout)
+		if err != nil {
+			return fmt.Errorf("invalid timeout `%v`: %v", timeout, err)
+		}
+
+		ns.ccTimeout = v
+		return nil
+	}
+
+	resp.Response = ns.ccTimeout.String()
+	return nil
+}
+
+// recv-limit
+func cliCCRecvLimit(ns *Namespace, c *minicli.Command, resp *minicli.Response) error {
+	if files, ok := c.StringArgs["files"]; ok {
+		v, err := strconv.Atoi(files)
+		if err != nil || v < 0 {
+			return fmt.Errorf("invalid max files: `%v`", files)
+		}
+
+		b, err := strconv.ParseInt(c.StringArgs["bytes"], 10, 64)
+		if err != nil || b < 0 {
+			return fmt.Errorf("invalid max bytes: `%v`", c.StringArgs["bytes"])
+		}
+
+		ns.ccRecvMaxFiles = v
+		ns.ccRecvMaxBytes = b
+		return nil
+	}
+
+	resp.Response = fmt.Sprintf("%v files / %v bytes", ns.ccRecvMaxFiles, ns.ccRecvMaxBytes)
+	return nil
+}
+
+// recv-quota
+func cliCCRecvQuota(ns *Namespace, c *minicli.Command, resp *minicli.Response) error {
+	if v, ok := c.StringArgs["per-file"]; ok {
+		file, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || file < 0 {
+			return fmt.Errorf("invalid per-file quota: `%v`", v)
+		}
+
+		client, err := strconv.ParseInt(c.StringArgs["per-client"], 10, 64)
+		if err != nil || client < 0 {
+			return fmt.Errorf("invalid per-client quota: `%v`", c.StringArgs["per-client"])
+		}
+
+		return ns.ccServer.SetRecvQuotas(file, client)
+	}
+
+	file, client := ns.ccServer.RecvQuotas()
+	resp.Response = fmt.Sprintf("%v bytes per file / %v bytes per client (%v transfers rejected)",
+		file, client, ns.ccServer.RecvQuotaViolations())
+	return nil
+}
+
+// schedule
+func cliCCSchedule(ns *Namespace, c *minicli.Command, resp *minicli.Response) error {
+	if c.BoolArgs["after"] {
+		v, err := time.ParseDuration(c.StringArgs["delay"])
+		if err != nil {
+			return fmt.Errorf("invalid delay `%v`: %v", c.StringArgs["delay"], err)
+		}
+
+		ns.ccAfter = v
+		ns.ccAt = time.Time{}
+		return nil
+	}
+
+	if c.BoolArgs["at"] {
+		v, err := time.Parse(time.RFC3339, c.StringArgs["time"])
+		if err != nil {
+			return fmt.Errorf("invalid time `%v`: %v", c.StringArgs["time"], err)
+		}
+
+		ns.ccAt = v
+		ns.ccAfter = 0
+		return nil
+	}
+
+	if c.BoolArgs["every"] {
+		v, err := time.ParseDuration(c.StringArgs["interval"])
+		if err != nil {
+			return fmt.Errorf("invalid interval `%v`: %v", c.StringArgs["interval"], err)
+		}
+
+		var count int
+		if s, ok := c.StringArgs["count"]; ok {
+			count, err = strconv.Atoi(s)
+			if err != nil || count < 0 {
+				return fmt.Errorf("invalid count: `%v`", s)
+			}
+		}
+
+		ns.ccInterval = v
+		ns.ccCount = count
+		return nil
+	}
+
+	// display the schedule that will apply to subsequently queued commands
+	cmd := &ron.Command{
+		After:    ns.ccAfter,
+		At:       ns.ccAt,
+		Interval: ns.ccInterval,
+		Count:    ns.ccCount,
+	}
+
+	resp.Response = cmd.Schedule()
+	return nil
+}
+
+// heartbeat
+func cliCCHeartbeat(ns *Namespace, c *minicli.Command, resp *minicli.Response) error {
+	if interval, ok := c.StringArgs["interval"]; ok {
+		v, err := time.ParseDuration(interval)
+		if err != nil {
+			return fmt.Errorf("invalid interval `%v`: %v", interval, err)
+		}
+
+		return ns.ccServer.SetHeartbeatRate(v)
+	}
+
+	resp.Response = ns.ccServer.HeartbeatRate().String()
+	return nil
+}
+
+// kill
+func cliCCKill(ns *Namespace, c *minicli.Command, resp *minicli.Response) error {
+	id, err := strconv.Atoi(c.StringArgs["id"])
+	if err != nil {
+		return fmt.Errorf("invalid command id: `%v`", c.StringArgs["id"])
+	}
+
+	cmd, err := ns.ccServer.KillCommand(id)
+	if err != nil {
+		return err
+	}
+
+	// send directly rather than via ns.NewCommand so that the original
+	// command's filter is preserved
+	resp.Data = ns.ccServer.NewCommand(cmd)
+	return nil
+}
+
+// preview shows the currently known clients that match the filter
+func cliCCPreview(ns *Namespace, c *minicli.Command, resp *minicli.Response) error {
+	clients := ns.ccServer.MatchingClients(ns.ccFilter)
+
+	if c.BoolArgs["count"] {
+		// per-host match counts rather than individual clients
+		counts := map[string]int{}
+		for _, c := range clients {
+			counts[c.Host]++
+		}
+
+		var hosts []string
+		for host := range counts {
+			hosts = append(hosts, host)
+		}
+		sort.Strings(hosts)
+
+		resp.Header = []string{"host", "count"}
+		resp.Tabular = [][]string{}
+		for _, host := range hosts {
+			resp.Tabular = append(resp.Tabular, []string{host, strconv.Itoa(counts[host])})
+		}
+
+		return nil
+	}
+
+	resp.Header = []string{
+		"uuid", "hostname", "host", "arch", "os", "ip", "mac",
+	}
+
+	sort.Slice(clients, func(i, j int) bool {
+		return clients[i].UUID < clients[j].UUID
+	})
+
+	for _, c := range clients {
+		resp.Tabular = append(resp.Tabular, []string{
+			c.UUID,
+			c.Hostname,
+			c.Host,
+			c.Arch,
+			c.OS,
+			fmt.Sprintf("%v", c.IPs),
+			fmt.Sprintf("%v", c.MACs),
+		})
+	}
+
+	return nil
+}
+
 // filter
 func cliCCFilter(ns *Namespace, c *minicli.Command, resp *minicli.Response) error {
 	if len(c.ListArgs["filter"]) > 0 {
@@ -316,6 +957,8 @@ func cliCCFilter(ns *Namespace, c *minicli.Command, resp *minicli.Response) erro
 				filter.UUID = strings.ToLower(parts[1])
 			case "hostname":
 				filter.Hostname = parts[1]
+			case "host":
+				filter.Host = parts[1]
 			case "arch":
 				filter.Arch = parts[1]
 			case "os":
@@ -356,10 +999,11 @@ func cliCCFilter(ns *Namespace, c *minicli.Command, resp *minicli.Response) erro
 
 	// Summary of current filter
 	if ns.ccFilter != nil {
-		resp.Header = []string{"uuid", "hostname", "arch", "os", "ip", "mac", "tags"}
+		resp.Header = []string{"uuid", "hostname", "host", "arch", "os", "ip", "mac", "tags"}
 		row := []string{
 			ns.ccFilter.UUID,
 			ns.ccFilter.Hostname,
+			ns.ccFilter.Host,
 			ns.ccFilter.Arch,
 			ns.ccFilter.OS,
 			fmt.Sprintf("%v", ns.ccFilter.IP),
@@ -381,6 +1025,43 @@ func cliCCFilter(ns *Namespace, c *minicli.Command, resp *minicli.Response) erro
 	return nil
 }
 
+// env
+func cliCCEnv(ns *Namespace, c *minicli.Command, resp *minicli.Response) error {
+	if c.BoolArgs["set"] {
+		if ns.ccEnv == nil {
+			ns.ccEnv = make(map[string]string)
+		}
+
+		ns.ccEnv[c.StringArgs["key"]] = c.StringArgs["value"]
+		return nil
+	}
+
+	if c.BoolArgs["clear"] {
+		if key, ok := c.StringArgs["key"]; ok {
+			delete(ns.ccEnv, key)
+		} else {
+			ns.ccEnv = nil
+		}
+
+		return nil
+	}
+
+	// Summary of current environment
+	resp.Header = []string{"key", "value"}
+
+	var keys []string
+	for k := range ns.ccEnv {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		resp.Tabular = append(resp.Tabular, []string{k, ns.ccEnv[k]})
+	}
+
+	return nil
+}
+
 // send
 func cliCCFileSend(ns *Namespace, c *minicli.Command, resp *minicli.Response) error {
 	files := make([]string, len(c.ListArgs["file"]))
@@ -443,14 +1124,30 @@ func cliCCFileRecv(ns *Namespace, c *minicli.Command, resp *minicli.Response) er
 
 // background (just exec with background==true)
 func cliCCBackground(ns *Namespace, c *minicli.Command, resp *minicli.Response) error {
-	stdin, stdout, stderr, command := ccCommandPreProcess(c.ListArgs["command"])
+	stdin, stdout, stderr, input, dir, user, command := ccCommandPreProcess(c.ListArgs["command"])
 
 	cmd := &ron.Command{
 		Background: true,
+		Once:       c.BoolArgs["once"],
 		Command:    command,
 		Stdin:      stdin,
 		Stdout:     stdout,
 		Stderr:     stderr,
+		Dir:        dir,
+		User:       user,
+	}
+
+	if input != "" {
+		if stdin != "" {
+			return errors.New("cannot combine stdin input with a stdin pipe")
+		}
+
+		data, err := ccStdinInput(input)
+		if err != nil {
+			return err
+		}
+
+		cmd.Input = data
 	}
 
 	resp.Data = ns.NewCommand(cmd)
@@ -489,19 +1186,57 @@ func cliCCProcessKillAll(ns *Namespace, c *minicli.Command, resp *minicli.Respon
 
 // exec
 func cliCCExec(ns *Namespace, c *minicli.Command, resp *minicli.Response) error {
-	stdin, stdout, stderr, command := ccCommandPreProcess(c.ListArgs["command"])
+	stdin, stdout, stderr, input, dir, user, command := ccCommandPreProcess(c.ListArgs["command"])
 
 	cmd := &ron.Command{
+		Once:    c.BoolArgs["once"],
 		Command: command,
 		Stdin:   stdin,
 		Stdout:  stdout,
 		Stderr:  stderr,
+		Dir:     dir,
+		User:    user,
+	}
+
+	if input != "" {
+		if stdin != "" {
+			return errors.New("cannot combine stdin input with a stdin pipe")
+		}
+
+		data, err := ccStdinInput(input)
+		if err != nil {
+			return err
+		}
+
+		cmd.Input = data
 	}
 
 	resp.Data = ns.NewCommand(cmd)
 	return nil
 }
 
+// ccStdinInput resolves the input argument for "cc exec stdin": the contents
+// of a file in the filepath directory when one exists, otherwise the argument
+// itself with a trailing newline appended if missing.
+func ccStdinInput(input string) (string, error) {
+	path := filepath.Join(*f_iomBase, input)
+
+	if _, err := os.Stat(path); err == nil {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return "", err
+		}
+
+		return string(data), nil
+	}
+
+	if !strings.HasSuffix(input, "\n") {
+		input += "\n"
+	}
+
+	return input, nil
+}
+
 // process
 func cliCCProcess(ns *Namespace, c *minicli.Command, resp *minicli.Response) error {
 	if c.BoolArgs["kill"] {
@@ -530,7 +1265,7 @@ func cliCCProcess(ns *Namespace, c *minicli.Command, resp *minicli.Response) err
 		activeVms = []string{vm.GetUUID()}
 	}
 
-	resp.Header = []string{"name", "uuid", "pid", "command"}
+	resp.Header = []string{"name", "uuid", "id", "pid", "command", "started", "exit"}
 	for _, uuid := range activeVms {
 		vm := ns.FindVM(uuid)
 		if vm == nil {
@@ -543,11 +1278,26 @@ func cliCCProcess(ns *Namespace, c *minicli.Command, resp *minicli.Response) err
 		}
 
 		for _, p := range processes {
+			// exited processes appear in exactly one check-in, with their
+			// exit code; older clients don't report IDs or start times
+			exit := ""
+			if p.Exited {
+				exit = strconv.Itoa(p.ExitCode)
+			}
+
+			started := ""
+			if !p.Started.IsZero() {
+				started = p.Started.Format(time.RFC3339)
+			}
+
 			resp.Tabular = append(resp.Tabular, []string{
 				vm.GetName(),
 				vm.GetUUID(),
+				strconv.Itoa(p.ID),
 				fmt.Sprintf("%v", p.PID),
 				strings.Join(p.Command, " "),
+				started,
+				exit,
 			})
 		}
 	}
@@ -555,11 +1305,13 @@ func cliCCProcess(ns *Namespace, c *minicli.Command, resp *minicli.Response) err
 	return nil
 }
 
-// parse out key/value pairs from the command list for stdio
-func ccCommandPreProcess(c []string) (stdin, stdout, stderr string, command []string) {
-	// pop key/value pairs (up to three) for stdio plumber redirection
-	for i := 0; i < 3 && i < len(c); i++ {
-		f := strings.Split(c[i], "=")
+// parse out key/value pairs from the command list for stdio, stdin input,
+// and working directory/user context
+func ccCommandPreProcess(c []string) (stdin, stdout, stderr, input, dir, user string, command []string) {
+	// pop key/value pairs (up to six) for stdio plumber redirection, stdin
+	// input, and dir/user context
+	for i := 0; i < 6 && i < len(c); i++ {
+		f := strings.SplitN(c[i], "=", 2)
 		if len(f) == 1 {
 			command = c[i:]
 			return
@@ -571,17 +1323,27 @@ func ccCommandPreProcess(c []string) (stdin, stdout, stderr string, command []st
 			stdout = f[1]
 		case "stderr":
 			stderr = f[1]
+		case "input":
+			input = f[1]
+		case "dir":
+			dir = f[1]
+		case "user":
+			user = f[1]
 		default:
 			// perhaps some goofy filename with an = in it
 			command = c[i:]
 			return
 		}
 	}
-	command = c[3:]
+	command = c[6:]
 	return
 }
 
 func cliCCLog(ns *Namespace, c *minicli.Command, resp *minicli.Response) error {
+	if c.BoolArgs["client"] {
+		return cliCCLogClient(ns, c, resp)
+	}
+
 	// search for level in BoolArgs, we know that one of the BoolArgs will
 	// parse without error thanks to minicli.
 	var level log.Level
@@ -601,13 +1363,181 @@ func cliCCLog(ns *Namespace, c *minicli.Command, resp *minicli.Response) error {
 	return nil
 }
 
+// cliCCLogClient starts, adjusts, or stops forwarding of a single client's
+// log output back to the server.
+func cliCCLogClient(ns *Namespace, c *minicli.Command, resp *minicli.Response) error {
+	v := c.StringArgs["vm"]
+
+	// get the vm uuid
+	vm := ns.FindVM(v)
+	if vm == nil {
+		return vmNotFound(v)
+	}
+	log.Debug("got vm: %v %v", vm.GetID(), vm.GetName())
+	uuid := vm.GetUUID()
+
+	forward := &ron.LogForward{}
+
+	if s, ok := c.StringArgs["level"]; ok {
+		level, err := log.ParseLevel(s)
+		if err != nil {
+			return err
+		}
+
+		forward.Level = level
+	} else {
+		forward.Stop = true
+	}
+
+	cmd := &ron.Command{
+		LogForward: forward,
+		Filter:     &ron.Filter{UUID: uuid},
+	}
+
+	resp.Data = ns.NewCommand(cmd)
+	return nil
+}
+
+// cliCCLogFollow tails response output for a command as it is recorded,
+// sending each new piece of output as its own response.
+func cliCCLogFollow(c *minicli.Command, respChan chan<- minicli.Responses) {
+	ns := GetNamespace()
+
+	resp := &minicli.Response{Host: hostname}
+
+	id, err := strconv.Atoi(c.StringArgs["id"])
+	if err != nil {
+		resp.Error = fmt.Sprintf("invalid command id: `%v`", c.StringArgs["id"])
+
+		respChan <- minicli.Responses{resp}
+		return
+	}
+
+	err = ns.ccServer.FollowResponse(id, func(s string) {
+		respChan <- minicli.Responses{&minicli.Response{
+			Host:     hostname,
+			Response: s,
+		}}
+	})
+
+	if err != nil {
+		resp.Error = err.Error()
+	}
+
+	respChan <- minicli.Responses{resp}
+}
+
+// transfers
+func cliCCTransfers(ns *Namespace, c *minicli.Command, resp *minicli.Response) error {
+	resp.Header = []string{
+		"uuid", "name", "dir", "transferred", "size", "progress",
+	}
+
+	transfers := ns.ccServer.GetFileTransfers()
+
+	sort.Slice(transfers, func(i, j int) bool {
+		if transfers[i].UUID != transfers[j].UUID {
+			return transfers[i].UUID < transfers[j].UUID
+		}
+
+		return transfers[i].Name < transfers[j].Name
+	})
+
+	for _, t := range transfers {
+		// peers that predate chunked progress don't report a total size
+		progress := "??"
+		if t.Size > 0 {
+			progress = fmt.Sprintf("%.0f%%", 100*float64(t.Sent)/float64(t.Size))
+		}
+
+		resp.Tabular = append(resp.Tabular, []string{
+			t.UUID,
+			t.Name,
+			t.Dir,
+			strconv.FormatInt(t.Sent, 10),
+			strconv.FormatInt(t.Size, 10),
+			progress,
+		})
+	}
+
+	return nil
+}
+
+// stats
+func cliCCStats(ns *Namespace, c *minicli.Command, resp *minicli.Response) error {
+	stats := ns.ccServer.CompressionStats()
+
+	resp.Header = []string{"direction", "raw", "compressed", "saved"}
+
+	row := func(dir string, raw, compressed int64) []string {
+		saved := "0%"
+		if raw > 0 {
+			saved = fmt.Sprintf("%.0f%%", 100*(1-float64(compressed)/float64(raw)))
+		}
+
+		return []string{
+			dir,
+			strconv.FormatInt(raw, 10),
+			strconv.FormatInt(compressed, 10),
+			saved,
+		}
+	}
+
+	resp.Tabular = [][]string{
+		row("sent", stats.RawOut, stats.CompressedOut),
+		row("received", stats.RawIn, stats.CompressedIn),
+	}
+
+	return nil
+}
+
+// chunk-size
+func cliCCChunkSize(ns *Namespace, c *minicli.Command, resp *minicli.Response) error {
+	if size, ok := c.StringArgs["size"]; ok {
+		v, err := strconv.ParseInt(size, 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid chunk size: `%v`", size)
+		}
+
+		return ns.ccServer.SetChunkSize(v)
+	}
+
+	resp.Response = strconv.FormatInt(ns.ccServer.ChunkSize(), 10)
+	return nil
+}
+
 // clients
 func cliCCClients(ns *Namespace, c *minicli.Command, resp *minicli.Response) error {
+	if c.BoolArgs["detail"] {
+		return cliCCClientsDetail(ns, resp)
+	} else if c.BoolArgs["summary"] {
+		return cliCCClientsSummary(ns, resp)
+	}
+
+	// only list clients that haven't checked in for at least this long
+	var stale time.Duration
+
+	if c.BoolArgs["stale"] {
+		var err error
+
+		stale, err = time.ParseDuration(c.StringArgs["duration"])
+		if err != nil {
+			return err
+		}
+	}
+
 	resp.Header = []string{
-		"uuid", "hostname", "arch", "os", "ip", "mac",
+		"uuid", "hostname", "arch", "os", "ip", "mac", "transport", "age",
+		"reconnects",
 	}
 
 	for _, c := range ns.ccServer.GetClients() {
+		age := time.Since(c.Checkin).Truncate(time.Second)
+
+		if age < stale {
+			continue
+		}
+
 		row := []string{
 			c.UUID,
 			c.Hostname,
@@ -615,19 +1545,89 @@ func cliCCClients(ns *Namespace, c *minicli.Command, resp *minicli.Response) err
 			c.OS,
 			fmt.Sprintf("%v", c.IPs),
 			fmt.Sprintf("%v", c.MACs),
+			c.Transport,
+			age.String(),
+			strconv.Itoa(c.Reconnects),
+		}
+
+		resp.Tabular = append(resp.Tabular, row)
+	}
+
+	return nil
+}
+
+// cliCCClientsDetail renders the inventory each client reports at check-in.
+// Clients that predate inventory reporting show empty fields.
+func cliCCClientsDetail(ns *Namespace, resp *minicli.Response) error {
+	resp.Header = []string{
+		"uuid", "hostname", "arch", "os", "osversion", "kernel", "uptime",
+		"users", "diskfree", "version",
+	}
+
+	for _, c := range ns.ccServer.GetClients() {
+		row := []string{
+			c.UUID,
+			c.Hostname,
+			c.Arch,
+			c.OS,
+		}
+
+		if i := c.Inventory; i != nil {
+			row = append(row,
+				i.OSVersion,
+				i.Kernel,
+				i.Uptime.String(),
+				strings.Join(i.Users, " "),
+				strconv.FormatUint(i.DiskFree, 10),
+			)
+		} else {
+			row = append(row, "", "", "", "", "")
 		}
 
+		row = append(row, c.Version)
+
 		resp.Tabular = append(resp.Tabular, row)
 	}
 
 	return nil
 }
 
+// cliCCClientsSummary counts the active clients by OS and architecture.
+func cliCCClientsSummary(ns *Namespace, resp *minicli.Response) error {
+	resp.Header = []string{"os", "arch", "count"}
+
+	counts := map[string]int{}
+
+	for _, c := range ns.ccServer.GetClients() {
+		counts[c.OS+"\x00"+c.Arch]++
+	}
+
+	var keys []string
+	for k := range counts {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		parts := strings.SplitN(k, "\x00", 2)
+		resp.Tabular = append(resp.Tabular, []string{
+			parts[0], parts[1], strconv.Itoa(counts[k]),
+		})
+	}
+
+	return nil
+}
+
 // command
 func cliCCCommand(ns *Namespace, c *minicli.Command, resp *minicli.Response) error {
+	if c.BoolArgs["status"] {
+		return cliCCCommandStatus(ns, c, resp)
+	}
+
 	resp.Header = []string{
-		"id", "prefix", "command", "responses", "background",
-		"sent", "received", "connectivity", "level", "filter",
+		"id", "prefix", "command", "responses", "background", "once",
+		"schedule", "delivered", "acked", "cached", "sent", "received",
+		"connectivity", "level", "filter", "env",
 	}
 	resp.Tabular = [][]string{}
 
@@ -642,12 +1642,19 @@ func cliCCCommand(ns *Namespace, c *minicli.Command, resp *minicli.Response) err
 
 	for _, id := range ids {
 		v := commands[id]
+		delivered, acked := ns.ccServer.Deliveries(v.ID)
+
 		row := []string{
 			strconv.Itoa(v.ID),
 			v.Prefix,
 			fmt.Sprintf("%v", v.Command),
 			strconv.Itoa(len(v.CheckedIn)),
 			strconv.FormatBool(v.Background),
+			strconv.FormatBool(v.Once),
+			v.Schedule(),
+			strconv.Itoa(delivered),
+			strconv.Itoa(acked),
+			strconv.Itoa(len(v.CachedSend)),
 			fmt.Sprintf("%v", v.FilesSend),
 			fmt.Sprintf("%v", v.FilesRecv),
 		}
@@ -666,12 +1673,74 @@ func cliCCCommand(ns *Namespace, c *minicli.Command, resp *minicli.Response) err
 
 		row = append(row, fmt.Sprintf("%v", v.Filter))
 
+		var env []string
+		for k, v := range v.Env {
+			env = append(env, k+"="+v)
+		}
+		sort.Strings(env)
+		row = append(row, strings.Join(env, " "))
+
 		resp.Tabular = append(resp.Tabular, row)
 	}
 
 	return nil
 }
 
+// cliCCCommandStatus reports per-client delivery state for a command: counts
+// by state, or the clients currently in a given state.
+func cliCCCommandStatus(ns *Namespace, c *minicli.Command, resp *minicli.Response) error {
+	id, err := strconv.Atoi(c.StringArgs["id"])
+	if err != nil {
+		return fmt.Errorf("invalid command id: `%v`", c.StringArgs["id"])
+	}
+
+	status, err := ns.ccServer.DeliveryStatus(id)
+	if err != nil {
+		return err
+	}
+
+	if s, ok := c.StringArgs["state"]; ok {
+		want, err := ron.ParseDeliveryState(s)
+		if err != nil {
+			return err
+		}
+
+		var uuids []string
+		for uuid, st := range status {
+			if st == want {
+				uuids = append(uuids, uuid)
+			}
+		}
+		sort.Strings(uuids)
+
+		resp.Header = []string{"uuid"}
+		resp.Tabular = [][]string{}
+		for _, uuid := range uuids {
+			resp.Tabular = append(resp.Tabular, []string{uuid})
+		}
+
+		return nil
+	}
+
+	counts := make(map[ron.DeliveryState]int)
+	for _, st := range status {
+		counts[st]++
+	}
+
+	states := []ron.DeliveryState{
+		ron.DELIVERY_QUEUED, ron.DELIVERY_SENT, ron.DELIVERY_ACKED,
+		ron.DELIVERY_RESPONDED, ron.DELIVERY_FAILED, ron.DELIVERY_EXPIRED,
+	}
+
+	resp.Header = []string{"state", "clients"}
+	resp.Tabular = [][]string{}
+	for _, st := range states {
+		resp.Tabular = append(resp.Tabular, []string{st.String(), strconv.Itoa(counts[st])})
+	}
+
+	return nil
+}
+
 func cliCCDelete(ns *Namespace, c *minicli.Command, resp *minicli.Response) error {
 	s := c.StringArgs["id"]
 
@@ -707,6 +1776,46 @@ func cliCCListen(ns *Namespace, c *minicli.Command, resp *minicli.Response) erro
 	return ns.ccServer.Listen(port)
 }
 
+// tls-listen
+func cliCCTLSListen(ns *Namespace, c *minicli.Command, resp *minicli.Response) error {
+	port, err := strconv.Atoi(c.StringArgs["port"])
+	if err != nil {
+		return err
+	}
+
+	// use the supplied certificate directory or generate certificates for
+	// the namespace on first use
+	dir := c.StringArgs["cert"]
+	if dir == "" {
+		if ns.Name == DefaultNamespace {
+			dir = filepath.Join(*f_iomBase, "cc_tls")
+		} else {
+			dir = filepath.Join(*f_iomBase, ns.Name, "cc_tls")
+		}
+
+		if err := ron.GenerateCerts(dir, ns.Name); err != nil {
+			return err
+		}
+	}
+
+	config, err := ron.NewTLSConfig(
+		filepath.Join(dir, "server.pem"),
+		filepath.Join(dir, "server-key.pem"),
+		filepath.Join(dir, "ca.pem"),
+		true,
+	)
+	if err != nil {
+		return err
+	}
+
+	if err := ns.ccServer.ListenTLS(port, config); err != nil {
+		return err
+	}
+
+	resp.Response = fmt.Sprintf("client credentials in %v", dir)
+	return nil
+}
+
 func cliCCTestConn(ns *Namespace, c *minicli.Command, resp *minicli.Response) error {
 	if _, err := strconv.Atoi(c.StringArgs["port"]); err != nil {
 		return fmt.Errorf("invalid port %s: %v", c.StringArgs["port"], err)
@@ -751,14 +1860,20 @@ func cliCCMount(c *minicli.Command, respChan chan<- minicli.Responses) {
 	makeResponse := func() *minicli.Response {
 		resp := &minicli.Response{Host: hostname}
 
-		resp.Header = []string{"name", "uuid", "addr", "path"}
+		resp.Header = []string{"name", "uuid", "addr", "path", "mode"}
 
 		for uuid, mnt := range ns.ccMounts {
+			mode := "ro"
+			if mnt.Writable {
+				mode = "rw"
+			}
+
 			resp.Tabular = append(resp.Tabular, []string{
 				mnt.Name,
 				uuid,
 				mnt.Addr,
 				mnt.Path,
+				mode,
 			})
 		}
 
@@ -796,6 +1911,13 @@ func cliCCMountUUID(c *minicli.Command, respChan chan<- minicli.Responses) {
 
 	id := c.StringArgs["uuid"]
 	path := c.StringArgs["path"]
+	writable := c.BoolArgs["rw"]
+
+	if c.Source != "" {
+		// fanned-out mounts only request the UFS port; the actual mount
+		// happens on the host where the user ran "cc mount"
+		path = ""
+	}
 
 	if path == "" && c.Source == "" {
 		// TODO: we could generate a sane default
@@ -852,7 +1974,7 @@ func cliCCMountUUID(c *minicli.Command, respChan chan<- minicli.Responses) {
 		}
 
 		// Start UFS
-		port, err := ns.ccServer.ListenUFS(vm.GetUUID())
+		port, err := ns.ccServer.ListenUFS(vm.GetUUID(), writable)
 		if err != nil {
 			resp.Error = err.Error()
 
@@ -860,12 +1982,13 @@ func cliCCMountUUID(c *minicli.Command, respChan chan<- minicli.Responses) {
 			return
 		}
 
-		log.Debug("ufs for %v started on %v", vm.GetUUID(), port)
+		log.Debug("ufs for %v started on %v, writable: %v", vm.GetUUID(), port, writable)
 
 		mnt := ccMount{
-			Name: vm.GetName(),
-			Addr: fmt.Sprintf("%v:%v", vm.GetHost(), port),
-			Path: path,
+			Name:     vm.GetName(),
+			Addr:     fmt.Sprintf("%v:%v", vm.GetHost(), port),
+			Path:     path,
+			Writable: writable,
 		}
 
 		if path == "" {
@@ -879,10 +2002,15 @@ func cliCCMountUUID(c *minicli.Command, respChan chan<- minicli.Responses) {
 
 		log.Info("mount for %v from :%v to %v", vm.GetUUID(), port, path)
 
-		// do the mount
+		// do the mount, read-only at the VFS level too unless rw was requested
 		opts := fmt.Sprintf("trans=tcp,port=%v,version=9p2000", port)
 
-		if err := syscall.Mount("127.0.0.1", path, "9p", 0, opts); err != nil {
+		var flags uintptr
+		if !writable {
+			flags = syscall.MS_RDONLY
+		}
+
+		if err := syscall.Mount("127.0.0.1", path, "9p", flags, opts); err != nil {
 			if err := ns.ccServer.DisconnectUFS(vm.GetUUID()); err != nil {
 				// zombie UFS
 				log.Error("unable to disconnect ufs for %v: %v", vm.GetUUID(), err)
@@ -908,6 +2036,9 @@ func cliCCMountUUID(c *minicli.Command, respChan chan<- minicli.Responses) {
 
 	// VM is running on a remote host
 	cmd := minicli.MustCompilef("namespace %v cc mount %v", ns.Name, vm.GetUUID())
+	if writable {
+		cmd = minicli.MustCompilef("namespace %v cc mount %v rw %v", ns.Name, vm.GetUUID(), path)
+	}
 	cmd.SetSource(ns.Name)
 	cmd.SetRecord(false)
 
@@ -956,13 +2087,19 @@ func cliCCMountUUID(c *minicli.Command, respChan chan<- minicli.Responses) {
 		// do the (remote) mount
 		opts := fmt.Sprintf("trans=tcp,port=%v,version=9p2000", port)
 
-		if err := syscall.Mount(addr.IP.String(), path, "9p", 0, opts); err != nil {
+		var flags uintptr
+		if !writable {
+			flags = syscall.MS_RDONLY
+		}
+
+		if err := syscall.Mount(addr.IP.String(), path, "9p", flags, opts); err != nil {
 			resp.Error = err.Error()
 		} else {
 			ns.ccMounts[vm.GetUUID()] = ccMount{
-				Name: vm.GetName(),
-				Addr: fmt.Sprintf("%v:%v", vm.GetHost(), port),
-				Path: path,
+				Name:     vm.GetName(),
+				Addr:     fmt.Sprintf("%v:%v", vm.GetHost(), port),
+				Path:     path,
+				Writable: writable,
 			}
 		}
 	}
@@ -984,12 +2121,24 @@ func cliCCClear(ns *Namespace, c *minicli.Command, resp *minicli.Response) error
 				switch what {
 				case "filter":
 					ns.ccFilter = nil
+				case "env":
+					ns.ccEnv = nil
 				case "commands":
 					ns.ccServer.ClearCommands()
 				case "responses":
 					ns.ccServer.ClearResponses()
 				case "prefix":
 					ns.ccPrefix = ""
+				case "timeout":
+					ns.ccTimeout = 0
+				case "recv-limit":
+					ns.ccRecvMaxFiles = 0
+					ns.ccRecvMaxBytes = 0
+				case "schedule":
+					ns.ccAfter = 0
+					ns.ccAt = time.Time{}
+					ns.ccInterval = 0
+					ns.ccCount = 0
 				}
 			}
 		}
@@ -385,11 +385,21 @@ func runCommands(cmd ...*minicli.Command) <-chan minicli.Responses {
 // list. All commands will be prefixed with "namespace <name>", have their
 // source set to the namespace name, and be record false.
 func namespaceCommands(ns *Namespace, cmd *minicli.Command) []*minicli.Command {
+	return namespaceCommandsFiltered(ns, cmd, nil)
+}
+
+// namespaceCommandsFiltered is namespaceCommands restricted to the hosts that
+// include accepts. A nil include sends to every host in the namespace.
+func namespaceCommandsFiltered(ns *Namespace, cmd *minicli.Command, include func(string) bool) []*minicli.Command {
 	var cmds = []*minicli.Command{}
 
 	var peers []string
 
 	for host := range ns.Hosts {
+		if include != nil && !include(host) {
+			continue
+		}
+
 		if host == hostname {
 			// Create a deep copy of the command by recompiling it
 			cmd2 := minicli.MustCompile(cmd.Original)
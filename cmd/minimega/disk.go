@@ -5,20 +5,26 @@
 package main
 
 import (
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io/ioutil"
 	"os"
+	"os/exec"
 	"path"
 	"path/filepath"
 	"regexp"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
 	"syscall"
 	"time"
 
 	"github.com/sandia-minimega/minimega/v2/internal/nbd"
 	"github.com/sandia-minimega/minimega/v2/pkg/minicli"
 	log "github.com/sandia-minimega/minimega/v2/pkg/minilog"
+	"github.com/sandia-minimega/minimega/v2/pkg/ranges"
 )
 
 // #include "linux/fs.h"
@@ -30,24 +36,45 @@ const (
 )
 
 type DiskInfo struct {
+	Path        string
 	Format      string
 	VirtualSize string
 	DiskSize    string
 	BackingFile string
 	FileSystem  string
+
+	// populated only when qemu-img supports JSON output
+	ClusterSize   int64
+	LazyRefcounts bool
 }
 
 type FSType string
 
 const (
 	LVM   FSType = "lvm"
+	LUKS  FSType = "luks"
 	ZFS   FSType = "zfs"
 	EXT4  FSType = "ext4"
 	NTFS  FSType = "ntfs"
 	BTRFS FSType = "btrfs"
+	VFAT  FSType = "vfat"
+	EXFAT FSType = "exfat"
+	XFS   FSType = "xfs"
 	NONE  FSType = ""
 )
 
+// nbdLock serializes commands that hold an nbd device (inject, partitions) so
+// two commands can't race to claim the same device.
+var nbdLock sync.Mutex
+
+// diskProcess runs external commands for the mount, inject, and unmount
+// machinery with the -disktimeout deadline applied so that a hung mount
+// cannot hold an nbd device forever. It is a variable so that tests can
+// substitute failures at specific stages.
+var diskProcess = func(args ...string) (string, error) {
+	return processWrapperTimeout(*f_diskTimeout, args...)
+}
+
 var diskCLIHandlers = []minicli.Handler{
 	{ // disk
 		HelpShort: "manipulate qcow disk images image",
@@ -62,6 +89,27 @@ Example of creating a new disk:
 The size argument is the size in bytes, or using optional suffixes "k"
 (kilobyte), "M" (megabyte), "G" (gigabyte), "T" (terabyte).
 
+Create optionally accepts a preallocation mode (off, metadata, falloc, or
+full) and, for qcow2 images, a cluster size:
+
+	disk create qcow2 foo.qcow2 100G prealloc full cluster 128k
+
+Metadata preallocation and cluster sizes only apply to qcow2. Note that
+fallocating or fully preallocating a large image may take several minutes.
+
+In a cluster, create can fan out over the mesh and report per-host status,
+and disk exists reports whether each node has the image along with its size
+and hash so mismatched copies stand out (hashes use the iomeshage hasher):
+
+	disk create qcow2 foo.qcow2 100G on all
+	mesh send all disk exists foo.qcow2
+
+Create can also build a qcow2 overlay on top of an existing backing image,
+recording the backing format explicitly. Size is inherited from the backing
+file unless supplied:
+
+	disk create qcow2 overlay.qc2 backing ubuntu.qc2
+
 Example of taking a snapshot of a disk:
 
 	disk snapshot windows7.qc2 window7_miniccc.qc2
@@ -70,13 +118,23 @@ If the destination name is omitted, a name will be randomly generated and the
 snapshot will be stored in the 'files' directory. Snapshots are always created
 in the 'files' directory.
 
+Each snapshot adds a link to the image's backing chain and deep chains hurt
+read performance; a warning is logged when the source chain is already deep
+(see the -chaindepth flag). To instead produce a standalone copy with no
+backing image, append flatten:
+
+	disk snapshot windows7_miniccc.qc2 windows7_flat.qc2 flatten
+
 To inject files into an image:
 
 	disk inject window7_miniccc.qc2 files "miniccc":"Program Files/miniccc"
 
 Each argument after the image should be a source and destination pair,
 separated by a ':'. If the file paths contain spaces, use double quotes.
-Optionally, you may specify a partition (partition 1 will be used by default):
+Relative sources (and the image itself) that are missing locally are fetched
+over the file mesh before mounting, so injects work on whichever node the
+scheduler picked. Optionally, you may specify a partition (partition 1 will
+be used by default):
 
 	disk inject window7_miniccc.qc2:2 files "miniccc":"Program Files/miniccc"
 
@@ -85,38 +143,211 @@ was directly written to the disk (this is highly unusual):
 
 	disk inject partitionless_disk.qc2:none files /miniccc:/miniccc
 
-To choose a File System Type specify the fstype flag, the default is EXT4:
+The filesystem is detected with blkid and mounted appropriately (ext*, ntfs,
+vfat, exfat, btrfs, and xfs are supported). LVM and ZFS need extra arguments,
+so for those specify the fstype flag explicitly:
 
 	(LVM) disk inject linux_mccc.qc2:<volumegroup>:<logical volume> fstype LVM files "miniccc":"Program Files/miniccc"
 	(ZFS) disk inject linux_mccc.qc2:<partition>:<zpool name> fstype ZFS files "miniccc":"Program Files/miniccc"
 
+A ZFS pool name may include a dataset, in which case only that dataset is
+mounted (at the mount directory) instead of the whole pool:
+
+	disk inject linux_mccc.qc2:2:rpool/ROOT/ubuntu fstype ZFS files "miniccc":"opt/minimega/miniccc"
+
+Each pair may carry optional mode, uid, and gid fields to apply after the
+copy, in the form src:dst[:mode[:uid[:gid]]]. The mode is octal and the
+uid/gid are numeric; empty fields are skipped, so ownership can be set without
+a mode. Any parent directories created for the destination inherit the
+specified ownership. For example:
+
+	disk inject linux_mccc.qc2 files miniccc:/opt/minimega/miniccc:755:0:0
+	disk inject linux_mccc.qc2 files "key:/home/user/.ssh/key::1000:1000"
+
+Ownership is silently skipped on NTFS images, which do not track unix
+uids/gids.
+
+LUKS-encrypted images and partitions can be opened by supplying a keyfile,
+which keeps the passphrase out of the command history:
+
+	disk inject hardened.qc2:2 fstype luks keyfile secret.key files foo:/foo
+
+The partition is opened with cryptsetup before mounting and closed again once
+the inject finishes, even on failure. For LVM-on-LUKS, combine a keyfile with
+fstype LVM; the LUKS container is assumed to be the first partition. Keyfile
+paths follow the same files-directory convention as images.
+
 You can optionally specify mount arguments to use with inject. Multiple options
 should be quoted. For example:
 
 	disk inject foo.qcow2 options "-t fat -o offset=100" files foo:bar
 
+Inject can also delete files from an image, for example to scrub host keys or
+machine-ids before cloning. The same partition, fstype, and options arguments
+apply. Directories are only removed when the recursive keyword is given:
+
+	disk inject window7_miniccc.qc2 delete "Program Files/miniccc"
+	disk inject linux_mccc.qc2 recursive delete /var/log
+
+Nonexistent paths are reported per-entry without aborting the rest.
+
+To see which partition to inject into, list the partition tables inside an
+image:
+
+	disk partitions window7_miniccc.qc2
+
+Each row shows the partition number, size, filesystem type, and label. LVM
+physical volumes and ZFS members are identified so you know to use the
+corresponding fstype flag.
+
+To merge a snapshot back into its backing image, use commit:
+
+	disk commit window7_miniccc.qc2
+
+The image must have a backing file and neither image may be in use by a VM in
+any namespace. The optional delete keyword removes the now-redundant overlay
+once the commit succeeds.
+
+To point a snapshot at a renamed or relocated backing image, use rebase. The
+safe mode copies any clusters that differ between the old and new backing
+files; if the backing image was merely renamed, the unsafe keyword skips the
+copy and only rewrites the header:
+
+	disk rebase window7_miniccc.qc2 windows7.qc2 unsafe
+
+Disk info lists the full backing chain, one row per image, and flags links
+that are missing on disk rather than erroring.
+
+Disk wipe zeroes the free space inside an image's filesystem and compacts the
+result, which can shrink golden images carrying gigabytes of deleted-but-
+allocated data. The original is only replaced once the compacted copy is
+complete. The image must not be in use by any VM:
+
+	disk wipe foo.qcow2
+
+Before deleting or rebasing a base image, disk du reports everything that
+depends on it: images in the files directory and disks attached to VMs
+(including snapshot overlays in instance paths) whose backing chain includes
+the given file, along with each overlay's size and any VM using it:
+
+	disk du ubuntu.qc2
+
+For interactive editing, an image can be left mounted at a directory of your
+choosing and unmounted later by image or mountpoint. Active mounts are listed
+by disk mounts, and a mounted image cannot be used to launch a VM:
+
+	disk mount foo.qcow2:1 /mnt/foo
+	disk mounts
+	disk umount /mnt/foo
+
 Disk image paths are always relative to the 'files' directory. Users may also
 use absolute paths if desired. The backing images for snapshots should always
 be in the files directory.`,
 		Patterns: []string{
 			"disk <create,> <qcow2,raw> <image name> <size>",
+			"disk <create,> <qcow2,raw> <image name> <size> prealloc <prealloc>",
+			"disk <create,> <qcow2,raw> <image name> <size> cluster <cluster>",
+			"disk <create,> <qcow2,raw> <image name> <size> prealloc <prealloc> cluster <cluster>",
+			"disk <create,> <qcow2,raw> <image name> <size> on <hosts>",
+			"disk <create,> <qcow2,raw> <image name> backing <backing image>",
+			"disk <create,> <qcow2,raw> <image name> <size> backing <backing image>",
 			"disk <snapshot,> <image> [dst image]",
+			"disk <snapshot,> <image> <dst image> <flatten,>",
 			"disk <inject,> <image> files <files like /path/to/src:/path/to/dst>...",
 			"disk <inject,> <image> options <options> files <files like /path/to/src:/path/to/dst>...",
 			"disk <inject,> <image> options <options> fstype <fstype> files <files like /path/to/src:/path/to/dst>...",
 			"disk <inject,> <image> fstype <fstype> files <files like /path/to/src:/path/to/dst>...",
+			"disk <inject,> <image> fstype <fstype> keyfile <keyfile> files <files like /path/to/src:/path/to/dst>...",
+			"disk <inject,> <image> options <options> fstype <fstype> keyfile <keyfile> files <files like /path/to/src:/path/to/dst>...",
+			"disk <inject,> <image> delete <paths like /path/to/file>...",
+			"disk <inject,> <image> <recursive,> delete <paths like /path/to/file>...",
+			"disk <inject,> <image> options <options> delete <paths like /path/to/file>...",
+			"disk <inject,> <image> options <options> <recursive,> delete <paths like /path/to/file>...",
+			"disk <inject,> <image> options <options> fstype <fstype> delete <paths like /path/to/file>...",
+			"disk <inject,> <image> options <options> fstype <fstype> <recursive,> delete <paths like /path/to/file>...",
+			"disk <inject,> <image> fstype <fstype> delete <paths like /path/to/file>...",
+			"disk <inject,> <image> fstype <fstype> <recursive,> delete <paths like /path/to/file>...",
+			"disk <inject,> <image> fstype <fstype> keyfile <keyfile> delete <paths like /path/to/file>...",
+			"disk <inject,> <image> fstype <fstype> keyfile <keyfile> <recursive,> delete <paths like /path/to/file>...",
+			"disk <commit,> <image> [delete,]",
+			"disk <rebase,> <image> <backing> [unsafe,]",
+			"disk <partitions,> <image>",
+			"disk <mount,> <image> <mountpoint>",
+			"disk <mount,> <image> fstype <fstype> <mountpoint>",
+			"disk <umount,> <image or mountpoint>",
+			"disk <mounts,>",
+			"disk <wipe,> <image>",
+			"disk <du,> <image>",
+			"disk <exists,> <image>",
 			"disk <info,> <image>",
 		},
 		Call: wrapSimpleCLI(cliDisk),
 	},
 }
 
+// diskCreateBacking creates a new qcow2 overlay, dst, on top of backing. The
+// backing format is detected and passed explicitly with -F since qemu-img is
+// deprecating format probing. Size is inherited from the backing file unless
+// supplied. Returns the new backing chain.
+func diskCreateBacking(dst, backing, size string) (string, error) {
+	if _, err := os.Stat(backing); err != nil {
+		return "", fmt.Errorf("[image %s] backing file: %v", dst, err)
+	}
+
+	if !strings.HasPrefix(backing, *f_iomBase) {
+		log.Warn("minimega expects backing images to be in the files directory")
+	}
+
+	info, err := diskInfo(backing)
+	if err != nil {
+		return "", err
+	}
+
+	args := []string{"qemu-img", "create", "-f", "qcow2", "-b", backing, "-F", info.Format, dst}
+	if size != "" {
+		args = append(args, size)
+	}
+
+	out, err := processWrapper(args...)
+	if err != nil {
+		return "", fmt.Errorf("[image %s] %v: %v", dst, out, err)
+	}
+
+	// report the new backing chain
+	chain, err := diskChain(dst)
+	if err != nil {
+		return "", err
+	}
+
+	names := []string{}
+	for _, info := range chain {
+		names = append(names, info.Path)
+	}
+
+	return strings.Join(names, " -> "), nil
+}
+
 // diskSnapshot creates a new image, dst, using src as the backing image.
-func diskSnapshot(src, dst string) error {
+// With flatten, dst is instead a standalone copy of src with no backing
+// image.
+func diskSnapshot(src, dst string, flatten bool) error {
 	if !strings.HasPrefix(src, *f_iomBase) {
 		log.Warn("minimega expects backing images to be in the files directory")
 	}
 
+	if flatten {
+		out, err := processWrapper("qemu-img", "convert", "-O", "qcow2", src, dst)
+		if err != nil {
+			return fmt.Errorf("[image %s] %v: %v", src, out, err)
+		}
+
+		return nil
+	}
+
+	if depth := diskChainDepth(src); *f_chainDepth > 0 && depth >= *f_chainDepth {
+		log.Warn("backing chain for %v is already %v images deep which hurts read performance, consider `disk snapshot %v <dst> flatten` or `disk commit`", src, depth, src)
+	}
+
 	out, err := processWrapper("qemu-img", "create", "-f", "qcow2", "-b", src, dst)
 	if err != nil {
 		return fmt.Errorf("[image %s] %v: %v", src, out, err)
@@ -125,9 +356,120 @@ func diskSnapshot(src, dst string) error {
 	return nil
 }
 
+// diskChainDepth returns the number of images in the backing chain for image,
+// including image itself. Errors are swallowed since callers only use the
+// depth for advisory warnings.
+func diskChainDepth(image string) int {
+	chain, err := diskChain(image)
+	if err != nil {
+		log.Debug("unable to walk chain for %v: %v", image, err)
+		return 0
+	}
+
+	return len(chain)
+}
+
+// qemuImgInfo matches the JSON output of `qemu-img info --output=json`.
+type qemuImgInfo struct {
+	Filename            string `json:"filename"`
+	Format              string `json:"format"`
+	VirtualSize         int64  `json:"virtual-size"`
+	ActualSize          int64  `json:"actual-size"`
+	ClusterSize         int64  `json:"cluster-size"`
+	BackingFilename     string `json:"backing-filename"`
+	FullBackingFilename string `json:"full-backing-filename"`
+	FormatSpecific      struct {
+		Type string `json:"type"`
+		Data struct {
+			LazyRefcounts bool `json:"lazy-refcounts"`
+		} `json:"data"`
+	} `json:"format-specific"`
+}
+
+// toDiskInfo converts parsed qemu-img JSON into a DiskInfo.
+func (q qemuImgInfo) toDiskInfo() DiskInfo {
+	info := DiskInfo{
+		Path:          q.Filename,
+		Format:        q.Format,
+		VirtualSize:   fmt.Sprintf("%v (%v bytes)", humanSize(q.VirtualSize), q.VirtualSize),
+		DiskSize:      humanSize(q.ActualSize),
+		ClusterSize:   q.ClusterSize,
+		LazyRefcounts: q.FormatSpecific.Data.LazyRefcounts,
+	}
+
+	// prefer the actual absolute path for the backing image, if present
+	info.BackingFile = q.FullBackingFilename
+	if info.BackingFile == "" {
+		info.BackingFile = q.BackingFilename
+	}
+
+	return info
+}
+
+// parseQemuImgInfo parses `qemu-img info --output=json` output, which is a
+// single object for one image or an array when --backing-chain is used.
+func parseQemuImgInfo(out string) ([]DiskInfo, error) {
+	var chain []qemuImgInfo
+
+	if err := json.Unmarshal([]byte(out), &chain); err != nil {
+		var single qemuImgInfo
+		if err := json.Unmarshal([]byte(out), &single); err != nil {
+			return nil, err
+		}
+
+		chain = append(chain, single)
+	}
+
+	res := []DiskInfo{}
+	for _, q := range chain {
+		res = append(res, q.toDiskInfo())
+	}
+
+	return res, nil
+}
+
+// humanSize formats a byte count the way qemu-img does (e.g. 100G).
+func humanSize(b int64) string {
+	if b < 1024 {
+		return strconv.FormatInt(b, 10)
+	}
+
+	suffixes := "KMGTP"
+
+	v := float64(b)
+	var i int
+	for v >= 1024 && i < len(suffixes) {
+		v /= 1024
+		i++
+	}
+
+	return fmt.Sprintf("%.4g%c", v, suffixes[i-1])
+}
+
 // diskInfo return information about the disk.
 func diskInfo(image string) (DiskInfo, error) {
-	info := DiskInfo{}
+	out, err := processWrapper("qemu-img", "info", "--output=json", image)
+	if err == nil {
+		infos, err := parseQemuImgInfo(out)
+		if err != nil {
+			return DiskInfo{}, fmt.Errorf("[image %s] %v", image, err)
+		}
+
+		if len(infos) > 0 {
+			info := infos[0]
+			info.Path = image
+			return info, nil
+		}
+	}
+
+	// fall back to scraping the human-readable output for ancient qemu-img
+	// versions that lack --output=json
+	return diskInfoText(image)
+}
+
+// diskInfoText parses the human-readable `qemu-img info` output.
+func diskInfoText(image string) (DiskInfo, error) {
+	info := DiskInfo{Path: image}
 
 	out, err := processWrapper("qemu-img", "info", image)
 	if err != nil {
@@ -163,40 +505,324 @@ func diskInfo(image string) (DiskInfo, error) {
 	return info, nil
 }
 
-// diskCreate creates a new disk image, dst, of given size/format.
-func diskCreate(format, dst, size string) error {
-	out, err := processWrapper("qemu-img", "create", "-f", format, dst, size)
-	if err != nil {
-		log.Error("diskCreate: %v", out)
-		return err
+// diskInUse returns an error if any VM in any local namespace references
+// image, either directly or as the path backing a snapshot.
+func diskInUse(image string) error {
+	for _, n := range ListNamespaces() {
+		ns := GetOrCreateNamespace(n)
+
+		for _, vm := range ns.VMs.FindKvmVMs() {
+			for _, d := range vm.Disks {
+				if d.Path == image || d.SnapshotPath == image {
+					return fmt.Errorf("[image %s] in use by vm %v in namespace %v", image, vm.GetName(), n)
+				}
+			}
+		}
 	}
+
 	return nil
 }
 
-// diskInject injects files into a disk image. dst/partition specify the image
-// and the partition number, pairs is the dst, src filepaths. options can be
-// used to supply mount arguments.
-func diskInject(dst, partition string, fstype string, pairs map[string]string, options []string) error {
-	// Load nbd
-	if err := nbd.Modprobe(); err != nil {
-		return err
+// diskDependent records an image whose backing chain includes some base
+// image, along with any VMs currently using it.
+type diskDependent struct {
+	Path string
+	Size int64
+	VMs  []string
+}
+
+// diskDependents returns the images that directly or transitively back onto
+// base, scanning both the files directory and the disks of every VM in every
+// namespace. Anything that deletes images out from under minimega (see `file
+// delete`) should consult this first.
+func diskDependents(base string) ([]*diskDependent, error) {
+	base = filepath.Clean(base)
+
+	deps := map[string]*diskDependent{}
+
+	add := func(image, vm string) {
+		image = filepath.Clean(image)
+		if image == base {
+			return
+		}
+
+		// use the backing chain rather than filename heuristics so that
+		// renamed or absolute-path backings are still found
+		chain, err := diskChain(image)
+		if err != nil {
+			log.Debug("skipping %v: %v", image, err)
+			return
+		}
+
+		var hit bool
+		for _, info := range chain[1:] {
+			if filepath.Clean(info.Path) == base {
+				hit = true
+				break
+			}
+		}
+		if !hit {
+			return
+		}
+
+		d := deps[image]
+		if d == nil {
+			d = &diskDependent{Path: image}
+			if fi, err := os.Stat(image); err == nil {
+				d.Size = fi.Size()
+			}
+			deps[image] = d
+		}
+		if vm != "" {
+			d.VMs = append(d.VMs, vm)
+		}
 	}
 
-	// create a tmp mount point
-	mntDir, err := ioutil.TempDir(*f_base, "dstImg")
+	// images in the files directory
+	err := filepath.Walk(*f_iomBase, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.Mode().IsRegular() {
+			add(p, "")
+		}
+		return nil
+	})
 	if err != nil {
-		return err
+		return nil, err
 	}
-	log.Debug("temporary mount point: %v", mntDir)
-	defer func() {
-		if err := os.Remove(mntDir); err != nil {
-			log.Error("rm mount dir failed: %v", err)
+
+	// disks attached to VMs, including snapshot overlays in instance paths
+	for _, n := range ListNamespaces() {
+		ns := GetOrCreateNamespace(n)
+
+		for _, vm := range ns.VMs.FindKvmVMs() {
+			for _, d := range vm.Disks {
+				add(d.Path, vm.GetName())
+				if d.SnapshotPath != "" {
+					add(d.SnapshotPath, vm.GetName())
+				}
+			}
 		}
-	}()
+	}
 
-	nbdPath, err := nbd.ConnectImage(dst)
+	res := []*diskDependent{}
+	for _, d := range deps {
+		res = append(res, d)
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].Path < res[j].Path })
+
+	return res, nil
+}
+
+// diskCommit merges the overlay image into its backing file. If del is true,
+// the now-redundant overlay is removed after a successful commit.
+func diskCommit(image string, del bool) (string, error) {
+	info, err := diskInfo(image)
 	if err != nil {
-		return err
+		return "", err
+	}
+
+	if info.BackingFile == "" {
+		return "", fmt.Errorf("[image %s] no backing file to commit into", image)
+	}
+
+	if err := diskInUse(image); err != nil {
+		return "", err
+	}
+	if err := diskInUse(info.BackingFile); err != nil {
+		return "", err
+	}
+
+	out, err := processWrapper("qemu-img", "commit", image)
+	if err != nil {
+		return "", fmt.Errorf("[image %s] %v: %v", image, out, err)
+	}
+
+	res := fmt.Sprintf("merged %v into %v", info.DiskSize, info.BackingFile)
+
+	if del {
+		if err := os.Remove(image); err != nil {
+			return res, fmt.Errorf("[image %s] commit succeeded but delete failed: %v", image, err)
+		}
+
+		res += ", deleted overlay"
+	}
+
+	return res, nil
+}
+
+// diskChainLimit caps how many backing files diskChain will follow in case a
+// damaged chain is deeper than any sane snapshot hierarchy.
+const diskChainLimit = 64
+
+// diskChain follows the backing chain for image, returning info for each
+// element starting with the image itself. A link that is missing on disk ends
+// the chain with a placeholder entry rather than an error; cycles and chains
+// deeper than diskChainLimit do error.
+func diskChain(image string) ([]DiskInfo, error) {
+	// one qemu-img invocation covers the whole chain when every link exists;
+	// fall through to the walk below for missing links or ancient qemu-img
+	if out, err := processWrapper("qemu-img", "info", "--output=json", "--backing-chain", image); err == nil {
+		if infos, err := parseQemuImgInfo(out); err == nil && len(infos) > 0 {
+			infos[0].Path = image
+			return infos, nil
+		}
+	}
+
+	var chain []DiskInfo
+
+	seen := map[string]bool{}
+
+	for next := image; next != ""; {
+		if seen[next] {
+			return nil, fmt.Errorf("[image %s] backing chain contains a cycle at %v", image, next)
+		}
+		seen[next] = true
+
+		if len(chain) >= diskChainLimit {
+			return nil, fmt.Errorf("[image %s] backing chain deeper than %v", image, diskChainLimit)
+		}
+
+		if _, err := os.Stat(next); err != nil {
+			chain = append(chain, DiskInfo{Path: next})
+			break
+		}
+
+		info, err := diskInfo(next)
+		if err != nil {
+			return nil, err
+		}
+
+		chain = append(chain, info)
+		next = info.BackingFile
+	}
+
+	return chain, nil
+}
+
+// diskVirtualSize parses the byte count out of a qemu-img virtual size
+// string such as "100G (107374182400 bytes)".
+func diskVirtualSize(s string) (int64, error) {
+	match := regexp.MustCompile(`\((\d+) bytes\)`).FindStringSubmatch(s)
+	if match == nil {
+		return 0, fmt.Errorf("unable to parse virtual size: %v", s)
+	}
+
+	return strconv.ParseInt(match[1], 10, 64)
+}
+
+// diskRebase changes the backing file of image to backing. In safe mode,
+// qemu-img copies any clusters that differ between the old and new backing
+// files; unsafe mode only rewrites the header, which is appropriate when the
+// backing file was simply renamed or moved. Returns the new backing chain.
+func diskRebase(image, backing string, unsafe bool) (string, error) {
+	if _, err := os.Stat(backing); err != nil {
+		return "", fmt.Errorf("[image %s] new backing file: %v", image, err)
+	}
+
+	info, err := diskInfo(image)
+	if err != nil {
+		return "", err
+	}
+
+	backingInfo, err := diskInfo(backing)
+	if err != nil {
+		return "", err
+	}
+
+	size, err := diskVirtualSize(info.VirtualSize)
+	if err != nil {
+		return "", fmt.Errorf("[image %s] %v", image, err)
+	}
+
+	backingSize, err := diskVirtualSize(backingInfo.VirtualSize)
+	if err != nil {
+		return "", fmt.Errorf("[image %s] %v", backing, err)
+	}
+
+	if size != backingSize {
+		return "", fmt.Errorf("[image %s] virtual size mismatch with %v: %v != %v", image, backing, info.VirtualSize, backingInfo.VirtualSize)
+	}
+
+	args := []string{"qemu-img", "rebase"}
+	if unsafe {
+		args = append(args, "-u")
+	}
+	args = append(args, "-b", backing, image)
+
+	out, err := processWrapper(args...)
+	if err != nil {
+		return "", fmt.Errorf("[image %s] %v: %v", image, out, err)
+	}
+
+	// report the new backing chain
+	chain, err := diskChain(image)
+	if err != nil {
+		return "", err
+	}
+
+	paths := []string{}
+	for _, info := range chain {
+		paths = append(paths, info.Path)
+	}
+
+	return strings.Join(paths, " -> "), nil
+}
+
+// diskDetectFS runs blkid on the device and maps the detected filesystem to
+// an FSType for the inject mount switch. Filesystems that need extra
+// arguments (LVM, ZFS, LUKS) produce an error telling the user which fstype
+// flag to pass instead.
+func diskDetectFS(dev string) (FSType, error) {
+	out, err := processWrapper("blkid", "-o", "value", "-s", "TYPE", dev)
+	if err != nil {
+		var exitErr *exec.ExitError
+		if !errors.As(err, &exitErr) {
+			// blkid itself is missing; let mount try to figure it out
+			log.Warn("blkid unavailable, mounting %v blind: %v", dev, err)
+			return EXT4, nil
+		}
+
+		return NONE, fmt.Errorf("no filesystem detected on %v by blkid", dev)
+	}
+
+	detected := strings.TrimSpace(out)
+
+	switch detected {
+	case "ext2", "ext3", "ext4":
+		return EXT4, nil
+	case "ntfs":
+		return NTFS, nil
+	case "vfat", "exfat", "btrfs", "xfs":
+		return FSType(detected), nil
+	case "LVM2_member":
+		return NONE, errors.New("LVM physical volume, use fstype LVM with a <volume group>:<logical volume> partition")
+	case "zfs_member":
+		return NONE, errors.New("ZFS member, use fstype ZFS with a <partition>:<zpool name> partition")
+	case "crypto_LUKS":
+		return NONE, errors.New("LUKS container, supply a keyfile")
+	default:
+		return NONE, fmt.Errorf("don't know how to mount filesystem: blkid saw `%v`", detected)
+	}
+}
+
+// diskPartitions connects the image via nbd and lists the partitions found
+// inside it. Each row contains the partition number, size, filesystem type,
+// and label as reported by blkid. LVM physical volumes and ZFS members are
+// called out so users know to use the corresponding fstype flag with inject.
+func diskPartitions(image string) ([][]string, error) {
+	nbdLock.Lock()
+	defer nbdLock.Unlock()
+
+	// Load nbd
+	if err := nbd.Modprobe(); err != nil {
+		return nil, err
+	}
+
+	nbdPath, err := nbd.ConnectImage(image)
+	if err != nil {
+		return nil, err
 	}
 	defer func() {
 		if err := nbd.DisconnectDevice(nbdPath); err != nil {
@@ -204,21 +830,393 @@ func diskInject(dst, partition string, fstype string, pairs map[string]string, o
 		}
 	}()
 
-	devPath := nbdPath
-
 	f, err := os.Open(nbdPath)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	defer f.Close()
 
-	// decide whether to mount partition or raw disk
-	if partition != "none" {
+	// keep rereading partitions and waiting for them to show up for a bit
+	timeoutTime := time.Now().Add(5 * time.Second)
+	for {
+		if time.Now().After(timeoutTime) {
+			return nil, fmt.Errorf("[image %s] no partitions found on image", image)
+		}
+
+		// tell kernel to reread partitions
+		syscall.Syscall(syscall.SYS_IOCTL, f.Fd(), C.BLKRRPART, 0)
+
+		if _, err := os.Stat(nbdPath + "p1"); err == nil {
+			break
+		}
+
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	var res [][]string
+
+	for i := 1; ; i++ {
+		part := fmt.Sprintf("%vp%v", nbdPath, i)
+
+		if _, err := os.Stat(part); err != nil {
+			break
+		}
+
+		var size string
+		if out, err := processWrapper("blockdev", "--getsize64", part); err == nil {
+			size = strings.TrimSpace(out)
+		}
+
+		var fstype, label string
+		if out, err := processWrapper("blkid", "-o", "export", part); err == nil {
+			for _, line := range strings.Split(out, "\n") {
+				parts := strings.SplitN(strings.TrimSpace(line), "=", 2)
+				if len(parts) != 2 {
+					continue
+				}
+
+				switch parts[0] {
+				case "TYPE":
+					fstype = parts[1]
+				case "LABEL":
+					label = parts[1]
+				}
+			}
+		}
+
+		// flag members of LVM and ZFS so users know to use the fstype flag
+		switch fstype {
+		case "LVM2_member":
+			fstype = "lvm (use fstype LVM)"
+		case "zfs_member":
+			fstype = "zfs (use fstype ZFS)"
+		}
+
+		res = append(res, []string{strconv.Itoa(i), size, fstype, label})
+	}
+
+	return res, nil
+}
+
+// diskWipe zeroes the free space in the image's filesystem and compacts the
+// result with qemu-img convert, atomically replacing the original. Returns a
+// before/after size report.
+func diskWipe(image, partition string) (string, error) {
+	if err := diskInUse(image); err != nil {
+		return "", err
+	}
+
+	before, err := os.Stat(image)
+	if err != nil {
+		return "", err
+	}
+
+	// zero the free space so the convert below can discard it
+	err = diskInjectOp(image, partition, "", "", nil, func(mntDir string, _ FSType) error {
+		// fstrim is quick when the whole stack supports discard
+		if _, err := diskProcess("fstrim", mntDir); err == nil {
+			return nil
+		}
+
+		// otherwise fill the free space with zeroes and delete the file
+		zero := filepath.Join(mntDir, "minimega.zero")
+
+		f, err := os.Create(zero)
+		if err != nil {
+			return err
+		}
+		defer os.Remove(zero)
+		defer f.Close()
+
+		buf := make([]byte, 1<<20)
+		for {
+			if _, err := f.Write(buf); err != nil {
+				if !errors.Is(err, syscall.ENOSPC) {
+					return err
+				}
+				break
+			}
+		}
+
+		return f.Sync()
+	})
+	if err != nil {
+		return "", err
+	}
+
+	// compact into a temp file next to the original so the rename is atomic
+	tmp := image + ".wipe"
+
+	if out, err := processWrapper("qemu-img", "convert", "-O", "qcow2", image, tmp); err != nil {
+		os.Remove(tmp)
+		return "", fmt.Errorf("[image %s] %v: %v", image, out, err)
+	}
+
+	if err := os.Rename(tmp, image); err != nil {
+		os.Remove(tmp)
+		return "", err
+	}
+
+	after, err := os.Stat(image)
+	if err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf("%v: %v -> %v", image, humanSize(before.Size()), humanSize(after.Size())), nil
+}
+
+// diskCreate creates a new disk image, dst, of given size/format. prealloc
+// and cluster are passed through to qemu-img create's -o options when set.
+func diskCreate(format, dst, size, prealloc, cluster string) error {
+	var opts []string
+
+	switch prealloc {
+	case "", "off":
+		// nothing to do
+	case "metadata":
+		if format != "qcow2" {
+			return fmt.Errorf("metadata preallocation requires qcow2, not %v", format)
+		}
+		opts = append(opts, "preallocation="+prealloc)
+	case "falloc", "full":
+		opts = append(opts, "preallocation="+prealloc)
+	default:
+		return fmt.Errorf("invalid preallocation mode: `%v`", prealloc)
+	}
+
+	if cluster != "" {
+		if format != "qcow2" {
+			return fmt.Errorf("cluster size requires qcow2, not %v", format)
+		}
+		opts = append(opts, "cluster_size="+cluster)
+	}
+
+	// writing out every cluster of a large image is slow, let the user know
+	// why the command is taking so long
+	if prealloc == "falloc" || prealloc == "full" {
+		log.Warn("preallocating %v may take several minutes for large images", dst)
+	}
+
+	args := []string{"qemu-img", "create", "-f", format}
+	if len(opts) > 0 {
+		args = append(args, "-o", strings.Join(opts, ","))
+	}
+	args = append(args, dst, size)
+
+	out, err := processWrapper(args...)
+	if err != nil {
+		log.Error("diskCreate: %v", out)
+		return err
+	}
+	return nil
+}
+
+// diskMounts tracks long-lived mounts created by `disk mount`, keyed on the
+// image path. Guarded by nbdLock.
+var diskMounts = map[string]*diskMount{}
+
+// diskMount tracks one mounted disk image, either for the duration of an
+// inject or long-lived via `disk mount`.
+type diskMount struct {
+	Image    string
+	Dev      string // the nbd device backing the mount
+	MountDir string
+	Fstype   FSType
+	Mounted  time.Time
+
+	// state for unmount, populated as the mount is built up
+	mountedDev    string // the device actually mounted (partition, mapper, lv)
+	luksName      string
+	volumeGroup   string
+	logicalVolume string
+	zpool         string
+	zfsDataset    string
+	mounted       bool
+	tmpDir        bool
+}
+
+// diskUnmountAll tears down any mounts left behind by `disk mount`, for use
+// at shutdown.
+func diskUnmountAll() {
+	nbdLock.Lock()
+	defer nbdLock.Unlock()
+
+	for k, m := range diskMounts {
+		log.Info("unmounting %v", m.Image)
+
+		if err := m.unmount(); err != nil {
+			log.Error("unmount %v: %v", m.Image, err)
+		}
+
+		delete(diskMounts, k)
+	}
+}
+
+// diskMounted returns whether the image is currently mounted for editing.
+func diskMounted(image string) bool {
+	nbdLock.Lock()
+	defer nbdLock.Unlock()
+
+	_, ok := diskMounts[image]
+	return ok
+}
+
+// zpoolImported returns whether a pool with the given name is currently
+// imported on the host.
+func zpoolImported(pool string) (bool, error) {
+	out, err := diskProcess("zpool", "list", "-H", "-o", "name")
+	if err != nil {
+		return false, fmt.Errorf("zpool list failed: %v", err)
+	}
+
+	for _, name := range strings.Fields(out) {
+		if name == pool {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// unmount tears a mount down in the reverse order it was built: flush and
+// unmount the filesystem, deactivate LVM or export the zpool, close any LUKS
+// mapping, and disconnect the nbd. Cleanup continues past individual
+// failures; the first error is returned.
+func (m *diskMount) unmount() error {
+	var firstErr error
+
+	saveErr := func(err error) {
+		log.Error("unmount %v: %v", m.Image, err)
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	if m.mounted {
+		// explicitly flush buffers
+		if out, err := diskProcess("blockdev", "--flushbufs", m.mountedDev); err != nil {
+			saveErr(fmt.Errorf("unable to flush: %v %v", out, err))
+		}
+
+		// the zpool export below unmounts ZFS
+		if m.Fstype != ZFS {
+			if err := syscall.Unmount(m.MountDir, 0); err != nil {
+				saveErr(fmt.Errorf("unmount failed: %v", err))
+			}
+		}
+	}
+
+	if m.volumeGroup != "" {
+		// deactivate the logical volume
+		if out, err := diskProcess("lvchange", "-an", fmt.Sprintf("%s/%s", m.volumeGroup, m.logicalVolume)); err != nil {
+			saveErr(fmt.Errorf("logical volume deactivation failed: %v %v", out, err))
+		}
+
+		// deactivate the volume group
+		if out, err := diskProcess("vgchange", "-an", m.volumeGroup); err != nil {
+			saveErr(fmt.Errorf("volume group deactivation failed: %v %v", out, err))
+		}
+	}
+
+	if m.zpool != "" {
+		if m.zfsDataset != "" {
+			if out, err := diskProcess("zfs", "unmount", m.zfsDataset); err != nil {
+				saveErr(fmt.Errorf("zfs unmount %v failed: %v %v", m.zfsDataset, out, err))
+			}
+		}
+
+		if out, err := diskProcess("zpool", "export", m.zpool); err != nil {
+			saveErr(fmt.Errorf("zpool %v is still imported, export it manually: %v %v", m.zpool, out, err))
+		} else if imported, err := zpoolImported(m.zpool); err != nil {
+			saveErr(err)
+		} else if imported {
+			saveErr(fmt.Errorf("zpool %v is still imported after export", m.zpool))
+		} else if dir, err := ioutil.ReadDir(m.MountDir); err == nil {
+			// the export is confirmed, so anything left in the mount dir is
+			// just altroot scaffolding
+			for _, d := range dir {
+				os.RemoveAll(path.Join(m.MountDir, d.Name()))
+			}
+		}
+	}
+
+	if m.luksName != "" {
+		if out, err := diskProcess("cryptsetup", "luksClose", m.luksName); err != nil {
+			saveErr(fmt.Errorf("luksClose failed: %v %v", out, err))
+		}
+	}
+
+	if m.Dev != "" {
+		if err := nbd.DisconnectDevice(m.Dev); err != nil {
+			saveErr(fmt.Errorf("nbd disconnect failed: %v", err))
+		}
+	}
+
+	if m.tmpDir {
+		if err := os.Remove(m.MountDir); err != nil {
+			saveErr(fmt.Errorf("rm mount dir failed: %v", err))
+		}
+	}
+
+	return firstErr
+}
+
+// diskMountImage mounts a disk image at mntDir and returns the mount state
+// needed to tear it down again. dst/partition specify the image and the
+// partition number, options can be used to supply mount arguments. The caller
+// must hold nbdLock and, on success, eventually call unmount.
+func diskMountImage(dst, partition string, fstype, keyfile string, mntDir string, options []string) (*diskMount, error) {
+	// the help text uses uppercase fstype flags but the FSType constants are
+	// lowercase
+	fstype = strings.ToLower(fstype)
+
+	if keyfile != "" {
+		// fail early with a clear message when cryptsetup isn't installed
+		if _, err := diskProcess("cryptsetup", "--version"); err != nil {
+			return nil, errors.New("cryptsetup not found, cannot open LUKS images")
+		}
+	} else if FSType(fstype) == LUKS {
+		return nil, errors.New("LUKS images require a keyfile")
+	}
+
+	// Load nbd
+	if err := nbd.Modprobe(); err != nil {
+		return nil, err
+	}
+
+	m := &diskMount{
+		Image:    dst,
+		MountDir: mntDir,
+		Mounted:  time.Now(),
+	}
+
+	// unwind whatever has been built up so far when a later step fails
+	fail := func(err error) (*diskMount, error) {
+		m.unmount()
+		return nil, err
+	}
+
+	nbdPath, err := nbd.ConnectImage(dst)
+	if err != nil {
+		return nil, err
+	}
+	m.Dev = nbdPath
+
+	devPath := nbdPath
+
+	// decide whether to mount partition or raw disk
+	if partition != "none" {
+		f, err := os.Open(nbdPath)
+		if err != nil {
+			return fail(err)
+		}
+
 		// keep rereading partitions and waiting for them to show up for a bit
 		timeoutTime := time.Now().Add(5 * time.Second)
 		for i := 1; ; i++ {
 			if time.Now().After(timeoutTime) {
-				return fmt.Errorf("[image %s] no partitions found on image", dst)
+				f.Close()
+				return fail(fmt.Errorf("[image %s] no partitions found on image", dst))
 			}
 
 			// tell kernel to reread partitions
@@ -233,11 +1231,13 @@ func diskInject(dst, partition string, fstype string, pairs map[string]string, o
 			time.Sleep(100 * time.Millisecond)
 		}
 
+		f.Close()
+
 		// default to first partition if there is only one partition
 		if partition == "" {
 			_, err = os.Stat(nbdPath + "p2")
 			if err == nil {
-				return fmt.Errorf("[image %s] please specify a partition; multiple found", dst)
+				return fail(fmt.Errorf("[image %s] please specify a partition; multiple found", dst))
 			}
 
 			partition = "1"
@@ -246,6 +1246,43 @@ func diskInject(dst, partition string, fstype string, pairs map[string]string, o
 		devPath = nbdPath + "p" + partition
 	}
 
+	// open the encrypted partition and use the cleartext mapper device in
+	// place of the raw partition; for LVM-on-LUKS the LVM handling below
+	// scans the opened device like any other physical volume
+	if keyfile != "" {
+		luksDev := devPath
+		if strings.Contains(partition, ":") {
+			// the partition spec names LVM/ZFS components rather than a
+			// partition number; assume the LUKS container is the first
+			// partition, like the detection loop above does
+			luksDev = nbdPath + "p1"
+		}
+
+		luksName := "minimega-" + filepath.Base(mntDir)
+
+		out, err := diskProcess("cryptsetup", "--key-file", keyfile, "luksOpen", luksDev, luksName)
+		if err != nil {
+			return fail(fmt.Errorf("[image %s] luksOpen: %v: %v", dst, out, err))
+		}
+
+		m.luksName = luksName
+		devPath = filepath.Join("/dev/mapper", luksName)
+	}
+
+	// detect the filesystem when the user didn't pick one; LVM and ZFS need
+	// extra arguments so they must still be requested explicitly
+	if FSType(fstype) == NONE || FSType(fstype) == LUKS {
+		detected, err := diskDetectFS(devPath)
+		if err != nil {
+			return fail(fmt.Errorf("[image %s] %v", dst, err))
+		}
+
+		log.Debug("detected filesystem on %v: %v", devPath, detected)
+		fstype = string(detected)
+	}
+
+	m.Fstype = FSType(fstype)
+
 	var volumeGroup string
 	var logicalVolume string
 	var zpool string
@@ -262,29 +1299,32 @@ func diskInject(dst, partition string, fstype string, pairs map[string]string, o
 			logicalVolume = partitionSplit[1]
 		} else {
 			log.Error("failed to determine LVM. can not find volume group,logical volume.")
-			return fmt.Errorf("failed to determine LVM.")
+			return fail(fmt.Errorf("failed to determine LVM."))
 		}
 
 		// scan for existing lvms and check for the one provided
-		vgscan, err := processWrapper("vgscan")
+		vgscan, err := diskProcess("vgscan")
 		if err != nil {
 			log.Error("failed to mount LVM. vgscan does not exist")
-			return fmt.Errorf("failed to mount LVM. %s", err)
+			return fail(fmt.Errorf("failed to mount LVM. %s", err))
 		}
 
 		if vgscan == "" || !strings.Contains(vgscan, volumeGroup) {
 			log.Error("failed to mount LVM. volume group specified does not exist")
-			return fmt.Errorf("failed to mount LVM. volume group specified does not exist")
+			return fail(fmt.Errorf("failed to mount LVM. volume group specified does not exist"))
 		}
 
 		// activate the volume group so it can be mounted
-		_, err = processWrapper("vgchange", "-ay", volumeGroup)
+		_, err = diskProcess("vgchange", "-ay", volumeGroup)
 
 		if err != nil {
 			log.Error("failed to mount LVM. failed to activate volume group")
-			return fmt.Errorf("failed to mount LVM. failed to activate volume group %s", err)
+			return fail(fmt.Errorf("failed to mount LVM. failed to activate volume group %s", err))
 		}
 
+		m.volumeGroup = volumeGroup
+		m.logicalVolume = logicalVolume
+
 		// update the path to the disk image to mount
 		devPath = fmt.Sprintf("/dev/%s/%s", volumeGroup, logicalVolume)
 
@@ -297,10 +1337,16 @@ func diskInject(dst, partition string, fstype string, pairs map[string]string, o
 		}
 		log.Debug("mount args: %v", args)
 
-		_, err = processWrapper(args...)
+		out, err := diskProcess(args...)
+
+		if err != nil {
+			log.Error("failed to mount partition")
+			return fail(fmt.Errorf("[image %s] %v: %v", dst, out, err))
+		}
 
 	case ZFS:
-		// the format is <physical partition number>:<zpool name>
+		// the format is <physical partition number>:<zpool name>, where the
+		// zpool name may include a dataset (e.g. 2:rpool/ROOT/ubuntu)
 		var parse bool
 		zpool = ""
 		partitionSplit := strings.Split(partition, ":")
@@ -315,7 +1361,19 @@ func diskInject(dst, partition string, fstype string, pairs map[string]string, o
 
 		} else {
 			log.Error("failed to determine partition. format was incorrect - <physical partition number>:<zpool name>")
-			return fmt.Errorf("failed to determine zpool and partition.")
+			return fail(fmt.Errorf("failed to determine zpool and partition."))
+		}
+
+		var dataset string
+		if i := strings.Index(zpool, "/"); i != -1 {
+			zpool, dataset = zpool[:i], zpool
+		}
+
+		// refuse to import over a pool the host is already using
+		if imported, err := zpoolImported(zpool); err != nil {
+			return fail(err)
+		} else if imported {
+			return fail(fmt.Errorf("zpool %v is already imported on this host, export it first", zpool))
 		}
 
 		/*
@@ -329,10 +1387,10 @@ func diskInject(dst, partition string, fstype string, pairs map[string]string, o
 		*/
 
 		// List zpools available and determine if the provided one is available
-		zpool_scan, err := processWrapper("zpool", "import")
+		zpool_scan, err := diskProcess("zpool", "import")
 
 		if !strings.Contains(zpool_scan, zpool) || err != nil {
-			return fmt.Errorf("[image %s] desired zpool %s not found", dst, zpool)
+			return fail(fmt.Errorf("[image %s] desired zpool %s not found", dst, zpool))
 		}
 
 		if parse {
@@ -351,36 +1409,72 @@ func diskInject(dst, partition string, fstype string, pairs map[string]string, o
 
 		_, err = os.Stat(devPath)
 		if err != nil {
-			return fmt.Errorf("[image %s] desired partition %s not found", dst, partition)
+			return fail(fmt.Errorf("[image %s] desired partition %s not found", dst, partition))
 		} else {
 			log.Info("desired partition %s found in image %s", partition, dst)
 		}
 
-		args := []string{"zpool", "import"}
-		args = append(args, zpool, "-R", mntDir, "-d", devPath, "-f")
+		args := []string{"zpool", "import", zpool, "-R", mntDir, "-d", devPath, "-f"}
+		if dataset != "" {
+			// hold off mounting anything, we only want the one dataset
+			args = append(args, "-N")
+		}
 
-		out, err := processWrapper(args...)
+		out, err := diskProcess(args...)
 
 		if err != nil {
 			log.Error("failed to mount partition")
-			return fmt.Errorf("[image %s] %v: %v", dst, out, err)
+			return fail(fmt.Errorf("[image %s] %v: %v", dst, out, err))
+		}
+
+		m.zpool = zpool
+
+		if dataset != "" {
+			// temporary mount that doesn't touch the dataset's mountpoint
+			// property
+			out, err := diskProcess("mount", "-t", "zfs", "-o", "zfsutil", dataset, mntDir)
+			if err != nil {
+				return fail(fmt.Errorf("[image %s] %v: %v", dst, out, err))
+			}
+
+			m.zfsDataset = dataset
 		}
 
-		// export (unmount) the zpool from the system so the drive can be disconnected
+		// the pool is exported (unmounted) again on cleanup so the drive can
+		// be disconnected
 
 	case NTFS:
 
 		// check that ntfs-3g is installed
-		_, err = processWrapper("ntfs-3g", "--version")
+		_, err = diskProcess("ntfs-3g", "--version")
 		if err != nil {
 			log.Error("ntfs-3g not found, ntfs images unwriteable")
 		}
 
 		// mount with ntfs-3g
-		out, err := processWrapper("mount", "-o", "ntfs-3g", devPath, mntDir)
+		out, err := diskProcess("mount", "-o", "ntfs-3g", devPath, mntDir)
+		if err != nil {
+			log.Error("failed to mount partition")
+			return fail(fmt.Errorf("[image %s] %v: %v", dst, out, err))
+		}
+
+	case VFAT, EXFAT, BTRFS, XFS:
+
+		// mount explicitly typed so the kernel doesn't have to guess
+		args := []string{"mount", "-t", fstype}
+		if len(options) != 0 {
+			args = append(args, options...)
+		} else {
+			args = append(args, "-w")
+		}
+		args = append(args, devPath, mntDir)
+		log.Debug("mount args: %v", args)
+
+		out, err := diskProcess(args...)
+
 		if err != nil {
 			log.Error("failed to mount partition")
-			return fmt.Errorf("[image %s] %v: %v", dst, out, err)
+			return fail(fmt.Errorf("[image %s] %v: %v", dst, out, err))
 		}
 
 	default:
@@ -394,105 +1488,257 @@ func diskInject(dst, partition string, fstype string, pairs map[string]string, o
 		}
 		log.Debug("mount args: %v", args)
 
-		out, err := processWrapper(args...)
+		out, err := diskProcess(args...)
 
 		if err != nil {
 			log.Error("failed to mount partition")
-			return fmt.Errorf("[image %s] %v: %v", dst, out, err)
+			return fail(fmt.Errorf("[image %s] %v: %v", dst, out, err))
 		}
 	}
 
-	defer func() error {
-		if FSType(fstype) == LVM {
-			// deactivate the logical volume
-			out, err := processWrapper("lvchange", "-an", fmt.Sprintf("%s/%s", volumeGroup, logicalVolume))
-			fmt.Println(out)
-			if err != nil {
-				log.Error("logical volume deactivation failed: %v", err)
+	m.mountedDev = devPath
+	m.mounted = true
+
+	return m, nil
+}
+
+// diskInjectOp mounts a disk image and invokes op with the temporary mount
+// point. dst/partition specify the image and the partition number, options
+// can be used to supply mount arguments.
+func diskInjectOp(dst, partition string, fstype, keyfile string, options []string, op func(mntDir string, fstype FSType) error) error {
+	nbdLock.Lock()
+	defer nbdLock.Unlock()
+
+	// create a tmp mount point
+	mntDir, err := ioutil.TempDir(*f_base, "dstImg")
+	if err != nil {
+		return err
+	}
+	log.Debug("temporary mount point: %v", mntDir)
+
+	mount, err := diskMountImage(dst, partition, fstype, keyfile, mntDir, options)
+	if err != nil {
+		if err := os.Remove(mntDir); err != nil {
+			log.Error("rm mount dir failed: %v", err)
+		}
+
+		return err
+	}
+	mount.tmpDir = true
+
+	opErr := op(mntDir, mount.Fstype)
+
+	if err := mount.unmount(); err != nil && opErr == nil {
+		return fmt.Errorf("[image %s] %v", dst, err)
+	}
+
+	return opErr
+}
+
+// diskInject injects files into a disk image. pairs maps the destination
+// path inside the image to the file to copy in.
+func diskInject(dst, partition string, fstype, keyfile string, pairs map[string]injectFile, options []string) error {
+	return diskInjectOp(dst, partition, fstype, keyfile, options, func(mntDir string, fstype FSType) error {
+		// copy files/folders into mntDir
+		for dst, f := range pairs {
+			uid, gid := f.uid, f.gid
+
+			// ntfs-3g does not track unix ownership so silently skip chowns
+			if fstype == NTFS {
+				uid, gid = -1, -1
 			}
 
-			// deactivate the volume group
-			out, err = processWrapper("vgchange", "-an", volumeGroup)
-			fmt.Println(out)
-			if err != nil {
-				log.Error("volume group deactivation failed: %v", err)
+			target := filepath.Join(mntDir, dst)
+
+			if err := mkdirAllOwned(filepath.Dir(target), uid, gid); err != nil {
+				return fmt.Errorf("[image %s] mkdir: %v", dst, err)
 			}
-		} else if FSType(fstype) == ZFS {
-			if _, err := processWrapper("zpool", "export", "-f", zpool); err != nil {
-				return fmt.Errorf("There was an error while exporting ZFS pool: %v", err)
+
+			if err := copyTree(f.src, target); err != nil {
+				return fmt.Errorf("[image %s] %v", dst, err)
 			}
 
-			dir, err := ioutil.ReadDir(mntDir)
+			if f.mode >= 0 {
+				if err := os.Chmod(target, os.FileMode(f.mode)); err != nil {
+					return fmt.Errorf("[image %s] chmod: %v", dst, err)
+				}
+			}
 
-			if err == nil {
-				for _, d := range dir {
-					os.RemoveAll(path.Join([]string{mntDir, d.Name()}...))
+			if uid >= 0 || gid >= 0 {
+				if err := os.Chown(target, int(uid), int(gid)); err != nil {
+					return fmt.Errorf("[image %s] chown: %v", dst, err)
 				}
-			} else {
-				return fmt.Errorf("Could not erase zfs contents left behind: %v", err)
 			}
 		}
 
 		return nil
-	}()
+	})
+}
 
-	// unmount the image from the temporary mount point
-	defer func() {
-		if FSType(fstype) != ZFS {
-			fmt.Println("Unmounting Image")
+// diskDelete removes the listed paths from a disk image, mounting it the same
+// way as diskInject. Directories are only removed when recursive is set.
+// Nonexistent paths are reported per-entry without aborting the rest.
+func diskDelete(dst, partition string, fstype, keyfile string, paths []string, recursive bool, options []string) ([]string, error) {
+	res := []string{}
 
-			if err := syscall.Unmount(mntDir, 0); err != nil {
-				log.Error("unmount failed: %v", err)
+	err := diskInjectOp(dst, partition, fstype, keyfile, options, func(mntDir string, fstype FSType) error {
+		for _, p := range paths {
+			target := filepath.Join(mntDir, p)
+
+			// make sure ".." can't escape the mount point
+			if !strings.HasPrefix(target, mntDir) {
+				res = append(res, fmt.Sprintf("%v: outside image", p))
+				continue
+			}
+
+			fi, err := os.Lstat(target)
+			if os.IsNotExist(err) {
+				res = append(res, fmt.Sprintf("%v: no such file or directory", p))
+				continue
+			} else if err != nil {
+				res = append(res, fmt.Sprintf("%v: %v", p, err))
+				continue
 			}
-		}
-	}()
 
-	// copy files/folders into mntDir
-	for dst, src := range pairs {
-		dir := filepath.Dir(filepath.Join(mntDir, dst))
-		os.MkdirAll(dir, 0775)
+			if fi.IsDir() && !recursive {
+				res = append(res, fmt.Sprintf("%v: is a directory, use recursive", p))
+				continue
+			}
 
-		out, err := processWrapper("cp", "-fr", src, filepath.Join(mntDir, dst))
-		if err != nil {
-			return fmt.Errorf("[image %s] %v: %v", dst, out, err)
+			if err := os.RemoveAll(target); err != nil {
+				res = append(res, fmt.Sprintf("%v: %v", p, err))
+				continue
+			}
+
+			res = append(res, fmt.Sprintf("%v: deleted", p))
 		}
-	}
 
-	// explicitly flush buffers
-	out, err := processWrapper("blockdev", "--flushbufs", devPath)
-	if err != nil {
-		return fmt.Errorf("[image %s] unable to flush: %v %v", dst, out, err)
-	}
+		return nil
+	})
 
-	return nil
+	return res, err
+}
+
+// injectFile describes a single file to copy into an image, along with
+// optional permissions and ownership to apply after the copy.
+type injectFile struct {
+	src string
+
+	// mode is the octal permission to chmod onto the destination, or -1 to
+	// keep whatever the copy produced
+	mode int64
+
+	// uid/gid to chown the destination to, or -1 to leave ownership alone
+	uid, gid int64
 }
 
-// parseInjectPairs parses a list of strings containing src:dst pairs into a
-// map of where the dst is the key and src is the value. We build the map this
-// way so that one source file can be written to multiple destinations and so
-// that we can detect and return an error if the user tries to inject two files
-// with the same destination.
-func parseInjectPairs(files []string) (map[string]string, error) {
-	pairs := map[string]string{}
+// parseInjectPairs parses a list of strings containing src:dst pairs, with
+// optional :mode:uid:gid suffixes, into a map keyed on dst. We build the map
+// this way so that one source file can be written to multiple destinations
+// and so that we can detect and return an error if the user tries to inject
+// two files with the same destination.
+func parseInjectPairs(files []string) (map[string]injectFile, error) {
+	pairs := map[string]injectFile{}
 
 	// parse inject pairs
 	for _, arg := range files {
 		parts := strings.Split(arg, ":")
-		if len(parts) != 2 {
-			return nil, errors.New("malformed command; expected src:dst pairs")
+		if len(parts) < 2 || len(parts) > 5 {
+			return nil, errors.New("malformed command; expected src:dst[:mode[:uid[:gid]]] pairs")
+		}
+
+		f := injectFile{src: parts[0], mode: -1, uid: -1, gid: -1}
+
+		var err error
+		if len(parts) > 2 && parts[2] != "" {
+			f.mode, err = strconv.ParseInt(parts[2], 8, 32)
+			if err != nil {
+				return nil, fmt.Errorf("invalid mode: `%v`", parts[2])
+			}
+		}
+		if len(parts) > 3 && parts[3] != "" {
+			f.uid, err = strconv.ParseInt(parts[3], 10, 32)
+			if err != nil {
+				return nil, fmt.Errorf("invalid uid: `%v`", parts[3])
+			}
+		}
+		if len(parts) > 4 && parts[4] != "" {
+			f.gid, err = strconv.ParseInt(parts[4], 10, 32)
+			if err != nil {
+				return nil, fmt.Errorf("invalid gid: `%v`", parts[4])
+			}
 		}
 
-		if pairs[parts[1]] != "" {
+		if _, ok := pairs[parts[1]]; ok {
 			return nil, fmt.Errorf("destination appears twice: `%v`", parts[1])
 		}
 
-		pairs[parts[1]] = parts[0]
+		pairs[parts[1]] = f
 		log.Debug("inject pair: %v, %v", parts[0], parts[1])
 	}
 
 	return pairs, nil
 }
 
+// diskResolveSources fetches any relative inject sources that are missing
+// locally through the file mesh, rewriting them to their local paths.
+// Absolute sources are left alone so files outside the files directory keep
+// working.
+func diskResolveSources(pairs map[string]injectFile) error {
+	for dst, f := range pairs {
+		if filepath.IsAbs(f.src) {
+			continue
+		}
+
+		if _, err := os.Stat(f.src); err == nil {
+			continue
+		}
+
+		local, err := iomHelper(f.src, "")
+		if err != nil {
+			return fmt.Errorf("source %v not found locally or on the mesh: %v", f.src, err)
+		}
+
+		if _, err := os.Stat(local); err != nil {
+			return fmt.Errorf("source %v not found locally or on the mesh", f.src)
+		}
+
+		f.src = local
+		pairs[dst] = f
+	}
+
+	return nil
+}
+
+// mkdirAllOwned creates any missing parent directories for the injected file,
+// applying the given ownership to each directory it creates.
+func mkdirAllOwned(dir string, uid, gid int64) error {
+	// find the directories that don't exist yet
+	var missing []string
+	for d := dir; ; d = filepath.Dir(d) {
+		if _, err := os.Stat(d); err == nil {
+			break
+		}
+		missing = append(missing, d)
+	}
+
+	if err := os.MkdirAll(dir, 0775); err != nil {
+		return err
+	}
+
+	if uid < 0 && gid < 0 {
+		return nil
+	}
+
+	for i := len(missing) - 1; i >= 0; i-- {
+		if err := os.Chown(missing[i], int(uid), int(gid)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
 func cliDisk(ns *Namespace, c *minicli.Command, resp *minicli.Response) error {
 	image := filepath.Clean(c.StringArgs["image"])
 	fstype := c.StringArgs["fstype"]
@@ -522,7 +1768,7 @@ func cliDisk(ns *Namespace, c *minicli.Command, resp *minicli.Response) error {
 
 		log.Debug("destination image: %v", dst)
 
-		return diskSnapshot(image, dst)
+		return diskSnapshot(image, dst, c.BoolArgs["flatten"])
 	} else if c.BoolArgs["inject"] {
 		var partition string
 
@@ -538,12 +1784,39 @@ func cliDisk(ns *Namespace, c *minicli.Command, resp *minicli.Response) error {
 		options := fieldsQuoteEscape("\"", c.StringArgs["options"])
 		log.Debug("got options: %v", options)
 
+		keyfile := c.StringArgs["keyfile"]
+		if keyfile != "" && !filepath.IsAbs(keyfile) {
+			keyfile = path.Join(*f_iomBase, keyfile)
+		}
+
+		// a head-node-only image can be injected on a worker: fetch it over
+		// the mesh when it's missing locally
+		if _, err := os.Stat(image); err != nil && strings.HasPrefix(image, *f_iomBase) {
+			if _, err := iomHelper(image, ""); err != nil {
+				return fmt.Errorf("image %v not found locally or on the mesh: %v", image, err)
+			}
+		}
+
+		if paths := c.ListArgs["paths"]; len(paths) > 0 {
+			res, err := diskDelete(image, partition, fstype, keyfile, paths, c.BoolArgs["recursive"], options)
+			if err != nil {
+				return err
+			}
+
+			resp.Response = strings.Join(res, "\n")
+			return nil
+		}
+
 		pairs, err := parseInjectPairs(c.ListArgs["files"])
 		if err != nil {
 			return err
 		}
 
-		return diskInject(image, partition, fstype, pairs, options)
+		if err := diskResolveSources(pairs); err != nil {
+			return err
+		}
+
+		return diskInject(image, partition, fstype, keyfile, pairs, options)
 	} else if c.BoolArgs["create"] {
 		size := c.StringArgs["size"]
 
@@ -552,17 +1825,237 @@ func cliDisk(ns *Namespace, c *minicli.Command, resp *minicli.Response) error {
 			format = "qcow2"
 		}
 
-		return diskCreate(format, image, size)
+		if hosts := c.StringArgs["hosts"]; hosts != "" {
+			var local bool
+			var remote []string
+
+			if hosts == Wildcard {
+				local = true
+				remote = []string{Wildcard}
+			} else {
+				targets, err := ranges.SplitList(hosts)
+				if err != nil {
+					return err
+				}
+
+				for _, t := range targets {
+					if t == hostname {
+						local = true
+					} else {
+						remote = append(remote, t)
+					}
+				}
+			}
+
+			resp.Header = []string{"host", "status"}
+			resp.Tabular = [][]string{}
+
+			if local {
+				status := "created"
+				if err := diskCreate(format, image, size, "", ""); err != nil {
+					status = err.Error()
+				}
+				resp.Tabular = append(resp.Tabular, []string{hostname, status})
+			}
+
+			if len(remote) > 0 {
+				cmd := minicli.MustCompilef("disk create %v %q %v", format, c.StringArgs["image"], size)
+
+				out, err := meshageSend(cmd, strings.Join(remote, ","))
+				if err != nil {
+					return err
+				}
+
+				for resps := range out {
+					for _, r := range resps {
+						status := "created"
+						if r.Error != "" {
+							status = r.Error
+						}
+						resp.Tabular = append(resp.Tabular, []string{r.Host, status})
+					}
+				}
+			}
+
+			return nil
+		}
+
+		if backing := c.StringArgs["backing"]; backing != "" {
+			if format != "qcow2" {
+				return errors.New("backing files require qcow2, not raw")
+			}
+
+			backing = filepath.Clean(backing)
+			if !filepath.IsAbs(backing) {
+				backing = path.Join(*f_iomBase, backing)
+			}
+
+			res, err := diskCreateBacking(image, backing, size)
+			if err != nil {
+				return err
+			}
+
+			resp.Response = res
+			return nil
+		}
+
+		return diskCreate(format, image, size, c.StringArgs["prealloc"], c.StringArgs["cluster"])
+	} else if c.BoolArgs["commit"] {
+		res, err := diskCommit(image, c.BoolArgs["delete"])
+		if err != nil {
+			return err
+		}
+
+		resp.Response = res
+		return nil
+	} else if c.BoolArgs["rebase"] {
+		backing := filepath.Clean(c.StringArgs["backing"])
+		if !filepath.IsAbs(backing) {
+			backing = path.Join(*f_iomBase, backing)
+		}
+
+		res, err := diskRebase(image, backing, c.BoolArgs["unsafe"])
+		if err != nil {
+			return err
+		}
+
+		resp.Response = res
+		return nil
+	} else if c.BoolArgs["du"] {
+		deps, err := diskDependents(image)
+		if err != nil {
+			return err
+		}
+
+		resp.Header = []string{"image", "size", "vms"}
+		resp.Tabular = [][]string{}
+
+		for _, d := range deps {
+			resp.Tabular = append(resp.Tabular, []string{
+				d.Path,
+				humanSize(d.Size),
+				strings.Join(d.VMs, ", "),
+			})
+		}
+
+		return nil
+	} else if c.BoolArgs["wipe"] {
+		var partition string
+
+		if strings.Contains(image, ":") {
+			parts := strings.Split(image, ":")
+			if len(parts) > 2 {
+				return errors.New("expected <path/to/image>:<partition>")
+			}
+
+			image, partition = parts[0], parts[1]
+		}
+
+		res, err := diskWipe(image, partition)
+		if err != nil {
+			return err
+		}
+
+		resp.Response = res
+		return nil
+	} else if c.BoolArgs["mount"] {
+		var partition string
+
+		if strings.Contains(image, ":") {
+			parts := strings.Split(image, ":")
+			if len(parts) > 2 {
+				return errors.New("expected <path/to/image>:<partition>")
+			}
+
+			image, partition = parts[0], parts[1]
+		}
+
+		mountpoint := c.StringArgs["mountpoint"]
+		if fi, err := os.Stat(mountpoint); err != nil || !fi.IsDir() {
+			return fmt.Errorf("invalid mountpoint: %v", mountpoint)
+		}
+
+		nbdLock.Lock()
+		defer nbdLock.Unlock()
+
+		if _, ok := diskMounts[image]; ok {
+			return fmt.Errorf("[image %s] already mounted", image)
+		}
+
+		mount, err := diskMountImage(image, partition, fstype, "", mountpoint, nil)
+		if err != nil {
+			return err
+		}
+
+		diskMounts[image] = mount
+		return nil
+	} else if c.BoolArgs["umount"] {
+		nbdLock.Lock()
+		defer nbdLock.Unlock()
+
+		// the argument may name the image or the mountpoint
+		target := filepath.Clean(c.StringArgs["image"])
+
+		for k, m := range diskMounts {
+			if k == image || m.MountDir == target {
+				delete(diskMounts, k)
+				return m.unmount()
+			}
+		}
+
+		return fmt.Errorf("no such mount: %v", target)
+	} else if c.BoolArgs["mounts"] {
+		nbdLock.Lock()
+		defer nbdLock.Unlock()
+
+		resp.Header = []string{"image", "device", "mountpoint", "age"}
+		for _, m := range diskMounts {
+			resp.Tabular = append(resp.Tabular, []string{
+				m.Image, m.Dev, m.MountDir, time.Since(m.Mounted).Round(time.Second).String(),
+			})
+		}
+
+		return nil
+	} else if c.BoolArgs["partitions"] {
+		parts, err := diskPartitions(image)
+		if err != nil {
+			return err
+		}
+
+		resp.Header = []string{"partition", "size", "fstype", "label"}
+		resp.Tabular = parts
+
+		return nil
+	} else if c.BoolArgs["exists"] {
+		resp.Header = []string{"image", "exists", "size", "hash"}
+		resp.Tabular = [][]string{}
+
+		if fi, err := os.Stat(image); err == nil {
+			resp.Tabular = append(resp.Tabular, []string{
+				image, "true", humanSize(fi.Size()), iom.Hash(image),
+			})
+		} else {
+			resp.Tabular = append(resp.Tabular, []string{image, "false", "", ""})
+		}
+
+		return nil
 	} else if c.BoolArgs["info"] {
-		info, err := diskInfo(image)
+		chain, err := diskChain(image)
 		if err != nil {
 			return err
 		}
 
-		resp.Header = []string{"image", "format", "virtualsize", "disksize", "backingfile"}
-		resp.Tabular = append(resp.Tabular, []string{
-			image, info.Format, info.VirtualSize, info.DiskSize, info.BackingFile,
-		})
+		resp.Header = []string{"image", "format", "virtualsize", "disksize", "backingfile", "exists"}
+		for _, info := range chain {
+			exists := "true"
+			if _, err := os.Stat(info.Path); err != nil {
+				exists = "false"
+			}
+
+			resp.Tabular = append(resp.Tabular, []string{
+				info.Path, info.Format, info.VirtualSize, info.DiskSize, info.BackingFile, exists,
+			})
+		}
 
 		return nil
 	}
@@ -0,0 +1,282 @@
+// Copyright 2015-2021 National Technology & Engineering Solutions of Sandia, LLC (NTESS).
+// Under the terms of Contract DE-NA0003525 with NTESS, the U.S. Government retains certain
+// rights in this software.
+
+package main
+
+import (
+	"fmt"
+	"os/exec"
+	"strings"
+	"testing"
+	"time"
+)
+
+// recordDiskProcess replaces diskProcess with a recorder for the duration of
+// the test. Commands named in fail return an error instead of succeeding.
+func recordDiskProcess(t *testing.T, fail map[string]bool) *[][]string {
+	t.Helper()
+
+	var calls [][]string
+
+	old := diskProcess
+	diskProcess = func(args ...string) (string, error) {
+		calls = append(calls, args)
+		if fail[args[0]] {
+			return "", fmt.Errorf("%v failed", args[0])
+		}
+		return "", nil
+	}
+	t.Cleanup(func() { diskProcess = old })
+
+	return &calls
+}
+
+func TestParseInjectPairs(t *testing.T) {
+	pairs, err := parseInjectPairs([]string{
+		"foo:/bar",
+		"miniccc:/opt/minimega/miniccc:755",
+		"mykey:/home/user/.ssh/key:600:1000:1000",
+		"motd:/etc/motd::0:0",
+	})
+	if err != nil {
+		t.Fatalf("parse pairs: %v", err)
+	}
+
+	if f := pairs["/bar"]; f.src != "foo" || f.mode != -1 || f.uid != -1 || f.gid != -1 {
+		t.Errorf("bare pair parsed incorrectly: %+v", f)
+	}
+	if f := pairs["/opt/minimega/miniccc"]; f.mode != 0755 || f.uid != -1 || f.gid != -1 {
+		t.Errorf("mode-only pair parsed incorrectly: %+v", f)
+	}
+	if f := pairs["/home/user/.ssh/key"]; f.mode != 0600 || f.uid != 1000 || f.gid != 1000 {
+		t.Errorf("full pair parsed incorrectly: %+v", f)
+	}
+	if f := pairs["/etc/motd"]; f.mode != -1 || f.uid != 0 || f.gid != 0 {
+		t.Errorf("ownership-only pair parsed incorrectly: %+v", f)
+	}
+}
+
+func TestParseInjectPairsInvalid(t *testing.T) {
+	invalid := [][]string{
+		{"foo"},                    // no dst
+		{"foo:/bar:rwx"},           // non-octal mode
+		{"foo:/bar:644:user"},      // non-numeric uid
+		{"foo:/bar:644:0:0:extra"}, // too many fields
+		{"foo:/bar", "foo2:/bar"},  // duplicate dst
+	}
+
+	for _, files := range invalid {
+		if _, err := parseInjectPairs(files); err == nil {
+			t.Errorf("expected error parsing %v", files)
+		}
+	}
+}
+
+// TestDiskUnmountOrder checks that a fully built-up LVM-over-LUKS mount is
+// torn down in the reverse order it was assembled, even when the filesystem
+// unmount itself fails.
+func TestDiskUnmountOrder(t *testing.T) {
+	calls := recordDiskProcess(t, nil)
+
+	m := &diskMount{
+		Image:         "test.qcow2",
+		MountDir:      t.TempDir(),
+		Fstype:        EXT4,
+		mountedDev:    "/dev/mapper/vg-lv",
+		volumeGroup:   "vg",
+		logicalVolume: "lv",
+		luksName:      "minimega-test",
+		mounted:       true,
+	}
+
+	// the mount dir isn't actually mounted, so syscall.Unmount fails; the
+	// rest of the teardown must still run and the failure must be reported
+	if err := m.unmount(); err == nil {
+		t.Errorf("expected unmount to report the failed umount")
+	}
+
+	want := []string{"blockdev", "lvchange", "vgchange", "cryptsetup"}
+
+	if len(*calls) != len(want) {
+		t.Fatalf("expected %v commands, got %v", want, *calls)
+	}
+	for i, cmd := range want {
+		if (*calls)[i][0] != cmd {
+			t.Errorf("expected %v at step %v, got %v", cmd, i, (*calls)[i][0])
+		}
+	}
+}
+
+// TestDiskUnmountKeepsFirstError checks that a failure partway through
+// teardown is returned without aborting the remaining cleanup.
+func TestDiskUnmountKeepsFirstError(t *testing.T) {
+	calls := recordDiskProcess(t, map[string]bool{"lvchange": true})
+
+	m := &diskMount{
+		Image:         "test.qcow2",
+		MountDir:      t.TempDir(),
+		volumeGroup:   "vg",
+		logicalVolume: "lv",
+		luksName:      "minimega-test",
+	}
+
+	err := m.unmount()
+	if err == nil || !strings.Contains(err.Error(), "logical volume") {
+		t.Errorf("expected the lvchange failure, got %v", err)
+	}
+
+	// the volume group and LUKS mapping must still have been cleaned up
+	var saw []string
+	for _, c := range *calls {
+		saw = append(saw, c[0])
+	}
+	if len(saw) != 3 || saw[1] != "vgchange" || saw[2] != "cryptsetup" {
+		t.Errorf("cleanup did not continue past the failure: %v", saw)
+	}
+}
+
+func TestProcessWrapperTimeout(t *testing.T) {
+	if _, err := exec.LookPath("sleep"); err != nil {
+		t.Skip("sleep not found")
+	}
+
+	start := time.Now()
+	_, err := processWrapperTimeout(50*time.Millisecond, "sleep", "10")
+	if err == nil || !strings.Contains(err.Error(), "timed out") {
+		t.Errorf("expected a timeout error, got %v", err)
+	}
+	if time.Since(start) > 5*time.Second {
+		t.Errorf("process was not killed at the deadline")
+	}
+}
+
+func TestParseQemuImgInfo(t *testing.T) {
+	// captured from `qemu-img info --output=json` for an image with no
+	// backing file
+	plain := `{
+    "virtual-size": 107374182400,
+    "filename": "miniccc.qc2",
+    "cluster-size": 65536,
+    "format": "qcow2",
+    "actual-size": 1508903424,
+    "format-specific": {
+        "type": "qcow2",
+        "data": {
+            "compat": "1.1",
+            "lazy-refcounts": false,
+            "refcount-bits": 16,
+            "corrupt": false
+        }
+    },
+    "dirty-flag": false
+}`
+
+	infos, err := parseQemuImgInfo(plain)
+	if err != nil {
+		t.Fatalf("parse plain image: %v", err)
+	}
+	if len(infos) != 1 {
+		t.Fatalf("expected 1 image, got %v", len(infos))
+	}
+	if infos[0].Format != "qcow2" {
+		t.Errorf("expected qcow2, got %v", infos[0].Format)
+	}
+	if infos[0].BackingFile != "" {
+		t.Errorf("unexpected backing file: %v", infos[0].BackingFile)
+	}
+	if infos[0].ClusterSize != 65536 {
+		t.Errorf("expected cluster size 65536, got %v", infos[0].ClusterSize)
+	}
+	if !strings.Contains(infos[0].VirtualSize, "(107374182400 bytes)") {
+		t.Errorf("expected byte count in virtual size, got %v", infos[0].VirtualSize)
+	}
+}
+
+func TestParseQemuImgInfoChain(t *testing.T) {
+	// captured from `qemu-img info --output=json --backing-chain` for a
+	// snapshot and its backing image
+	chain := `[
+{
+    "virtual-size": 107374182400,
+    "filename": "snapshot012345",
+    "cluster-size": 65536,
+    "format": "qcow2",
+    "actual-size": 200704,
+    "backing-filename": "miniccc.qc2",
+    "full-backing-filename": "/tmp/minimega/files/miniccc.qc2",
+    "backing-filename-format": "qcow2",
+    "format-specific": {
+        "type": "qcow2",
+        "data": {
+            "compat": "1.1",
+            "lazy-refcounts": true,
+            "refcount-bits": 16,
+            "corrupt": false
+        }
+    },
+    "dirty-flag": false
+},
+{
+    "virtual-size": 107374182400,
+    "filename": "/tmp/minimega/files/miniccc.qc2",
+    "cluster-size": 65536,
+    "format": "qcow2",
+    "actual-size": 1508903424,
+    "format-specific": {
+        "type": "qcow2",
+        "data": {
+            "compat": "1.1",
+            "lazy-refcounts": false,
+            "refcount-bits": 16,
+            "corrupt": false
+        }
+    },
+    "dirty-flag": false
+}
+]`
+
+	infos, err := parseQemuImgInfo(chain)
+	if err != nil {
+		t.Fatalf("parse backing chain: %v", err)
+	}
+	if len(infos) != 2 {
+		t.Fatalf("expected 2 images, got %v", len(infos))
+	}
+
+	// should prefer the full backing filename
+	if infos[0].BackingFile != "/tmp/minimega/files/miniccc.qc2" {
+		t.Errorf("expected full backing path, got %v", infos[0].BackingFile)
+	}
+	if !infos[0].LazyRefcounts {
+		t.Errorf("expected lazy refcounts on overlay")
+	}
+	if infos[1].BackingFile != "" {
+		t.Errorf("unexpected backing file on base: %v", infos[1].BackingFile)
+	}
+}
+
+func TestParseQemuImgInfoRaw(t *testing.T) {
+	// raw images have no cluster size or format-specific data
+	raw := `{
+    "virtual-size": 10485760,
+    "filename": "foo.img",
+    "format": "raw",
+    "actual-size": 0,
+    "dirty-flag": false
+}`
+
+	infos, err := parseQemuImgInfo(raw)
+	if err != nil {
+		t.Fatalf("parse raw image: %v", err)
+	}
+	if len(infos) != 1 {
+		t.Fatalf("expected 1 image, got %v", len(infos))
+	}
+	if infos[0].Format != "raw" {
+		t.Errorf("expected raw, got %v", infos[0].Format)
+	}
+	if infos[0].ClusterSize != 0 {
+		t.Errorf("unexpected cluster size: %v", infos[0].ClusterSize)
+	}
+}
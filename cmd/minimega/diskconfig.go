@@ -23,6 +23,10 @@ type DiskConfig struct {
 	// Raw string that we used when creating this disk config will be
 	// reparsed if we ever clone the VM that has this config.
 	Raw string
+
+	// Standalone is set once the overlay no longer depends on a backing
+	// image (see "vm disk stream").
+	Standalone bool
 }
 
 type DiskConfigs []DiskConfig
@@ -0,0 +1,158 @@
+// Copyright 2015-2021 National Technology & Engineering Solutions of Sandia, LLC (NTESS).
+// Under the terms of Contract DE-NA0003525 with NTESS, the U.S. Government retains certain
+// rights in this software.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+const (
+	// whence values for finding data and holes in sparse files, see lseek(2)
+	seekData = 3
+	seekHole = 4
+)
+
+// copyTree copies src to dst the way `cp -fr` would, except implemented
+// natively so that errors identify the exact destination path and how far the
+// copy got. Regular files are copied with sparse-hole detection, symlinks are
+// recreated as symlinks rather than followed, and modes and timestamps are
+// preserved.
+func copyTree(src, dst string) error {
+	fi, err := os.Lstat(src)
+	if err != nil {
+		return err
+	}
+
+	// like cp, copy into dst when it is an existing directory
+	if di, err := os.Stat(dst); err == nil && di.IsDir() {
+		dst = filepath.Join(dst, filepath.Base(src))
+	}
+
+	if !fi.IsDir() {
+		return copyEntry(src, dst, fi)
+	}
+
+	return filepath.Walk(src, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+
+		return copyEntry(path, filepath.Join(dst, rel), info)
+	})
+}
+
+// copyEntry copies a single directory, symlink, or regular file, preserving
+// mode and timestamps.
+func copyEntry(src, dst string, fi os.FileInfo) error {
+	switch {
+	case fi.IsDir():
+		if err := os.MkdirAll(dst, fi.Mode().Perm()); err != nil {
+			return err
+		}
+	case fi.Mode()&os.ModeSymlink != 0:
+		// recreate symlinks rather than following them so that trees
+		// containing loops or absolute links copy faithfully
+		target, err := os.Readlink(src)
+		if err != nil {
+			return err
+		}
+
+		os.Remove(dst)
+		if err := os.Symlink(target, dst); err != nil {
+			return err
+		}
+
+		// mode and timestamps don't apply to the link itself
+		return nil
+	case fi.Mode().IsRegular():
+		written, err := copyFileSparse(src, dst, fi)
+		if err != nil {
+			return fmt.Errorf("copy to %v failed after %v bytes: %v", dst, written, err)
+		}
+	default:
+		// sockets, devices, fifos... nothing we should be injecting
+		return fmt.Errorf("unsupported file type: %v", src)
+	}
+
+	return os.Chtimes(dst, fi.ModTime(), fi.ModTime())
+}
+
+// copyFileSparse copies a regular file, skipping holes in src so the copy is
+// as sparse as the original. Returns the number of bytes written, which on
+// error tells the caller how far the copy got.
+func copyFileSparse(src, dst string, fi os.FileInfo) (int64, error) {
+	in, err := os.Open(src)
+	if err != nil {
+		return 0, err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, fi.Mode().Perm())
+	if err != nil {
+		return 0, err
+	}
+
+	written, err := copySparse(out, in, fi.Size())
+	if err != nil {
+		out.Close()
+		return written, err
+	}
+
+	return written, out.Close()
+}
+
+// copySparse copies size bytes from in to out, seeking over holes rather than
+// writing them. Falls back to a plain copy on filesystems without SEEK_DATA
+// support.
+func copySparse(out, in *os.File, size int64) (int64, error) {
+	var written int64
+
+	var offset int64
+	for offset < size {
+		start, err := in.Seek(offset, seekData)
+		if errors.Is(err, syscall.ENXIO) {
+			// no data past offset, only a trailing hole
+			break
+		} else if offset == 0 && (errors.Is(err, syscall.EINVAL) || errors.Is(err, syscall.ENOTSUP)) {
+			// filesystem doesn't know about holes
+			return io.Copy(out, in)
+		} else if err != nil {
+			return written, err
+		}
+
+		end, err := in.Seek(start, seekHole)
+		if err != nil {
+			return written, err
+		}
+
+		if _, err := in.Seek(start, io.SeekStart); err != nil {
+			return written, err
+		}
+		if _, err := out.Seek(start, io.SeekStart); err != nil {
+			return written, err
+		}
+
+		n, err := io.CopyN(out, in, end-start)
+		written += n
+		if err != nil {
+			return written, err
+		}
+
+		offset = end
+	}
+
+	// extend out to the full size so a trailing hole is preserved
+	return written, out.Truncate(size)
+}
@@ -0,0 +1,154 @@
+// Copyright 2015-2021 National Technology & Engineering Solutions of Sandia, LLC (NTESS).
+// Under the terms of Contract DE-NA0003525 with NTESS, the U.S. Government retains certain
+// rights in this software.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+)
+
+func TestCopySparseFile(t *testing.T) {
+	dir := t.TempDir()
+
+	src := filepath.Join(dir, "sparse")
+
+	// data at the start, a 1M hole, data in the middle, and a trailing hole
+	f, err := os.Create(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write([]byte("head")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.WriteAt([]byte("middle"), 1<<20); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Truncate(2 << 20); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	dst := filepath.Join(dir, "copy")
+	if err := copyTree(src, dst); err != nil {
+		t.Fatalf("copy sparse file: %v", err)
+	}
+
+	want, err := ioutil.ReadFile(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := ioutil.ReadFile(dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(want, got) {
+		t.Errorf("copy does not match source")
+	}
+
+	fi, err := os.Stat(dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Size() != 2<<20 {
+		t.Errorf("expected trailing hole to be preserved, size is %v", fi.Size())
+	}
+}
+
+func TestCopyTreeSymlinkLoop(t *testing.T) {
+	dir := t.TempDir()
+
+	src := filepath.Join(dir, "src")
+	if err := os.Mkdir(src, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(src, "file"), []byte("hello"), 0640); err != nil {
+		t.Fatal(err)
+	}
+	// a symlink loop back to the directory itself
+	if err := os.Symlink(".", filepath.Join(src, "loop")); err != nil {
+		t.Fatal(err)
+	}
+
+	dst := filepath.Join(dir, "dst")
+	if err := copyTree(src, dst); err != nil {
+		t.Fatalf("copy tree with symlink loop: %v", err)
+	}
+
+	// the loop should be recreated as a symlink, not followed
+	target, err := os.Readlink(filepath.Join(dst, "loop"))
+	if err != nil {
+		t.Fatalf("expected a symlink: %v", err)
+	}
+	if target != "." {
+		t.Errorf("expected symlink to `.`, got %v", target)
+	}
+
+	fi, err := os.Stat(filepath.Join(dst, "file"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode().Perm() != 0640 {
+		t.Errorf("expected mode 0640, got %v", fi.Mode().Perm())
+	}
+}
+
+// benchTree creates a tree with count files of size bytes each for the copy
+// benchmarks.
+func benchTree(b *testing.B, count, size int) string {
+	b.Helper()
+
+	src := filepath.Join(b.TempDir(), "src")
+
+	data := bytes.Repeat([]byte("minimega"), size/8)
+
+	for i := 0; i < count; i++ {
+		dir := filepath.Join(src, fmt.Sprintf("dir%v", i%10))
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			b.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(dir, fmt.Sprintf("file%v", i)), data, 0644); err != nil {
+			b.Fatal(err)
+		}
+	}
+
+	return src
+}
+
+func BenchmarkCopyTree(b *testing.B) {
+	src := benchTree(b, 100, 64<<10)
+	dst := b.TempDir()
+
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		if err := copyTree(src, filepath.Join(dst, fmt.Sprintf("copy%v", i))); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkCopyTreeCp(b *testing.B) {
+	if _, err := exec.LookPath("cp"); err != nil {
+		b.Skip("cp not found")
+	}
+
+	src := benchTree(b, 100, 64<<10)
+	dst := b.TempDir()
+
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		out, err := exec.Command("cp", "-fr", src, filepath.Join(dst, fmt.Sprintf("copy%v", i))).CombinedOutput()
+		if err != nil {
+			b.Fatalf("%v: %v", string(out), err)
+		}
+	}
+}
@@ -5,6 +5,7 @@
 package main
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"os/exec"
@@ -37,8 +38,8 @@ var externalDependencies = map[string]bool{
 	"ip":        true, // used in bridge_cli.go
 	"scp":       true, // used in deploy.go
 	"ssh":       true, // used in deploy.go
-	"cp":        true, // used in disk.go
 	"qemu-img":  true, // used in disk.go
+	"blkid":     true, // used in disk.go
 	"ntfs-3g":   true, // used in disk.go
 	"blockdev":  true, // used in disk.go
 	"ovs-vsctl": true, // used in external.go
@@ -273,15 +274,33 @@ func lsModule(s string) bool {
 // processWrapper executes the given arg list and returns a combined
 // stdout/stderr and any errors. processWrapper blocks until the process exits.
 func processWrapper(args ...string) (string, error) {
+	return processWrapperTimeout(0, args...)
+}
+
+// processWrapperTimeout is processWrapper with a deadline: the process is
+// killed and a timeout error returned if it runs longer than timeout. A
+// timeout of zero means wait forever.
+func processWrapperTimeout(timeout time.Duration, args ...string) (string, error) {
 	if len(args) == 0 {
 		return "", fmt.Errorf("empty argument list")
 	}
 
+	ctx := context.Background()
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
 	start := time.Now()
-	out, err := exec.Command(args[0], args[1:]...).CombinedOutput()
+	out, err := exec.CommandContext(ctx, args[0], args[1:]...).CombinedOutput()
 	stop := time.Now()
 	log.Debug("cmd %v completed in %v", args[0], stop.Sub(start))
 
+	if ctx.Err() == context.DeadlineExceeded {
+		err = fmt.Errorf("%v timed out after %v", args[0], timeout)
+	}
+
 	return string(out), err
 }
 
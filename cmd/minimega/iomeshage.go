@@ -5,9 +5,12 @@
 package main
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"io"
 	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
@@ -16,6 +19,7 @@ import (
 	"github.com/sandia-minimega/minimega/v2/internal/meshage"
 	"github.com/sandia-minimega/minimega/v2/pkg/minicli"
 	log "github.com/sandia-minimega/minimega/v2/pkg/minilog"
+	"github.com/sandia-minimega/minimega/v2/pkg/ranges"
 )
 
 const (
@@ -41,6 +45,23 @@ relative to the served directory:
 
 Issuing "file list /" will list the contents of the served directory.
 
+Symbolic links are listed with their targets ("name -> target"). Getting a
+symlink recreates the link when its target also lives under the served
+directory, fetching the target first; a link whose target lives outside the
+served directory is materialized as a regular file with the target's content.
+
+The mesh form lists every node's copy of the matching files, one row per node
+and file, with sizes, modification times, and hashes when the -hashfiles flag
+is enabled. The hashed column shows when each node computed its hash; a hash
+older than the file's modification time is marked stale, meaning that node's
+background hasher hasn't caught up. The summary form collapses identical
+copies into a single row and
+calls out nodes whose copy differs or that are missing the file; nodes that
+didn't respond before the timeout are marked with a trailing "?":
+
+	file list ubuntu.qc2 mesh
+	file list ubuntu.qc2 mesh summary
+
 Files can be deleted with the delete command:
 
 	file delete /foo
@@ -60,25 +81,108 @@ undefined.
 If a directory is specified, that directory will be recursively transferred to
 the node.
 
+Transfers have a priority: internal fetches, such as a VM launch waiting on an
+image, run urgent and skip the transfer queue; "file get" runs at normal
+priority; and the bulk flag marks a transfer that should yield queue slots to
+normal transfers (bulk transfers age back to normal so they can't starve):
+
+	file get big-corpus.tar bulk
+
+A file can be stored under a different name or in a subdirectory with the "as"
+form, relative to the files directory:
+
+	file get vyos-1.4.qc2 as routers/vyos.qc2
+
+Recursive gets accept comma-separated exclusion patterns, matched against the
+relative path of each file, and a maximum directory depth:
+
+	file get experiments/ exclude *.log,old/*
+	file get experiments/ exclude *.log depth 2
+
+If a transfer was interrupted by a restart, the parts already on disk are
+verified and reused the next time the same file is requested, so only the
+missing parts are fetched.
+
 To see files that are currently being transferred, use the status command:
 
 	file status
 
+A short history of recently finished transfers is kept so completion can be
+confirmed after the fact, along with each transfer's duration, average rate,
+and which nodes served it:
+
+	file status history
+
+At most -transferlimit transfers run at once; the rest queue. The limit can be
+inspected and resized at runtime, e.g. raised on a beefy storage node or
+lowered on an edge node, without restarting:
+
+	file transfer-limit
+	file transfer-limit 8
+
+Shrinking the limit below the number of running transfers lets them finish
+while admitting no new ones until under the limit.
+
+Located files are remembered briefly so back-to-back commands don't
+re-broadcast to the whole mesh. The cache is invalidated automatically when a
+transfer fails or local files change; "file flush-cache" drops it manually.
+
 You can also supply globs (wildcards) with the * operator. For example:
 
 	file get *.qcow2
 	file delete *.qcow2
 
+To pre-stage files across the mesh before an experiment, use the push command,
+which instructs the targeted nodes to fetch the file immediately:
+
+	file push big.qcow2
+	file push big.qcow2 to kn[1-100]
+
+Push is a mesh-wide get: each targeted node fetches the file as if it had run
+"file get", so a node that already has a matching copy is a fast no-op and
+-headnode semantics are respected. Use "mesh send all file status" to watch
+aggregate progress.
+
+Mesh-fetched files can be pruned once a retention policy is configured with
+the -filemaxage or -fileminfree flags. Files the user placed locally are never
+touched and files referenced by defined VMs are never pruned. The policy runs
+periodically on its own; to trigger it manually, or preview what it would
+remove:
+
+	file prune dry-run
+	file prune
+
+The sync command fetches only the files below a directory that are missing
+locally or differ from the source, instead of recursively re-transferring
+everything. With the prune flag, local files that the source doesn't have are
+deleted. Sync is restartable -- rerunning it picks up where it left off -- and
+the fetches it starts show up in "file status":
+
+	file sync experiments/
+	file sync experiments/ prune
+
 The stream command allows users to stream files through the Response. Each part
 of the file is returned as a separate response which can then be combined to
 form the original file. This command blocks until the stream is complete.`,
 		Patterns: []string{
 			"file <list,>",
 			"file <list,> <path> [recursive,]",
-			"file <get,> <file>",
+			"file <list,> <path> <mesh,> [summary,]",
+			"file <get,> <file> [bulk,]",
+			"file <get,> <file> as <dst>",
+			"file <get,> <file> exclude <patterns>",
+			"file <get,> <file> exclude <patterns> depth <depth>",
+			"file <get,> <file> depth <depth>",
+			"file <push,> <file>",
+			"file <push,> <file> to <hosts>",
 			"file <stream,> <file>",
+			"file <sync,> <dir> [prune,]",
+			"file <prune,> [dry-run,]",
 			"file <delete,> <file>",
-			"file <status,>",
+			"file <status,> [history,]",
+			"file <transfer-limit,>",
+			"file <transfer-limit,> <limit>",
+			"file <flush-cache,>",
 		},
 		Call: cliFile,
 	},
@@ -86,8 +190,66 @@ form the original file. This command blocks until the stream is complete.`,
 
 func iomeshageStart(node *meshage.Node) error {
 	var err error
-	iom, err = iomeshage.New(*f_iomBase, node, *f_headnode, *f_hashfiles)
-	return err
+	iomeshage.Parallelism = *f_partfetch
+	iom, err = iomeshage.New(*f_iomBase, node, *f_headnode, *f_hashfiles, *f_partSize, *f_transfers)
+	if err != nil {
+		return err
+	}
+
+	iom.SetTimeout(*f_fileTimeout)
+	iom.SetRetention(*f_fileMaxAge, *f_fileMinFree, iomFileInUse)
+
+	return nil
+}
+
+// fetchContext returns a context for a file fetch, bounded by the
+// -fetchtimeout deadline when one is configured. The deadline covers the
+// whole transfer, not just the initial lookup.
+func fetchContext() (context.Context, context.CancelFunc) {
+	if *f_fetchTimeout > 0 {
+		return context.WithTimeout(context.Background(), *f_fetchTimeout)
+	}
+
+	return context.WithCancel(context.Background())
+}
+
+// iomFileInUse reports whether a file in the files directory is referenced by
+// a defined VM, either directly or through a backing chain. Used to veto
+// pruning.
+func iomFileInUse(path string) bool {
+	path = filepath.Clean(path)
+
+	for _, n := range ListNamespaces() {
+		ns := GetOrCreateNamespace(n)
+
+		for _, vm := range ns.VMs.FindKvmVMs() {
+			for _, d := range vm.Disks {
+				for _, p := range []string{d.Path, d.SnapshotPath} {
+					if p == "" {
+						continue
+					}
+
+					if filepath.Clean(p) == path {
+						return true
+					}
+
+					// walk the backing chain so base images stay put
+					chain, err := diskChain(p)
+					if err != nil {
+						continue
+					}
+
+					for _, info := range chain[1:] {
+						if filepath.Clean(info.Path) == path {
+							return true
+						}
+					}
+				}
+			}
+		}
+	}
+
+	return false
 }
 
 func cliFile(c *minicli.Command, respChan chan<- minicli.Responses) {
@@ -108,6 +270,11 @@ func cliFile(c *minicli.Command, respChan chan<- minicli.Responses) {
 			resp.Header = append(resp.Header, "hash")
 		}
 
+		if c.BoolArgs["mesh"] {
+			cliFileMeshList(c, respChan, path)
+			return
+		}
+
 		recursive := c.BoolArgs["recursive"]
 
 		files, err := iom.List(path, recursive)
@@ -123,7 +290,12 @@ func cliFile(c *minicli.Command, respChan chan<- minicli.Responses) {
 				dir = "<dir>"
 			}
 
-			row := []string{dir, iom.Rel(f), strconv.FormatInt(f.Size, 10), f.ModTime.Format(time.RFC3339)}
+			name := iom.Rel(f)
+			if f.LinkTarget != "" {
+				name += " -> " + f.LinkTarget
+			}
+
+			row := []string{dir, name, strconv.FormatInt(f.Size, 10), f.ModTime.Format(time.RFC3339)}
 
 			if *f_hashfiles {
 				row = append(row, f.Hash)
@@ -135,45 +307,430 @@ func cliFile(c *minicli.Command, respChan chan<- minicli.Responses) {
 		respChan <- minicli.Responses{resp}
 		return
 	case c.BoolArgs["get"]:
-		respChan <- errResp(iom.Get(fname))
+		ctx, cancel := fetchContext()
+		defer cancel()
+
+		if dst := c.StringArgs["dst"]; dst != "" {
+			respChan <- errResp(iom.GetAs(ctx, fname, dst))
+			return
+		}
+
+		if c.StringArgs["patterns"] != "" || c.StringArgs["depth"] != "" {
+			var excludes []string
+			if p := c.StringArgs["patterns"]; p != "" {
+				excludes = strings.Split(p, ",")
+			}
+
+			var depth int
+			if d := c.StringArgs["depth"]; d != "" {
+				var err error
+				if depth, err = strconv.Atoi(d); err != nil || depth < 1 {
+					respChan <- errResp(fmt.Errorf("invalid depth: `%v`", d))
+					return
+				}
+			}
+
+			respChan <- errResp(iom.GetFiltered(ctx, fname, excludes, depth))
+			return
+		}
+
+		priority := iomeshage.PRIORITY_NORMAL
+		if c.BoolArgs["bulk"] {
+			priority = iomeshage.PRIORITY_BULK
+		}
+
+		respChan <- errResp(iom.GetPriority(ctx, fname, priority))
+		return
+	case c.BoolArgs["push"]:
+		resp := &minicli.Response{Host: hostname}
+		resp.Header = []string{"host", "status"}
+		resp.Tabular = [][]string{}
+
+		var local bool
+		var remote []string
+
+		hosts := c.StringArgs["hosts"]
+		if hosts == "" || hosts == Wildcard {
+			local = true
+			remote = []string{Wildcard}
+		} else {
+			targets, err := ranges.SplitList(hosts)
+			if err != nil {
+				respChan <- errResp(err)
+				return
+			}
+
+			for _, t := range targets {
+				if t == hostname {
+					local = true
+				} else {
+					remote = append(remote, t)
+				}
+			}
+		}
+
+		if local {
+			status := "started"
+			if err := iom.Get(fname); err != nil {
+				if errors.Is(err, iomeshage.ErrInFlight) {
+					status = "in flight"
+				} else {
+					status = err.Error()
+				}
+			}
+			resp.Tabular = append(resp.Tabular, []string{hostname, status})
+		}
+
+		if len(remote) > 0 {
+			// a get on a node that already has a matching copy is a no-op, so
+			// a push is just a mesh-wide get with the status fanned back in
+			cmd := minicli.MustCompilef("file get %q", fname)
+
+			out, err := meshageSend(cmd, strings.Join(remote, ","))
+			if err != nil {
+				respChan <- errResp(err)
+				return
+			}
+
+			for resps := range out {
+				for _, r := range resps {
+					status := "started"
+					if r.Error != "" {
+						status = r.Error
+					}
+					resp.Tabular = append(resp.Tabular, []string{r.Host, status})
+				}
+			}
+		}
+
+		respChan <- minicli.Responses{resp}
 		return
 	case c.BoolArgs["stream"]:
-		stream, err := iom.Stream(fname)
+		r, err := iom.StreamReader(fname)
 		if err != nil {
 			respChan <- errResp(err)
 			return
 		}
+		defer r.Close()
+
+		buf := make([]byte, *f_partSize)
+
+		for {
+			n, err := r.Read(buf)
+			if n > 0 {
+				data := make([]byte, n)
+				copy(data, buf[:n])
+
+				resp := &minicli.Response{
+					Host: hostname,
+					Data: data,
+				}
 
-		for v := range stream {
-			resp := &minicli.Response{
-				Host: hostname,
-				Data: v,
+				respChan <- minicli.Responses{resp}
 			}
 
-			respChan <- minicli.Responses{resp}
+			if err == io.EOF {
+				return
+			} else if err != nil {
+				respChan <- errResp(err)
+				return
+			}
+		}
+	case c.BoolArgs["sync"]:
+		resp := &minicli.Response{Host: hostname}
+		resp.Header = []string{"file", "action"}
+		resp.Tabular = [][]string{}
+
+		fetched, pruned, err := iom.Sync(c.StringArgs["dir"], c.BoolArgs["prune"])
+		if err != nil {
+			respChan <- errResp(err)
+			return
 		}
 
+		for _, f := range fetched {
+			resp.Tabular = append(resp.Tabular, []string{f, "fetching"})
+		}
+		for _, f := range pruned {
+			resp.Tabular = append(resp.Tabular, []string{f, "pruned"})
+		}
+
+		respChan <- minicli.Responses{resp}
 		return
 	case c.BoolArgs["delete"]:
 		respChan <- errResp(iom.Delete(fname))
 		return
+	case c.BoolArgs["prune"]:
+		resp := &minicli.Response{Host: hostname}
+		resp.Header = []string{"file", "status"}
+		resp.Tabular = [][]string{}
+
+		status := "pruned"
+		if c.BoolArgs["dry-run"] {
+			status = "would prune"
+		}
+
+		pruned, err := iom.Prune(c.BoolArgs["dry-run"])
+		if err != nil {
+			respChan <- errResp(err)
+			return
+		}
+
+		for _, f := range pruned {
+			resp.Tabular = append(resp.Tabular, []string{f, status})
+		}
+
+		respChan <- minicli.Responses{resp}
+		return
 	case c.BoolArgs["status"]:
 		resp := &minicli.Response{Host: hostname}
 
-		resp.Header = []string{"filename", "tempdir", "completed", "queued"}
+		if c.BoolArgs["history"] {
+			resp.Header = []string{"filename", "destination", "completed", "duration", "avg MB/s", "sources", "rejected", "finished", "state"}
+			resp.Tabular = [][]string{}
+
+			for _, f := range iom.History() {
+				completed := fmt.Sprintf("%v/%v", len(f.Parts), f.NumParts)
+
+				srcs := []string{}
+				for src, n := range f.Sources {
+					srcs = append(srcs, fmt.Sprintf("%v:%v", src, n))
+				}
+				sort.Strings(srcs)
+
+				state := "failed"
+				switch {
+				case f.Complete && f.Verified:
+					state = "verified"
+				case f.Complete:
+					state = "complete"
+				}
+
+				row := []string{
+					f.Filename,
+					f.Dest,
+					completed,
+					f.Duration().Round(time.Second).String(),
+					fmt.Sprintf("%.2f", f.AverageRate()/(1<<20)),
+					strings.Join(srcs, " "),
+					strconv.Itoa(f.Rejected),
+					f.Finished.Format(time.RFC3339),
+					state,
+				}
+				resp.Tabular = append(resp.Tabular, row)
+			}
+
+			respChan <- minicli.Responses{resp}
+			return
+		}
+
+		resp.Header = []string{"filename", "destination", "completed", "percent", "MB/s", "eta", "priority", "sources", "rejected", "state"}
 		resp.Tabular = [][]string{}
 
 		for _, f := range iom.Status() {
 			completed := fmt.Sprintf("%v/%v", len(f.Parts), f.NumParts)
-			row := []string{f.Filename, f.Dir, completed, fmt.Sprintf("%v", f.Queued)}
+
+			percent := "100%"
+			if f.NumParts > 0 {
+				percent = fmt.Sprintf("%.0f%%", float64(len(f.Parts))/float64(f.NumParts)*100)
+			}
+
+			// per-source breakdown so the fan-in is visible
+			srcs := []string{}
+			for src, n := range f.Sources {
+				srcs = append(srcs, fmt.Sprintf("%v:%v", src, n))
+			}
+			sort.Strings(srcs)
+
+			var rate, eta string
+
+			state := "transferring"
+			switch {
+			case f.Complete && f.Verified:
+				state = "verified"
+			case f.Complete:
+				state = "complete"
+			case !f.Finished.IsZero():
+				state = "failed"
+			case f.Queued:
+				state = "queued"
+			default:
+				rate = fmt.Sprintf("%.2f", f.Rate()/(1<<20))
+				eta = f.ETA().Round(time.Second).String()
+			}
+
+			row := []string{f.Filename, f.Dest, completed, percent, rate, eta, f.Priority.String(), strings.Join(srcs, " "), strconv.Itoa(f.Rejected), state}
 			resp.Tabular = append(resp.Tabular, row)
 		}
 
 		respChan <- minicli.Responses{resp}
+
+		// follow with the transfer slots so load is visible at a glance
+		used, limit := iom.TransferLimit()
+
+		slots := &minicli.Response{Host: hostname}
+		slots.Header = []string{"in use", "limit"}
+		slots.Tabular = [][]string{{strconv.Itoa(used), strconv.Itoa(limit)}}
+
+		respChan <- minicli.Responses{slots}
+		return
+	case c.BoolArgs["transfer-limit"]:
+		if l := c.StringArgs["limit"]; l != "" {
+			n, err := strconv.Atoi(l)
+			if err != nil || n < 1 {
+				respChan <- errResp(fmt.Errorf("invalid transfer limit: `%v`", l))
+				return
+			}
+
+			iom.SetTransferLimit(n)
+			respChan <- errResp(nil)
+			return
+		}
+
+		used, limit := iom.TransferLimit()
+
+		resp := &minicli.Response{Host: hostname}
+		resp.Header = []string{"in use", "limit"}
+		resp.Tabular = [][]string{{strconv.Itoa(used), strconv.Itoa(limit)}}
+
+		respChan <- minicli.Responses{resp}
+		return
+	case c.BoolArgs["flush-cache"]:
+		iom.FlushInfoCache()
+		respChan <- errResp(nil)
 		return
 	}
 }
 
+// cliFileMeshList renders "file list <path> mesh [summary]": one row per
+// (node, file) pair, or one row per distinct copy with the outliers called
+// out when summarizing.
+func cliFileMeshList(c *minicli.Command, respChan chan<- minicli.Responses, path string) {
+	byNode, silent, err := iom.MeshList(path)
+	if err != nil {
+		respChan <- errResp(err)
+		return
+	}
+
+	resp := &minicli.Response{Host: hostname}
+	resp.Tabular = [][]string{}
+
+	var nodes []string
+	for node := range byNode {
+		nodes = append(nodes, node)
+	}
+	sort.Strings(nodes)
+
+	if !c.BoolArgs["summary"] {
+		resp.Header = []string{"node", "file", "size", "modified", "hash", "hashed"}
+
+		for _, node := range nodes {
+			for _, f := range byNode[node] {
+				var hashed string
+				if !f.HashTime.IsZero() {
+					hashed = f.HashTime.Format(time.RFC3339)
+					if f.HashTime.Before(f.ModTime) {
+						hashed += " (stale)"
+					}
+				}
+
+				name := f.Path
+				if f.LinkTarget != "" {
+					name += " -> " + f.LinkTarget
+				}
+
+				row := []string{node, name, strconv.FormatInt(f.Size, 10), f.ModTime.Format(time.RFC3339), f.Hash, hashed}
+				resp.Tabular = append(resp.Tabular, row)
+			}
+		}
+
+		for _, node := range silent {
+			resp.Tabular = append(resp.Tabular, []string{node, "<no response>", "", "", "", ""})
+		}
+
+		respChan <- minicli.Responses{resp}
+		return
+	}
+
+	// one copy of a file, identified by size and hash, held by some nodes
+	type variant struct {
+		size int64
+		hash string
+	}
+
+	variants := make(map[string]map[variant][]string)
+
+	for _, node := range nodes {
+		for _, f := range byNode[node] {
+			v := variant{f.Size, f.Hash}
+
+			if variants[f.Path] == nil {
+				variants[f.Path] = make(map[variant][]string)
+			}
+			variants[f.Path][v] = append(variants[f.Path][v], node)
+		}
+	}
+
+	var files []string
+	for f := range variants {
+		files = append(files, f)
+	}
+	sort.Strings(files)
+
+	resp.Header = []string{"file", "size", "hash", "nodes", "mismatched", "missing"}
+
+	for _, f := range files {
+		// the variant held by the most nodes is presumed canonical
+		var canonical variant
+		for v := range variants[f] {
+			if len(variants[f][v]) > len(variants[f][canonical]) {
+				canonical = v
+			}
+		}
+
+		var mismatched []string
+		holders := make(map[string]bool)
+
+		for v, held := range variants[f] {
+			for _, node := range held {
+				holders[node] = true
+
+				if v != canonical {
+					if v.hash != "" {
+						mismatched = append(mismatched, fmt.Sprintf("%v:%v", node, v.hash))
+					} else {
+						mismatched = append(mismatched, fmt.Sprintf("%v:%v bytes", node, v.size))
+					}
+				}
+			}
+		}
+		sort.Strings(mismatched)
+
+		// nodes that answered but don't have the file; nodes that didn't
+		// answer might have it, mark them with a "?"
+		var missing []string
+		for _, node := range nodes {
+			if !holders[node] {
+				missing = append(missing, node)
+			}
+		}
+		for _, node := range silent {
+			missing = append(missing, node+"?")
+		}
+
+		row := []string{
+			f,
+			strconv.FormatInt(canonical.size, 10),
+			canonical.hash,
+			strconv.Itoa(len(variants[f][canonical])),
+			strings.Join(mismatched, " "),
+			strings.Join(missing, " "),
+		}
+		resp.Tabular = append(resp.Tabular, row)
+	}
+
+	respChan <- minicli.Responses{resp}
+}
+
 // iomHelper supports grabbing files for internal minimega operations. It
 // returns the local path of the file or an error if the file doesn't exist or
 // could not transfer. iomHelper blocks until all file transfers are completed.
@@ -194,14 +751,25 @@ func iomHelper(file, updatee string) (string, error) {
 		file = rel
 	}
 
-	if err := iom.Get(file); err != nil {
-		// suppress in-flight error -- we'll just wait as normal
+	// internal fetches hold up VM launches, so run them urgent and bounded
+	// by the -fetchtimeout deadline
+	ctx, cancel := fetchContext()
+	defer cancel()
+
+	if err := iom.GetPriority(ctx, file, iomeshage.PRIORITY_URGENT); err != nil {
+		// suppress in-flight error -- we'll join the existing transfer below
 		if !errors.Is(err, iomeshage.ErrInFlight) {
 			return "", err
 		}
 	}
 
-	iomWait(file, updatee)
+	if err := iomWait(ctx, file, updatee); err != nil {
+		return "", err
+	}
+
+	// count internal fetches, e.g. a VM launch, as a use of the file so a
+	// retention policy doesn't prune images that are still being launched
+	iom.MarkUsed(file)
 
 	dst := filepath.Join(*f_iomBase, file)
 
@@ -229,42 +797,77 @@ func iomHelper(file, updatee string) (string, error) {
 	return dst, nil
 }
 
-// iomWait polls until the file transfer is completed, optionally periodically
-// sending status update messages to the updatee if provided
-func iomWait(file, updatee string) {
+// iomWait blocks until the file transfer is completed or ctx expires by
+// joining the in-flight transfer rather than polling for it, optionally
+// periodically sending status update messages to the updatee if provided.
+// Every caller waiting on the same transfer succeeds or fails with it.
+func iomWait(ctx context.Context, file, updatee string) error {
 	log.Info("waiting on file: %v", file)
 
-	lastStatus := time.Now()
-
 	meshageStatusLock.RLock()
 	period := meshageStatusPeriod
 	meshageStatusLock.RUnlock()
 
-outer:
+	// report progress to the updatee while we wait
+	if updatee != "" {
+		done := make(chan struct{})
+		defer close(done)
+
+		go func() {
+			for {
+				select {
+				case <-done:
+					return
+				case <-time.After(period):
+					iomStatusUpdate(file, updatee)
+				}
+			}
+		}()
+	}
+
+	// join every in-flight transfer matching the file -- a directory get fans
+	// out into one transfer per constituent file
 	for {
+		var joined bool
+
 		for _, f := range iom.Status() {
-			if strings.Contains(f.Filename, file) {
-				log.Info("iomHelper waiting on %v: %v/%v", f.Filename, len(f.Parts), f.NumParts)
+			// skip recently finished transfers in the history
+			if !f.Finished.IsZero() || !strings.Contains(f.Filename, file) {
+				continue
+			}
 
-				if updatee != "" && time.Since(lastStatus) >= period {
-					var status string
+			log.Info("iomHelper waiting on %v: %v/%v", f.Filename, len(f.Parts), f.NumParts)
 
-					if len(f.Parts) == f.NumParts {
-						status = fmt.Sprintf("merging file %s", f.Filename)
-					} else {
-						status = fmt.Sprintf("transferring file %s: %f%% complete", f.Filename, float64(len(f.Parts))/float64(f.NumParts)*100.0)
-					}
+			if err := iom.Wait(ctx, f.Dest); err != nil {
+				return fmt.Errorf("waiting for %v: %w", file, err)
+			}
 
-					sendStatusMessage(status, updatee)
-					lastStatus = time.Now()
-				}
+			joined = true
+		}
 
-				time.Sleep(IOM_HELPER_WAIT)
-				continue outer
-			}
+		if !joined {
+			return nil
+		}
+	}
+}
+
+// iomStatusUpdate sends the updatee a progress message for each in-flight
+// transfer matching the file.
+func iomStatusUpdate(file, updatee string) {
+	for _, f := range iom.Status() {
+		if !f.Finished.IsZero() || !strings.Contains(f.Filename, file) {
+			continue
+		}
+
+		var status string
+
+		if len(f.Parts) == f.NumParts {
+			status = fmt.Sprintf("merging file %s", f.Filename)
+		} else {
+			status = fmt.Sprintf("transferring file %s: %f%% complete", f.Filename, float64(len(f.Parts))/float64(f.NumParts)*100.0)
 		}
 
-		break
+		sendStatusMessage(status, updatee)
 	}
 }
 
@@ -276,7 +879,7 @@ func iomCompleter(last string) []string {
 	}
 
 	fileprefix := strings.TrimPrefix(last, IOM_HELPER_MATCH)
-	matches := iom.Info(fileprefix + "*")
+	matches := iom.Info(fileprefix+"*", nil, 0)
 	log.Debug("got raw matches: %v", matches)
 
 	// we need to clean up matches to collapse directories, unless
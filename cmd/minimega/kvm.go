@@ -16,8 +16,10 @@ import (
 	"os"
 	"os/exec"
 	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"text/tabwriter"
 	"time"
 
@@ -41,6 +43,12 @@ const (
 
 	QMP_CONNECT_RETRY = 50
 	QMP_CONNECT_DELAY = 100
+
+	QMP_EVENT_BUFFER = 128 // Max events per VM before we drop the oldest
+
+	// Max time to wait for a file to transfer over the mesh at launch before
+	// moving the VM to the error state
+	VM_FETCH_TIMEOUT = 10 * time.Minute
 )
 
 type KVMConfig struct {
@@ -159,6 +167,16 @@ type KVMConfig struct {
 	// Default: "std"
 	Vga string
 
+	// Attach a vhost-vsock device to the VM for host-guest communication
+	// over AF_VSOCK. The value is the guest CID (context ID) to assign,
+	// which must be 3 or higher, or "auto" to allocate a free CID from a
+	// host-wide pool at launch. CIDs are unique per host -- launching two
+	// VMs configured with the same explicit CID is an error.
+	//
+	// Note: this configuration only applies to KVM-based VMs and requires
+	// /dev/vhost-vsock on the host.
+	VsockCID string `validate:"validVsockCID"`
+
 	// Add an append string to a kernel set with vm kernel. Setting vm append
 	// without using vm kernel will result in an error.
 	//
@@ -190,6 +208,10 @@ type KVMConfig struct {
 	// hugepagesMountPath is copied from ns.hugepagesMountPath when the VM is
 	// launched. Not set by "vm config" APIs.
 	hugepagesMountPath string
+
+	// vsockCID is the guest CID allocated to the VM at launch, zero when no
+	// vhost-vsock device is configured. Not set by "vm config" APIs.
+	vsockCID uint64
 }
 
 type qemuOverride struct {
@@ -204,6 +226,15 @@ type vmHotplug struct {
 	Version string
 }
 
+// qmpEvent is a single asynchronous message received over a VM's QMP
+// connection, recorded so that `vm events` can show what the guest did and
+// when.
+type qmpEvent struct {
+	Time  time.Time
+	Event string
+	Data  string
+}
+
 type KvmVM struct {
 	*BaseVM   // embed
 	KVMConfig // embed
@@ -211,17 +242,21 @@ type KvmVM struct {
 	// Internal variables
 	hotplug map[int]vmHotplug
 
+	qmpEvents []qmpEvent // ring buffer of recent asynchronous QMP events
+
+	// named virtio-serial ports in slot order, including those hot-added
+	// after launch. Removed ports leave an empty string so that the slots of
+	// the remaining ports don't shift.
+	virtioPorts []string
+
 	q qmp.Conn // qmp connection for this vm
 
 	vncShim net.Listener // shim for VNC connections
 	VNCPort int
-}
 
-type BlockDevice struct {
-	Device   string `json:"device"`
-	Inserted *struct {
-		File string `json:"file"`
-	} `json:"inserted"`
+	// QemuVersion is the version of the QEMU binary that the VM was
+	// launched under, detected at launch time.
+	QemuVersion string
 }
 
 type BlockDeviceJobs struct {
@@ -234,6 +269,48 @@ type BlockDeviceJobs struct {
 // Ensure that KvmVM implements the VM interface
 var _ VM = (*KvmVM)(nil)
 
+// vsockCIDs tracks the guest CIDs allocated to VMs on this host so that two
+// VMs never share a CID. Maps CID -> VM ID.
+var vsockCIDs = map[uint64]int{}
+var vsockCIDLock sync.Mutex
+
+// allocVsockCID reserves a guest CID for the given VM from the host-wide
+// pool. want is the configured CID or "auto" to allocate the lowest free CID.
+func allocVsockCID(want string, id int) (uint64, error) {
+	vsockCIDLock.Lock()
+	defer vsockCIDLock.Unlock()
+
+	if want != "auto" {
+		v, err := strconv.ParseUint(want, 10, 64)
+		if err != nil || v < 3 {
+			return 0, fmt.Errorf("invalid vsock CID: `%v`", want)
+		}
+
+		if id2, ok := vsockCIDs[v]; ok {
+			return 0, fmt.Errorf("vsock CID %v already in use by VM %v", v, id2)
+		}
+
+		vsockCIDs[v] = id
+		return v, nil
+	}
+
+	// CIDs 0-2 are reserved by the vsock address family so start at 3
+	for v := uint64(3); ; v++ {
+		if _, ok := vsockCIDs[v]; !ok {
+			vsockCIDs[v] = id
+			return v, nil
+		}
+	}
+}
+
+// releaseVsockCID returns a guest CID to the host-wide pool.
+func releaseVsockCID(cid uint64) {
+	vsockCIDLock.Lock()
+	defer vsockCIDLock.Unlock()
+
+	delete(vsockCIDs, cid)
+}
+
 // Copy makes a deep copy and returns reference to the new struct.
 func (old KVMConfig) Copy() KVMConfig {
 	// Copy all fields
@@ -279,6 +356,12 @@ func (vm *KvmVM) Copy() VM {
 		vm2.hotplug[k] = v
 	}
 
+	vm2.qmpEvents = make([]qmpEvent, len(vm.qmpEvents))
+	copy(vm2.qmpEvents, vm.qmpEvents)
+
+	vm2.virtioPorts = make([]string, len(vm.virtioPorts))
+	copy(vm2.virtioPorts, vm.virtioPorts)
+
 	return vm2
 }
 
@@ -316,6 +399,12 @@ func (vm *KvmVM) Flush() error {
 		}
 	}
 
+	// return the VM's guest CID, if any, to the host-wide pool
+	if vm.vsockCID != 0 {
+		releaseVsockCID(vm.vsockCID)
+		vm.vsockCID = 0
+	}
+
 	return vm.BaseVM.Flush()
 }
 
@@ -394,6 +483,35 @@ func (vm *KvmVM) Info(field string) (string, error) {
 		return strconv.Itoa(vm.VNCPort), nil
 	case "pid":
 		return strconv.Itoa(vm.Pid), nil
+	case "qemu_version":
+		return vm.QemuVersion, nil
+	case "qemu_status":
+		// show qemu's own notion of the run state alongside the tracked
+		// state for debugging
+		if vm.State&(VM_RUNNING|VM_PAUSED) == 0 {
+			return "", nil
+		}
+		status, err := vm.q.QueryStatus()
+		if err != nil {
+			return "", err
+		}
+		return status.Status, nil
+	case "vsock-cid":
+		// show the allocated CID once the VM has launched
+		if vm.vsockCID != 0 {
+			return strconv.FormatUint(vm.vsockCID, 10), nil
+		}
+	case "virtio-ports":
+		// include any ports hot-added since launch
+		if len(vm.virtioPorts) > 0 {
+			names := []string{}
+			for _, v := range vm.virtioPorts {
+				if v != "" {
+					names = append(names, v)
+				}
+			}
+			return strings.Join(names, ","), nil
+		}
 	}
 
 	return vm.KVMConfig.Info(field)
@@ -425,6 +543,11 @@ func (vm *KvmVM) ConflictsKVM(vm2 *KvmVM) error {
 		}
 	}
 
+	// explicit guest CIDs are host-wide so two VMs must never share one
+	if vm.VsockCID != "" && vm.VsockCID != "auto" && vm.VsockCID == vm2.VsockCID {
+		return fmt.Errorf("vsock CID conflict with vm %v: %v", vm.Name, vm.VsockCID)
+	}
+
 	return vm.BaseVM.conflicts(vm2.BaseVM)
 }
 
@@ -450,6 +573,7 @@ func (vm *KVMConfig) String() string {
 	fmt.Fprintf(w, "Threads:\t%v\n", vm.Threads)
 	fmt.Fprintf(w, "Sockets:\t%v\n", vm.Sockets)
 	fmt.Fprintf(w, "VGA:\t%v\n", vm.Vga)
+	fmt.Fprintf(w, "Vsock CID:\t%v\n", vm.VsockCID)
 	w.Flush()
 	fmt.Fprintln(&o)
 	return o.String()
@@ -463,6 +587,50 @@ func (vm *KvmVM) QMPRaw(input string) (string, error) {
 	return vm.q.Raw(input)
 }
 
+func (vm *KvmVM) HMP(input string) (string, error) {
+	return vm.q.HumanMonitorCommand(input)
+}
+
+func (vm *KvmVM) QomList(path string) ([]qmp.QomListEntry, error) {
+	return vm.q.QomList(path)
+}
+
+func (vm *KvmVM) QomGet(path, property string) (interface{}, error) {
+	return vm.q.QomGet(path, property)
+}
+
+func (vm *KvmVM) QomSet(path, property string, value interface{}) error {
+	return vm.q.QomSet(path, property, value)
+}
+
+// QGAPing issues a guest-ping to the qemu guest agent over the virtio-serial
+// port named org.qemu.guest_agent.0. Returns an error if the port is not
+// configured or the agent doesn't respond before the timeout.
+func (vm *KvmVM) QGAPing(timeout time.Duration) error {
+	conn, err := net.DialTimeout("unix", vm.path("org.qemu.guest_agent.0"), timeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	conn.SetDeadline(time.Now().Add(timeout))
+
+	if _, err := conn.Write([]byte(`{"execute":"guest-ping"}` + "\n")); err != nil {
+		return err
+	}
+
+	var res map[string]interface{}
+	if err := json.NewDecoder(conn).Decode(&res); err != nil {
+		return err
+	}
+
+	if _, ok := res["return"]; !ok {
+		return fmt.Errorf("unexpected response from guest agent: %v", res)
+	}
+
+	return nil
+}
+
 func (vm *KvmVM) Save(filename string) error {
 	// skip save if using kernel/initrd or cdrom as boot device
 	if len(vm.KVMConfig.Disks) == 0 {
@@ -479,15 +647,11 @@ func (vm *KvmVM) Save(filename string) error {
 
 	fp := fmt.Sprintf("%s/%s", *f_base, strconv.Itoa(vm.ID))
 
-	r, err := vm.q.QueryBlock()
+	v, err := vm.q.QueryBlock()
 	if err != nil {
 		return err
 	}
 
-	rString, err := json.Marshal(r)
-	var v []BlockDevice
-	json.Unmarshal(rString, &v)
-
 	// find the device name
 	var device string
 	for _, dev := range v {
@@ -529,6 +693,130 @@ func (vm *KvmVM) Migrate(filename string) error {
 	return vm.q.MigrateDisk(filename)
 }
 
+// parseMigrateOptions maps migration options from the CLI to QMP
+// capabilities and parameters. Options are either bare capability names
+// (compress, auto-converge) or key=value pairs (multifd=4, bandwidth=500M,
+// downtime=300ms).
+func parseMigrateOptions(options []string) (map[string]bool, map[string]interface{}, error) {
+	caps := map[string]bool{}
+	params := map[string]interface{}{}
+
+	for _, opt := range options {
+		parts := strings.SplitN(opt, "=", 2)
+
+		switch parts[0] {
+		case "compress", "auto-converge":
+			if len(parts) != 1 {
+				return nil, nil, fmt.Errorf("`%v` does not take a value", parts[0])
+			}
+			caps[parts[0]] = true
+		case "multifd":
+			channels := 2
+			if len(parts) == 2 {
+				v, err := strconv.Atoi(parts[1])
+				if err != nil || v <= 0 {
+					return nil, nil, fmt.Errorf("invalid multifd channels: `%v`", parts[1])
+				}
+				channels = v
+			}
+			caps["multifd"] = true
+			params["multifd-channels"] = channels
+		case "bandwidth":
+			if len(parts) != 2 {
+				return nil, nil, errors.New("bandwidth requires a value such as 500M")
+			}
+			v, err := parseBytes(parts[1])
+			if err != nil {
+				return nil, nil, fmt.Errorf("invalid bandwidth: `%v`", parts[1])
+			}
+			params["max-bandwidth"] = v
+		case "downtime":
+			if len(parts) != 2 {
+				return nil, nil, errors.New("downtime requires a value such as 300ms")
+			}
+			d, err := time.ParseDuration(parts[1])
+			if err != nil {
+				return nil, nil, fmt.Errorf("invalid downtime: `%v`", parts[1])
+			}
+			params["downtime-limit"] = int64(d / time.Millisecond)
+		default:
+			return nil, nil, fmt.Errorf("unknown migration option: `%v`", parts[0])
+		}
+	}
+
+	return caps, params, nil
+}
+
+// parseBytes parses a size with an optional K, M, or G suffix into bytes.
+func parseBytes(s string) (int64, error) {
+	var shift uint
+
+	switch {
+	case strings.HasSuffix(s, "K"):
+		shift, s = 10, strings.TrimSuffix(s, "K")
+	case strings.HasSuffix(s, "M"):
+		shift, s = 20, strings.TrimSuffix(s, "M")
+	case strings.HasSuffix(s, "G"):
+		shift, s = 30, strings.TrimSuffix(s, "G")
+	}
+
+	v, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || v < 0 {
+		return 0, fmt.Errorf("invalid size: `%v`", s)
+	}
+
+	return v << shift, nil
+}
+
+// SetMigrateOptions applies migration capabilities and parameters ahead of a
+// migration. Capabilities that this QEMU doesn't support degrade to a
+// warning rather than aborting the migration.
+func (vm *KvmVM) SetMigrateOptions(options []string) error {
+	caps, params, err := parseMigrateOptions(options)
+	if err != nil {
+		return err
+	}
+
+	vm.lock.Lock()
+	defer vm.lock.Unlock()
+
+	// apply capabilities one at a time so that a capability this QEMU
+	// doesn't know about doesn't take the others down with it
+	for name, state := range caps {
+		if err := vm.q.MigrateSetCapabilities(map[string]bool{name: state}); err != nil {
+			log.Warn("vm %v: migration capability %v not applied: %v", vm.ID, name, err)
+		}
+	}
+
+	for name, value := range params {
+		if err := vm.q.MigrateSetParameters(map[string]interface{}{name: value}); err != nil {
+			log.Warn("vm %v: migration parameter %v not applied: %v", vm.ID, name, err)
+		}
+	}
+
+	return nil
+}
+
+// MigrateCapabilities returns the names of the enabled migration
+// capabilities so that users can see whether compression or multifd is
+// actually active.
+func (vm *KvmVM) MigrateCapabilities() ([]string, error) {
+	caps, err := vm.q.QueryMigrateCapabilities()
+	if err != nil {
+		return nil, err
+	}
+
+	var res []string
+	for name, state := range caps {
+		if state {
+			res = append(res, name)
+		}
+	}
+	sort.Strings(res)
+
+	return res, nil
+}
+
 func (vm *KvmVM) QueryMigrate() (string, float64, error) {
 	var status string
 	var completed float64
@@ -610,6 +898,37 @@ func (vm *KvmVM) Screenshot(size int) ([]byte, error) {
 	return pngResult, nil
 }
 
+// reconcileState updates minimega's state machine to match the run state
+// that qemu reports, logging any divergence. qemu is authoritative after a
+// QMP (re)connect since minimega may have missed transitions. The caller
+// must hold vm.lock.
+func (vm *KvmVM) reconcileState() error {
+	status, err := vm.q.QueryStatus()
+	if err != nil {
+		return err
+	}
+
+	// only reconcile states that map onto qemu's run state -- building,
+	// quit, and error are minimega concepts
+	if vm.State&(VM_RUNNING|VM_PAUSED) == 0 {
+		return nil
+	}
+
+	// note that "inmigrate" means qemu was launched with -incoming and is
+	// waiting for migration data, so the guest isn't running yet
+	state := VM_PAUSED
+	if status.Running {
+		state = VM_RUNNING
+	}
+
+	if vm.State != state {
+		log.Warn("vm %v: state %v disagrees with qemu status %v, updating", vm.ID, vm.State, status.Status)
+		vm.setState(state)
+	}
+
+	return nil
+}
+
 func (vm *KvmVM) connectQMP() (err error) {
 	delay := QMP_CONNECT_DELAY * time.Millisecond
 
@@ -617,6 +936,10 @@ func (vm *KvmVM) connectQMP() (err error) {
 		vm.q, err = qmp.Dial(vm.path("qmp"))
 		if err == nil {
 			log.Debug("qmp dial to %v successful", vm.ID)
+
+			// a wedged guest can make QMP block forever which would hang the
+			// CLI since we hold the VM lock across commands
+			vm.q.SetTimeouts(qmp.COMMAND_TIMEOUT, qmp.LONG_COMMAND_TIMEOUT)
 			return
 		}
 
@@ -628,8 +951,32 @@ func (vm *KvmVM) connectQMP() (err error) {
 	return errors.New("qmp timeout")
 }
 
+// vncListen creates a vnc shim listener, within the namespace's restricted
+// port range when one is set and on an ephemeral port otherwise. Busy ports
+// within the range are skipped so that VMs fall back to the next free port.
+func vncListen(ns *Namespace) (net.Listener, error) {
+	min, max := ns.vncMin, ns.vncMax
+	if min == 0 {
+		return net.Listen("tcp", "")
+	}
+
+	for port := min; port <= max; port++ {
+		l, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
+		if err == nil {
+			return l, nil
+		}
+
+		log.Debug("vnc port %v unavailable: %v", port, err)
+	}
+
+	return nil, fmt.Errorf("no free vnc port in range %v-%v", min, max)
+}
+
 func (vm *KvmVM) connectVNC() error {
-	l, err := net.Listen("tcp", "")
+	// should never create...
+	ns := GetOrCreateNamespace(vm.Namespace)
+
+	l, err := vncListen(ns)
 	if err != nil {
 		return err
 	}
@@ -641,9 +988,6 @@ func (vm *KvmVM) connectVNC() error {
 	go func() {
 		defer l.Close()
 
-		// should never create...
-		ns := GetOrCreateNamespace(vm.Namespace)
-
 		for {
 			// Sit waiting for new connections
 			remote, err := l.Accept()
@@ -667,8 +1011,9 @@ func (vm *KvmVM) connectVNC() error {
 				}
 				defer local.Close()
 
-				// copy local -> remote
-				go io.Copy(remote, local)
+				// copy local -> remote, teeing the server's side of the
+				// connection to any active shim framebuffer recording
+				go io.Copy(remote, io.TeeReader(local, ns.Recorder.FBTap(vm.GetName())))
 
 				// Reads will implicitly copy from remote -> local
 				tee := io.TeeReader(remote, local)
@@ -711,19 +1056,25 @@ func (vm *KvmVM) createTapName(bridge string) (string, error) {
 }
 
 // addTap does the work of adding the specified tap associated with a network
-func (vm *KvmVM) addTap(name, bridge, mac string, vlan int, qinq bool) (string, error) {
-	br, err := getBridge(bridge)
+func (vm *KvmVM) addTap(name string, nic NetConfig) (string, error) {
+	br, err := getBridge(nic.Bridge)
 	if err != nil {
-		return name, vm.setErrorf("unable to get bridge %v: %v", bridge, err)
+		return name, vm.setErrorf("unable to get bridge %v: %v", nic.Bridge, err)
 	}
 
-	tap, err := br.CreateTap(name, mac, vlan)
+	tap, err := br.CreateTap(name, nic.MAC, nic.VLAN)
 	if err != nil {
 		return tap, err
 	}
 
-	if qinq {
-		if err := br.SetTapQinQ(tap, vlan); err != nil {
+	if nic.QinQ {
+		if err := br.SetTapQinQ(tap, nic.VLAN); err != nil {
+			return tap, err
+		}
+	}
+
+	if nic.MTU != 0 {
+		if err := br.SetTapMTU(tap, nic.MTU); err != nil {
 			return tap, err
 		}
 	}
@@ -741,7 +1092,7 @@ func (vm *KvmVM) createTaps() error {
 			continue
 		}
 
-		tap, err := vm.addTap("", nic.Bridge, nic.MAC, nic.VLAN, nic.QinQ)
+		tap, err := vm.addTap("", *nic)
 		if err != nil {
 			return vm.setErrorf("unable to create tap %v: %v", i, err)
 		}
@@ -758,6 +1109,76 @@ func (vm *KvmVM) createTaps() error {
 	return nil
 }
 
+// fetchFiles resolves any configured images that live in the files directory
+// through iomeshage, fetching the ones that are not present locally before we
+// start qemu. Paths outside the files directory are left alone. The caller
+// should hold the VM's lock.
+func (vm *KvmVM) fetchFiles() error {
+	files := []string{
+		vm.KernelPath,
+		vm.InitrdPath,
+		vm.CdromPath,
+		vm.MigratePath,
+	}
+	for _, d := range vm.Disks {
+		files = append(files, d.Path)
+	}
+
+	for _, f := range files {
+		if f == "" || !strings.HasPrefix(f, *f_iomBase) {
+			continue
+		}
+
+		if _, err := os.Stat(f); err == nil {
+			continue
+		}
+
+		log.Info("fetching %v for vm %v", f, vm.ID)
+
+		if err := vm.fetchFile(f); err != nil {
+			return vm.setErrorf("unable to fetch %v: %v", f, err)
+		}
+	}
+
+	return nil
+}
+
+// fetchFile fetches a single file from the mesh, surfacing transfer progress
+// in the VM's tags while the VM is still building. Transfers that take longer
+// than VM_FETCH_TIMEOUT are abandoned.
+func (vm *KvmVM) fetchFile(file string) error {
+	rel, err := filepath.Rel(*f_iomBase, filepath.Clean(file))
+	if err != nil {
+		return err
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		// iomHelper also grabs any backing images for disks
+		_, err := iomHelper(file, "")
+		done <- err
+	}()
+
+	defer delete(vm.Tags, "transfer")
+
+	timeout := time.After(VM_FETCH_TIMEOUT)
+
+	for {
+		select {
+		case err := <-done:
+			return err
+		case <-timeout:
+			return fmt.Errorf("timed out waiting for transfer after %v", VM_FETCH_TIMEOUT)
+		case <-time.After(IOM_HELPER_WAIT):
+			for _, f := range iom.Status() {
+				if strings.Contains(f.Filename, rel) {
+					vm.Tags["transfer"] = fmt.Sprintf("%v: %.0f%%", rel, float64(len(f.Parts))/float64(f.NumParts)*100)
+				}
+			}
+		}
+	}
+}
+
 // launch is the low-level launch function for KVM VMs. The caller should hold
 // the VM's lock.
 func (vm *KvmVM) launch() error {
@@ -771,11 +1192,27 @@ func (vm *KvmVM) launch() error {
 			return vm.setErrorf("unable to create VM dir: %v", err)
 		}
 
+		// fetch any missing images from the mesh before we touch the disks
+		if err := vm.fetchFiles(); err != nil {
+			return err
+		}
+
+		// refuse to run against an image that is mounted for editing
+		for _, d := range vm.Disks {
+			if diskMounted(d.Path) {
+				return vm.setErrorf("disk %v is mounted on the host, umount it first", d.Path)
+			}
+		}
+
 		// Create a snapshot of each disk image
 		if vm.Snapshot {
 			for i, d := range vm.Disks {
+				if depth := diskChainDepth(d.Path); *f_chainDepth > 0 && depth >= *f_chainDepth {
+					log.Warn("launching %v on a backing chain %v images deep (%v), reads will be slow", vm.Name, depth, d.Path)
+				}
+
 				dst := vm.path(fmt.Sprintf("disk-%v.qcow2", i))
-				if err := diskSnapshot(d.Path, dst); err != nil {
+				if err := diskSnapshot(d.Path, dst, false); err != nil {
 					return vm.setErrorf("unable to snapshot %v: %v", d, err)
 				}
 
@@ -797,24 +1234,55 @@ func (vm *KvmVM) launch() error {
 	var sOut bytes.Buffer
 	var sErr bytes.Buffer
 
+	// allocate a guest CID if the VM wants a vhost-vsock device and doesn't
+	// already have one from a previous launch
+	if vm.VsockCID != "" && vm.vsockCID == 0 {
+		if _, err := os.Stat("/dev/vhost-vsock"); err != nil {
+			return vm.setErrorf("vhost-vsock unsupported on this host: %v", err)
+		}
+
+		cid, err := allocVsockCID(vm.VsockCID, vm.ID)
+		if err != nil {
+			return vm.setErrorf("unable to allocate vsock CID: %v", err)
+		}
+
+		vm.vsockCID = cid
+
+		// record the CID in the VM's tags so that in-guest software can
+		// discover it via the cc layer
+		vm.Tags["vsock-cid"] = strconv.FormatUint(cid, 10)
+	}
+
 	vmConfig := VMConfig{BaseConfig: vm.BaseConfig, KVMConfig: vm.KVMConfig}
+
+	// seed the named ports for hot-add accounting -- ports hot-added via
+	// AddVirtioPort do not survive a relaunch
+	vm.virtioPorts = vmConfig.virtioPortNames()
+
 	args := vmConfig.qemuArgs(vm.ID, vm.instancePath)
 	args = vmConfig.applyQemuOverrides(args)
 	log.Debug("final qemu args: %#v", args)
 
 	// if the QemuPath is not absolute, try a lookup based on $PATH
-	qemu := vm.QemuPath
-	if !filepath.IsAbs(qemu) {
-		v, err := process(qemu)
+	qemuPath := vm.QemuPath
+	if !filepath.IsAbs(qemuPath) {
+		v, err := process(qemuPath)
 		if err != nil {
 			return vm.setErrorf("unable to launch VM: %v", err)
 		}
-		qemu = v
+		qemuPath = v
+	}
+
+	// record the version of the binary we are about to invoke for `vm info`
+	if v, err := qemu.Version(qemuPath); err != nil {
+		log.Warn("vm %v: %v", vm.ID, err)
+	} else {
+		vm.QemuVersion = v
 	}
 
 	cmd := &exec.Cmd{
-		Path:   qemu,
-		Args:   append([]string{qemu}, args...),
+		Path:   qemuPath,
+		Args:   append([]string{qemuPath}, args...),
 		Stdout: &sOut,
 		Stderr: &sErr,
 	}
@@ -858,7 +1326,13 @@ func (vm *KvmVM) launch() error {
 		return vm.setErrorf("unable to connect to qmp socket: %v", err)
 	}
 
-	go vm.qmpLogger()
+	// minimega and qemu can disagree about the run state when connecting to
+	// an already-running qemu, let qemu win
+	if err := vm.reconcileState(); err != nil {
+		log.Warn("vm %v: unable to reconcile state: %v", vm.ID, err)
+	}
+
+	go vm.qmpDispatcher(waitChan)
 
 	if err := vm.connectVNC(); err != nil {
 		// Failed to connect to vnc so clean up the process
@@ -895,6 +1369,10 @@ func (vm *KvmVM) Connect(cc *ron.Server, reconnect bool) error {
 		return cc.DialSerial(vm.path("cc"), vm.GetUUID())
 	}
 
+	// the VM was relaunched so any existing serial connection is stale --
+	// close it and the monitor started by DialSerial will redial
+	cc.DisconnectSerial(vm.path("cc"))
+
 	return nil
 }
 
@@ -912,14 +1390,23 @@ func (vm *KvmVM) AddNIC(nic NetConfig) error {
 	vm.lock.Lock()
 	defer vm.lock.Unlock()
 
+	// validate the driver before creating the tap or issuing any QMP commands
+	// -- QMP reports device_add failures rather opaquely
+	nics, err := qemu.NICs(vm.QemuPath, vm.Machine)
+	if err != nil {
+		return err
+	}
+	if !nics[nic.Driver] {
+		return fmt.Errorf("invalid NIC driver: `%v`, see help", nic.Driver)
+	}
+
 	if nic.MAC == "" {
 		nic.MAC = randomMac()
 	}
-	var err error
 	nic.Tap, err = vm.createTapName(nic.Bridge)
 	vm.Networks = append(vm.Networks, nic)
 
-	if _, err := vm.addTap(nic.Tap, nic.Bridge, nic.MAC, nic.VLAN, nic.QinQ); err != nil {
+	if _, err := vm.addTap(nic.Tap, nic); err != nil {
 		return vm.setErrorf("Unable to add tap %v: %v", nic.Tap, err)
 	}
 
@@ -943,6 +1430,108 @@ func (vm *KvmVM) AddNIC(nic NetConfig) error {
 	return nil
 }
 
+// AddVirtioPort hot-adds a named virtio-serial port to a running VM. The port
+// is backed by a unix socket in the VM's instance path named after the port.
+// When the current virtio-serial-pci controller is full, a new controller is
+// created using the same accounting as qemuArgs.
+func (vm *KvmVM) AddVirtioPort(name string) error {
+	vm.lock.Lock()
+	defer vm.lock.Unlock()
+
+	if name == "" {
+		return errors.New("invalid virtio-port name")
+	}
+
+	if name == "cc" && vm.Backchannel {
+		return errors.New("virtio-port name conflicts with miniccc's")
+	}
+
+	for _, v := range vm.virtioPorts {
+		if v == name {
+			return fmt.Errorf("virtio-port already exists: %v", name)
+		}
+	}
+
+	// hot-added ports are always appended -- slots from removed ports are
+	// never reused so that the chardev ids stay unique
+	slot := len(vm.virtioPorts)
+
+	// count controllers the same way qemuArgs does -- the backchannel gets a
+	// controller of its own and then each DEV_PER_VIRTIO ports share one
+	controller := slot/DEV_PER_VIRTIO + 1
+	if !vm.Backchannel {
+		controller--
+	}
+
+	bus := fmt.Sprintf("virtio-serial%v", controller)
+
+	// if this slot starts a new controller, hot-add the controller first
+	if slot%DEV_PER_VIRTIO == 0 {
+		r, err := vm.q.VirtioSerialAdd(bus)
+		if err != nil {
+			return err
+		}
+		log.Debugln("qmp device_add response:", r)
+	}
+
+	id := fmt.Sprintf("charvserial%v", slot)
+
+	sock := qmp.ChardevSocket{
+		Path:   vm.path(name),
+		Server: true,
+	}
+	if err := vm.q.ChardevAdd(id, sock); err != nil {
+		return err
+	}
+
+	r, err := vm.q.VirtioPortAdd(id, bus, id, name)
+	if err != nil {
+		return err
+	}
+	log.Debugln("qmp device_add response:", r)
+
+	vm.virtioPorts = append(vm.virtioPorts, name)
+
+	return nil
+}
+
+// RemoveVirtioPort hot-removes a virtio-serial port that was hot-added or
+// created at launch. The controller is left in place since other ports may
+// still be attached to it.
+func (vm *KvmVM) RemoveVirtioPort(name string) error {
+	vm.lock.Lock()
+	defer vm.lock.Unlock()
+
+	if name == "cc" && vm.Backchannel {
+		return errors.New("cannot remove miniccc's virtio-port")
+	}
+
+	for i, v := range vm.virtioPorts {
+		if v != name || name == "" {
+			continue
+		}
+
+		id := fmt.Sprintf("charvserial%v", i)
+
+		r, err := vm.q.DeviceDel(id)
+		if err != nil {
+			return err
+		}
+		log.Debugln("qmp device_del response:", r)
+
+		if err := vm.q.ChardevRemove(id); err != nil {
+			return err
+		}
+
+		// leave a hole so that the slots of the remaining ports don't shift
+		vm.virtioPorts[i] = ""
+
+		return nil
+	}
+
+	return fmt.Errorf("no such virtio-port: %v", name)
+}
+
 func (vm *KvmVM) Hotplug(f, version, serial string) error {
 	var bus string
 	switch version {
@@ -1086,6 +1675,181 @@ func (vm *KvmVM) ejectCD(force bool) error {
 	return err
 }
 
+// QueryCPUs returns the guest vCPU to host thread mapping from QEMU.
+func (vm *KvmVM) QueryCPUs() ([]qmp.CPU, error) {
+	vm.lock.Lock()
+	defer vm.lock.Unlock()
+
+	return vm.q.QueryCPUs()
+}
+
+// findDisk resolves a disk argument, which may be an index into the VM's
+// disks or a path, to the matching DiskConfig. An empty argument is allowed
+// when the VM has exactly one disk.
+func (vm *KvmVM) findDisk(s string) (*DiskConfig, error) {
+	vm.lock.Lock()
+	defer vm.lock.Unlock()
+
+	if s == "" {
+		if len(vm.Disks) != 1 {
+			return nil, fmt.Errorf("vm has %v disks, please specify one", len(vm.Disks))
+		}
+		return &vm.Disks[0], nil
+	}
+
+	if i, err := strconv.Atoi(s); err == nil {
+		if i < 0 || i >= len(vm.Disks) {
+			return nil, fmt.Errorf("no disk with index %v", i)
+		}
+		return &vm.Disks[i], nil
+	}
+
+	for i, d := range vm.Disks {
+		if d.Path == s || d.SnapshotPath == s {
+			return &vm.Disks[i], nil
+		}
+	}
+
+	return nil, fmt.Errorf("no disk matching `%v`", s)
+}
+
+// diskDevice returns the QMP block device name backing the given disk. The
+// caller must hold vm.lock.
+func (vm *KvmVM) diskDevice(d DiskConfig) (string, error) {
+	path := d.Path
+	if vm.Snapshot && d.SnapshotPath != "" {
+		path = d.SnapshotPath
+	}
+
+	devices, err := vm.q.QueryBlock()
+	if err != nil {
+		return "", err
+	}
+
+	for _, dev := range devices {
+		if dev.Inserted != nil && dev.Inserted.File == path {
+			return dev.Device, nil
+		}
+	}
+
+	return "", fmt.Errorf("no block device for %v", path)
+}
+
+// StreamDisk starts a block-stream job that pulls data from the backing
+// image into the given disk's per-instance overlay so that subsequent reads
+// are local. Progress is surfaced via the VM's tags and completion is
+// handled asynchronously.
+func (vm *KvmVM) StreamDisk(d *DiskConfig) error {
+	vm.lock.Lock()
+	defer vm.lock.Unlock()
+
+	device, err := vm.diskDevice(*d)
+	if err != nil {
+		return err
+	}
+
+	// subscribe before starting the job so that we can't miss completion
+	events, cancel := vm.q.Subscribe("BLOCK_JOB_COMPLETED", "BLOCK_JOB_ERROR", "BLOCK_JOB_CANCELLED")
+
+	if err := vm.q.BlockStream(device, ""); err != nil {
+		cancel()
+		return err
+	}
+
+	vm.Tags["stream-"+device] = "0%"
+
+	go vm.streamProgress(d, device, events, cancel)
+
+	return nil
+}
+
+// streamProgress tracks an in-flight block-stream job, updating the VM's
+// tags with progress and marking the overlay standalone on completion.
+func (vm *KvmVM) streamProgress(d *DiskConfig, device string, events <-chan qmp.Event, cancel func()) {
+	defer cancel()
+
+	tick := time.NewTicker(time.Second)
+	defer tick.Stop()
+
+	for {
+		select {
+		case e, ok := <-events:
+			if !ok {
+				// QMP connection went away, the VM is gone
+				return
+			}
+			if e.Data["device"] != device {
+				continue
+			}
+
+			vm.lock.Lock()
+
+			switch e.Name {
+			case "BLOCK_JOB_COMPLETED":
+				if v, ok := e.Data["error"]; ok {
+					vm.Tags["stream-"+device] = fmt.Sprintf("error: %v", v)
+				} else {
+					delete(vm.Tags, "stream-"+device)
+
+					// overlay no longer depends on its backing image
+					d.Standalone = true
+					log.Info("block stream complete for vm %v device %v", vm.Name, device)
+				}
+			case "BLOCK_JOB_CANCELLED":
+				delete(vm.Tags, "stream-"+device)
+			case "BLOCK_JOB_ERROR":
+				log.Warn("block stream error for vm %v device %v: %v", vm.Name, device, e.Data)
+
+				vm.lock.Unlock()
+				continue
+			}
+
+			vm.lock.Unlock()
+			return
+		case <-tick.C:
+			vm.lock.Lock()
+
+			if jobs, err := vm.q.QueryBlockJobs(); err == nil {
+				for _, job := range jobs {
+					j, ok := job.(map[string]interface{})
+					if !ok || j["device"] != device {
+						continue
+					}
+
+					length, _ := j["len"].(float64)
+					offset, _ := j["offset"].(float64)
+					if length > 0 {
+						vm.Tags["stream-"+device] = fmt.Sprintf("%.0f%%", offset/length*100)
+					}
+				}
+			}
+
+			vm.lock.Unlock()
+		}
+	}
+}
+
+// CancelDiskJob cancels an active block job on the given disk.
+func (vm *KvmVM) CancelDiskJob(d *DiskConfig) error {
+	vm.lock.Lock()
+	defer vm.lock.Unlock()
+
+	device, err := vm.diskDevice(*d)
+	if err != nil {
+		return err
+	}
+
+	return vm.q.BlockJobCancel(device)
+}
+
+// BlockStats returns per-device I/O statistics as reported by QEMU.
+func (vm *KvmVM) BlockStats() ([]qmp.BlockStats, error) {
+	vm.lock.Lock()
+	defer vm.lock.Unlock()
+
+	return vm.q.QueryBlockstats()
+}
+
 func (vm *KvmVM) ProcStats() (map[int]*ProcStats, error) {
 	p, err := GetProcStats(vm.Pid)
 	if err != nil {
@@ -1222,8 +1986,14 @@ func (vm VMConfig) qemuArgs(id int, vmPath string) []string {
 				args = append(args, "ahci,id=ahci")
 			}
 
+			// `ide-drive` was removed in QEMU 4.0 in favor of `ide-hd`
+			ideDevice := "ide-drive"
+			if ok, err := qemu.VersionAtLeast(vm.QemuPath, 4, 0); err == nil && ok {
+				ideDevice = "ide-hd"
+			}
+
 			args = append(args, "-device")
-			args = append(args, fmt.Sprintf("ide-drive,drive=ahci-drive-%v,bus=ahci.%v", ahciBusSlot, ahciBusSlot))
+			args = append(args, fmt.Sprintf("%v,drive=ahci-drive-%v,bus=ahci.%v", ideDevice, ahciBusSlot, ahciBusSlot))
 
 			driveParams = fmt.Sprintf("id=ahci-drive-%v,file=%v,media=disk,if=none", ahciBusSlot, path)
 
@@ -1274,8 +2044,15 @@ func (vm VMConfig) qemuArgs(id int, vmPath string) []string {
 	for _, net := range vm.Networks {
 		args = append(args, "-netdev")
 		args = append(args, fmt.Sprintf("tap,id=%v,script=no,ifname=%v", net.Tap, net.Tap))
+
+		device := fmt.Sprintf("driver=%v,netdev=%v,mac=%v,bus=pci.%v,addr=0x%x", net.Driver, net.Tap, net.MAC, bus, addr)
+		// virtio can advertise the MTU to the guest
+		if net.MTU != 0 && strings.HasPrefix(net.Driver, "virtio-net") {
+			device += fmt.Sprintf(",host_mtu=%v", net.MTU)
+		}
+
 		args = append(args, "-device")
-		args = append(args, fmt.Sprintf("driver=%v,netdev=%v,mac=%v,bus=pci.%v,addr=0x%x", net.Driver, net.Tap, net.MAC, bus, addr))
+		args = append(args, device)
 		addr++
 		if addr == DEV_PER_BUS {
 			addBus()
@@ -1308,18 +2085,7 @@ func (vm VMConfig) qemuArgs(id int, vmPath string) []string {
 	}
 
 	if vm.VirtioPorts != "" {
-		names := []string{}
-
-		v, err := strconv.ParseUint(vm.VirtioPorts, 10, 64)
-		if err == nil {
-			// if the VirtioPorts is an int, assume they want automatically generated names
-			for i := uint64(0); i < v; i++ {
-				names = append(names, "virtio-serial"+strconv.FormatUint(i, 10))
-			}
-		} else {
-			// otherwise, assume they specified a list of names
-			names = strings.Split(vm.VirtioPorts, ",")
-		}
+		names := vm.virtioPortNames()
 
 		for i, name := range names {
 			if name == "cc" && vm.Backchannel {
@@ -1339,6 +2105,12 @@ func (vm VMConfig) qemuArgs(id int, vmPath string) []string {
 		}
 	}
 
+	// vhost-vsock for host-guest communication
+	if vm.vsockCID != 0 {
+		args = append(args, "-device")
+		args = append(args, fmt.Sprintf("vhost-vsock-pci,guest-cid=%v", vm.vsockCID))
+	}
+
 	// hook for hugepage support
 	if vm.hugepagesMountPath != "" {
 		args = append(args, "-mem-info")
@@ -1356,6 +2128,31 @@ func (vm VMConfig) qemuArgs(id int, vmPath string) []string {
 	return args
 }
 
+// virtioPortNames expands the VirtioPorts config into the list of named ports
+// that will be created at launch. If VirtioPorts is an integer, names are
+// generated automatically; otherwise, it is treated as a comma-separated list
+// of names.
+func (vm VMConfig) virtioPortNames() []string {
+	if vm.VirtioPorts == "" {
+		return nil
+	}
+
+	names := []string{}
+
+	v, err := strconv.ParseUint(vm.VirtioPorts, 10, 64)
+	if err == nil {
+		// if the VirtioPorts is an int, assume they want automatically generated names
+		for i := uint64(0); i < v; i++ {
+			names = append(names, "virtio-serial"+strconv.FormatUint(i, 10))
+		}
+	} else {
+		// otherwise, assume they specified a list of names
+		names = strings.Split(vm.VirtioPorts, ",")
+	}
+
+	return names
+}
+
 func (vm VMConfig) qemuOverrideString() string {
 	// create output
 	var o bytes.Buffer
@@ -1396,13 +2193,95 @@ func (c QemuOverrides) WriteConfig(w io.Writer) error {
 	return nil
 }
 
-// log any asynchronous messages, such as vnc connects, to log.Info
-func (vm KvmVM) qmpLogger() {
+// qmpDispatcher logs any asynchronous messages, such as vnc connects, records
+// them in the VM's ring buffer for `vm events`, and applies any state changes
+// that they imply to the VM. waitChan is closed when the qemu process exits --
+// once that happens we stop applying transitions since the goroutine reaping
+// the process owns the final state.
+func (vm *KvmVM) qmpDispatcher(waitChan <-chan bool) {
 	for v := vm.q.Message(); v != nil; v = vm.q.Message() {
 		log.Info("VM %v received asynchronous message: %v", vm.ID, v)
+
+		event, _ := v["event"].(string)
+		if event == "" {
+			continue
+		}
+
+		select {
+		case <-waitChan:
+			// the process has already exited so the state machine has
+			// settled -- drop any events still in flight rather than
+			// transitioning a dead VM
+			continue
+		default:
+		}
+
+		vm.lock.Lock()
+
+		vm.recordEvent(event, v["data"])
+
+		var reset bool
+
+		switch event {
+		case "STOP":
+			if vm.State == VM_RUNNING {
+				vm.setState(VM_PAUSED)
+			}
+		case "RESUME":
+			if vm.State == VM_PAUSED {
+				vm.setState(VM_RUNNING)
+			}
+		case "RESET":
+			// the guest rebooted -- handled below, once the vm is unlocked
+			reset = vm.Backchannel
+		case "SHUTDOWN":
+			// a guest-initiated shutdown is followed by the qemu process
+			// exiting which transitions the VM to VM_QUIT, so don't
+			// transition here to avoid doing so twice.
+		case "BLOCK_IO_ERROR":
+			vm.Tags["block-io-error"] = marshal(v["data"])
+			if *f_vmErrorOnIOError && vm.State != VM_ERROR {
+				vm.setErrorf("block I/O error: %v", vm.Tags["block-io-error"])
+			}
+		}
+
+		vm.lock.Unlock()
+
+		if reset {
+			// the serial backchannel doesn't see a disconnect when the guest
+			// reboots, so close the stale connection and let ron redial
+			ns := GetOrCreateNamespace(vm.GetNamespace())
+			ns.ccServer.DisconnectSerial(vm.path("cc"))
+		}
 	}
 }
 
+// recordEvent appends an asynchronous QMP event to the VM's ring buffer,
+// dropping the oldest event once the buffer is full. Assumes that the caller
+// has locked the vm.
+func (vm *KvmVM) recordEvent(event string, data interface{}) {
+	e := qmpEvent{Time: time.Now(), Event: event}
+	if data != nil {
+		e.Data = marshal(data)
+	}
+
+	if len(vm.qmpEvents) >= QMP_EVENT_BUFFER {
+		vm.qmpEvents = vm.qmpEvents[1:]
+	}
+	vm.qmpEvents = append(vm.qmpEvents, e)
+}
+
+// Events returns a copy of the VM's ring buffer of asynchronous QMP events.
+func (vm *KvmVM) Events() []qmpEvent {
+	vm.lock.Lock()
+	defer vm.lock.Unlock()
+
+	res := make([]qmpEvent, len(vm.qmpEvents))
+	copy(res, vm.qmpEvents)
+
+	return res
+}
+
 func validCPU(vmConfig VMConfig, cpu string) error {
 	cpus, err := qemu.CPUs(vmConfig.QemuPath, vmConfig.Machine)
 	if err != nil {
@@ -1416,6 +2295,29 @@ func validCPU(vmConfig VMConfig, cpu string) error {
 	return nil
 }
 
+func validVsockCID(vmConfig VMConfig, cid string) error {
+	if cid == "" || cid == "auto" {
+		return nil
+	}
+
+	v, err := strconv.ParseUint(cid, 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid vsock CID: `%v`", cid)
+	}
+
+	// CIDs 0-2 are reserved by the vsock address family
+	if v < 3 {
+		return fmt.Errorf("invalid vsock CID: `%v`, must be 3 or higher", cid)
+	}
+
+	// vhost-vsock landed in QEMU 2.8 -- warn now rather than failing at launch
+	if ok, err := qemu.VersionAtLeast(vmConfig.QemuPath, 2, 8); err == nil && !ok {
+		log.Warn("vsock requires QEMU 2.8 or later, %v is older", vmConfig.QemuPath)
+	}
+
+	return nil
+}
+
 func validMachine(vmConfig VMConfig, machine string) error {
 	machines, err := qemu.Machines(vmConfig.QemuPath)
 	if err != nil {
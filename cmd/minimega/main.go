@@ -35,22 +35,33 @@ const (
 )
 
 var (
-	f_base        = flag.String("base", BASE_PATH, "base path for minimega data")
-	f_degree      = flag.Uint("degree", 0, "meshage starting degree")
-	f_msaTimeout  = flag.Uint("msa", 10, "meshage MSA timeout")
-	f_broadcastIP = flag.String("broadcast", "255.255.255.255", "meshage broadcast address to use")
-	f_port        = flag.Int("port", 9000, "meshage port to listen on")
-	f_force       = flag.Bool("force", false, "force minimega to run even if it appears to already be running")
-	f_nostdin     = flag.Bool("nostdin", false, "disable reading from stdin, useful for putting minimega in the background")
-	f_version     = flag.Bool("version", false, "print the version and copyright notices")
-	f_context     = flag.String("context", "minimega", "meshage context for discovery")
-	f_iomBase     = flag.String("filepath", IOM_PATH, "directory to serve files from")
-	f_cli         = flag.Bool("cli", false, "validate and print the minimega cli, in JSON, to stdout and exit")
-	f_panic       = flag.Bool("panic", false, "panic on quit, producing stack traces for debugging")
-	f_cgroup      = flag.String("cgroup", "/sys/fs/cgroup", "path to cgroup mount")
-	f_pipe        = flag.String("pipe", "", "read/write to or from a named pipe")
-	f_headnode    = flag.String("headnode", "", "mesh node to send all logs to and get all files from")
-	f_hashfiles   = flag.Bool("hashfiles", false, "hash files to be served by iomeshage")
+	f_base         = flag.String("base", BASE_PATH, "base path for minimega data")
+	f_degree       = flag.Uint("degree", 0, "meshage starting degree")
+	f_msaTimeout   = flag.Uint("msa", 10, "meshage MSA timeout")
+	f_broadcastIP  = flag.String("broadcast", "255.255.255.255", "meshage broadcast address to use")
+	f_port         = flag.Int("port", 9000, "meshage port to listen on")
+	f_force        = flag.Bool("force", false, "force minimega to run even if it appears to already be running")
+	f_nostdin      = flag.Bool("nostdin", false, "disable reading from stdin, useful for putting minimega in the background")
+	f_version      = flag.Bool("version", false, "print the version and copyright notices")
+	f_context      = flag.String("context", "minimega", "meshage context for discovery")
+	f_iomBase      = flag.String("filepath", IOM_PATH, "directory to serve files from")
+	f_cli          = flag.Bool("cli", false, "validate and print the minimega cli, in JSON, to stdout and exit")
+	f_panic        = flag.Bool("panic", false, "panic on quit, producing stack traces for debugging")
+	f_cgroup       = flag.String("cgroup", "/sys/fs/cgroup", "path to cgroup mount")
+	f_pipe         = flag.String("pipe", "", "read/write to or from a named pipe")
+	f_headnode     = flag.String("headnode", "", "mesh node to send all logs to and get all files from")
+	f_hashfiles    = flag.Bool("hashfiles", false, "hash files to be served by iomeshage")
+	f_partfetch    = flag.Int("partfetchers", 3, "number of file parts to fetch concurrently per transfer")
+	f_fileMaxAge   = flag.Duration("filemaxage", 0, "prune mesh-fetched files unused for this long, 0 to disable")
+	f_fileMinFree  = flag.Uint64("fileminfree", 0, "prune least recently used mesh-fetched files when free space in the files directory drops below this many bytes, 0 to disable")
+	f_partSize     = flag.Int64("filepart-size", 10485760, "size in bytes of the file parts served by iomeshage")
+	f_fileTimeout  = flag.Duration("filetimeout", 30*time.Second, "timeout for a single iomeshage message exchange")
+	f_fetchTimeout = flag.Duration("fetchtimeout", 0, "overall deadline for a single file fetch, 0 to disable")
+	f_transfers    = flag.Int("transferlimit", 3, "maximum concurrent file transfers, resizable at runtime with \"file transfer-limit\"")
+	f_diskTimeout  = flag.Duration("disktimeout", 2*time.Minute, "timeout for external commands run during disk operations")
+	f_chainDepth   = flag.Int("chaindepth", 8, "warn when snapshotting an image whose backing chain is at least this deep, 0 to disable")
+
+	f_vmErrorOnIOError = flag.Bool("vmerroronioerror", false, "move VMs to the error state when a QMP BLOCK_IO_ERROR event is received")
 
 	f_e         = flag.Bool("e", false, "execute command on running minimega")
 	f_attach    = flag.Bool("attach", false, "attach the minimega command line to a running instance of minimega")
@@ -317,6 +328,7 @@ func teardown() {
 	DestroyNamespace(Wildcard)
 
 	// clean-up non-namespace things
+	diskUnmountAll()
 	dnsmasqKillAll()
 	ksmDisable()
 	containerTeardown()
@@ -19,6 +19,7 @@ import (
 	"strings"
 	"time"
 
+	"github.com/sandia-minimega/minimega/v2/internal/qemu"
 	"github.com/sandia-minimega/minimega/v2/internal/version"
 	"github.com/sandia-minimega/minimega/v2/pkg/minicli"
 	log "github.com/sandia-minimega/minimega/v2/pkg/minilog"
@@ -130,6 +131,19 @@ With arguments, debug writes files that can be read using "go tool pprof":
 		},
 		Call: wrapSimpleCLI(cliEcho),
 	},
+	{ // clear qemu-cache
+		HelpShort: "clear cached QEMU capabilities",
+		HelpLong: `
+minimega caches the CPUs, machines, and NIC drivers supported by each QEMU
+binary so that validation and tab completion don't fork the binary on every
+call. The cache is invalidated automatically when the binary's modification
+time changes; use "clear qemu-cache" to force a re-probe, for example after
+swapping a binary in place without changing its mtime.`,
+		Patterns: []string{
+			"clear qemu-cache",
+		},
+		Call: wrapSimpleCLI(cliClearQemuCache),
+	},
 	{ // clear all
 		HelpShort: "reset all resettable ",
 		HelpLong: `
@@ -374,10 +388,16 @@ func cliEcho(ns *Namespace, c *minicli.Command, resp *minicli.Response) error {
 	return nil
 }
 
+func cliClearQemuCache(ns *Namespace, c *minicli.Command, resp *minicli.Response) error {
+	qemu.ClearCache()
+	return nil
+}
+
 func cliClearAll(ns *Namespace, c *minicli.Command, resp *minicli.Response) error {
 	all := []string{
 		// clear non-namespaced things (except history)
 		"clear deploy flags",
+		"clear qemu-cache",
 		"dnsmasq kill all",
 		// clear all namespaced things
 		"clear namespace all",
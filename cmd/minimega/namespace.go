@@ -75,6 +75,11 @@ type Namespace struct {
 	// QueuedVMs toggles whether we should queue VMs or not when launching
 	QueueVMs bool
 
+	// vncMin and vncMax restrict the ports the vnc shim listens on for this
+	// namespace's VMs so external firewall rules can be written once; zero
+	// means ephemeral ports (see "ns vnc-range")
+	vncMin, vncMax int
+
 	vmConfig      VMConfig
 	savedVMConfig map[string]VMConfig
 
@@ -86,9 +91,22 @@ type Namespace struct {
 	*vnc.Player   // embed vnc player for this namespace
 
 	// Command and control for this namespace
-	ccServer *ron.Server
-	ccFilter *ron.Filter
-	ccPrefix string
+	ccServer  *ron.Server
+	ccFilter  *ron.Filter
+	ccPrefix  string
+	ccEnv     map[string]string
+	ccTimeout time.Duration
+
+	// limits for file retrieval with "cc recv"; zero uses the client
+	// defaults
+	ccRecvMaxFiles int
+	ccRecvMaxBytes int64
+
+	// schedule applied to subsequently queued commands, see "cc schedule"
+	ccAfter    time.Duration
+	ccAt       time.Time
+	ccInterval time.Duration
+	ccCount    int
 
 	ccMounts map[string]ccMount
 
@@ -151,6 +169,7 @@ func NewNamespace(name string) *Namespace {
 		if err != nil {
 			log.Fatal("creating cc node %v", err)
 		}
+		ccServer.StaleHandler = ccStaleHandler
 		ns.ccServer = ccServer
 
 		return ns
@@ -160,6 +179,7 @@ func NewNamespace(name string) *Namespace {
 	if err != nil {
 		log.Fatal("creating cc node %v", err)
 	}
+	ccServer.StaleHandler = ccStaleHandler
 	ns.ccServer = ccServer
 
 	// By default, every mesh-reachable node is part of the namespace
@@ -528,11 +548,26 @@ func (n *Namespace) Launch(requestor string, q *QueuedVMs) []error {
 	return errs
 }
 
-// NewCommand takes a command, adds the current filter and prefix, and then
-// sends the command to ron.
+// NewCommand takes a command, adds the current filter, prefix, and
+// environment, and then sends the command to ron.
 func (ns *Namespace) NewCommand(c *ron.Command) int {
 	c.Filter = ns.ccFilter
 	c.Prefix = ns.ccPrefix
+	c.Timeout = ns.ccTimeout
+	c.RecvMaxFiles = ns.ccRecvMaxFiles
+	c.RecvMaxBytes = ns.ccRecvMaxBytes
+	c.After = ns.ccAfter
+	c.At = ns.ccAt
+	c.Interval = ns.ccInterval
+	c.Count = ns.ccCount
+
+	// record the environment in effect when the command was queued
+	if len(ns.ccEnv) > 0 {
+		c.Env = make(map[string]string)
+		for k, v := range ns.ccEnv {
+			c.Env[k] = v
+		}
+	}
 
 	id := ns.ccServer.NewCommand(c)
 	log.Debug("generated command %v: %v", id, c)
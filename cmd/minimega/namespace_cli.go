@@ -59,6 +59,9 @@ Display or modify the active namespace.
 - queue     : display VM queue
 - flush     : clear the VM queue
 - queueing  : toggle VMs queueing when launching (default false)
+- vnc-range : display or restrict vnc ports for new VMs to a fixed range
+  (e.g. "5900-5999") so firewall rules can be written once, "none" to unset;
+  busy ports are skipped within the range
 - schedule  : run scheduler (same as "vm launch")
   - dry-run : determine VM placement and print out VM -> host assignments
   - dump    : print out VM -> host assignments (after dry-run)
@@ -80,6 +83,7 @@ Display or modify the active namespace.
 			"ns <queue,>",
 			"ns <flush,>",
 			"ns <queueing,> [true,false]",
+			"ns <vnc-range,> [range]",
 			"ns <schedule,>",
 			"ns <schedule,> <dry-run,>",
 			"ns <schedule,> <dump,>",
@@ -129,6 +133,7 @@ var nsCliHandlers = map[string]minicli.CLIFunc{
 	"load":       wrapSimpleCLI(cliNamespaceLoad),
 	"queue":      wrapSimpleCLI(cliNamespaceQueue),
 	"queueing":   wrapSimpleCLI(cliNamespaceQueueing),
+	"vnc-range":  wrapSimpleCLI(cliNamespaceVNCRange),
 	"flush":      wrapSimpleCLI(cliNamespaceFlush),
 	"schedule":   wrapSimpleCLI(cliNamespaceSchedule),
 	"bridge":     wrapSimpleCLI(cliNamespaceBridge),
@@ -337,6 +342,36 @@ func cliNamespaceQueueing(ns *Namespace, c *minicli.Command, resp *minicli.Respo
 	return nil
 }
 
+func cliNamespaceVNCRange(ns *Namespace, c *minicli.Command, resp *minicli.Response) error {
+	r, ok := c.StringArgs["range"]
+	if !ok {
+		if ns.vncMin != 0 {
+			resp.Response = fmt.Sprintf("%v-%v", ns.vncMin, ns.vncMax)
+		}
+
+		return nil
+	}
+
+	if r == "none" {
+		ns.vncMin, ns.vncMax = 0, 0
+
+		return nil
+	}
+
+	var min, max int
+	if _, err := fmt.Sscanf(r, "%d-%d", &min, &max); err != nil || min <= 0 || max < min || max > 65535 {
+		return fmt.Errorf("invalid vnc port range: `%v` (expected min-max)", r)
+	}
+
+	ns.vncMin, ns.vncMax = min, max
+
+	if ns.VMs.Count() > 0 {
+		log.Warn("vnc range only applies to VMs launched after it is set")
+	}
+
+	return nil
+}
+
 func cliNamespaceFlush(ns *Namespace, c *minicli.Command, resp *minicli.Response) error {
 	ns.queue = nil
 	return nil
@@ -9,6 +9,7 @@ import (
 	"fmt"
 	"io"
 	"net"
+	"strconv"
 	"strings"
 
 	log "github.com/sandia-minimega/minimega/v2/pkg/minilog"
@@ -35,6 +36,7 @@ type NetConfig struct {
 	Tap    string
 	MAC    string
 	Driver string
+	MTU    int
 	IP4    string
 	IP6    string
 	QinQ   bool
@@ -90,7 +92,7 @@ func NewVMConfig() VMConfig {
 // VLAN alias must be resolved using the active namespace. This takes a bit of
 // parsing, because the entry can be in a few forms:
 //
-// 	vlan alias
+//	vlan alias
 //
 //	bridge,vlan alias
 //	vlan alias,mac
@@ -111,11 +113,33 @@ func NewVMConfig() VMConfig {
 //
 //	bridge,vlan alias,mac,driver,qinq
 //
+// Additionally, an mtu=<MTU> field may appear anywhere in the spec to set the
+// MTU for the interface.
+//
 // If there are 2 or 3 fields, just the last field for the presence of a mac
 func ParseNetConfig(spec string, nics map[string]bool) (*NetConfig, error) {
 	// example: my_bridge,100,00:00:00:00:00:00
 	f := strings.Split(spec, ",")
 
+	// pull out any mtu=<MTU> field first so that the positional parsing below
+	// doesn't have to consider it
+	var mtu int
+
+	fields := []string{}
+	for _, v := range f {
+		if strings.HasPrefix(v, "mtu=") {
+			i, err := strconv.Atoi(strings.TrimPrefix(v, "mtu="))
+			if err != nil || i <= 0 {
+				return nil, fmt.Errorf("invalid MTU: `%v`", v)
+			}
+			mtu = i
+			continue
+		}
+
+		fields = append(fields, v)
+	}
+	f = fields
+
 	isDriver := func(d string) bool {
 		return nics[d]
 	}
@@ -207,6 +231,7 @@ func ParseNetConfig(spec string, nics map[string]bool) (*NetConfig, error) {
 		Bridge: b,
 		MAC:    strings.ToLower(m),
 		Driver: d,
+		MTU:    mtu,
 		QinQ:   q,
 	}, nil
 }
@@ -230,6 +255,10 @@ func (c NetConfig) String() string {
 		parts = append(parts, c.Driver)
 	}
 
+	if c.MTU != 0 {
+		parts = append(parts, fmt.Sprintf("mtu=%v", c.MTU))
+	}
+
 	if c.QinQ {
 		parts = append(parts, "qinq")
 	}
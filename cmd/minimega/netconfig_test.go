@@ -24,6 +24,10 @@ func TestParseNetConfig(t *testing.T) {
 		"my_bridge,foo,virtio-net-pci",
 		"my_bridge,foo,de:ad:be:ef:ca:fe",
 		"my_bridge,foo,de:ad:be:ef:ca:fe,virtio-net-pci",
+
+		"foo,mtu=9000",
+		"foo,virtio-net-pci,mtu=9000",
+		"my_bridge,foo,de:ad:be:ef:ca:fe,virtio-net-pci,mtu=9000",
 	}
 
 	for _, s := range examples {
@@ -143,7 +143,9 @@ var vmInfo = []string{
 	"memory",
 	// kvm fields
 	"vcpus", "disks", "snapshot", "initrd", "kernel", "cdrom", "migrate",
-	"append", "serial-ports", "virtio-ports", "vnc_port",
+	"append", "serial-ports", "virtio-ports", "vsock-cid", "qemu_version",
+	"qemu_status",
+	"vnc_port",
 	// container fields
 	"filesystem", "hostname", "init", "preinit", "fifo", "volume",
 	"console_port",
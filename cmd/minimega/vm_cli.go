@@ -17,6 +17,7 @@ import (
 	"sync"
 	"time"
 
+	"github.com/sandia-minimega/minimega/v2/internal/qmp"
 	"github.com/sandia-minimega/minimega/v2/pkg/minicli"
 	log "github.com/sandia-minimega/minimega/v2/pkg/minilog"
 )
@@ -61,6 +62,9 @@ Additional fields are available for KVM-based VMs:
 - pid           : pid of qemu process
 - serial        : number of serial ports
 - virtio-serial : number of virtio ports
+- vsock-cid     : guest CID for the vhost-vsock device
+- qemu_version  : version of the QEMU binary the VM was launched with
+- qemu_status   : run state as reported by QEMU, for comparison with state
 - vnc_port      : port for VNC shim
 
 Additional fields are available for container-based VMs:
@@ -238,6 +242,33 @@ See "vm start" for a full description of allowable targets.`,
 		Call:    wrapVMTargetCLI(cliVMHotplug),
 		Suggest: wrapVMSuggest(VM_ANY_STATE, true),
 	},
+	{ // vm virtio-port
+		HelpShort: "add and remove virtio-serial ports",
+		HelpLong: `
+Add and remove named virtio-serial ports on a launched VM. Ports added at
+launch with "vm config virtio-ports" require a reboot to change -- this
+command hot-adds a new port over QMP instead. The port is backed by a unix
+socket in the VM's instance directory named after the port and shows up in the
+guest as /dev/virtio-port/<name>. For example, to add a port named foo to VM
+bar:
+
+	vm virtio-port add bar foo
+
+To remove the port again:
+
+	vm virtio-port remove bar foo
+
+Port names must be unique per VM and must not collide with the "cc"
+backchannel. Hot-added ports do not survive a VM relaunch.
+
+See "vm start" for a full description of allowable targets.`,
+		Patterns: []string{
+			"vm virtio-port <add,> <vm target> <name>",
+			"vm virtio-port <remove,> <vm target> <name>",
+		},
+		Call:    wrapVMTargetCLI(cliVMVirtioPort),
+		Suggest: wrapVMSuggest(VM_ANY_STATE, true),
+	},
 	{ // vm net
 		HelpShort: "add, disconnect, or move network connections",
 		HelpLong: `
@@ -316,6 +347,49 @@ option.`,
 			return nil
 		}),
 	},
+	{ // vm events
+		HelpShort: "display recent QMP events for VMs",
+		HelpLong: `
+Display recent asynchronous QMP events for one or more KVM-based VMs, such as
+SHUTDOWN, RESET, STOP, RESUME, WATCHDOG, and BLOCK_IO_ERROR. minimega records
+the most recent events per VM in a ring buffer so that users can see what the
+guest did and when. For example, to see events for a VM named foo:
+
+	vm events foo
+
+See "vm start" for a full description of allowable targets.`,
+		Patterns: []string{
+			"vm events <vm target>",
+		},
+		Call:    wrapVMTargetCLI(cliVMEvents),
+		Suggest: wrapVMSuggest(VM_ANY_STATE, true),
+	},
+	{ // vm wait
+		HelpShort: "wait for VMs to become ready",
+		HelpLong: `
+Block until the targeted VMs reach a readiness signal, or until the optional
+timeout (default 5m) expires. Three signals are supported:
+
+- cc  : the VM's miniccc client has checked in with the cc server
+- arp : one of the VM's MACs has been seen in ARP or Neighbor Discovery
+  traffic on its bridge
+- qga : the qemu guest agent responds to a ping. This requires a virtio-serial
+  port named org.qemu.guest_agent.0 (see "vm config virtio-ports") and only
+  applies to KVM-based VMs.
+
+vm wait returns a table showing which VMs became ready, how long they took,
+and which timed out. For example, to wait up to one minute for all VMs to
+check in with cc:
+
+	vm wait cc all 1m
+
+See "vm start" for a full description of allowable targets.`,
+		Patterns: []string{
+			"vm wait <cc,arp,qga> <vm target> [timeout]",
+		},
+		Call:    wrapVMTargetCLI(cliVMWait),
+		Suggest: wrapVMSuggest(VM_ANY_STATE, true),
+	},
 	{ // vm qmp
 		HelpShort: "issue a JSON-encoded QMP command",
 		HelpLong: `
@@ -331,6 +405,50 @@ and a JSON string, and returns the JSON encoded response. For example:
 		Call:    wrapVMTargetCLI(cliVMQmp),
 		Suggest: wrapVMSuggest(VM_ANY_STATE, false),
 	},
+	{ // vm hmp
+		HelpShort: "issue a human monitor (HMP) command",
+		HelpLong: `
+Issue a human monitor (HMP) command to a VM. This exposes monitor
+functionality that has no QMP equivalent, such as "info registers" and the
+sendkey variants. The human-readable response is returned directly, including
+any newlines. For example:
+
+	vm hmp 0 "info status"
+	VM status: running
+
+Commands that would change or destroy state behind minimega's back, such as
+quit, are rejected unless the force variant is used:
+
+	vm hmp force 0 quit`,
+		Patterns: []string{
+			"vm hmp <vm name> <hmp command>",
+			"vm hmp <force,> <vm name> <hmp command>",
+		},
+		Call:    wrapVMTargetCLI(cliVMHmp),
+		Suggest: wrapVMSuggest(VM_ANY_STATE, false),
+	},
+	{ // vm qom
+		HelpShort: "inspect or modify QOM properties of a VM",
+		HelpLong: `
+List, read, or write QEMU Object Model (QOM) properties of a running VM. This
+is useful when debugging device problems. For example, to list the properties
+of a device and then read one of them:
+
+	vm qom 0 list /machine/peripheral/foo
+	vm qom 0 get /machine/peripheral/foo mac
+
+Values for set are decoded as JSON so that bools and integers round-trip
+sensibly, anything that doesn't parse as JSON is sent as a plain string:
+
+	vm qom 0 set /machine/peripheral/foo mac "de:ad:be:ef:ca:fe"`,
+		Patterns: []string{
+			"vm qom <vm name> <list,> <path>",
+			"vm qom <vm name> <get,> <path> <property>",
+			"vm qom <vm name> <set,> <path> <property> <value>",
+		},
+		Call:    wrapVMTargetCLI(cliVMQom),
+		Suggest: wrapVMSuggest(VM_ANY_STATE, false),
+	},
 	{ // vm screenshot
 		HelpShort: "take a screenshot of a running vm",
 		HelpLong: `
@@ -382,10 +500,19 @@ migrate.
 
 Migration files are written to the files directory as specified with -filepath.
 On success, a call to migrate a VM will return immediately. You can check the
-status of in-flight migrations by invoking vm migrate with no arguments.`,
+status of in-flight migrations by invoking vm migrate with no arguments.
+
+Transfer settings can be tuned with trailing options, applied before the
+migration starts. Capabilities are bare names, parameters take a value:
+
+        vm migrate foo foo.migrate compress auto-converge multifd=4 bandwidth=500M downtime=300ms
+
+Capabilities that this QEMU doesn't support are skipped with a warning. The
+status output includes the enabled capabilities so that you can see whether
+compression or multifd is actually active.`,
 		Patterns: []string{
 			"vm migrate",
-			"vm migrate <vm name> <filename>",
+			"vm migrate <vm name> <filename> [option]...",
 		},
 		Call:    wrapVMTargetCLI(cliVMMigrate),
 		Suggest: wrapVMSuggest(VM_ANY_STATE, false),
@@ -422,6 +549,53 @@ See "vm start" for a full description of allowable targets.`,
 		Call:    wrapVMTargetCLI(cliVMCdrom),
 		Suggest: wrapVMSuggest(VM_ANY_STATE, true),
 	},
+	{ // vm cpu
+		HelpShort: "display vCPU information for a VM",
+		HelpLong: `
+Display guest vCPU information for running KVM VMs, one row per vCPU,
+including the host thread ID backing the vCPU, its topology properties, and
+the host CPU usage of the backing thread over a one second window:
+
+        vm cpu info 0
+
+See "vm start" for a full description of allowable targets.`,
+		Patterns: []string{
+			"vm cpu <info,> <vm target>",
+		},
+		Call:    wrapVMTargetCLI(cliVMCPUInfo),
+		Suggest: wrapVMSuggest(VM_ANY_STATE, true),
+	},
+	{ // vm disk
+		HelpShort: "display disk statistics or manage disk jobs for a VM",
+		HelpLong: `
+Display disk I/O statistics or manage block jobs for running KVM VMs.
+
+"vm disk stats" prints one row per block device, as reported by QEMU:
+
+        vm disk stats 0
+
+"vm disk stream" starts pulling data from a disk's backing image into the
+per-instance overlay so that subsequent reads are local. This is useful when
+the backing image lives on slow shared storage. Progress is reported via the
+VM's tags and, on completion, the overlay no longer depends on the backing
+image. The disk may be given as an index or a path and may be omitted if the
+VM has exactly one disk:
+
+        vm disk stream foo 0
+
+An in-flight job can be cancelled:
+
+        vm disk cancel foo 0
+
+See "vm start" for a full description of allowable targets.`,
+		Patterns: []string{
+			"vm disk <stats,> <vm target>",
+			"vm disk <stream,> <vm name> [disk]",
+			"vm disk <cancel,> <vm name> [disk]",
+		},
+		Call:    wrapVMTargetCLI(cliVMDisk),
+		Suggest: wrapVMSuggest(VM_ANY_STATE, true),
+	},
 	{ // vm tag
 		HelpShort: "display or set a tag for the specified VM",
 		HelpLong: `
@@ -585,6 +759,134 @@ func cliVMCdrom(ns *Namespace, c *minicli.Command, resp *minicli.Response) error
 	return unreachable()
 }
 
+func cliVMCPUInfo(ns *Namespace, c *minicli.Command, resp *minicli.Response) error {
+	// collect the target VMs first so that we only sleep once below
+	var vms []*KvmVM
+	var mu sync.Mutex
+
+	err := ns.VMs.Apply(c.StringArgs["vm"], func(vm VM, wild bool) (bool, error) {
+		kvm, ok := vm.(*KvmVM)
+		if !ok {
+			return false, nil
+		}
+
+		mu.Lock()
+		defer mu.Unlock()
+
+		vms = append(vms, kvm)
+		return true, nil
+	})
+	if err != nil {
+		return err
+	}
+
+	type vcpu struct {
+		name string
+		cpu  qmp.CPU
+		a, b *ProcStats
+	}
+
+	var vcpus []*vcpu
+
+	for _, kvm := range vms {
+		cpus, err := kvm.QueryCPUs()
+		if err != nil {
+			return err
+		}
+
+		for _, cpu := range cpus {
+			v := &vcpu{name: kvm.GetName(), cpu: cpu}
+			v.a, _ = GetProcStats(cpu.ThreadID)
+			vcpus = append(vcpus, v)
+		}
+	}
+
+	// second snapshot after a short window so that we can compute the host
+	// CPU usage of each vCPU thread
+	time.Sleep(time.Second)
+
+	resp.Header = []string{"name", "cpu", "thread_id", "halted", "socket", "core", "host_cpu"}
+	resp.Tabular = [][]string{}
+
+	for _, v := range vcpus {
+		v.b, _ = GetProcStats(v.cpu.ThreadID)
+
+		usage := ""
+		if v.a != nil && v.b != nil {
+			usage = fmt.Sprintf("%.2f", ProcCPU(v.a, v.b)*100)
+		}
+
+		resp.Tabular = append(resp.Tabular, []string{
+			v.name,
+			strconv.Itoa(v.cpu.Index),
+			strconv.Itoa(v.cpu.ThreadID),
+			strconv.FormatBool(v.cpu.Halted),
+			strconv.Itoa(v.cpu.Props.SocketID),
+			strconv.Itoa(v.cpu.Props.CoreID),
+			usage,
+		})
+	}
+
+	return nil
+}
+
+func cliVMDisk(ns *Namespace, c *minicli.Command, resp *minicli.Response) error {
+	if c.BoolArgs["stats"] {
+		return cliVMDiskStats(ns, c, resp)
+	}
+
+	vm, err := ns.FindKvmVM(c.StringArgs["vm"])
+	if err != nil {
+		return err
+	}
+
+	disk, err := vm.findDisk(c.StringArgs["disk"])
+	if err != nil {
+		return err
+	}
+
+	if c.BoolArgs["stream"] {
+		return vm.StreamDisk(disk)
+	}
+
+	return vm.CancelDiskJob(disk)
+}
+
+func cliVMDiskStats(ns *Namespace, c *minicli.Command, resp *minicli.Response) error {
+	resp.Header = []string{"name", "device", "rd_bytes", "wr_bytes", "rd_ops", "wr_ops"}
+	resp.Tabular = [][]string{}
+
+	var mu sync.Mutex
+
+	return ns.VMs.Apply(c.StringArgs["vm"], func(vm VM, wild bool) (bool, error) {
+		kvm, ok := vm.(*KvmVM)
+		if !ok {
+			return false, nil
+		}
+
+		stats, err := kvm.BlockStats()
+		if err != nil {
+			return true, err
+		}
+
+		mu.Lock()
+		defer mu.Unlock()
+
+		for _, s := range stats {
+			resp.Tabular = append(resp.Tabular, []string{
+				vm.GetName(),
+				s.Device,
+				strconv.FormatInt(s.Stats.ReadBytes, 10),
+				strconv.FormatInt(s.Stats.WriteBytes, 10),
+				strconv.FormatInt(s.Stats.ReadOps, 10),
+				strconv.FormatInt(s.Stats.WriteOps, 10),
+			})
+		}
+
+		return true, nil
+	})
+}
+
 func cliVMTag(ns *Namespace, c *minicli.Command, resp *minicli.Response) error {
 	target := c.StringArgs["vm"]
 
@@ -723,6 +1025,182 @@ func cliVMLaunch(ns *Namespace, c *minicli.Command, resp *minicli.Response) erro
 	return ns.Schedule(false)
 }
 
+func cliVMVirtioPort(ns *Namespace, c *minicli.Command, resp *minicli.Response) error {
+	target := c.StringArgs["vm"]
+	name := c.StringArgs["name"]
+
+	return ns.VMs.Apply(target, func(vm VM, wild bool) (bool, error) {
+		kvm, ok := vm.(*KvmVM)
+		if !ok {
+			return false, nil
+		}
+
+		if c.BoolArgs["add"] {
+			return true, kvm.AddVirtioPort(name)
+		}
+
+		return true, kvm.RemoveVirtioPort(name)
+	})
+}
+
+func cliVMWait(ns *Namespace, c *minicli.Command, resp *minicli.Response) error {
+	timeout := 5 * time.Minute
+	if v, ok := c.StringArgs["timeout"]; ok {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return fmt.Errorf("invalid timeout: `%v`", v)
+		}
+		timeout = d
+	}
+
+	// collect the targeted VMs under Apply and wait outside of it so that we
+	// don't hold up other VM operations while we block
+	var mu sync.Mutex
+	vms := []VM{}
+
+	err := ns.VMs.Apply(c.StringArgs["vm"], func(vm VM, wild bool) (bool, error) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		vms = append(vms, vm)
+		return true, nil
+	})
+	if err != nil {
+		return err
+	}
+
+	type result struct {
+		name    string
+		err     error
+		elapsed time.Duration
+	}
+
+	start := time.Now()
+	results := make([]result, len(vms))
+
+	var wg sync.WaitGroup
+	for i, vm := range vms {
+		wg.Add(1)
+		go func(i int, vm VM) {
+			defer wg.Done()
+
+			err := waitVMReady(ns, vm, c.BoolArgs, timeout)
+			results[i] = result{vm.GetName(), err, time.Since(start)}
+		}(i, vm)
+	}
+	wg.Wait()
+
+	resp.Header = []string{"name", "ready", "elapsed", "error"}
+	for _, r := range results {
+		var errStr string
+		if r.err != nil {
+			errStr = r.err.Error()
+		}
+
+		resp.Tabular = append(resp.Tabular, []string{
+			r.name,
+			strconv.FormatBool(r.err == nil),
+			r.elapsed.Truncate(time.Millisecond).String(),
+			errStr,
+		})
+	}
+
+	return nil
+}
+
+// waitVMReady blocks until the VM reaches the requested readiness signal or
+// the timeout expires.
+func waitVMReady(ns *Namespace, vm VM, signals map[string]bool, timeout time.Duration) error {
+	switch {
+	case signals["cc"]:
+		select {
+		case <-ns.ccServer.NotifyCheckin(vm.GetUUID()):
+			return nil
+		case <-time.After(timeout):
+			return errors.New("timed out waiting for cc check-in")
+		}
+	case signals["arp"]:
+		networks := vm.GetNetworks()
+		if len(networks) == 0 {
+			return errors.New("vm has no network interfaces")
+		}
+
+		// ready as soon as any of the VM's MACs is seen on its bridge
+		ready := make(chan bool, len(networks))
+
+		for _, nic := range networks {
+			br, err := getBridge(nic.Bridge)
+			if err != nil {
+				return err
+			}
+
+			go func(ch <-chan bool) {
+				<-ch
+				ready <- true
+			}(br.NotifyMAC(nic.MAC))
+		}
+
+		select {
+		case <-ready:
+			return nil
+		case <-time.After(timeout):
+			return errors.New("timed out waiting for MAC on bridge")
+		}
+	case signals["qga"]:
+		kvm, ok := vm.(*KvmVM)
+		if !ok {
+			return errors.New("qga wait only supported for KVM VMs")
+		}
+
+		deadline := time.Now().Add(timeout)
+
+		for {
+			// short per-ping deadline so that we keep retrying while the
+			// guest boots
+			err := kvm.QGAPing(5 * time.Second)
+			if err == nil {
+				return nil
+			}
+
+			if time.Now().After(deadline) {
+				return fmt.Errorf("timed out waiting for guest agent: %v", err)
+			}
+
+			time.Sleep(time.Second)
+		}
+	}
+
+	return errors.New("unreachable")
+}
+
+func cliVMEvents(ns *Namespace, c *minicli.Command, resp *minicli.Response) error {
+	resp.Header = []string{"name", "time", "event", "data"}
+
+	// synchronizes appends to resp.Tabular
+	var mu sync.Mutex
+
+	return ns.VMs.Apply(c.StringArgs["vm"], func(vm VM, wild bool) (bool, error) {
+		kvm, ok := vm.(*KvmVM)
+		if !ok {
+			return false, nil
+		}
+
+		mu.Lock()
+		defer mu.Unlock()
+
+		for _, e := range kvm.Events() {
+			resp.Tabular = append(resp.Tabular, []string{
+				kvm.GetName(),
+				e.Time.Format(time.RFC3339),
+				e.Event,
+				e.Data,
+			})
+		}
+
+		return true, nil
+	})
+}
+
 func cliVMQmp(ns *Namespace, c *minicli.Command, resp *minicli.Response) error {
 	vm, err := ns.FindKvmVM(c.StringArgs["vm"])
 	if err != nil {
@@ -743,6 +1221,86 @@ func cliVMQmp(ns *Namespace, c *minicli.Command, resp *minicli.Response) error {
 	return nil
 }
 
+func cliVMQom(ns *Namespace, c *minicli.Command, resp *minicli.Response) error {
+	vm, err := ns.FindKvmVM(c.StringArgs["vm"])
+	if err != nil {
+		return err
+	}
+
+	path := c.StringArgs["path"]
+
+	switch {
+	case c.BoolArgs["list"]:
+		props, err := vm.QomList(path)
+		if err != nil {
+			return err
+		}
+
+		resp.Header = []string{"name", "type"}
+		resp.Tabular = [][]string{}
+
+		for _, p := range props {
+			resp.Tabular = append(resp.Tabular, []string{p.Name, p.Type})
+		}
+		return nil
+	case c.BoolArgs["get"]:
+		v, err := vm.QomGet(path, c.StringArgs["property"])
+		if err != nil {
+			return err
+		}
+
+		switch v := v.(type) {
+		case string:
+			resp.Response = v
+		case bool, float64:
+			resp.Response = fmt.Sprintf("%v", v)
+		default:
+			b, err := json.Marshal(v)
+			if err != nil {
+				return err
+			}
+			resp.Response = string(b)
+		}
+		return nil
+	case c.BoolArgs["set"]:
+		// decode the value as JSON so that bools and integers round-trip
+		// sensibly, falling back to a plain string
+		var v interface{}
+		if err := json.Unmarshal([]byte(c.StringArgs["value"]), &v); err != nil {
+			v = c.StringArgs["value"]
+		}
+
+		return vm.QomSet(path, c.StringArgs["property"], v)
+	}
+
+	return unreachable()
+}
+
+func cliVMHmp(ns *Namespace, c *minicli.Command, resp *minicli.Response) error {
+	vm, err := ns.FindKvmVM(c.StringArgs["vm"])
+	if err != nil {
+		return err
+	}
+
+	command := c.StringArgs["hmp"]
+
+	// reject commands that change or destroy state behind minimega's back
+	if fields := strings.Fields(command); len(fields) > 0 && !c.BoolArgs["force"] {
+		switch fields[0] {
+		case "quit", "q", "migrate", "loadvm":
+			return fmt.Errorf("`%v` can break minimega's state tracking, use force if you are sure", fields[0])
+		}
+	}
+
+	out, err := vm.HMP(command)
+	if err != nil {
+		return err
+	}
+
+	resp.Response = out
+	return nil
+}
+
 func cliVMScreenshot(ns *Namespace, c *minicli.Command, resp *minicli.Response) error {
 	file := c.StringArgs["filename"]
 
@@ -849,7 +1407,7 @@ func cliVMSnapshot(ns *Namespace, c *minicli.Command, resp *minicli.Response) er
 
 func cliVMMigrate(ns *Namespace, c *minicli.Command, resp *minicli.Response) error {
 	if _, ok := c.StringArgs["vm"]; !ok { // report current migrations
-		resp.Header = []string{"id", "name", "status", "complete (%)"}
+		resp.Header = []string{"id", "name", "status", "complete (%)", "capabilities"}
 
 		for _, vm := range ns.FindKvmVMs() {
 			status, complete, err := vm.QueryMigrate()
@@ -860,11 +1418,17 @@ func cliVMMigrate(ns *Namespace, c *minicli.Command, resp *minicli.Response) err
 				continue
 			}
 
+			caps, err := vm.MigrateCapabilities()
+			if err != nil {
+				return err
+			}
+
 			resp.Tabular = append(resp.Tabular, []string{
 				fmt.Sprintf("%v", vm.GetID()),
 				vm.GetName(),
 				status,
-				fmt.Sprintf("%.2f", complete)})
+				fmt.Sprintf("%.2f", complete),
+				strings.Join(caps, ",")})
 		}
 
 		return nil
@@ -890,6 +1454,12 @@ func cliVMMigrate(ns *Namespace, c *minicli.Command, resp *minicli.Response) err
 		return err
 	}
 
+	if opts := c.ListArgs["option"]; len(opts) > 0 {
+		if err := vm.SetMigrateOptions(opts); err != nil {
+			return err
+		}
+	}
+
 	return vm.Migrate(fname)
 }
 
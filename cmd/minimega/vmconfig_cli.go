@@ -126,6 +126,10 @@ The order is:
 
 	<bridge>,<VLAN>,<MAC>,<driver>,<qinq>
 
+An mtu=<MTU> field may also appear anywhere in the netspec to set the MTU for
+the interface. The MTU is applied to the host tap and, for virtio interfaces,
+advertised to the guest. Containers ignore the MTU field.
+
 Examples:
 
 To connect a VM to VLANs 1 and 5:
@@ -152,6 +156,10 @@ To specify the use of "dot1q-tunnel" mode with VLAN 105 as the outer VLAN:
 
 	vm config net 105,qinq
 
+To enable jumbo frames on a virtio interface:
+
+	vm config net 100,virtio-net-pci,mtu=9000
+
 If you prefer, you can also use aliases for VLANs:
 
 	vm config net DMZ CORE
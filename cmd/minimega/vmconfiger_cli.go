@@ -572,6 +572,36 @@ Default: "std"
 			return nil
 		}),
 	},
+	{
+		HelpShort: "configures vsock-cid",
+		HelpLong: `Attach a vhost-vsock device to the VM for host-guest communication
+over AF_VSOCK. The value is the guest CID (context ID) to assign,
+which must be 3 or higher, or "auto" to allocate a free CID from a
+host-wide pool at launch. CIDs are unique per host -- launching two
+VMs configured with the same explicit CID is an error.
+
+Note: this configuration only applies to KVM-based VMs and requires
+/dev/vhost-vsock on the host.
+`,
+		Patterns: []string{
+			"vm config vsock-cid [value]",
+		},
+
+		Call: wrapSimpleCLI(func(ns *Namespace, c *minicli.Command, r *minicli.Response) error {
+			if len(c.StringArgs) == 0 {
+				r.Response = ns.vmConfig.VsockCID
+				return nil
+			}
+
+			if err := validVsockCID(ns.vmConfig, c.StringArgs["value"]); err != nil {
+				return err
+			}
+
+			ns.vmConfig.VsockCID = c.StringArgs["value"]
+
+			return nil
+		}),
+	},
 	{
 		HelpShort: "configures append",
 		HelpLong: `Add an append string to a kernel set with vm kernel. Setting vm append
@@ -901,6 +931,7 @@ newly launched VMs.
 			"clear vm config <vga,>",
 			"clear vm config <virtio-ports,>",
 			"clear vm config <volume,>",
+			"clear vm config <vsock-cid,>",
 		},
 		Call: wrapSimpleCLI(func(ns *Namespace, c *minicli.Command, r *minicli.Response) error {
 			// at most one key will be set in BoolArgs but we don't know what it
@@ -1122,6 +1153,9 @@ func (v *KVMConfig) Info(field string) (string, error) {
 	if field == "vga" {
 		return v.Vga, nil
 	}
+	if field == "vsock-cid" {
+		return v.VsockCID, nil
+	}
 	if field == "append" {
 		return fmt.Sprintf("%v", v.Append), nil
 	}
@@ -1178,6 +1212,9 @@ func (v *KVMConfig) Clear(mask string) {
 	if mask == Wildcard || mask == "vga" {
 		v.Vga = "std"
 	}
+	if mask == Wildcard || mask == "vsock-cid" {
+		v.VsockCID = ""
+	}
 	if mask == Wildcard || mask == "append" {
 		v.Append = nil
 	}
@@ -1232,6 +1269,9 @@ func (v *KVMConfig) WriteConfig(w io.Writer) error {
 	if v.Vga != "std" {
 		fmt.Fprintf(w, "vm config vga %v\n", v.Vga)
 	}
+	if v.VsockCID != "" {
+		fmt.Fprintf(w, "vm config vsock-cid %v\n", v.VsockCID)
+	}
 	if len(v.Append) > 0 {
 		fmt.Fprintf(w, "vm config append %v\n", quoteJoin(v.Append, " "))
 	}
@@ -8,8 +8,12 @@ import (
 	"errors"
 	"fmt"
 	"path/filepath"
+	"strconv"
+	"strings"
 	"sync"
+	"time"
 
+	"github.com/sandia-minimega/minimega/v2/internal/vnc"
 	"github.com/sandia-minimega/minimega/v2/pkg/minicli"
 )
 
@@ -24,10 +28,33 @@ user can watch a video of interactions with the VM.
 If record is selected, a file will be created containing a record of mouse
 and keyboard actions by the user or of the framebuffer for the VM.
 
+The shimfb mode records the server-to-client traffic of the user's own vnc
+connections through the shim, rather than opening a separate connection, so
+the recording reflects exactly what the user saw. An optional maximum size in
+bytes rotates the file once to <filename>.1 when exceeded, bounding disk
+usage for long sessions.
+
+Keyboard recordings are plaintext. The optional compress flag gzips the
+recording as it is written, with periodic flushes so a crash loses at most a
+few seconds of events. Playback detects compressed files by their magic bytes,
+so old uncompressed recordings still play. Framebuffer recordings are always
+compressed.
+
+Record and stop accept the same VM targets as "vm start", so one command can
+start or stop recordings for a whole namespace. When the target matches
+several VMs the filename should include the {vm} placeholder, which expands
+to the VM's name; {timestamp} expands to the time the command ran:
+
+	vnc record kb all recordings/{vm}-{timestamp}.kb
+
+Successful recordings are listed with their expanded filenames. When stopping
+with a wildcard target, VMs that aren't recording are skipped.
+
 Note: recordings are written to the host where the VM is running.`,
 		Patterns: []string{
-			"vnc <record,> <kb,fb> <vm name> <filename>",
-			"vnc <stop,> <kb,fb> <vm name>",
+			"vnc <record,> <kb,fb> <vm target> <filename> [compress,]",
+			"vnc <record,> <shimfb,> <vm target> <filename> [maxsize]",
+			"vnc <stop,> <kb,fb,shimfb> <vm target>",
 		},
 		Call:    wrapVMTargetCLI(cliVNCRecord),
 		Suggest: wrapVMSuggest(VM_ANY_STATE, false),
@@ -45,8 +72,23 @@ targets. VMs without a valid playback that are part of the target will return a
 
 Playbacks can be paused with the pause command, and resumed using continue. The
 step command will immediately move to the next event contained in the playback
-file. Use the getstep command to view the current vnc event. Calling stop will
-end a playback.
+file; an optional count steps through that many events at once. The seek
+command fast-forwards to a position (a duration from the start of the
+playback, such as "5m30s"), discarding the intervening events rather than
+injecting them -- except key releases, which are still sent so that no key is
+left stuck down. Seeking backwards is not supported. Use the getstep command
+to view the current vnc event. Calling stop will end a playback. The vnc
+status output shows the current position against the total duration.
+
+Playback speed can be scaled with a rate multiplier such as "4x" or "0.5x",
+either when starting a playback or on a running one:
+
+	vnc play vm-0 foo.kb rate 4x
+	vnc play vm-0 rate 0.5x
+
+Scaled waits are floored so that even extreme rates deliver events in order,
+and changing the rate never drops queued events. The vnc status output shows
+the active rate and the time remaining at that rate.
 
 VNC playback also supports injecting mouse/keyboard events in the format found
 in the playback file. Injected commands must omit the time delta as they are
@@ -58,18 +100,59 @@ New playback files can be injected as well:
 
 	vnc inject vm-0 LoadFile,foo.kb
 
+Simple interactions can be driven without crafting a recording file. The key,
+type, and click forms synthesize the corresponding events and send them to
+the VM whether or not a viewer is attached:
+
+	vnc inject vm-0 key Return
+	vnc inject vm-0 type "root"
+	vnc inject vm-0 click 400 300
+
+Typed text handles shift for uppercase and symbols, assuming a US keyboard
+layout in the guest. Click takes an optional button number (1 is the left
+button). Synthesized events are rate-limited and logged at the debug level so
+scripted runs are reproducible.
+
+Guests configured for a non-US keyboard layout garble replayed and injected
+keysyms because they travel through qemu's en-us keymap. The layout option
+translates key events for the guest's layout (supported: us, gb, de, fr),
+remapping moved keys and wrapping characters in the shift and AltGr presses
+their position needs:
+
+	vnc play vm-0 foo.kb layout de
+	vnc inject vm-0 type "zählen" layout de
+
+Unknown keysyms pass through untranslated; the count is logged when the
+playback ends.
+
+A recording can be played into all the VMs of a multi-VM target at once. The
+optional stagger form delays each successive VM's playback by the given
+offset, so scripted activity doesn't run in lockstep:
+
+	vnc play vm[0-4] foo.kb stagger 30s
+
+Each playback remains independently controllable afterward.
+
 Comments in the playback file are logged at the info level. An example is given
 below.
 
 #: This is an example of a vnc playback comment`,
 		Patterns: []string{
 			"vnc <play,> <vm target> <filename>",
+			"vnc <play,> <vm target> <filename> <rate,> <multiplier>",
+			"vnc <play,> <vm target> <filename> <layout,> <layoutname>",
+			"vnc <play,> <vm target> <filename> <stagger,> <offset>",
+			"vnc <play,> <vm target> <rate,> <multiplier>",
 			"vnc <stop,> <vm target>",
 			"vnc <pause,> <vm target>",
 			"vnc <continue,> <vm target>",
-			"vnc <step,> <vm target>",
+			"vnc <step,> <vm target> [count]",
+			"vnc <seek,> <vm target> <timestamp>",
 			"vnc <getstep,> <vm target>",
 			"vnc <inject,> <vm target> <cmd>",
+			"vnc <inject,> <vm target> <key,> <keysym> [layoutname]",
+			"vnc <inject,> <vm target> <type,> <text> [layoutname]",
+			"vnc <inject,> <vm target> <click,> <x> <y> [button]",
 		},
 		Call:    wrapVMTargetCLI(cliVNCPlay),
 		Suggest: wrapVMSuggest(VM_ANY_STATE, false),
@@ -114,6 +197,19 @@ func cliVNCPlay(ns *Namespace, c *minicli.Command, resp *minicli.Response) error
 		resp.Header = []string{"name", "step"}
 	}
 
+	// offset between successive playback starts, counted by nth under mu
+	var stagger time.Duration
+	var nth int
+
+	if c.BoolArgs["stagger"] {
+		var err error
+
+		stagger, err = time.ParseDuration(c.StringArgs["offset"])
+		if err != nil || stagger < 0 {
+			return fmt.Errorf("invalid stagger offset: `%v`", c.StringArgs["offset"])
+		}
+	}
+
 	return ns.Apply(target, func(vm VM, _ bool) (bool, error) {
 		kvm, ok := vm.(*KvmVM)
 		if !ok {
@@ -125,17 +221,121 @@ func cliVNCPlay(ns *Namespace, c *minicli.Command, resp *minicli.Response) error
 
 		switch {
 		case c.BoolArgs["play"]:
-			return true, ns.Player.Playback(id, rhost, fname)
+			rate := 1.0
+
+			if c.BoolArgs["rate"] {
+				var err error
+
+				rate, err = vnc.ParseRate(c.StringArgs["multiplier"])
+				if err != nil {
+					return true, err
+				}
+
+				// rate adjustment on a running playback
+				if c.StringArgs["filename"] == "" {
+					return true, ns.Player.SetRate(id, rate)
+				}
+			}
+
+			var layout *vnc.Layout
+
+			if c.BoolArgs["layout"] {
+				var err error
+
+				layout, err = vnc.ParseLayout(c.StringArgs["layoutname"])
+				if err != nil {
+					return true, err
+				}
+			}
+
+			var delay time.Duration
+
+			if c.BoolArgs["stagger"] {
+				mu.Lock()
+				delay = time.Duration(nth) * stagger
+				nth++
+				mu.Unlock()
+			}
+
+			return true, ns.Player.Playback(id, rhost, fname, rate, layout, delay)
 		case c.BoolArgs["stop"]:
 			return true, ns.Player.Stop(id)
 		case c.BoolArgs["inject"]:
+			switch {
+			case c.BoolArgs["key"]:
+				events, err := vnc.KeyPressEvents(c.StringArgs["keysym"])
+				if err != nil {
+					return true, err
+				}
+
+				if events, err = translateEvents(c, events); err != nil {
+					return true, err
+				}
+
+				return true, ns.Player.InjectEvents(id, rhost, events)
+			case c.BoolArgs["type"]:
+				events, err := vnc.TextEvents(c.StringArgs["text"])
+				if err != nil {
+					return true, err
+				}
+
+				if events, err = translateEvents(c, events); err != nil {
+					return true, err
+				}
+
+				return true, ns.Player.InjectEvents(id, rhost, events)
+			case c.BoolArgs["click"]:
+				x, err := strconv.ParseUint(c.StringArgs["x"], 10, 16)
+				if err != nil {
+					return true, fmt.Errorf("invalid x position: `%v`", c.StringArgs["x"])
+				}
+
+				y, err := strconv.ParseUint(c.StringArgs["y"], 10, 16)
+				if err != nil {
+					return true, fmt.Errorf("invalid y position: `%v`", c.StringArgs["y"])
+				}
+
+				button := uint64(1)
+				if v, ok := c.StringArgs["button"]; ok {
+					button, err = strconv.ParseUint(v, 10, 8)
+					if err != nil {
+						return true, fmt.Errorf("invalid mouse button: `%v`", v)
+					}
+				}
+
+				events, err := vnc.ClickEvents(uint16(x), uint16(y), uint(button))
+				if err != nil {
+					return true, err
+				}
+
+				return true, ns.Player.InjectEvents(id, rhost, events)
+			}
+
 			return true, ns.Player.Inject(id, rhost, c.StringArgs["cmd"])
 		case c.BoolArgs["pause"]:
 			return true, ns.Player.Pause(id)
 		case c.BoolArgs["continue"]:
 			return true, ns.Player.Continue(id)
 		case c.BoolArgs["step"]:
-			return true, ns.Player.Step(id)
+			n := 1
+
+			if v, ok := c.StringArgs["count"]; ok {
+				var err error
+
+				n, err = strconv.Atoi(v)
+				if err != nil || n < 1 {
+					return true, fmt.Errorf("invalid step count: `%v`", v)
+				}
+			}
+
+			return true, ns.Player.Step(id, n)
+		case c.BoolArgs["seek"]:
+			target, err := time.ParseDuration(c.StringArgs["timestamp"])
+			if err != nil {
+				return true, fmt.Errorf("invalid seek timestamp: `%v`", c.StringArgs["timestamp"])
+			}
+
+			return true, ns.Player.Seek(id, target)
 		case c.BoolArgs["getstep"]:
 			res, err := ns.Player.GetStep(id)
 			if err != nil {
@@ -157,34 +357,115 @@ func cliVNCPlay(ns *Namespace, c *minicli.Command, resp *minicli.Response) error
 	})
 }
 
-func cliVNCRecord(ns *Namespace, c *minicli.Command, resp *minicli.Response) error {
-	fname := c.StringArgs["filename"]
-	// Ensure that relative paths are always relative to /files/
-	if !filepath.IsAbs(fname) {
-		// TODO: should we capture to the VM directory instead?
-		fname = filepath.Join(*f_iomBase, fname)
+// translateEvents applies the optional guest keyboard layout argument to a
+// synthesized event sequence.
+func translateEvents(c *minicli.Command, events []vnc.Event) ([]vnc.Event, error) {
+	name, ok := c.StringArgs["layoutname"]
+	if !ok {
+		return events, nil
 	}
 
-	vm, err := ns.FindKvmVM(c.StringArgs["vm"])
+	layout, err := vnc.ParseLayout(name)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	id := vm.Name
-	rhost := fmt.Sprintf("%v:%v", vm.GetHost(), vm.VNCPort)
+	return layout.TranslateEvents(events), nil
+}
 
-	if c.BoolArgs["record"] {
-		if c.BoolArgs["kb"] {
-			return ns.RecordKB(id, rhost, fname)
-		}
+// expandRecordingPath expands the {vm} and {timestamp} placeholders in a
+// recording filename so that one command can record many VMs to distinct
+// files.
+func expandRecordingPath(fname, vm string, now time.Time) string {
+	fname = strings.Replace(fname, "{vm}", vm, -1)
+	fname = strings.Replace(fname, "{timestamp}", now.Format("20060102-150405"), -1)
+
+	return fname
+}
 
-		return ns.RecordFB(id, rhost, fname)
+func cliVNCRecord(ns *Namespace, c *minicli.Command, resp *minicli.Response) error {
+	var kind string
+	switch {
+	case c.BoolArgs["kb"]:
+		kind = "kb"
+	case c.BoolArgs["shimfb"]:
+		kind = "shimfb"
+	default:
+		kind = "fb"
 	}
 
-	if c.BoolArgs["kb"] {
-		return ns.Recorder.StopKB(vm.Name)
+	// all VMs share one timestamp so their filenames line up
+	now := time.Now()
+
+	// synchronize adding rows to resp.Tabular
+	var mu sync.Mutex
+	if c.BoolArgs["record"] {
+		resp.Header = []string{"name", "filename"}
 	}
-	return ns.Recorder.StopFB(vm.Name)
+
+	return ns.Apply(c.StringArgs["vm"], func(vm VM, wild bool) (bool, error) {
+		kvm, ok := vm.(*KvmVM)
+		if !ok {
+			return false, nil
+		}
+
+		id := kvm.GetName()
+		rhost := fmt.Sprintf("%v:%v", kvm.GetHost(), kvm.VNCPort)
+
+		if c.BoolArgs["stop"] {
+			// skip VMs that aren't recording when the target is a wildcard so
+			// that one command can stop a namespace's recordings
+			if wild && !ns.Recorder.Recording(kind, id) {
+				return false, nil
+			}
+
+			switch kind {
+			case "kb":
+				return true, ns.Recorder.StopKB(id)
+			case "shimfb":
+				return true, ns.Recorder.StopShimFB(id)
+			}
+
+			return true, ns.Recorder.StopFB(id)
+		}
+
+		fname := expandRecordingPath(c.StringArgs["filename"], id, now)
+		// Ensure that relative paths are always relative to /files/
+		if !filepath.IsAbs(fname) {
+			// TODO: should we capture to the VM directory instead?
+			fname = filepath.Join(*f_iomBase, fname)
+		}
+
+		var err error
+
+		switch kind {
+		case "kb":
+			err = ns.RecordKB(id, rhost, fname, c.BoolArgs["compress"])
+		case "shimfb":
+			var maxSize int64
+
+			if v, ok := c.StringArgs["maxsize"]; ok {
+				maxSize, err = strconv.ParseInt(v, 10, 64)
+				if err != nil || maxSize < 0 {
+					return true, fmt.Errorf("invalid max size: `%v`", v)
+				}
+			}
+
+			err = ns.RecordShimFB(id, fname, maxSize)
+		default:
+			err = ns.RecordFB(id, rhost, fname)
+		}
+		if err != nil {
+			return true, err
+		}
+
+		mu.Lock()
+		defer mu.Unlock()
+
+		resp.Tabular = append(resp.Tabular, []string{id, fname})
+
+		return true, nil
+	})
 }
 
 // List all active recordings and playbacks
@@ -0,0 +1,30 @@
+// Copyright (2014) Sandia Corporation.
+// Under the terms of Contract DE-AC04-94AL85000 with Sandia Corporation,
+// the U.S. Government retains certain rights in this software.
+
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestExpandRecordingPath(t *testing.T) {
+	now := time.Date(2021, 6, 1, 12, 30, 45, 0, time.UTC)
+
+	tests := []struct {
+		fname string
+		want  string
+	}{
+		{"foo.kb", "foo.kb"},
+		{"recordings/{vm}.kb", "recordings/vm-0.kb"},
+		{"recordings/{vm}-{timestamp}.kb", "recordings/vm-0-20210601-123045.kb"},
+		{"{vm}/{vm}.fb", "vm-0/vm-0.fb"},
+	}
+
+	for _, tt := range tests {
+		if got := expandRecordingPath(tt.fname, "vm-0", now); got != tt.want {
+			t.Errorf("expandRecordingPath(%q): got %q, want %q", tt.fname, got, tt.want)
+		}
+	}
+}
@@ -8,9 +8,12 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"net"
 	"net/http"
 	"os"
 	"strings"
+	"sync"
+	"time"
 
 	log "github.com/sandia-minimega/minimega/v2/pkg/minilog"
 
@@ -57,8 +60,69 @@ func parsePasswords(fname string) error {
 	return json.NewDecoder(f).Decode(&passwords)
 }
 
+// after maxFailures failed auth attempts within failureWindow, further
+// attempts from that address are rejected outright
+const (
+	maxFailures   = 5
+	failureWindow = time.Minute
+)
+
+var failures = struct {
+	sync.Mutex
+
+	m map[string][]time.Time
+}{m: map[string][]time.Time{}}
+
+func failureSource(r *http.Request) string {
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		return host
+	}
+
+	return r.RemoteAddr
+}
+
+// rateLimited reports whether the source of the request has failed
+// authentication too many times recently to try again.
+func rateLimited(r *http.Request) bool {
+	addr := failureSource(r)
+
+	failures.Lock()
+	defer failures.Unlock()
+
+	var recent []time.Time
+	for _, t := range failures.m[addr] {
+		if time.Since(t) < failureWindow {
+			recent = append(recent, t)
+		}
+	}
+	failures.m[addr] = recent
+
+	return len(recent) >= maxFailures
+}
+
+// recordFailure logs a failed authentication attempt with its source address
+// and counts it against the rate limit.
+func recordFailure(r *http.Request) {
+	addr := failureSource(r)
+	log.Warn("failed auth attempt for %v from %v", r.URL.Path, addr)
+
+	failures.Lock()
+	defer failures.Unlock()
+
+	failures.m[addr] = append(failures.m[addr], time.Now())
+}
+
 func mustAuth(f http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
+		if rateLimited(r) {
+			http.Error(w, "too many failed attempts, try again later", http.StatusTooManyRequests)
+			return
+		}
+
+		if *f_tokens != "" && !checkToken(w, r) {
+			return
+		}
+
 		// check if URL is password protected
 		var matches []PasswordEntry
 		for _, entry := range passwords {
@@ -85,6 +149,10 @@ func mustAuth(f http.HandlerFunc) http.HandlerFunc {
 		}
 
 		// all matches failed
+		if ok {
+			recordFailure(r)
+		}
+
 		w.Header().Set("WWW-Authenticate", `Basic realm="minimega"`)
 		http.Error(w, "unauthorized", http.StatusUnauthorized)
 	}
@@ -30,9 +30,14 @@ var (
 	f_base      = flag.String("base", defaultBase, "base path for minimega")
 	f_passwords = flag.String("passwords", "", "password file for auth")
 	f_bootstrap = flag.Bool("bootstrap", false, "create password file for auth")
+	f_tokens    = flag.String("tokens", "", "token file for namespace-scoped access tokens")
+	f_gentoken  = flag.String("gentoken", "", "generate a token for the given namespace, add it to -tokens, and exit")
+	f_revoke    = flag.String("revoke", "", "revoke a token from -tokens and exit")
 	f_console   = flag.String("console", "", "path to minimega to enable console (e.g. bin/minimega)")
 	f_key       = flag.String("key", "", "key file for TLS in PEM format")
 	f_cert      = flag.String("cert", "", "cert file for TLS in PEM format")
+	f_selfsign  = flag.Bool("selfsigned", false, "generate a self-signed TLS cert under -base if no cert/key given")
+	f_redirect  = flag.String("redirect", "", "listen address for plain HTTP redirects to the TLS listener")
 	f_namespace = flag.String("namespace", "", "limit miniweb to a namespace")
 )
 
@@ -64,12 +69,43 @@ func main() {
 		return
 	}
 
+	if *f_gentoken != "" || *f_revoke != "" {
+		if *f_tokens == "" {
+			log.Fatalln("must specify -tokens")
+		}
+
+		if *f_gentoken != "" {
+			token, err := generateToken(*f_tokens, *f_gentoken)
+			if err != nil {
+				log.Fatalln(err)
+			}
+
+			fmt.Printf("token for namespace %v: %v\n", *f_gentoken, token)
+		}
+
+		if *f_revoke != "" {
+			if err := revokeToken(*f_tokens, *f_revoke); err != nil {
+				log.Fatalln(err)
+			}
+
+			fmt.Printf("revoked token %v\n", *f_revoke)
+		}
+
+		return
+	}
+
 	if *f_passwords != "" {
 		if err := parsePasswords(*f_passwords); err != nil {
 			log.Fatalln(err)
 		}
 	}
 
+	if *f_tokens != "" {
+		if err := parseTokens(*f_tokens); err != nil {
+			log.Fatalln(err)
+		}
+	}
+
 	files, err := ioutil.ReadDir(*f_root)
 	if err != nil {
 		log.Fatalln(err)
@@ -136,13 +172,35 @@ func main() {
 		Handler: mux,
 	}
 
+	if *f_cert == "" && *f_key == "" && *f_selfsign {
+		*f_cert, *f_key, err = generateCert(*f_base)
+		if err != nil {
+			log.Fatalln(err)
+		}
+	}
+
 	if *f_cert != "" && *f_key != "" {
+		if *f_redirect != "" {
+			redirect, err := redirectHandler(*f_addr)
+			if err != nil {
+				log.Fatalln(err)
+			}
+
+			go func() {
+				log.Info("redirecting HTTP on %v to HTTPS", *f_redirect)
+				log.Fatalln(http.ListenAndServe(*f_redirect, redirect))
+			}()
+		}
+
 		log.Info("serving HTTPS on %v", *f_addr)
 		log.Fatalln(server.ListenAndServeTLS(*f_cert, *f_key))
 	}
 	if *f_cert != "" || *f_key != "" {
 		log.Fatalln("must specify both cert and key files to enable TLS")
 	}
+	if *f_redirect != "" {
+		log.Fatalln("-redirect requires TLS, see -cert/-key or -selfsigned")
+	}
 
 	log.Info("serving HTTP on %v", *f_addr)
 	log.Fatalln(server.ListenAndServe())
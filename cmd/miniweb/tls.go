@@ -0,0 +1,128 @@
+// Copyright 2017-2021 National Technology & Engineering Solutions of Sandia, LLC (NTESS).
+// Under the terms of Contract DE-NA0003525 with NTESS, the U.S. Government retains certain
+// rights in this software.
+
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"time"
+
+	log "github.com/sandia-minimega/minimega/v2/pkg/minilog"
+)
+
+// generateCert creates a self-signed certificate and key under dir, reusing
+// the pair from a previous run if both files already exist. Returns the cert
+// and key filenames.
+func generateCert(dir string) (string, string, error) {
+	certFile := filepath.Join(dir, "miniweb.crt")
+	keyFile := filepath.Join(dir, "miniweb.key")
+
+	if _, err := os.Stat(certFile); err == nil {
+		if _, err := os.Stat(keyFile); err == nil {
+			log.Info("reusing self-signed cert: %v", certFile)
+			return certFile, keyFile, nil
+		}
+	}
+
+	log.Info("generating self-signed cert: %v", certFile)
+
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return "", "", err
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return "", "", err
+	}
+
+	template := x509.Certificate{
+		SerialNumber: serial,
+		Subject: pkix.Name{
+			CommonName: "miniweb",
+		},
+		NotBefore: time.Now(),
+		NotAfter:  time.Now().Add(365 * 24 * time.Hour),
+
+		KeyUsage:              x509.KeyUsageKeyEncipherment | x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+
+		DNSNames:    []string{"localhost"},
+		IPAddresses: []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback},
+	}
+
+	if hostname, err := os.Hostname(); err == nil {
+		template.DNSNames = append(template.DNSNames, hostname)
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &priv.PublicKey, priv)
+	if err != nil {
+		return "", "", err
+	}
+
+	cert, err := os.Create(certFile)
+	if err != nil {
+		return "", "", err
+	}
+	defer cert.Close()
+
+	if err := pem.Encode(cert, &pem.Block{Type: "CERTIFICATE", Bytes: der}); err != nil {
+		return "", "", err
+	}
+
+	key, err := os.OpenFile(keyFile, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return "", "", err
+	}
+	defer key.Close()
+
+	b, err := x509.MarshalECPrivateKey(priv)
+	if err != nil {
+		return "", "", err
+	}
+
+	if err := pem.Encode(key, &pem.Block{Type: "EC PRIVATE KEY", Bytes: b}); err != nil {
+		return "", "", err
+	}
+
+	return certFile, keyFile, nil
+}
+
+// redirectHandler redirects plain HTTP requests to the TLS listener so that
+// browsers hitting the old port get sent along rather than a hang or a
+// garbled TLS error.
+func redirectHandler(tlsAddr string) (http.Handler, error) {
+	_, port, err := net.SplitHostPort(tlsAddr)
+	if err != nil {
+		return nil, err
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := r.Host
+		if h, _, err := net.SplitHostPort(r.Host); err == nil {
+			host = h
+		}
+
+		u := url.URL{
+			Scheme:   "https",
+			Host:     net.JoinHostPort(host, port),
+			Path:     r.URL.Path,
+			RawQuery: r.URL.RawQuery,
+		}
+
+		http.Redirect(w, r, u.String(), http.StatusMovedPermanently)
+	}), nil
+}
@@ -0,0 +1,196 @@
+// Copyright 2017-2021 National Technology & Engineering Solutions of Sandia, LLC (NTESS).
+// Under the terms of Contract DE-NA0003525 with NTESS, the U.S. Government retains certain
+// rights in this software.
+
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	log "github.com/sandia-minimega/minimega/v2/pkg/minilog"
+)
+
+// TokenEntry grants access to one namespace. An empty namespace grants access
+// to all of them.
+type TokenEntry struct {
+	Token     string `json:"token"`
+	Namespace string `json:"namespace"`
+}
+
+// tokens caches the token file, reloaded whenever the file changes so that
+// tokens generated or revoked while miniweb is running take effect.
+var tokens = struct {
+	sync.Mutex
+
+	entries []TokenEntry
+	mtime   time.Time
+}{}
+
+func parseTokens(fname string) error {
+	f, err := os.Open(fname)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	var entries []TokenEntry
+	if err := json.NewDecoder(f).Decode(&entries); err != nil {
+		return err
+	}
+
+	tokens.Lock()
+	defer tokens.Unlock()
+
+	tokens.entries = entries
+	tokens.mtime = info.ModTime()
+
+	return nil
+}
+
+func saveTokens(fname string, entries []TokenEntry) error {
+	f, err := os.OpenFile(fname, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	enc := json.NewEncoder(f)
+	enc.SetIndent("", "\t")
+	return enc.Encode(&entries)
+}
+
+// lookupToken returns the namespace a token grants access to, reloading the
+// token file first if it has changed on disk.
+func lookupToken(token string) (string, bool) {
+	if info, err := os.Stat(*f_tokens); err == nil {
+		tokens.Lock()
+		stale := info.ModTime().After(tokens.mtime)
+		tokens.Unlock()
+
+		if stale {
+			if err := parseTokens(*f_tokens); err != nil {
+				log.Error("unable to reload tokens: %v", err)
+			}
+		}
+	}
+
+	tokens.Lock()
+	defer tokens.Unlock()
+
+	for _, e := range tokens.entries {
+		if subtle.ConstantTimeCompare([]byte(e.Token), []byte(token)) == 1 {
+			return e.Namespace, true
+		}
+	}
+
+	return "", false
+}
+
+// generateToken appends a new random token for the namespace to the token
+// file and returns it.
+func generateToken(fname, namespace string) (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	token := hex.EncodeToString(b)
+
+	// carry over existing entries, if any
+	if _, err := os.Stat(fname); err == nil {
+		if err := parseTokens(fname); err != nil {
+			return "", err
+		}
+	}
+
+	tokens.Lock()
+	defer tokens.Unlock()
+
+	tokens.entries = append(tokens.entries, TokenEntry{
+		Token:     token,
+		Namespace: namespace,
+	})
+
+	return token, saveTokens(fname, tokens.entries)
+}
+
+// revokeToken removes a token from the token file.
+func revokeToken(fname, token string) error {
+	if err := parseTokens(fname); err != nil {
+		return err
+	}
+
+	tokens.Lock()
+	defer tokens.Unlock()
+
+	var entries []TokenEntry
+	for _, e := range tokens.entries {
+		if e.Token != token {
+			entries = append(entries, e)
+		}
+	}
+
+	if len(entries) == len(tokens.entries) {
+		return fmt.Errorf("token not found: %v", token)
+	}
+
+	tokens.entries = entries
+	return saveTokens(fname, entries)
+}
+
+// checkToken authorizes the request against the token file. Tokens arrive as
+// a query parameter on URLs handed to analysts; the first valid use sets a
+// cookie so that later requests, including websocket upgrades, stay
+// authorized. A namespaced token pins the request to its namespace so it only
+// exposes that namespace's VMs.
+func checkToken(w http.ResponseWriter, r *http.Request) bool {
+	token := r.URL.Query().Get("token")
+
+	fromURL := token != ""
+	if !fromURL {
+		if c, err := r.Cookie("miniweb-token"); err == nil {
+			token = c.Value
+		}
+	}
+
+	namespace, ok := lookupToken(token)
+	if !ok {
+		// a missing token isn't a guess, so only presented tokens count
+		// against the rate limit
+		if token != "" {
+			recordFailure(r)
+		}
+
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return false
+	}
+
+	if fromURL {
+		http.SetCookie(w, &http.Cookie{
+			Name:  "miniweb-token",
+			Value: token,
+			Path:  "/",
+		})
+	}
+
+	if namespace != "" && *f_namespace == "" {
+		v := r.URL.Query()
+		v.Set("namespace", namespace)
+		v.Del("token")
+		r.URL.RawQuery = v.Encode()
+	}
+
+	return true
+}
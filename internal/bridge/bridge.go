@@ -43,6 +43,10 @@ type Bridge struct {
 
 	taps map[string]*Tap
 
+	// macWaiters stores channels to close the first time the matching MAC is
+	// seen in snooped traffic on the bridge, keyed by lowercase MAC
+	macWaiters map[string][]chan bool
+
 	nf *gonetflow.Netflow
 
 	// tapChan is a reference to the tapChan from the Bridges struct that
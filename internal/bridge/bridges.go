@@ -97,16 +97,17 @@ func (b Bridges) newBridge(name string) error {
 	log.Info("creating new bridge: %v", name)
 
 	br := &Bridge{
-		Name:     name,
-		taps:     make(map[string]*Tap),
-		trunks:   make(map[string]bool),
-		tunnels:  make(map[string]bool),
-		mirrors:  make(map[string]bool),
-		bonds:    make(map[string]map[string]int),
-		captures: make(map[int]capture),
-		tapChan:  b.tapChan,
-		bondChan: b.bondChan,
-		config:   make(map[string]string),
+		Name:       name,
+		taps:       make(map[string]*Tap),
+		macWaiters: make(map[string][]chan bool),
+		trunks:     make(map[string]bool),
+		tunnels:    make(map[string]bool),
+		mirrors:    make(map[string]bool),
+		bonds:      make(map[string]map[string]int),
+		captures:   make(map[int]capture),
+		tapChan:    b.tapChan,
+		bondChan:   b.bondChan,
+		config:     make(map[string]string),
 	}
 
 	// Create the bridge
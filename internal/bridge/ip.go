@@ -6,6 +6,9 @@ package bridge
 
 import (
 	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
 	"strings"
 
 	log "github.com/sandia-minimega/minimega/v2/pkg/minilog"
@@ -41,6 +44,28 @@ func downInterface(name string) error {
 	return nil
 }
 
+// setMTU sets the MTU for an interface using the `ip` command.
+func setMTU(name string, mtu int) error {
+	log.Info("setting MTU: %v %v", name, mtu)
+
+	out, err := processWrapper("ip", "link", "set", "dev", name, "mtu", strconv.Itoa(mtu))
+	if err != nil {
+		return fmt.Errorf("set MTU failed: %v: %v", err, out)
+	}
+
+	return nil
+}
+
+// deviceMTU reads the current MTU for an interface from sysfs.
+func deviceMTU(name string) (int, error) {
+	d, err := ioutil.ReadFile(filepath.Join("/sys/class/net", name, "mtu"))
+	if err != nil {
+		return 0, err
+	}
+
+	return strconv.Atoi(strings.TrimSpace(string(d)))
+}
+
 // createTap creates a tuntap of the specified name using the `ip` command.
 func createTap(name string) error {
 	log.Info("creating tuntap: %v", name)
@@ -6,6 +6,7 @@ package bridge
 
 import (
 	"net"
+	"strings"
 
 	log "github.com/sandia-minimega/minimega/v2/pkg/minilog"
 
@@ -75,6 +76,29 @@ func (b *Bridge) snooper() {
 	log.Info("%v snoop out", b.Name)
 }
 
+// NotifyMAC returns a channel that is closed the first time the specified MAC
+// is seen in snooped ARP or Neighbor Discovery traffic on the bridge. If the
+// MAC has already been seen (a matching tap has an IP recorded), the channel
+// is closed immediately.
+func (b *Bridge) NotifyMAC(mac string) <-chan bool {
+	bridgeLock.Lock()
+	defer bridgeLock.Unlock()
+
+	mac = strings.ToLower(mac)
+
+	ch := make(chan bool)
+
+	for _, tap := range b.taps {
+		if !tap.Defunct && tap.MAC == mac && (tap.IP4 != "" || tap.IP6 != "") {
+			close(ch)
+			return ch
+		}
+	}
+
+	b.macWaiters[mac] = append(b.macWaiters[mac], ch)
+	return ch
+}
+
 func (b *Bridge) updateIP(mac string, ip net.IP) {
 	if ip == nil || ip.IsLinkLocalUnicast() {
 		return
@@ -85,6 +109,12 @@ func (b *Bridge) updateIP(mac string, ip net.IP) {
 	bridgeLock.Lock()
 	defer bridgeLock.Unlock()
 
+	// wake up anyone waiting to see this MAC on the bridge
+	for _, ch := range b.macWaiters[mac] {
+		close(ch)
+	}
+	delete(b.macWaiters, mac)
+
 	for _, tap := range b.taps {
 		if tap.Defunct || tap.MAC != mac {
 			continue
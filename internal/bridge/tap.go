@@ -156,6 +156,24 @@ func (b *Bridge) SetTapQinQ(tap string, outer int) error {
 	return ovsSetPortQinQ(tap, outer)
 }
 
+// SetTapMTU sets the MTU for the given tap. A warning is logged if the new
+// MTU doesn't match the MTU of the bridge itself since traffic between the
+// two may be dropped or fragmented.
+func (b *Bridge) SetTapMTU(tap string, mtu int) error {
+	bridgeLock.Lock()
+	defer bridgeLock.Unlock()
+
+	if err := setMTU(tap, mtu); err != nil {
+		return err
+	}
+
+	if v, err := deviceMTU(b.Name); err == nil && v != mtu {
+		log.Warn("MTU mismatch: tap %v has MTU %v, bridge %v has MTU %v", tap, mtu, b.Name, v)
+	}
+
+	return nil
+}
+
 // DestroyTap removes a tap from the bridge and marks it as defunct. See
 // `Bridge.ReapTaps` to clean up defunct taps. If the tap is a mirror, it
 // cleans up the mirror too.
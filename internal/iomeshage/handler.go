@@ -6,6 +6,7 @@ package iomeshage
 
 import (
 	"fmt"
+	"os"
 	"path/filepath"
 
 	log "github.com/sandia-minimega/minimega/v2/pkg/minilog"
@@ -91,17 +92,49 @@ func (iom *IOMeshage) handleInfo(m *Message) {
 		log.Debug("handleInfo: file does not exist: %v", m.Filename)
 	} else if len(files) == 1 && iom.Rel(files[0]) == m.Filename {
 		resp.ACK = !files[0].IsDir()
-		resp.Part = files[0].numParts()
+		resp.Part = files[0].numParts(iom.partSize)
+		resp.PartSize = iom.partSize
 		resp.Perm = files[0].Perm()
 		resp.ModTime = files[0].ModTime
 		resp.Hash = iom.getHash(files[0].Path)
 
+		if files[0].LinkTarget != "" {
+			resp.Link = files[0].LinkTarget
+			resp.LinkRel = iom.linkRel(files[0].Path)
+
+			// an in-tree link moves no content -- the receiver fetches the
+			// target and recreates the link. An out-of-tree link materializes
+			// the target's content, sized by the target rather than the link.
+			resp.Part = 0
+			if resp.LinkRel == "" {
+				if ti, err := os.Stat(files[0].Path); err == nil && !ti.IsDir() {
+					resp.Part = (ti.Size() + iom.partSize - 1) / iom.partSize
+				}
+			}
+		}
+
+		if m.Sync {
+			resp.Manifest = []FileInfo{iom.manifestEntry(files[0])}
+		}
+
 		log.Debug("handleInfo: found %v with %v parts", m.Filename, resp.Part)
 	} else {
 		// populate Glob
 		resp.ACK = true
 		for _, file := range files {
-			resp.Glob = append(resp.Glob, iom.Rel(file))
+			rel := iom.Rel(file)
+
+			// apply the requester's exclusions and depth limit here so the
+			// mesh never learns about files it isn't going to fetch
+			if excludeMatch(rel, m.Exclude) || tooDeep(rel, m.Filename, m.MaxDepth) {
+				continue
+			}
+
+			resp.Glob = append(resp.Glob, rel)
+
+			if m.Sync && !file.IsDir() {
+				resp.Manifest = append(resp.Manifest, iom.manifestEntry(file))
+			}
 		}
 
 		log.Debug("handleInfo: found glob for %v: %v", m.Filename, resp.Glob)
@@ -175,6 +208,13 @@ func (iom *IOMeshage) handlePart(m *Message, xfer bool) {
 
 	log.Info("handlePart for %v (part %v), xfer = %v", m.Filename, m.Part, xfer)
 
+	// honor the part size the requester is working with; requests from older
+	// nodes that don't send one use the default
+	partSize := m.PartSize
+	if partSize == 0 {
+		partSize = PART_SIZE
+	}
+
 	files, err := iom.List(m.Filename, false)
 	if err != nil {
 		resp.ACK = false
@@ -187,7 +227,8 @@ func (iom *IOMeshage) handlePart(m *Message, xfer bool) {
 		resp.Part = m.Part
 
 		if xfer {
-			resp.Data = iom.readPart(files[0].Path, m.Part)
+			resp.Data = iom.readPart(files[0].Path, m.Part, partSize)
+			resp.Checksum = hashData(resp.Data)
 		} else {
 			resp.ModTime = files[0].ModTime
 			resp.Hash = iom.getHash(files[0].Path)
@@ -211,20 +252,23 @@ func (iom *IOMeshage) handlePart(m *Message, xfer bool) {
 	// transferrable IFF it exists on disk and is marked as being fully
 	// received.
 	iom.transferLock.RLock()
-	if t, ok := iom.transfers[m.Filename]; ok && t.Parts[m.Part] {
+	for _, t := range iom.transfers {
+		if t.Filename != m.Filename || !t.Parts[m.Part] {
+			continue
+		}
+
 		// we are currently transferring parts of the file
 		partname := fmt.Sprintf("%v/%v.part_%v", t.Dir, filepath.Base(t.Filename), m.Part)
-		_, err := iom.List(partname, false)
-		if err == nil {
+		if _, err := iom.List(partname, false); err == nil {
 			// we have it
 			resp.ACK = true
 			resp.Part = m.Part
 			if xfer {
-				resp.Data = iom.readPart(partname, 0)
+				resp.Data = iom.readPart(partname, 0, partSize)
+				resp.Checksum = hashData(resp.Data)
 				log.Debug("sending partial %v", partname)
 			}
-		} else {
-			resp.ACK = false
+			break
 		}
 	}
 	iom.transferLock.RUnlock()
@@ -6,6 +6,7 @@ import (
 	"os"
 	"path/filepath"
 	"strings"
+	"sync"
 	"time"
 
 	log "github.com/sandia-minimega/minimega/v2/pkg/minilog"
@@ -17,10 +18,82 @@ import (
 // ignoredDirectories is a list of strings to look for in directory paths to be
 // ignored when adding directories to the file system event watcher.
 //
-// transfer_ - don't hash file parts as they're being transferred. Instead, just
-// wait for the CREATE event for the final, combined file.
+// transfer_ - don't hash file parts as they're being transferred. Completed
+// transfers are hashed via the completion notification instead.
 var ignoredDirectories = []string{"transfer_"}
 
+// rehashDelay is how long the rehasher waits after a change event before
+// recomputing a hash so that a burst of writes to one file costs one rehash.
+// rehashMinInterval is the floor between successive rehashes of the same file
+// so a constantly-churning file, like a log, doesn't pin a CPU.
+const (
+	rehashDelay       = time.Second
+	rehashMinInterval = 30 * time.Second
+)
+
+// rehasher recomputes hashes for files the watcher reports as changed,
+// coalescing bursts of events and rate-limiting rehashes per file.
+type rehasher struct {
+	iom *IOMeshage
+
+	mu      sync.Mutex
+	pending map[string]bool      // files with a rehash already scheduled
+	last    map[string]time.Time // when each file was last rehashed
+}
+
+func newRehasher(iom *IOMeshage) *rehasher {
+	return &rehasher{
+		iom:     iom,
+		pending: make(map[string]bool),
+		last:    make(map[string]time.Time),
+	}
+}
+
+// schedule invalidates the cached hash for a changed file and queues a
+// recompute. The invalidation happens immediately, under the usual hash lock,
+// so a stale hash is never served while the recompute is pending.
+func (r *rehasher) schedule(path string) {
+	r.iom.updateHash(path, "")
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.pending[path] {
+		return
+	}
+	r.pending[path] = true
+
+	delay := rehashDelay
+	if since := time.Since(r.last[path]); since < rehashMinInterval {
+		delay = rehashMinInterval - since
+	}
+
+	time.AfterFunc(delay, func() {
+		r.rehash(path)
+	})
+}
+
+// rehash computes and records the hash for a scheduled file.
+func (r *rehasher) rehash(path string) {
+	r.mu.Lock()
+	delete(r.pending, path)
+	r.last[path] = time.Now()
+	r.mu.Unlock()
+
+	// the file may have disappeared while the rehash was pending
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		return
+	}
+
+	hash, err := hashFile(path)
+	if err != nil {
+		log.Error("getting hash for file %s: %v", path, err)
+		return
+	}
+
+	r.iom.updateHash(path, hash)
+}
+
 // startHasher generates a Murmur3 hash for all existing files and also watches
 // for new or updated files and generates a hash for them as well.
 func (iom *IOMeshage) startHasher() {
@@ -31,6 +104,34 @@ func (iom *IOMeshage) startHasher() {
 
 	defer watcher.Close()
 
+	// Completed transfers are announced directly so hashing them doesn't
+	// depend on the watcher having picked up their destination directory yet.
+	completions := make(chan string, QUEUE_LEN)
+	iom.NotifyComplete(completions)
+
+	go func() {
+		for rel := range completions {
+			path := filepath.Join(iom.base, rel)
+
+			// verified transfers already recorded their hash
+			if iom.getHash(path) != "" {
+				continue
+			}
+
+			go func(path string) {
+				hash, err := hashFile(path)
+				if err != nil {
+					log.Error("getting hash for file %s: %v", path, err)
+					return
+				}
+
+				iom.updateHash(path, hash)
+			}(path)
+		}
+	}()
+
+	rehash := newRehasher(iom)
+
 	// This goroutine continually processes events generated by the fsnotify
 	// watcher and hashes files in the background as needed to help speed things
 	// up when the hash actually needs to be used.
@@ -60,33 +161,15 @@ func (iom *IOMeshage) startHasher() {
 						watcher.Add(event.Name)
 					} else {
 						if stat.Size() > 0 {
-							log.Debug("getting hash for file %s", event.Name)
-
-							go func() {
-								hash, err := hashFile(event.Name)
-								if err != nil {
-									log.Error("getting hash for file %s: %v", event.Name, err)
-									return
-								}
-
-								iom.updateHash(event.Name, hash)
-							}()
+							log.Debug("scheduling hash for file %s", event.Name)
+							rehash.schedule(event.Name)
 						}
 					}
 				}
 
 				if event.Has(fsnotify.Write) {
-					log.Debug("getting hash for file %s", event.Name)
-
-					go func() {
-						hash, err := hashFile(event.Name)
-						if err != nil {
-							log.Error("getting hash for file %s: %v", event.Name, err)
-							return
-						}
-
-						iom.updateHash(event.Name, hash)
-					}()
+					log.Debug("scheduling hash for file %s", event.Name)
+					rehash.schedule(event.Name)
 				}
 
 				if event.Has(fsnotify.Remove) {
@@ -187,6 +270,14 @@ func hashFile(path string) (string, error) {
 	return hash, nil
 }
 
+// hashData generates a Murmur3 hash for a part payload.
+func hashData(data []byte) string {
+	hasher := murmur3.New64()
+	hasher.Write(data)
+
+	return fmt.Sprintf("%x", hasher.Sum(nil))
+}
+
 // ignoreDirectory checks to see if the given path contains any of the
 // ignoredDirectories.
 func ignoreDirectory(path string) bool {
@@ -0,0 +1,72 @@
+// Copyright 2017-2021 National Technology & Engineering Solutions of Sandia, LLC (NTESS).
+// Under the terms of Contract DE-NA0003525 with NTESS, the U.S. Government retains certain
+// rights in this software.
+
+package iomeshage
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestRehasher(t *testing.T) {
+	dir := t.TempDir()
+
+	iom := &IOMeshage{
+		base:      dir,
+		hashes:    make(map[string]string),
+		hashTimes: make(map[string]time.Time),
+	}
+
+	name := filepath.Join(dir, "image.qc2")
+	if err := ioutil.WriteFile(name, []byte("image"), 0664); err != nil {
+		t.Fatal(err)
+	}
+
+	iom.updateHash(name, "stale")
+
+	// scheduling must invalidate the cached hash immediately so a stale value
+	// is never served while the recompute is pending
+	r := newRehasher(iom)
+	r.schedule(name)
+
+	if hash := iom.getHash(name); hash != "" {
+		t.Fatalf("expected schedule to invalidate the hash, got %q", hash)
+	}
+
+	// a second schedule for the same file coalesces with the first
+	r.schedule(name)
+
+	r.mu.Lock()
+	pending := len(r.pending)
+	r.mu.Unlock()
+
+	if pending != 1 {
+		t.Fatalf("expected one pending rehash, got %v", pending)
+	}
+
+	r.rehash(name)
+
+	want, err := hashFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hash, hashed := iom.getHashTime(name)
+	if hash != want {
+		t.Fatalf("expected rehash to record %v, got %v", want, hash)
+	}
+	if hashed.IsZero() {
+		t.Fatal("expected rehash to record when the hash was computed")
+	}
+
+	// rehashing a file that no longer exists records nothing
+	gone := filepath.Join(dir, "gone")
+	r.rehash(gone)
+
+	if hash := iom.getHash(gone); hash != "" {
+		t.Fatalf("expected no hash for a missing file, got %q", hash)
+	}
+}
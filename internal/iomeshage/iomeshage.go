@@ -5,6 +5,8 @@
 package iomeshage
 
 import (
+	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
@@ -12,8 +14,11 @@ import (
 	"math/rand"
 	"os"
 	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
 
 	"github.com/sandia-minimega/minimega/v2/internal/meshage"
@@ -22,9 +27,72 @@ import (
 
 const (
 	MAX_ATTEMPTS = 3
-	QUEUE_LEN    = 3
+
+	// QUEUE_LEN is the default limit on concurrent transfers, see New and
+	// SetTransferLimit.
+	QUEUE_LEN = 3
+
+	// DEFAULT_TIMEOUT bounds a single message exchange with another node, see
+	// SetTimeout.
+	DEFAULT_TIMEOUT = 30 * time.Second
+
+	// TRANSFER_HISTORY is how many finished transfers Status keeps around.
+	TRANSFER_HISTORY = 10
+
+	// rateWindow is how far back the rolling transfer rate looks.
+	rateWindow = 10 * time.Second
+
+	// infoCacheTTL is how long located files are remembered before the next
+	// lookup has to broadcast to the mesh again.
+	infoCacheTTL = 30 * time.Second
+
+	// fetchedFile is the sidecar in the base directory that remembers which
+	// files came from the mesh and when they were last used.
+	fetchedFile = ".fetched"
+
+	// lockFileName is the sidecar in the base directory that instances lock
+	// to detect a base path shared by mistake.
+	lockFileName = ".lock"
+
+	// pruneInterval is how often a configured retention policy runs on its
+	// own.
+	pruneInterval = time.Hour
+
+	// bulkMaxWait is how long a bulk transfer yields the queue to normal
+	// transfers before aging into normal priority so it can't starve.
+	bulkMaxWait = 5 * time.Minute
+
+	// bulkYield is how long a bulk transfer backs off between attempts to
+	// take a queue slot.
+	bulkYield = time.Second
 )
 
+// Priority of a transfer. Urgent transfers skip the transfer queue entirely,
+// normal and bulk transfers wait for a slot, with bulk yielding to normal
+// when both are waiting.
+type Priority int
+
+const (
+	PRIORITY_NORMAL Priority = iota
+	PRIORITY_URGENT
+	PRIORITY_BULK
+)
+
+func (p Priority) String() string {
+	switch p {
+	case PRIORITY_URGENT:
+		return "urgent"
+	case PRIORITY_BULK:
+		return "bulk"
+	}
+
+	return "normal"
+}
+
+// Parallelism bounds how many parts a single transfer fetches concurrently.
+// It should be set before any transfers start.
+var Parallelism = 3
+
 // IOMeshage object, which must have a base path to serve files on and a
 // meshage node.
 type IOMeshage struct {
@@ -32,33 +100,155 @@ type IOMeshage struct {
 	node      *meshage.Node         // meshage node to use
 	Messages  chan *meshage.Message // Incoming messages from meshage
 	drainLock sync.RWMutex
-	queue     chan bool
+	queue     *semaphore
 	rand      *rand.Rand
 
-	head string // node to prioritize getting files from (if set)
-	hash bool   // file hashing enabled
+	head     string        // node to prioritize getting files from (if set)
+	hash     bool          // file hashing enabled
+	partSize int64         // size of file parts served by this node
+	timeout  time.Duration // wait for a single message exchange, see SetTimeout
+	lock     *os.File      // advisory lock on the base directory
 
-	// transferLock guards transfers
+	// transferLock guards transfers, history, and recovered
 	transferLock sync.RWMutex
 	transfers    map[string]*Transfer // current transfers
+	history      []*Transfer          // recently finished transfers
+	recovered    map[string]*recovery // partial transfers from a previous instance
 
 	// tidLock guards TIDs
 	tidLock sync.Mutex
 	TIDs    map[int64]chan *Message // transfer ID -> channel
 
-	// hashLock guards hashes
-	hashLock sync.RWMutex
-	hashes   map[string]string
+	// hashLock guards hashes and hashTimes
+	hashLock  sync.RWMutex
+	hashes    map[string]string
+	hashTimes map[string]time.Time // when each cached hash was computed
+
+	// cacheLock guards infoCache
+	cacheLock sync.Mutex
+	infoCache map[string]*infoEntry
+
+	// fetchLock guards fetched and the retention policy
+	fetchLock sync.Mutex
+	fetched   map[string]time.Time // mesh-fetched files -> last use
+
+	// notifyLock guards notify
+	notifyLock sync.Mutex
+	notify     []chan<- string // channels to notify when a transfer completes
+
+	// retention policy for mesh-fetched files, zero values disable pruning
+	pruneAge  time.Duration
+	pruneFree uint64
+	inUse     func(path string) bool
+}
+
+// infoEntry is a cached set of info responses for a single lookup.
+type infoEntry struct {
+	files   *Files
+	expires time.Time
 }
 
 // Transfer describes an in-flight transfer.
 type Transfer struct {
 	Dir      string         // temporary directory hold the file parts
-	Filename string         // file name
+	Filename string         // file name on the source node
+	Dest     string         // destination path relative to the base directory
 	Parts    map[int64]bool // completed parts
 	NumParts int            // total number of parts for this file
-	Inflight int64          // currently in-flight part, -1 if none
+	Inflight map[int64]bool // parts currently being fetched
+	Sources  map[string]int // completed parts per source node
+	Priority Priority
 	Queued   bool
+	Started  time.Time // when the transfer was created
+	Bytes    int64     // bytes received so far
+	Complete bool      // whether the transfer finished with all parts
+	Verified bool      // whether the assembled file matched the source's hash
+	Rejected int       // parts dropped because their checksum didn't match
+	Finished time.Time // when the transfer finished, zero while in flight
+
+	// recent samples for the rolling rate, guarded by transferLock
+	samples []transferSample
+
+	// channels from callers that joined the transfer via Wait, each notified
+	// once when the transfer finishes; guarded by transferLock
+	waiters []chan error
+}
+
+type transferSample struct {
+	when  time.Time
+	bytes int64
+}
+
+// recovery describes a transfer directory left behind by a previous instance.
+type recovery struct {
+	Dir   string          // the old transfer directory
+	Parts map[int64]int64 // parts present on disk -> size in bytes
+}
+
+// addBytes records n received bytes for the rolling rate. The caller must
+// hold transferLock.
+func (t *Transfer) addBytes(n int64) {
+	now := time.Now()
+
+	t.Bytes += n
+	t.samples = append(t.samples, transferSample{now, t.Bytes})
+
+	// prune samples that have aged out of the rate window
+	for len(t.samples) > 1 && now.Sub(t.samples[0].when) > rateWindow {
+		t.samples = t.samples[1:]
+	}
+}
+
+// Rate returns the recent transfer rate in bytes per second. Stalls are
+// visible since the rate decays when no new bytes arrive.
+func (t *Transfer) Rate() float64 {
+	if len(t.samples) == 0 || !t.Finished.IsZero() {
+		return 0
+	}
+
+	first := t.samples[0]
+
+	elapsed := time.Since(first.when).Seconds()
+	if elapsed <= 0 {
+		return 0
+	}
+
+	return float64(t.Bytes-first.bytes) / elapsed
+}
+
+// Duration returns how long the transfer ran, or how long it has been
+// running when still in flight.
+func (t *Transfer) Duration() time.Duration {
+	if t.Finished.IsZero() {
+		return time.Since(t.Started)
+	}
+
+	return t.Finished.Sub(t.Started)
+}
+
+// AverageRate returns the transfer's average rate in bytes per second over
+// its whole duration.
+func (t *Transfer) AverageRate() float64 {
+	elapsed := t.Duration().Seconds()
+	if elapsed <= 0 {
+		return 0
+	}
+
+	return float64(t.Bytes) / elapsed
+}
+
+// ETA estimates the remaining transfer time from the completed part count
+// and the recent rate. Returns 0 when no estimate can be made.
+func (t *Transfer) ETA() time.Duration {
+	rate := t.Rate()
+	if rate <= 0 || len(t.Parts) == 0 {
+		return 0
+	}
+
+	// estimate the total size from the average part size so far
+	total := t.Bytes / int64(len(t.Parts)) * int64(t.NumParts)
+
+	return time.Duration(float64(total-t.Bytes)/rate) * time.Second
 }
 
 var (
@@ -66,11 +256,17 @@ var (
 	// transferred to this node.
 	ErrInFlight = errors.New("file already in flight")
 
-	timeout = time.Duration(30 * time.Second)
+	// errChecksum is returned by xfer when a part payload doesn't match the
+	// checksum the sender computed.
+	errChecksum = errors.New("checksum mismatch")
 )
 
-// New returns a new iomeshage object service base directory via meshage
-func New(base string, node *meshage.Node, head string, hash bool) (*IOMeshage, error) {
+// New returns a new iomeshage object service base directory via meshage.
+// partSize controls the size of the parts this node serves; nodes with
+// different part sizes interoperate since the sender's part size is carried
+// in the message exchange. limit bounds how many transfers run concurrently
+// and can be resized later with SetTransferLimit.
+func New(base string, node *meshage.Node, head string, hash bool, partSize int64, limit int) (*IOMeshage, error) {
 	base = filepath.Clean(base)
 
 	log.Debug("new iomeshage node on base %v", base)
@@ -79,17 +275,39 @@ func New(base string, node *meshage.Node, head string, hash bool) (*IOMeshage, e
 		return nil, err
 	}
 
+	if partSize <= 0 {
+		partSize = PART_SIZE
+	}
+
+	if limit <= 0 {
+		limit = QUEUE_LEN
+	}
+
 	r := &IOMeshage{
 		base:      base,
 		node:      node,
 		Messages:  make(chan *meshage.Message, 1024),
 		TIDs:      make(map[int64]chan *Message),
 		transfers: make(map[string]*Transfer),
-		queue:     make(chan bool, QUEUE_LEN),
+		queue:     newSemaphore(limit),
 		rand:      rand.New(rand.NewSource(time.Now().UnixNano())),
 		head:      head,
 		hash:      hash,
+		partSize:  partSize,
+		timeout:   DEFAULT_TIMEOUT,
 		hashes:    make(map[string]string),
+		hashTimes: make(map[string]time.Time),
+		recovered: make(map[string]*recovery),
+		infoCache: make(map[string]*infoEntry),
+		fetched:   make(map[string]time.Time),
+	}
+
+	r.loadFetched()
+
+	// only reclaim old transfer directories when no other instance shares the
+	// base path, otherwise we'd be deleting its in-flight parts
+	if r.lockBase() {
+		r.recoverTransfers()
 	}
 
 	if hash {
@@ -101,7 +319,417 @@ func New(base string, node *meshage.Node, head string, hash bool) (*IOMeshage, e
 	return r, nil
 }
 
-func (iom *IOMeshage) info(file string) (*Files, error) {
+// NotifyComplete registers a channel that receives the relative destination
+// path of every transfer once the assembled file is in place. Sends block
+// rather than drop, so consumers must drain promptly or buffer generously.
+func (iom *IOMeshage) NotifyComplete(c chan<- string) {
+	iom.notifyLock.Lock()
+	defer iom.notifyLock.Unlock()
+
+	iom.notify = append(iom.notify, c)
+}
+
+// notifyComplete fans a completed transfer out to the registered channels.
+func (iom *IOMeshage) notifyComplete(rel string) {
+	iom.notifyLock.Lock()
+	defer iom.notifyLock.Unlock()
+
+	for _, c := range iom.notify {
+		c <- rel
+	}
+}
+
+// SetTransferLimit resizes the limit on concurrent transfers. Shrinking it
+// below the number of running transfers lets them finish while admitting no
+// new ones until under the limit.
+func (iom *IOMeshage) SetTransferLimit(limit int) {
+	if limit > 0 {
+		iom.queue.setLimit(limit)
+	}
+}
+
+// TransferLimit returns the transfer slots in use and the current limit.
+func (iom *IOMeshage) TransferLimit() (used, limit int) {
+	return iom.queue.status()
+}
+
+// SetTimeout sets how long a single message exchange with another node may
+// take before it is abandoned. The default is DEFAULT_TIMEOUT.
+func (iom *IOMeshage) SetTimeout(d time.Duration) {
+	if d > 0 {
+		iom.timeout = d
+	}
+}
+
+// loadFetched reads the sidecar of mesh-fetched files, if there is one.
+func (iom *IOMeshage) loadFetched() {
+	iom.fetchLock.Lock()
+	defer iom.fetchLock.Unlock()
+
+	data, err := ioutil.ReadFile(filepath.Join(iom.base, fetchedFile))
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Errorln(err)
+		}
+		return
+	}
+
+	if err := json.Unmarshal(data, &iom.fetched); err != nil {
+		log.Errorln(err)
+	}
+}
+
+// saveFetched writes the sidecar of mesh-fetched files. The caller must hold
+// fetchLock.
+func (iom *IOMeshage) saveFetched() {
+	data, err := json.Marshal(iom.fetched)
+	if err != nil {
+		log.Errorln(err)
+		return
+	}
+
+	if err := ioutil.WriteFile(filepath.Join(iom.base, fetchedFile), data, 0644); err != nil {
+		log.Errorln(err)
+	}
+}
+
+// markFetched records that a file came from the mesh so the retention policy
+// applies to it but not to files the user placed locally.
+func (iom *IOMeshage) markFetched(rel string) {
+	iom.fetchLock.Lock()
+	defer iom.fetchLock.Unlock()
+
+	iom.fetched[rel] = time.Now()
+	iom.saveFetched()
+}
+
+// MarkUsed refreshes the last-use timestamp for a mesh-fetched file. Callers
+// should invoke it whenever a file is referenced, e.g. by a VM launch.
+func (iom *IOMeshage) MarkUsed(path string) {
+	if !filepath.IsAbs(path) {
+		path = iom.cleanPath(path)
+	}
+
+	rel, err := filepath.Rel(iom.base, path)
+	if err != nil {
+		return
+	}
+
+	iom.fetchLock.Lock()
+	defer iom.fetchLock.Unlock()
+
+	if _, ok := iom.fetched[rel]; ok {
+		iom.fetched[rel] = time.Now()
+		iom.saveFetched()
+	}
+}
+
+// SetRetention configures the retention policy for mesh-fetched files: files
+// unused for longer than age, or the least recently used files when free
+// space in the base directory drops below free bytes, are pruned. inUse, if
+// set, vetoes pruning files that are still referenced (e.g. by defined VMs).
+// A configured policy also runs periodically in the background.
+func (iom *IOMeshage) SetRetention(age time.Duration, free uint64, inUse func(string) bool) {
+	iom.fetchLock.Lock()
+	iom.pruneAge = age
+	iom.pruneFree = free
+	iom.inUse = inUse
+	iom.fetchLock.Unlock()
+
+	if age > 0 || free > 0 {
+		go func() {
+			for {
+				time.Sleep(pruneInterval)
+
+				if pruned, err := iom.Prune(false); err != nil {
+					log.Errorln(err)
+				} else if len(pruned) > 0 {
+					log.Info("pruned %v mesh-fetched files", len(pruned))
+				}
+			}
+		}()
+	}
+}
+
+// Prune applies the retention policy to mesh-fetched files, returning the
+// files it removed. With dryRun, nothing is removed and the returned files
+// are the ones that would have been.
+func (iom *IOMeshage) Prune(dryRun bool) ([]string, error) {
+	iom.fetchLock.Lock()
+	defer iom.fetchLock.Unlock()
+
+	if iom.pruneAge == 0 && iom.pruneFree == 0 {
+		return nil, errors.New("no retention policy configured, see -filemaxage and -fileminfree")
+	}
+
+	// consider the least recently used files first so free-space pruning
+	// removes the stalest ones
+	var candidates []string
+	for rel := range iom.fetched {
+		candidates = append(candidates, rel)
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		return iom.fetched[candidates[i]].Before(iom.fetched[candidates[j]])
+	})
+
+	var pruned []string
+
+	for _, rel := range candidates {
+		path := iom.cleanPath(rel)
+
+		if _, err := os.Stat(path); err != nil {
+			// the file is already gone, drop the bookkeeping
+			delete(iom.fetched, rel)
+			continue
+		}
+
+		expired := iom.pruneAge > 0 && time.Since(iom.fetched[rel]) > iom.pruneAge
+		low := iom.pruneFree > 0 && iom.freeSpace() < iom.pruneFree
+
+		if !expired && !low {
+			continue
+		}
+
+		if iom.inUse != nil && iom.inUse(path) {
+			log.Debug("not pruning %v, still in use", rel)
+			continue
+		}
+
+		pruned = append(pruned, rel)
+
+		if dryRun {
+			continue
+		}
+
+		log.Info("pruning %v, last used %v", rel, iom.fetched[rel].Format(time.RFC3339))
+
+		if err := os.Remove(path); err != nil {
+			return pruned, err
+		}
+
+		delete(iom.fetched, rel)
+	}
+
+	if !dryRun {
+		iom.saveFetched()
+	}
+
+	return pruned, nil
+}
+
+// freeSpace returns the bytes available on the filesystem holding the base
+// directory.
+func (iom *IOMeshage) freeSpace() uint64 {
+	var fs syscall.Statfs_t
+
+	if err := syscall.Statfs(iom.base, &fs); err != nil {
+		log.Errorln(err)
+		// don't let a stat failure trigger pruning
+		return ^uint64(0)
+	}
+
+	return fs.Bavail * uint64(fs.Bsize)
+}
+
+// lockBase takes an advisory lock on the base directory. Two instances
+// sharing a base path is a misconfiguration, but it shouldn't cost anyone
+// their in-flight transfers.
+func (iom *IOMeshage) lockBase() bool {
+	f, err := os.OpenFile(filepath.Join(iom.base, lockFileName), os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		log.Errorln(err)
+		return false
+	}
+
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		log.Warn("files directory %v is in use by another instance, skipping transfer recovery", iom.base)
+		f.Close()
+		return false
+	}
+
+	// hold the lock for the life of the process
+	iom.lock = f
+
+	return true
+}
+
+// recoverTransfers scans the base directory for transfer_ directories left
+// behind by a previous instance. Directories holding parsable file parts are
+// kept so the next Get of the same file only fetches the missing parts;
+// anything else is an orphan and is removed.
+func (iom *IOMeshage) recoverTransfers() {
+	dirs, err := filepath.Glob(filepath.Join(iom.base, "transfer_*"))
+	if err != nil {
+		log.Errorln(err)
+		return
+	}
+
+	for _, dir := range dirs {
+		fi, err := os.Stat(dir)
+		if err != nil || !fi.IsDir() {
+			continue
+		}
+
+		files, err := ioutil.ReadDir(dir)
+		if err != nil {
+			log.Errorln(err)
+			continue
+		}
+
+		// parts are named <file>.part_<n>
+		var name string
+		r := &recovery{Dir: dir, Parts: make(map[int64]int64)}
+
+		for _, f := range files {
+			i := strings.LastIndex(f.Name(), ".part_")
+			if i < 1 {
+				continue
+			}
+
+			p, err := strconv.ParseInt(f.Name()[i+len(".part_"):], 10, 64)
+			if err != nil {
+				continue
+			}
+
+			if name != "" && name != f.Name()[:i] {
+				// parts from more than one file, something else made this
+				name = ""
+				break
+			}
+
+			name = f.Name()[:i]
+			r.Parts[p] = f.Size()
+		}
+
+		if name == "" || len(r.Parts) == 0 {
+			var reclaimed int64
+			for _, f := range files {
+				reclaimed += f.Size()
+			}
+
+			log.Info("removing orphaned transfer directory %v, reclaiming %v bytes", dir, reclaimed)
+			if err := os.RemoveAll(dir); err != nil {
+				log.Errorln(err)
+			}
+			continue
+		}
+
+		if prev, ok := iom.recovered[name]; ok {
+			// a newer directory for the same file supersedes the old one
+			log.Info("removing superseded transfer directory: %v", prev.Dir)
+			if err := os.RemoveAll(prev.Dir); err != nil {
+				log.Errorln(err)
+			}
+		}
+
+		log.Info("recovered %v parts of %v from %v", len(r.Parts), name, dir)
+		iom.recovered[name] = r
+	}
+}
+
+// recoverTransfer reuses a recovered transfer directory when one matches the
+// file, returning the directory and the parts that pass verification so only
+// the rest need to be fetched. Falls back to a fresh temporary directory.
+func (iom *IOMeshage) recoverTransfer(use *Message) (string, map[int64]bool, error) {
+	parts := make(map[int64]bool)
+
+	name := filepath.Base(use.Filename)
+
+	iom.transferLock.Lock()
+	r, ok := iom.recovered[name]
+	delete(iom.recovered, name)
+	iom.transferLock.Unlock()
+
+	if !ok {
+		tdir, err := ioutil.TempDir(iom.base, "transfer_")
+		return tdir, parts, err
+	}
+
+	partSize := use.PartSize
+	if partSize == 0 {
+		partSize = PART_SIZE
+	}
+
+	for p, size := range r.Parts {
+		// verify by size: every part except the final one is exactly one
+		// part long. TODO: verify by hash once per-part checksums exist.
+		if p >= use.Part || size == 0 || size > partSize || (p < use.Part-1 && size != partSize) {
+			fname := fmt.Sprintf("%v/%v.part_%v", r.Dir, name, p)
+			log.Debug("discarding unverifiable filepart %v", fname)
+			if err := os.Remove(fname); err != nil {
+				log.Errorln(err)
+			}
+			continue
+		}
+
+		parts[p] = true
+	}
+
+	log.Info("resuming transfer of %v with %v of %v parts", use.Filename, len(parts), use.Part)
+
+	return r.Dir, parts, nil
+}
+
+// cachedInfo returns a previously cached set of info responses for the file,
+// or nil if there isn't one or it has expired.
+func (iom *IOMeshage) cachedInfo(file string) *Files {
+	iom.cacheLock.Lock()
+	defer iom.cacheLock.Unlock()
+
+	e, ok := iom.infoCache[file]
+	if !ok {
+		return nil
+	}
+
+	if time.Now().After(e.expires) {
+		delete(iom.infoCache, file)
+		return nil
+	}
+
+	return e.files
+}
+
+// cacheInfo remembers a set of info responses for a short window so
+// back-to-back lookups don't re-broadcast to the whole mesh.
+func (iom *IOMeshage) cacheInfo(file string, files *Files) {
+	iom.cacheLock.Lock()
+	defer iom.cacheLock.Unlock()
+
+	iom.infoCache[file] = &infoEntry{
+		files:   files,
+		expires: time.Now().Add(infoCacheTTL),
+	}
+}
+
+// uncacheInfo drops the cached info responses for a single file.
+func (iom *IOMeshage) uncacheInfo(file string) {
+	iom.cacheLock.Lock()
+	defer iom.cacheLock.Unlock()
+
+	delete(iom.infoCache, file)
+}
+
+// FlushInfoCache drops all cached info responses. The cache is invalidated
+// automatically when a transfer from a cached source fails or the local file
+// list changes; this is the escape hatch for everything else.
+func (iom *IOMeshage) FlushInfoCache() {
+	iom.cacheLock.Lock()
+	defer iom.cacheLock.Unlock()
+
+	iom.infoCache = make(map[string]*infoEntry)
+}
+
+func (iom *IOMeshage) info(ctx context.Context, file string, excludes []string, depth int) (*Files, error) {
+	// filtered lookups are cached separately from plain ones
+	key := file
+	if len(excludes) > 0 || depth > 0 {
+		key = fmt.Sprintf("%v|%v|%v", file, strings.Join(excludes, ","), depth)
+	}
+
+	if files := iom.cachedInfo(key); files != nil {
+		return files, nil
+	}
+
 	TID, c := iom.newTID()
 	defer iom.unregisterTID(TID)
 
@@ -110,6 +738,8 @@ func (iom *IOMeshage) info(file string) (*Files, error) {
 		Type:     TYPE_INFO,
 		Filename: file,
 		TID:      TID,
+		Exclude:  excludes,
+		MaxDepth: depth,
 	}
 
 	recipients, err := iom.node.Broadcast(m)
@@ -137,67 +767,52 @@ func (iom *IOMeshage) info(file string) (*Files, error) {
 
 				info.add(resp)
 			}
-		case <-time.After(timeout):
+		case <-time.After(iom.timeout):
 			return nil, fmt.Errorf("timeout")
+		case <-ctx.Done():
+			return nil, ctx.Err()
 		}
 	}
 
+	iom.cacheInfo(key, info)
+
 	return info, nil
 }
 
 // search the mesh for the file/glob/directory, returning a slice of string
-// matches. The search includes local matches.
-func (iom *IOMeshage) Info(file string) []string {
+// matches. The search includes local matches. excludes and depth filter the
+// results the same way they filter GetFiltered, so the listing previews what
+// a get would pull.
+func (iom *IOMeshage) Info(file string, excludes []string, depth int) []string {
 	var ret []string
 
 	// search locally
 	files, _ := iom.List(file, true)
-	for _, file := range files {
-		ret = append(ret, iom.Rel(file))
-	}
+	for _, f := range files {
+		rel := iom.Rel(f)
 
-	// search the mesh
-	TID, c := iom.newTID()
-	defer iom.unregisterTID(TID)
+		if excludeMatch(rel, excludes) || tooDeep(rel, file, depth) {
+			continue
+		}
 
-	m := &Message{
-		From:     iom.node.Name(),
-		Type:     TYPE_INFO,
-		Filename: file,
-		TID:      TID,
+		ret = append(ret, rel)
 	}
-	recipients, err := iom.node.Broadcast(m)
+
+	// search the mesh
+	info, err := iom.info(context.Background(), file, excludes, depth)
 	if err != nil {
 		log.Errorln(err)
 		return nil
 	}
-	if log.WillLog(log.DEBUG) {
-		log.Debug("sent info request to %v nodes", len(recipients))
-	}
 
-	// wait for n responses, or a timeout
-	for i := 0; i < len(recipients); i++ {
-		select {
-		case resp := <-c:
-			if log.WillLog(log.DEBUG) {
-				log.Debugln("got response: ", resp)
-			}
-			if resp.ACK {
-				if log.WillLog(log.DEBUG) {
-					log.Debugln("got info from: ", resp.From)
-				}
-				if len(resp.Glob) == 0 {
-					// exact match unless the exact match is the original glob
-					if !strings.Contains(resp.Filename, "*") {
-						ret = append(ret, resp.Filename)
-					}
-				} else {
-					ret = append(ret, resp.Glob...)
-				}
+	for _, resp := range info.messages() {
+		if len(resp.Glob) == 0 {
+			// exact match unless the exact match is the original glob
+			if !strings.Contains(resp.Filename, "*") {
+				ret = append(ret, resp.Filename)
 			}
-		case <-time.After(timeout):
-			log.Errorln(fmt.Errorf("timeout"))
-			return nil
+		} else {
+			ret = append(ret, resp.Glob...)
 		}
 	}
 
@@ -209,11 +824,93 @@ func (iom *IOMeshage) Info(file string) []string {
 // directory, the entire directory will be recursively transferred. If the file
 // already exists on this node, Get will return immediately with no error.
 func (iom *IOMeshage) Get(file string) error {
+	return iom.get(context.Background(), file, file, PRIORITY_NORMAL, nil, 0)
+}
+
+// GetContext retrieves a file like Get, bounded by ctx. Cancellation stops
+// any outstanding waits and releases the transfer's queue slot and temporary
+// directory. A deadline also bounds the transfer itself, which continues in
+// the background after GetContext returns.
+func (iom *IOMeshage) GetContext(ctx context.Context, file string) error {
+	return iom.get(ctx, file, file, PRIORITY_NORMAL, nil, 0)
+}
+
+// GetPriority retrieves a file like GetContext at the given priority.
+func (iom *IOMeshage) GetPriority(ctx context.Context, file string, priority Priority) error {
+	return iom.get(ctx, file, file, priority, nil, 0)
+}
+
+// GetFiltered retrieves a directory or glob like GetContext, skipping files
+// that match one of the exclusion patterns or sit more than depth directories
+// below the requested path. Exclusions are matched against relative paths.
+func (iom *IOMeshage) GetFiltered(ctx context.Context, file string, excludes []string, depth int) error {
+	return iom.get(ctx, file, file, PRIORITY_NORMAL, excludes, depth)
+}
+
+// GetAs retrieves a file like Get but stores it under dst, relative to the
+// base directory. Destinations that escape the base directory are refused.
+// Transfers are keyed on the destination, so simultaneous gets of the same
+// source to different destinations are independent.
+func (iom *IOMeshage) GetAs(ctx context.Context, file, dst string) error {
+	return iom.get(ctx, file, dst, PRIORITY_NORMAL, nil, 0)
+}
+
+// GetWait retrieves a file like GetContext but blocks until the transfer
+// finishes. When the file is already in flight, GetWait joins the existing
+// transfer instead of returning ErrInFlight, so every caller waiting on one
+// transfer sees the same result.
+func (iom *IOMeshage) GetWait(ctx context.Context, file string) error {
+	if err := iom.get(ctx, file, file, PRIORITY_NORMAL, nil, 0); err != nil && !errors.Is(err, ErrInFlight) {
+		return err
+	}
+
+	return iom.Wait(ctx, file)
+}
+
+// Wait blocks until any in-flight transfer to the destination finishes and
+// returns the transfer's result. All waiters on one transfer succeed or fail
+// together. Returns immediately when nothing is in flight.
+func (iom *IOMeshage) Wait(ctx context.Context, dst string) error {
+	rel, err := filepath.Rel(iom.base, iom.cleanPath(dst))
+	if err != nil || strings.HasPrefix(rel, "..") {
+		return fmt.Errorf("invalid destination: %v", dst)
+	}
+
+	iom.transferLock.Lock()
+
+	t, ok := iom.transfers[rel]
+	if !ok {
+		iom.transferLock.Unlock()
+		return nil
+	}
+
+	c := make(chan error, 1)
+	t.waiters = append(t.waiters, c)
+	iom.transferLock.Unlock()
+
+	select {
+	case err := <-c:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (iom *IOMeshage) get(ctx context.Context, file, dst string, priority Priority, excludes []string, depth int) error {
 	var exists bool
 
-	// If this is a file, and it currently exists locally on disk, and we're not
-	// in -headnode mode, then don't attempt to get the file from the mesh.
-	fi, err := os.Stat(filepath.Join(iom.base, file))
+	// clean the destination, refusing anything that escapes the base
+	// directory
+	rel, err := filepath.Rel(iom.base, iom.cleanPath(dst))
+	if err != nil || strings.HasPrefix(rel, "..") {
+		return fmt.Errorf("invalid destination: %v", dst)
+	}
+	dst = rel
+
+	// If the destination is a file, and it currently exists locally on disk,
+	// and we're not in -headnode mode, then don't attempt to get the file
+	// from the mesh.
+	fi, err := os.Stat(filepath.Join(iom.base, dst))
 	if err == nil && !fi.IsDir() {
 		if iom.head == "" {
 			return nil
@@ -222,16 +919,16 @@ func (iom *IOMeshage) Get(file string) error {
 		exists = true
 	}
 
-	// is this file already in flight?
+	// is this destination already in flight?
 	iom.transferLock.RLock()
-	_, ok := iom.transfers[file]
+	_, ok := iom.transfers[dst]
 	iom.transferLock.RUnlock()
 
 	if ok {
 		return ErrInFlight
 	}
 
-	info, err := iom.info(file)
+	info, err := iom.info(ctx, file, excludes, depth)
 	if err != nil {
 		return err
 	}
@@ -248,7 +945,7 @@ func (iom *IOMeshage) Get(file string) error {
 				continue
 			}
 
-			use, ok := info.use(v.Filename, iom.getHash(v.Filename), exists)
+			use, ok := info.use(v.Filename, iom.getHash(dst), exists)
 			if !ok { // should never happen since this isn't a glob
 				log.Error("unable to determine where to get file %s from", v.Filename)
 				continue
@@ -261,8 +958,29 @@ func (iom *IOMeshage) Get(file string) error {
 
 			log.Info("found file on node %v with %v parts", use.From, use.Part)
 
-			// create a transfer object
-			tdir, err := ioutil.TempDir(iom.base, "transfer_")
+			// store under the requested destination; anything else that
+			// turned up in the responses keeps its own name
+			dest := dst
+			if use.Filename != file {
+				dest = use.Filename
+			}
+
+			// the source advertised a symlink -- recreate it rather than
+			// copying the target's content under the link's name, unless the
+			// target escapes the source's base directory and the content has
+			// to be materialized
+			if use.Link != "" && (use.LinkRel != "" || use.Part == 0) {
+				if err := iom.recreateLink(ctx, dest, use, priority); err != nil {
+					return err
+				}
+
+				inflight[use.Filename] = true
+				continue
+			}
+
+			// create a transfer object, reusing any parts recovered from an
+			// interrupted transfer of the same file
+			tdir, parts, err := iom.recoverTransfer(use)
 			if err != nil {
 				return err
 			}
@@ -270,19 +988,49 @@ func (iom *IOMeshage) Get(file string) error {
 			transfer := &Transfer{
 				Dir:      tdir,
 				Filename: use.Filename,
-				Parts:    make(map[int64]bool),
+				Dest:     dest,
+				Parts:    parts,
 				NumParts: int(use.Part),
-				Inflight: -1,
+				Inflight: make(map[int64]bool),
+				Sources:  make(map[string]int),
+				Priority: priority,
 				Queued:   true,
+				Started:  time.Now(),
 			}
 
 			iom.transferLock.Lock()
-			iom.transfers[use.Filename] = transfer
+			iom.transfers[dest] = transfer
 			iom.transferLock.Unlock()
 
-			go iom.getParts(use)
+			// every node holding the same version of the file can serve
+			// parts, fan the fetches out across all of them
+			var sources []*Message
+			for _, msg := range info.messages() {
+				if len(msg.Glob) == 0 && msg.Filename == use.Filename && msg.Part == use.Part && msg.Hash == use.Hash {
+					sources = append(sources, msg)
+				}
+			}
+
+			// the transfer itself runs in the background: carry the
+			// caller's deadline over but not its cancellation, since the
+			// caller regains control as soon as the transfer begins
+			tctx := context.Background()
+			tcancel := context.CancelFunc(func() {})
+			if d, ok := ctx.Deadline(); ok {
+				tctx, tcancel = context.WithDeadline(tctx, d)
+			}
+
+			go func() {
+				defer tcancel()
+				iom.getParts(tctx, dest, use, sources)
+			}()
+
 			inflight[use.Filename] = true
 		} else {
+			if dst != file {
+				return fmt.Errorf("cannot use a destination with a directory or glob: %v", file)
+			}
+
 			// call Get on each of the constituent files, queued in a random order
 
 			// fisher-yates shuffle
@@ -293,55 +1041,300 @@ func (iom *IOMeshage) Get(file string) error {
 				v.Glob[i] = t
 			}
 
-			for _, x := range v.Glob {
-				if _, ok := inflight[x]; ok {
-					continue
-				}
+			for _, x := range v.Glob {
+				if _, ok := inflight[x]; ok {
+					continue
+				}
+
+				// filter again in case the source was an older node that
+				// ignored the exclusions in the request
+				if excludeMatch(x, excludes) || tooDeep(x, file, depth) {
+					continue
+				}
+
+				if err := iom.get(ctx, x, x, priority, nil, 0); err != nil {
+					if !errors.Is(err, ErrInFlight) {
+						return err
+					}
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+// recreateLink reproduces a symlink advertised by a source node. When the
+// target lives under the base directory it is fetched first, joining any
+// transfer already in flight, and the link is recreated relative to the local
+// copy. A dangling link is recreated with its raw target.
+func (iom *IOMeshage) recreateLink(ctx context.Context, dest string, use *Message, priority Priority) error {
+	abs := filepath.Join(iom.base, dest)
+
+	if err := os.MkdirAll(filepath.Dir(abs), 0755); err != nil {
+		return err
+	}
+
+	target := use.Link
+
+	if use.LinkRel != "" {
+		if err := iom.get(ctx, use.LinkRel, use.LinkRel, priority, nil, 0); err != nil && !errors.Is(err, ErrInFlight) {
+			return err
+		}
+		if err := iom.Wait(ctx, use.LinkRel); err != nil {
+			return err
+		}
+
+		// point the link at the local copy of the target, relative to the
+		// link itself so it survives the base directory moving
+		rel, err := filepath.Rel(filepath.Dir(abs), filepath.Join(iom.base, use.LinkRel))
+		if err != nil {
+			return err
+		}
+		target = rel
+	}
+
+	// replace a stale link from an earlier fetch
+	if fi, err := os.Lstat(abs); err == nil && fi.Mode()&os.ModeSymlink != 0 {
+		os.Remove(abs)
+	}
+
+	log.Info("recreating symlink %v -> %v", dest, target)
+
+	if err := os.Symlink(target, abs); err != nil {
+		return err
+	}
+
+	iom.FlushInfoCache()
+
+	return nil
+}
+
+// streamSource resolves which node a stream of the file should come from,
+// returning nil when the local copy should be used.
+func (iom *IOMeshage) streamSource(ctx context.Context, file string) (*Message, error) {
+	var exists bool
+
+	// If this is a file, and it currently exists locally on disk, and we're not
+	// in -headnode mode, then stream it.
+	fi, err := os.Stat(filepath.Join(iom.base, file))
+	if err == nil && !fi.IsDir() {
+		if iom.head == "" {
+			return nil, nil
+		}
+
+		exists = true
+	}
+
+	info, err := iom.info(ctx, file, nil, 0)
+	if err != nil {
+		return nil, err
+	}
+	if len(info.messages()) == 0 {
+		return nil, fmt.Errorf("stream %v: file not found", file)
+	}
+
+	use, ok := info.use(file, iom.getHash(file), exists)
+	if !ok {
+		return nil, errors.New("cannot stream a glob")
+	}
+
+	return use, nil
+}
+
+// MeshList broadcasts a listing request for path and returns the files each
+// node reported, keyed by node name, including this node's own. Nodes that
+// don't answer before the timeout are returned separately rather than failing
+// the listing.
+func (iom *IOMeshage) MeshList(path string) (map[string][]FileInfo, []string, error) {
+	TID, c := iom.newTID()
+	defer iom.unregisterTID(TID)
+
+	m := &Message{
+		From:     iom.node.Name(),
+		Type:     TYPE_INFO,
+		Filename: path,
+		TID:      TID,
+		Sync:     true,
+	}
+
+	recipients, err := iom.node.Broadcast(m)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	res := make(map[string][]FileInfo)
+
+	// the broadcast doesn't include us
+	var local []FileInfo
+	files, _ := iom.List(path, true)
+	for _, f := range files {
+		if !f.IsDir() {
+			local = append(local, iom.manifestEntry(f))
+		}
+	}
+	res[iom.node.Name()] = local
+
+	pending := make(map[string]bool)
+	for _, r := range recipients {
+		pending[r] = true
+	}
+
+	for i := 0; i < len(recipients); i++ {
+		select {
+		case resp := <-c:
+			delete(pending, resp.From)
+
+			if resp.ACK {
+				res[resp.From] = resp.Manifest
+			} else {
+				// the node responded but doesn't have the file
+				res[resp.From] = nil
+			}
+		case <-time.After(iom.timeout):
+			// report the stragglers instead of failing the listing
+			var silent []string
+			for r := range pending {
+				silent = append(silent, r)
+			}
+			sort.Strings(silent)
+
+			return res, silent, nil
+		}
+	}
+
+	return res, nil, nil
+}
+
+// Sync compares the local copy of dir against the mesh and fetches only the
+// files that are missing locally or whose hash differs from the source. When
+// prune is set, local files below dir that the source doesn't have are
+// deleted. Returns the files being fetched and the files pruned. Sync is
+// restartable: files already transferred are skipped and interrupted
+// transfers resume from the parts on disk.
+func (iom *IOMeshage) Sync(dir string, prune bool) (fetched, pruned []string, err error) {
+	manifest, err := iom.syncManifest(dir)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// index the local files below dir
+	local := make(map[string]FileInfo)
+
+	files, _ := iom.List(dir, true)
+	for _, f := range files {
+		if !f.IsDir() {
+			local[iom.Rel(f)] = f
+		}
+	}
+
+	remote := make(map[string]bool)
+
+	for _, f := range manifest {
+		remote[f.Path] = true
+
+		if l, ok := local[f.Path]; ok {
+			if l.Size == f.Size && (f.Hash == "" || iom.Hash(l.Path) == f.Hash) {
+				continue
+			}
+
+			// the local copy is different, replace it
+			if err := os.Remove(l.Path); err != nil {
+				return fetched, pruned, err
+			}
+		}
+
+		if err := iom.Get(f.Path); err != nil && !errors.Is(err, ErrInFlight) {
+			return fetched, pruned, err
+		}
+
+		fetched = append(fetched, f.Path)
+	}
+
+	if prune {
+		for rel, f := range local {
+			if remote[rel] {
+				continue
+			}
+
+			log.Info("pruning %v, not present on the sync source", rel)
+
+			if err := os.Remove(f.Path); err != nil {
+				return fetched, pruned, err
+			}
+
+			pruned = append(pruned, rel)
+		}
+	}
+
+	return fetched, pruned, nil
+}
+
+// syncManifest asks the mesh for a manifest of the files below dir,
+// preferring the head node's answer when one is configured.
+func (iom *IOMeshage) syncManifest(dir string) ([]FileInfo, error) {
+	TID, c := iom.newTID()
+	defer iom.unregisterTID(TID)
+
+	m := &Message{
+		From:     iom.node.Name(),
+		Type:     TYPE_INFO,
+		Filename: dir,
+		TID:      TID,
+		Sync:     true,
+	}
+
+	recipients, err := iom.node.Broadcast(m)
+	if err != nil {
+		return nil, err
+	}
+
+	var manifest []FileInfo
+
+	for i := 0; i < len(recipients); i++ {
+		select {
+		case resp := <-c:
+			if !resp.ACK || len(resp.Manifest) == 0 {
+				continue
+			}
+
+			if resp.From == iom.head {
+				// the canonical copy
+				return resp.Manifest, nil
+			}
 
-				if err := iom.Get(x); err != nil {
-					if !errors.Is(err, ErrInFlight) {
-						return err
-					}
-				}
+			if manifest == nil {
+				manifest = resp.Manifest
 			}
+		case <-time.After(iom.timeout):
+			return nil, fmt.Errorf("timeout")
 		}
 	}
 
-	return nil
+	if manifest == nil {
+		return nil, fmt.Errorf("sync %v: not found on the mesh", dir)
+	}
+
+	return manifest, nil
 }
 
 // Stream requests each part of the file in order, returning a channel to read
 // the parts from. This does not store the file locally to avoid filling up the
 // local disk.
 func (iom *IOMeshage) Stream(file string) (chan []byte, error) {
-	var exists bool
-
-	// If this is a file, and it currently exists locally on disk, and we're not
-	// in -headnode mode, then stream it.
-	fi, err := os.Stat(filepath.Join(iom.base, file))
-	if err == nil && !fi.IsDir() {
-		if iom.head == "" {
-			return stream(filepath.Join(iom.base, file))
-		}
-
-		exists = true
-	}
+	return iom.StreamContext(context.Background(), file)
+}
 
-	info, err := iom.info(file)
+// StreamContext streams a file like Stream, bounded by ctx. Cancellation
+// stops the part fetches, releases the queue slot, and closes the channel.
+func (iom *IOMeshage) StreamContext(ctx context.Context, file string) (chan []byte, error) {
+	use, err := iom.streamSource(ctx, file)
 	if err != nil {
 		return nil, err
 	}
-	if len(info.messages()) == 0 {
-		return nil, fmt.Errorf("stream %v: file not found", file)
-	}
-
-	use, ok := info.use(file, iom.getHash(file), exists)
-	if !ok {
-		return nil, errors.New("cannot stream a glob")
-	}
 
 	if use == nil {
-		return stream(filepath.Join(iom.base, file))
+		return stream(filepath.Join(iom.base, file), iom.partSize)
 	}
 
 	out := make(chan []byte)
@@ -354,43 +1347,226 @@ func (iom *IOMeshage) Stream(file string) (chan []byte, error) {
 		}
 
 		// get in line
-		iom.queue <- true
-		defer func() {
-			<-iom.queue
-		}()
+		if err := iom.enqueue(ctx, PRIORITY_NORMAL); err != nil {
+			log.Error("stream failed: %v", err)
+			return
+		}
+		defer iom.dequeue(PRIORITY_NORMAL)
 
 		for i := int64(0); i < use.Part; i++ {
-			data, err := iom.xfer(use, i)
+			data, err := iom.xfer(ctx, use, i)
 			if err != nil {
 				log.Error("stream failed: %v", err)
 				return
 			}
 
-			out <- data
+			select {
+			case out <- data:
+			case <-ctx.Done():
+				return
+			}
 		}
 	}()
 
 	return out, nil
 }
 
-// Get a file with msg.Part parts. getParts will randomize the order of the
-// parts to maximize the distributed transfer behavior of iomeshage when used at
-// scale.
-func (iom *IOMeshage) getParts(msg *Message) {
-	defer iom.destroyTempTransfer(msg.Filename)
+// StreamReader returns the file as an io.ReadCloser built on the same
+// part-fetch loop as Stream. Reads may consume any fraction of a part, a
+// mid-stream transfer failure surfaces as a read error, and Close stops
+// requesting parts and releases the queue slot promptly.
+func (iom *IOMeshage) StreamReader(file string) (io.ReadCloser, error) {
+	use, err := iom.streamSource(context.Background(), file)
+	if err != nil {
+		return nil, err
+	}
+
+	if use == nil {
+		return os.Open(filepath.Join(iom.base, file))
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	r := &streamReader{
+		parts:  make(chan []byte),
+		errs:   make(chan error, 1),
+		cancel: cancel,
+	}
+
+	go func() {
+		defer close(r.parts)
+
+		if log.WillLog(log.DEBUG) {
+			log.Debug("found file on node %v with %v parts", use.From, use.Part)
+		}
+
+		// get in line
+		if err := iom.enqueue(ctx, PRIORITY_NORMAL); err != nil {
+			return
+		}
+		defer iom.dequeue(PRIORITY_NORMAL)
+
+		for i := int64(0); i < use.Part; i++ {
+			data, err := iom.xfer(ctx, use, i)
+			if err != nil {
+				r.errs <- fmt.Errorf("stream %v: %w", file, err)
+				return
+			}
+
+			select {
+			case r.parts <- data:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return r, nil
+}
+
+// streamReader adapts a part stream to an io.ReadCloser.
+type streamReader struct {
+	parts  chan []byte        // parts from the producer, closed when it exits
+	errs   chan error         // the producer's failure, if any
+	cancel context.CancelFunc // stops the producer
+
+	buf []byte // remainder of the current part
+	err error  // sticky error
+}
+
+func (r *streamReader) Read(p []byte) (int, error) {
+	for len(r.buf) == 0 {
+		if r.err != nil {
+			return 0, r.err
+		}
+
+		data, ok := <-r.parts
+		if !ok {
+			// the producer exited: either the stream is done or it failed
+			select {
+			case err := <-r.errs:
+				r.err = err
+			default:
+				r.err = io.EOF
+			}
+
+			continue
+		}
+
+		r.buf = data
+	}
+
+	n := copy(p, r.buf)
+	r.buf = r.buf[n:]
+
+	return n, nil
+}
+
+// Close stops the producer. Any parts still in flight are dropped.
+func (r *streamReader) Close() error {
+	r.cancel()
+
+	return nil
+}
+
+// enqueue takes a transfer slot according to priority, giving up when ctx is
+// done. Urgent transfers don't wait for one. Bulk transfers back off between
+// attempts so a waiting normal transfer usually wins the slot, but age into
+// normal priority after bulkMaxWait so they can't starve.
+func (iom *IOMeshage) enqueue(ctx context.Context, priority Priority) error {
+	switch priority {
+	case PRIORITY_URGENT:
+		return nil
+	case PRIORITY_BULK:
+		for start := time.Now(); time.Since(start) < bulkMaxWait; {
+			if iom.queue.tryAcquire() {
+				return nil
+			}
+
+			// yield to any waiting normal transfer
+			select {
+			case <-time.After(bulkYield):
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+	}
+
+	return iom.queue.acquire(ctx)
+}
+
+// dequeue releases the transfer slot taken by enqueue, if any.
+func (iom *IOMeshage) dequeue(priority Priority) {
+	if priority == PRIORITY_URGENT {
+		return
+	}
+
+	iom.queue.release()
+}
+
+// Get a file with msg.Part parts, fetching from the nodes in sources and
+// storing it under dest. If the assembled file fails hash verification, the
+// parts are discarded and the transfer is retried once.
+func (iom *IOMeshage) getParts(ctx context.Context, dest string, msg *Message, sources []*Message) {
+	defer iom.destroyTempTransfer(dest)
 
 	// corner case - empty file
 	if msg.Part == 0 {
-		fname := filepath.Join(iom.base, msg.Filename)
+		fname := filepath.Join(iom.base, dest)
 		log.Debug("file %v has 0 parts, creating empty file", fname)
 
 		if err := touch(fname, msg.Perm); err != nil {
 			log.Error("touch failed: %v", err)
+		} else {
+			iom.markFetched(dest)
+			iom.notifyComplete(dest)
 		}
 
 		return
 	}
 
+	iom.transferLock.RLock()
+	priority := iom.transfers[dest].Priority
+	iom.transferLock.RUnlock()
+
+	// get in line
+	if err := iom.enqueue(ctx, priority); err != nil {
+		log.Info("canceled queued transfer of %v: %v", dest, err)
+		return
+	}
+	defer iom.dequeue(priority)
+
+	iom.transferLock.Lock()
+	iom.transfers[dest].Queued = false
+	iom.transferLock.Unlock()
+
+	if len(sources) == 0 {
+		sources = []*Message{msg}
+	}
+
+	for attempt := 0; attempt < 2; attempt++ {
+		if !iom.fetchParts(ctx, dest, msg, sources) {
+			// a cached source may have gone away, force rediscovery
+			iom.uncacheInfo(msg.Filename)
+			return
+		}
+
+		log.Info("got all parts for %v", msg.Filename)
+
+		if iom.assembleParts(dest, msg) {
+			return
+		}
+
+		// the parts were discarded, fetch everything again
+	}
+}
+
+// fetchParts fetches any parts of the file not already on disk, returning
+// whether every part was transferred. The parts are fetched in a random order
+// to maximize the distributed transfer behavior of iomeshage when used at
+// scale, up to Parallelism at a time, spread across all the nodes in sources
+// that hold the file.
+func (iom *IOMeshage) fetchParts(ctx context.Context, dest string, msg *Message, sources []*Message) bool {
 	// create a random list of parts to grab
 	var (
 		parts []int64
@@ -409,68 +1585,132 @@ func (iom *IOMeshage) getParts(msg *Message) {
 		parts[i] = t
 	}
 
-	// get in line
-	iom.queue <- true
-	defer func() {
-		<-iom.queue
-	}()
+	parallel := Parallelism
+	if parallel < 1 {
+		parallel = 1
+	}
+	if parallel > len(parts) {
+		parallel = len(parts)
+	}
 
-	iom.transferLock.Lock()
-	iom.transfers[msg.Filename].Queued = false
-	iom.transferLock.Unlock()
+	var (
+		mu     sync.Mutex
+		failed bool
+	)
 
-Outer:
-	for _, p := range parts {
-		// attempt to get this part up to MAX_ATTEMPTS attempts
-		for attempt := 0; attempt < MAX_ATTEMPTS; attempt++ {
-			if log.WillLog(log.DEBUG) {
-				log.Debug("transferring filepart %v:%vattempt %v", msg.Filename, p, attempt)
-			}
+	work := make(chan int64)
+
+	var wg sync.WaitGroup
 
-			if err := iom.getPart(msg, p); err != nil {
-				log.Error("get filepart %v:%v failed: %v", msg.Filename, p, err)
+	for w := 0; w < parallel; w++ {
+		wg.Add(1)
 
-				if attempt > 0 {
-					// we're most likely issuing multiple attempts because of
-					// heavy traffic, wait a bit for things to calm down
-					time.Sleep(timeout)
+		go func() {
+			defer wg.Done()
+
+			for p := range work {
+				mu.Lock()
+				skip := failed
+				mu.Unlock()
+				if skip || ctx.Err() != nil {
+					// another part already failed or the transfer was
+					// canceled, just drain the queue
+					continue
 				}
-				continue
-			}
 
-			// success
-			continue Outer
-		}
+				// attempt to get this part up to MAX_ATTEMPTS attempts,
+				// rotating through the sources so a single bad node doesn't
+				// sink the transfer
+				var ok bool
 
-		iom.transferLock.RLock()
-		if !iom.transfers[msg.Filename].Parts[p] {
-			log.Error("could not transfer filepart %v:%v after %v attempts", msg.Filename, p, MAX_ATTEMPTS)
-			iom.transferLock.RUnlock()
-			return
-		}
-		iom.transferLock.RUnlock()
+				for attempt := 0; attempt < MAX_ATTEMPTS; attempt++ {
+					if ctx.Err() != nil {
+						break
+					}
+
+					src := sources[(int(p)+attempt)%len(sources)]
+
+					if attempt == MAX_ATTEMPTS-1 {
+						// last try: ask the mesh who actually has this part
+						if who, err := iom.whoHas(ctx, msg.Filename, p); err == nil {
+							src = &Message{From: who, Filename: msg.Filename, PartSize: msg.PartSize}
+						}
+					}
+
+					if log.WillLog(log.DEBUG) {
+						log.Debug("transferring filepart %v:%v from %v attempt %v", msg.Filename, p, src.From, attempt)
+					}
+
+					if err := iom.getPart(ctx, dest, src, p); err != nil {
+						log.Error("get filepart %v:%v from %v failed: %v", msg.Filename, p, src.From, err)
+
+						if attempt > 0 {
+							// we're most likely issuing multiple attempts
+							// because of heavy traffic, wait a bit for things
+							// to calm down
+							select {
+							case <-time.After(iom.timeout):
+							case <-ctx.Done():
+							}
+						}
+						continue
+					}
+
+					ok = true
+					break
+				}
+
+				if !ok {
+					// did we get it via another node's request anyway?
+					iom.transferLock.RLock()
+					ok = iom.transfers[dest].Parts[p]
+					iom.transferLock.RUnlock()
+				}
+
+				if !ok {
+					log.Error("could not transfer filepart %v:%v after %v attempts", msg.Filename, p, MAX_ATTEMPTS)
+
+					mu.Lock()
+					failed = true
+					mu.Unlock()
+				}
+			}
+		}()
 	}
 
-	log.Info("got all parts for %v", msg.Filename)
+	for _, p := range parts {
+		work <- p
+	}
+	close(work)
+	wg.Wait()
+
+	return !failed && ctx.Err() == nil
+}
 
+// assembleParts concatenates the transferred parts, verifies the assembled
+// file against the hash the source advertised when hashing is enabled, and
+// moves it into place. On a hash mismatch the assembled file and all the
+// parts are discarded so the caller can retry the transfer.
+func (iom *IOMeshage) assembleParts(dest string, msg *Message) bool {
 	// copy the parts into the whole file
 	iom.transferLock.RLock()
-	t := iom.transfers[msg.Filename]
+	t := iom.transfers[dest]
 	iom.transferLock.RUnlock()
 
 	tfile, err := ioutil.TempFile(t.Dir, "cat_")
 	if err != nil {
 		log.Errorln(err)
+		return false
 	}
 
-	for i = 0; i < msg.Part; i++ {
+	for i := int64(0); i < msg.Part; i++ {
 		fname := fmt.Sprintf("%v/%v.part_%v", t.Dir, filepath.Base(msg.Filename), i)
 
 		fpart, err := os.Open(fname)
 		if err != nil {
 			log.Errorln(err)
 			tfile.Close()
-			return
+			return false
 		}
 
 		io.Copy(tfile, fpart)
@@ -480,30 +1720,85 @@ Outer:
 	name := tfile.Name()
 	tfile.Close()
 
+	if iom.hash && msg.Hash != "" {
+		hash, err := hashFile(name)
+		if err != nil {
+			log.Errorln(err)
+			os.Remove(name)
+			return false
+		}
+
+		if hash != msg.Hash {
+			log.Error("assembled file %v failed verification: got hash %v, expected %v", msg.Filename, hash, msg.Hash)
+
+			os.Remove(name)
+
+			iom.transferLock.Lock()
+			// log where the parts came from to help track down the bad node
+			for src, n := range t.Sources {
+				log.Error("%v of the discarded parts of %v came from %v", n, msg.Filename, src)
+			}
+
+			// discard everything so a retry starts from scratch
+			for p := range t.Parts {
+				os.Remove(fmt.Sprintf("%v/%v.part_%v", t.Dir, filepath.Base(msg.Filename), p))
+			}
+			t.Parts = make(map[int64]bool)
+			t.Sources = make(map[string]int)
+			t.Bytes = 0
+			t.samples = nil
+			iom.transferLock.Unlock()
+
+			// one of the cached sources served us bad data
+			iom.uncacheInfo(msg.Filename)
+
+			return false
+		}
+	}
+
 	// create subdirectories
-	fullPath := filepath.Join(iom.base, msg.Filename)
+	fullPath := filepath.Join(iom.base, t.Dest)
 
 	if err := os.MkdirAll(filepath.Dir(fullPath), 0755); err != nil {
 		log.Errorln(err)
-		return
+		return false
 	}
 
-	// Give the file system watcher time to start watching the directory (if it's
-	// not already) before moving the file into it.
-	time.Sleep(500 * time.Millisecond)
 	os.Rename(name, fullPath)
 
+	// the local file list changed
+	iom.uncacheInfo(msg.Filename)
+
+	// remember that this file came from the mesh for the retention policy
+	iom.markFetched(t.Dest)
+
+	if iom.hash && msg.Hash != "" {
+		// advertise the verified hash right away rather than waiting for the
+		// background hasher to catch up
+		iom.updateHash(fullPath, msg.Hash)
+
+		iom.transferLock.Lock()
+		t.Verified = true
+		iom.transferLock.Unlock()
+	}
+
 	log.Debug("changing permissions: %v %v", fullPath, msg.Perm)
 
 	if err := os.Chmod(fullPath, msg.Perm); err != nil {
 		log.Errorln(err)
 	}
+
+	// tell anyone listening, e.g. the background hasher, that the file is in
+	// place rather than making them race to watch the directory with inotify
+	iom.notifyComplete(t.Dest)
+
+	return true
 }
 
 // Remove a temporary transfer directory and any transferred parts.
-func (iom *IOMeshage) destroyTempTransfer(filename string) {
+func (iom *IOMeshage) destroyTempTransfer(dest string) {
 	iom.transferLock.RLock()
-	t, ok := iom.transfers[filename]
+	t, ok := iom.transfers[dest]
 	iom.transferLock.RUnlock()
 	if !ok {
 		log.Errorln("could not access transfer object!")
@@ -517,11 +1812,30 @@ func (iom *IOMeshage) destroyTempTransfer(filename string) {
 		log.Errorln(err)
 	}
 	iom.transferLock.Lock()
-	delete(iom.transfers, filename)
+	delete(iom.transfers, dest)
+
+	// keep a short history so completion can be confirmed after the fact
+	t.Complete = len(t.Parts) == t.NumParts
+	t.Finished = time.Now()
+
+	// wake callers that joined the transfer; they succeed or fail together
+	var result error
+	if !t.Complete {
+		result = fmt.Errorf("transfer of %v failed", dest)
+	}
+	for _, c := range t.waiters {
+		c <- result
+	}
+	t.waiters = nil
+
+	iom.history = append(iom.history, t)
+	if len(iom.history) > TRANSFER_HISTORY {
+		iom.history = iom.history[len(iom.history)-TRANSFER_HISTORY:]
+	}
 	iom.transferLock.Unlock()
 }
 
-func (iom *IOMeshage) whoHas(filename string, p int64) (string, error) {
+func (iom *IOMeshage) whoHas(ctx context.Context, filename string, p int64) (string, error) {
 	TID, c := iom.newTID()
 	defer iom.unregisterTID(TID)
 
@@ -553,49 +1867,56 @@ func (iom *IOMeshage) whoHas(filename string, p int64) (string, error) {
 
 				return resp.From, nil
 			}
-		case <-time.After(timeout):
+		case <-time.After(iom.timeout):
 			timeoutCount++
 
 			if timeoutCount == MAX_ATTEMPTS {
 				return "", errors.New("too many timeouts")
 			}
+		case <-ctx.Done():
+			return "", ctx.Err()
 		}
 	}
 
 	return "", fmt.Errorf("who has %v: file not found", filename)
 }
 
-func (iom *IOMeshage) getPart(msg *Message, p int64) error {
+func (iom *IOMeshage) getPart(ctx context.Context, dest string, msg *Message, p int64) error {
 	// did I already get this part via another node's request?
 	iom.transferLock.Lock()
-	if iom.transfers[msg.Filename].Parts[p] {
+	t, ok := iom.transfers[dest]
+	if !ok {
+		iom.transferLock.Unlock()
+		return fmt.Errorf("no transfer for %v", dest)
+	}
+	if t.Parts[p] {
 		iom.transferLock.Unlock()
 		return nil
 	}
-	iom.transfers[msg.Filename].Inflight = p
+	t.Inflight[p] = true
 	iom.transferLock.Unlock()
 
-	/*
-		who, err := iom.whoHas(filename, p)
-		if err != nil {
-			return err
-		}
-
-		if log.WillLog(log.DEBUG) {
-			log.Debug("found part %v on node %v", p, who)
+	defer func() {
+		iom.transferLock.Lock()
+		if t, ok := iom.transfers[dest]; ok {
+			delete(t.Inflight, p)
 		}
-	*/
+		iom.transferLock.Unlock()
+	}()
 
 	// transfer the part from a specific node
-	data, err := iom.xfer(msg, p)
+	data, err := iom.xfer(ctx, msg, p)
 	if err != nil {
+		if errors.Is(err, errChecksum) {
+			iom.rejectPart(dest)
+		}
 		return err
 	}
 
 	iom.transferLock.Lock()
 	defer iom.transferLock.Unlock()
 
-	t, ok := iom.transfers[msg.Filename]
+	t, ok = iom.transfers[dest]
 	if !ok {
 		return fmt.Errorf("ghost transfer of %v:%v finished", msg.Filename, p)
 	}
@@ -607,21 +1928,31 @@ func (iom *IOMeshage) getPart(msg *Message, p int64) error {
 	}
 
 	t.Parts[p] = true
+	t.Sources[msg.From]++
+	t.addBytes(int64(len(data)))
 
 	return nil
 }
 
 // xfer returns a part of the file read requested from a remote node.
-func (iom *IOMeshage) xfer(msg *Message, part int64) ([]byte, error) {
+func (iom *IOMeshage) xfer(ctx context.Context, msg *Message, part int64) ([]byte, error) {
 	TID, c := iom.newTID()
 	defer iom.unregisterTID(TID)
 
+	// honor the part size the source advertised; older nodes that don't
+	// advertise one use the default
+	partSize := msg.PartSize
+	if partSize == 0 {
+		partSize = PART_SIZE
+	}
+
 	m := &Message{
 		From:     iom.node.Name(),
 		Type:     TYPE_XFER,
 		Filename: msg.Filename,
 		TID:      TID,
 		Part:     part,
+		PartSize: partSize,
 	}
 	if _, err := iom.node.Set([]string{msg.From}, m); err != nil {
 		return nil, err
@@ -638,12 +1969,31 @@ func (iom *IOMeshage) xfer(msg *Message, part int64) ([]byte, error) {
 				log.Debugln("got part from: ", resp.From)
 			}
 
+			// older nodes don't send a checksum; when one is present the
+			// payload must match it
+			if resp.Checksum != "" && hashData(resp.Data) != resp.Checksum {
+				return nil, fmt.Errorf("%w for part %v from %v", errChecksum, part, resp.From)
+			}
+
 			return resp.Data, nil
 		}
 
 		return nil, fmt.Errorf("received NACK from xfer node")
-	case <-time.After(timeout):
+	case <-time.After(iom.timeout):
 		return nil, fmt.Errorf("timeout")
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// rejectPart counts a part that failed checksum verification so the drops
+// show up in Status.
+func (iom *IOMeshage) rejectPart(dest string) {
+	iom.transferLock.Lock()
+	defer iom.transferLock.Unlock()
+
+	if t, ok := iom.transfers[dest]; ok {
+		t.Rejected++
 	}
 }
 
@@ -657,24 +2007,37 @@ func (iom *IOMeshage) MITM(m *Message) {
 
 	iom.transferLock.Lock()
 	defer iom.transferLock.Unlock()
-	if f, ok := iom.transfers[m.Filename]; ok {
-		if f.Inflight == m.Part {
-			return
+
+	// transfers are keyed on the destination, so walk them looking for any
+	// that want parts of this file
+	for _, f := range iom.transfers {
+		if f.Filename != m.Filename || f.Inflight[m.Part] || f.Parts[m.Part] {
+			continue
 		}
-		if !f.Parts[m.Part] {
-			log.Debug("snooped filepart %v;%v", f.Filename, m.Part)
-			outfile := fmt.Sprintf("%v/%v.part_%v", f.Dir, filepath.Base(f.Filename), m.Part)
-			err := ioutil.WriteFile(outfile, m.Data, 0664)
-			if err != nil {
-				log.Errorln(err)
-				return
-			}
-			f.Parts[m.Part] = true
+
+		if m.Checksum != "" && hashData(m.Data) != m.Checksum {
+			// don't persist a corrupt snooped part, the normal retry
+			// path will re-request it
+			log.Debug("dropping snooped filepart %v;%v with bad checksum", m.Filename, m.Part)
+			f.Rejected++
+			continue
+		}
+
+		log.Debug("snooped filepart %v;%v", f.Filename, m.Part)
+		outfile := fmt.Sprintf("%v/%v.part_%v", f.Dir, filepath.Base(f.Filename), m.Part)
+		err := ioutil.WriteFile(outfile, m.Data, 0664)
+		if err != nil {
+			log.Errorln(err)
+			continue
 		}
+		f.Parts[m.Part] = true
+		f.Sources[m.From]++
+		f.addBytes(int64(len(m.Data)))
 	}
 }
 
-// Status returns a deep copy of the in-flight file transfers
+// Status returns a deep copy of the in-flight file transfers followed by the
+// recently finished ones.
 func (iom *IOMeshage) Status() []*Transfer {
 	iom.transferLock.RLock()
 	defer iom.transferLock.RUnlock()
@@ -682,19 +2045,60 @@ func (iom *IOMeshage) Status() []*Transfer {
 	res := []*Transfer{}
 
 	for _, t := range iom.transfers {
-		t2 := new(Transfer)
+		res = append(res, t.copy())
+	}
+
+	for _, t := range iom.history {
+		res = append(res, t.copy())
+	}
 
-		// Make shallow copies of all fields
-		*t2 = *t
+	return res
+}
 
-		// Make deep copies
-		t2.Parts = make(map[int64]bool)
-		for k, v := range t.Parts {
-			t2.Parts[k] = v
-		}
+// History returns a deep copy of the recently finished transfers, oldest
+// first.
+func (iom *IOMeshage) History() []*Transfer {
+	iom.transferLock.RLock()
+	defer iom.transferLock.RUnlock()
+
+	res := []*Transfer{}
 
-		res = append(res, t2)
+	for _, t := range iom.history {
+		res = append(res, t.copy())
 	}
 
 	return res
 }
+
+// copy returns a deep copy of the transfer. The caller must hold
+// transferLock.
+func (t *Transfer) copy() *Transfer {
+	t2 := new(Transfer)
+
+	// Make shallow copies of all fields
+	*t2 = *t
+
+	// Make deep copies
+	t2.Parts = make(map[int64]bool)
+	for k, v := range t.Parts {
+		t2.Parts[k] = v
+	}
+
+	t2.Inflight = make(map[int64]bool)
+	for k, v := range t.Inflight {
+		t2.Inflight[k] = v
+	}
+
+	t2.Sources = make(map[string]int)
+	for k, v := range t.Sources {
+		t2.Sources[k] = v
+	}
+
+	t2.samples = append([]transferSample{}, t.samples...)
+
+	// waiters are notification channels, not status -- don't carry them into
+	// the copy
+	t2.waiters = nil
+
+	return t2
+}
@@ -29,6 +29,13 @@ type FileInfo struct {
 	// Murmur3 hash of the file
 	Hash string
 
+	// When Hash was computed; the zero time when no hash is cached. A
+	// HashTime older than ModTime marks the hash as stale.
+	HashTime time.Time
+
+	// LinkTarget is the raw target of a symlink, empty for regular files
+	LinkTarget string
+
 	// embed
 	os.FileMode
 }
@@ -43,12 +50,53 @@ func newFileInfo(path, hash string, fi os.FileInfo) FileInfo {
 	}
 }
 
-func (f FileInfo) numParts() int64 {
+// localInfo builds the FileInfo for a local file, attaching the cached hash
+// and when it was computed.
+func (iom *IOMeshage) localInfo(path string, fi os.FileInfo) FileInfo {
+	hash, hashed := iom.getHashTime(path)
+
+	info := newFileInfo(path, hash, fi)
+	info.HashTime = hashed
+
+	if fi.Mode()&os.ModeSymlink != 0 {
+		if target, err := os.Readlink(path); err == nil {
+			info.LinkTarget = target
+		}
+	}
+
+	return info
+}
+
+// linkRel resolves a symlink, following chains, and returns the final
+// target's path relative to the base directory. Returns "" when the link
+// dangles or its target escapes the base directory.
+func (iom *IOMeshage) linkRel(path string) string {
+	resolved, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		// dangling link
+		return ""
+	}
+
+	// resolve the base too in case it sits behind a symlink itself
+	base, err := filepath.EvalSymlinks(iom.base)
+	if err != nil {
+		base = iom.base
+	}
+
+	rel, err := filepath.Rel(base, resolved)
+	if err != nil || strings.HasPrefix(rel, "..") {
+		return ""
+	}
+
+	return rel
+}
+
+func (f FileInfo) numParts(partSize int64) int64 {
 	if f.IsDir() {
 		return 0
 	}
 
-	return (f.Size + PART_SIZE - 1) / PART_SIZE
+	return (f.Size + partSize - 1) / partSize
 }
 
 func (iom *IOMeshage) Rel(info FileInfo) string {
@@ -75,13 +123,27 @@ func (iom *IOMeshage) List(path string, recurse bool) ([]FileInfo, error) {
 	var res []FileInfo
 
 	for _, f := range glob {
-		info, err := os.Stat(f)
+		info, err := os.Lstat(f)
 		if err != nil {
 			return nil, err
 		}
 
+		// follow links to directories so they can still be listed into, but
+		// report file links themselves so transfers can recreate them
+		if info.Mode()&os.ModeSymlink != 0 {
+			if ti, err := os.Stat(f); err == nil && ti.IsDir() {
+				info = ti
+			}
+		}
+
+		if f != iom.cleanPath(path) && hidden(info.Name()) {
+			// globs don't expand to internal bookkeeping, though an explicit
+			// path still resolves, e.g. to serve an in-flight part
+			continue
+		}
+
 		if !info.IsDir() {
-			res = append(res, newFileInfo(f, iom.getHash(f), info))
+			res = append(res, iom.localInfo(f, info))
 			continue
 		}
 
@@ -92,8 +154,12 @@ func (iom *IOMeshage) List(path string, recurse bool) ([]FileInfo, error) {
 			}
 
 			for _, info := range files {
+				if hidden(info.Name()) {
+					continue
+				}
+
 				path := filepath.Join(f, info.Name())
-				res = append(res, newFileInfo(path, iom.getHash(path), info))
+				res = append(res, iom.localInfo(path, info))
 			}
 
 			continue
@@ -105,8 +171,16 @@ func (iom *IOMeshage) List(path string, recurse bool) ([]FileInfo, error) {
 				return err
 			}
 
+			if hidden(info.Name()) && path != f {
+				if info.IsDir() {
+					return filepath.SkipDir
+				}
+
+				return nil
+			}
+
 			if !info.IsDir() {
-				res = append(res, newFileInfo(path, iom.getHash(path), info))
+				res = append(res, iom.localInfo(path, info))
 			}
 
 			return nil
@@ -120,6 +194,65 @@ func (iom *IOMeshage) List(path string, recurse bool) ([]FileInfo, error) {
 	return res, nil
 }
 
+// hidden reports whether a directory entry is iomeshage bookkeeping -- a
+// transfer directory or one of the sidecar files -- that List should never
+// report as a served file.
+func hidden(name string) bool {
+	return name == fetchedFile || name == lockFileName || strings.HasPrefix(name, "transfer_")
+}
+
+// excludeMatch reports whether the relative path matches any of the
+// exclusion patterns. Patterns are matched against the whole relative path
+// as well as the basename, so both "old/*" and "*.log" behave as expected.
+func excludeMatch(rel string, excludes []string) bool {
+	for _, pattern := range excludes {
+		if ok, err := filepath.Match(pattern, rel); err == nil && ok {
+			return true
+		}
+
+		if ok, err := filepath.Match(pattern, filepath.Base(rel)); err == nil && ok {
+			return true
+		}
+	}
+
+	return false
+}
+
+// tooDeep reports whether the relative path sits more than depth directories
+// below the requested path. depth <= 0 means unlimited.
+func tooDeep(rel, req string, depth int) bool {
+	if depth <= 0 {
+		return false
+	}
+
+	// the requested directory, without any glob suffix
+	req = filepath.Clean("/" + req)
+	if i := strings.IndexAny(req, "*?["); i != -1 {
+		req = filepath.Dir(req[:i])
+	}
+
+	rel = filepath.Clean("/" + rel)
+
+	sub := strings.TrimPrefix(rel, strings.TrimSuffix(req, "/"))
+	sub = strings.TrimPrefix(sub, "/")
+
+	return strings.Count(sub, "/")+1 > depth
+}
+
+// manifestEntry converts a local FileInfo into a sync manifest entry with a
+// relative path and, when hashing is enabled, a hash.
+func (iom *IOMeshage) manifestEntry(f FileInfo) FileInfo {
+	e := f
+	e.Path = iom.Rel(f)
+
+	if iom.hash && e.Hash == "" {
+		e.Hash = iom.Hash(f.Path)
+		_, e.HashTime = iom.getHashTime(f.Path)
+	}
+
+	return e
+}
+
 // Delete a file or directory on the local node. Supports Globs.
 func (iom *IOMeshage) Delete(path string) error {
 	glob, err := filepath.Glob(iom.cleanPath(path))
@@ -150,6 +283,9 @@ func (iom *IOMeshage) Delete(path string) error {
 		}
 	}
 
+	// the local file list changed
+	iom.FlushInfoCache()
+
 	return nil
 }
 
@@ -164,8 +300,8 @@ func (iom *IOMeshage) cleanPath(path string) string {
 	return path
 }
 
-// Read a filepart and return a byteslice.
-func (iom *IOMeshage) readPart(filename string, part int64) []byte {
+// Read a filepart of the given size and return a byteslice.
+func (iom *IOMeshage) readPart(filename string, part, partSize int64) []byte {
 	if !strings.HasPrefix(filename, iom.base) {
 		filename = filepath.Join(iom.base, filename)
 	}
@@ -183,15 +319,15 @@ func (iom *IOMeshage) readPart(filename string, part int64) []byte {
 		return nil
 	}
 
-	parts := (fi.Size() + PART_SIZE - 1) / PART_SIZE // integer divide with ceiling instead of floor
+	parts := (fi.Size() + partSize - 1) / partSize // integer divide with ceiling instead of floor
 	if part > parts {
 		log.Errorln("attempt to read beyond file")
 		return nil
 	}
 
-	// read up to PART_SIZE
-	data := make([]byte, PART_SIZE)
-	n, err := f.ReadAt(data, part*PART_SIZE)
+	// read up to partSize
+	data := make([]byte, partSize)
+	n, err := f.ReadAt(data, part*partSize)
 
 	if err != nil {
 		if err != io.EOF {
@@ -214,6 +350,41 @@ func (iom *IOMeshage) getHash(path string) string {
 	return iom.hashes[path]
 }
 
+// getHashTime returns the cached hash for the file and when it was computed.
+func (iom *IOMeshage) getHashTime(path string) (string, time.Time) {
+	if !filepath.IsAbs(path) {
+		path = iom.cleanPath(path)
+	}
+
+	iom.hashLock.RLock()
+	defer iom.hashLock.RUnlock()
+
+	return iom.hashes[path], iom.hashTimes[path]
+}
+
+// Hash returns the hash for the file at the given path, computing and caching
+// it on demand when the background hasher hasn't gotten to it yet (or isn't
+// enabled).
+func (iom *IOMeshage) Hash(path string) string {
+	if !filepath.IsAbs(path) {
+		path = iom.cleanPath(path)
+	}
+
+	if hash := iom.getHash(path); hash != "" {
+		return hash
+	}
+
+	hash, err := hashFile(path)
+	if err != nil {
+		log.Error("getting hash for file %s: %v", path, err)
+		return ""
+	}
+
+	iom.updateHash(path, hash)
+
+	return hash
+}
+
 func (iom *IOMeshage) updateHash(path, hash string) {
 	if !filepath.IsAbs(path) {
 		path = iom.cleanPath(path)
@@ -224,14 +395,16 @@ func (iom *IOMeshage) updateHash(path, hash string) {
 
 	if hash == "" {
 		delete(iom.hashes, path)
+		delete(iom.hashTimes, path)
 	} else {
 		iom.hashes[path] = hash
+		iom.hashTimes[path] = time.Now()
 	}
 }
 
 // stream reads a file from the local node's filesystem and returns the parts
 // via a channel.
-func stream(fname string) (chan []byte, error) {
+func stream(fname string, partSize int64) (chan []byte, error) {
 	out := make(chan []byte)
 
 	f, err := os.Open(fname)
@@ -244,7 +417,7 @@ func stream(fname string) (chan []byte, error) {
 		defer close(out)
 
 		for {
-			buf := make([]byte, PART_SIZE)
+			buf := make([]byte, partSize)
 
 			n, err := f.Read(buf)
 			if err == io.EOF {
@@ -0,0 +1,692 @@
+// Copyright 2017-2021 National Technology & Engineering Solutions of Sandia, LLC (NTESS).
+// Under the terms of Contract DE-NA0003525 with NTESS, the U.S. Government retains certain
+// rights in this software.
+
+package iomeshage
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testPartRoundTrip writes a file of the given size, splits it into parts of
+// the given size, and checks that reassembling the parts reproduces the file.
+func testPartRoundTrip(t *testing.T, size, partSize int64) {
+	t.Helper()
+
+	dir := t.TempDir()
+
+	iom := &IOMeshage{
+		base:      dir,
+		hashes:    make(map[string]string),
+		hashTimes: make(map[string]time.Time),
+	}
+
+	data := make([]byte, size)
+	rand.New(rand.NewSource(size)).Read(data)
+
+	name := filepath.Join(dir, "file")
+	if err := ioutil.WriteFile(name, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	fi, err := os.Stat(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	parts := newFileInfo(name, "", fi).numParts(partSize)
+
+	want := (size + partSize - 1) / partSize
+	if parts != want {
+		t.Fatalf("expected %v parts for %v bytes, got %v", want, size, parts)
+	}
+
+	var got []byte
+	for p := int64(0); p < parts; p++ {
+		part := iom.readPart(name, p, partSize)
+		if part == nil {
+			t.Fatalf("read part %v failed", p)
+		}
+
+		got = append(got, part...)
+	}
+
+	if !bytes.Equal(data, got) {
+		t.Fatalf("reassembled file does not match source (%v != %v bytes)", len(got), len(data))
+	}
+}
+
+func TestPartsExactMultiple(t *testing.T) {
+	testPartRoundTrip(t, 4*1024, 1024)
+}
+
+func TestPartsOneByteOver(t *testing.T) {
+	testPartRoundTrip(t, 4*1024+1, 1024)
+}
+
+func TestPartsSmallerThanPart(t *testing.T) {
+	testPartRoundTrip(t, 100, 1024)
+}
+
+func TestRecoverTransfers(t *testing.T) {
+	dir := t.TempDir()
+
+	// a directory with valid parts for one file
+	valid := filepath.Join(dir, "transfer_0")
+	if err := os.Mkdir(valid, 0755); err != nil {
+		t.Fatal(err)
+	}
+	for p := 0; p < 3; p++ {
+		name := filepath.Join(valid, fmt.Sprintf("foo.qc2.part_%v", p))
+		if err := ioutil.WriteFile(name, make([]byte, 1024), 0664); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// a directory with nothing that parses as a part
+	orphan := filepath.Join(dir, "transfer_1")
+	if err := os.Mkdir(orphan, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(orphan, "junk"), []byte("junk"), 0664); err != nil {
+		t.Fatal(err)
+	}
+
+	iom := &IOMeshage{
+		base:      dir,
+		recovered: make(map[string]*recovery),
+	}
+
+	iom.recoverTransfers()
+
+	r, ok := iom.recovered["foo.qc2"]
+	if !ok {
+		t.Fatal("expected parts of foo.qc2 to be recovered")
+	}
+	if len(r.Parts) != 3 {
+		t.Fatalf("expected 3 recovered parts, got %v", len(r.Parts))
+	}
+
+	if _, err := os.Stat(orphan); !os.IsNotExist(err) {
+		t.Fatal("expected orphaned transfer directory to be removed")
+	}
+
+	// resuming should verify the recovered parts by size
+	tdir, parts, err := iom.recoverTransfer(&Message{
+		Filename: "foo.qc2",
+		Part:     4,
+		PartSize: 1024,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tdir != valid {
+		t.Fatalf("expected resumed transfer to reuse %v, got %v", valid, tdir)
+	}
+	if len(parts) != 3 {
+		t.Fatalf("expected 3 verified parts, got %v", len(parts))
+	}
+}
+
+func TestInfoCacheExpiry(t *testing.T) {
+	iom := &IOMeshage{infoCache: make(map[string]*infoEntry)}
+
+	files := NewFiles("", false)
+	iom.cacheInfo("foo", files)
+
+	if got := iom.cachedInfo("foo"); got != files {
+		t.Fatal("expected cached info for foo")
+	}
+
+	// force the entry to expire
+	iom.infoCache["foo"].expires = time.Now().Add(-time.Second)
+
+	if got := iom.cachedInfo("foo"); got != nil {
+		t.Fatal("expected expired entry to be dropped")
+	}
+	if _, ok := iom.infoCache["foo"]; ok {
+		t.Fatal("expected expired entry to be deleted")
+	}
+
+	iom.cacheInfo("foo", files)
+	iom.FlushInfoCache()
+
+	if got := iom.cachedInfo("foo"); got != nil {
+		t.Fatal("expected flushed cache to be empty")
+	}
+}
+
+func TestPrune(t *testing.T) {
+	dir := t.TempDir()
+
+	iom := &IOMeshage{
+		base:     dir,
+		fetched:  make(map[string]time.Time),
+		pruneAge: time.Hour,
+		inUse: func(path string) bool {
+			return strings.HasSuffix(path, "keep")
+		},
+	}
+
+	for _, name := range []string{"old", "keep", "fresh"} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(name), 0664); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	iom.fetched["old"] = time.Now().Add(-2 * time.Hour)
+	iom.fetched["keep"] = time.Now().Add(-2 * time.Hour)
+	iom.fetched["fresh"] = time.Now()
+
+	// a dry run reports the eligible files but removes nothing
+	pruned, err := iom.Prune(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pruned) != 1 || pruned[0] != "old" {
+		t.Fatalf("expected dry run to report only old, got %v", pruned)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "old")); err != nil {
+		t.Fatal("expected dry run to leave old in place")
+	}
+
+	pruned, err = iom.Prune(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pruned) != 1 || pruned[0] != "old" {
+		t.Fatalf("expected to prune only old, got %v", pruned)
+	}
+
+	if _, err := os.Stat(filepath.Join(dir, "old")); !os.IsNotExist(err) {
+		t.Fatal("expected old to be removed")
+	}
+	for _, name := range []string{"keep", "fresh"} {
+		if _, err := os.Stat(filepath.Join(dir, name)); err != nil {
+			t.Fatalf("expected %v to survive pruning", name)
+		}
+	}
+}
+
+func TestExcludeMatch(t *testing.T) {
+	tests := []struct {
+		rel      string
+		excludes []string
+		want     bool
+	}{
+		{"experiments/run.log", []string{"*.log"}, true},
+		{"experiments/old/image.qc2", []string{"old/*"}, false},
+		{"old/image.qc2", []string{"old/*"}, true},
+		{"experiments/image.qc2", []string{"*.log", "old/*"}, false},
+		{"experiments/image.qc2", nil, false},
+	}
+
+	for _, test := range tests {
+		if got := excludeMatch(test.rel, test.excludes); got != test.want {
+			t.Errorf("excludeMatch(%q, %v) = %v, want %v", test.rel, test.excludes, got, test.want)
+		}
+	}
+}
+
+func TestTooDeep(t *testing.T) {
+	tests := []struct {
+		rel   string
+		req   string
+		depth int
+		want  bool
+	}{
+		{"dir/a", "dir/", 1, false},
+		{"dir/sub/a", "dir/", 1, true},
+		{"dir/sub/a", "dir/", 2, false},
+		{"dir/sub/a", "dir/*", 1, true},
+		{"dir/sub/deep/a", "dir/", 0, false},
+	}
+
+	for _, test := range tests {
+		if got := tooDeep(test.rel, test.req, test.depth); got != test.want {
+			t.Errorf("tooDeep(%q, %q, %v) = %v, want %v", test.rel, test.req, test.depth, got, test.want)
+		}
+	}
+}
+
+func TestEnqueueCanceled(t *testing.T) {
+	iom := &IOMeshage{queue: newSemaphore(1)}
+
+	// fill the queue so enqueue has to wait
+	if !iom.queue.tryAcquire() {
+		t.Fatal("expected to take the only slot")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if err := iom.enqueue(ctx, PRIORITY_NORMAL); err == nil {
+		t.Fatal("expected enqueue with a canceled context to fail")
+	}
+
+	// urgent transfers never wait, so they succeed even when canceled
+	if err := iom.enqueue(ctx, PRIORITY_URGENT); err != nil {
+		t.Fatalf("expected urgent enqueue to succeed, got %v", err)
+	}
+}
+
+func TestNotifyComplete(t *testing.T) {
+	dir := t.TempDir()
+
+	iom := &IOMeshage{
+		base:      dir,
+		transfers: make(map[string]*Transfer),
+		infoCache: make(map[string]*infoEntry),
+		fetched:   make(map[string]time.Time),
+		hashes:    make(map[string]string),
+		hashTimes: make(map[string]time.Time),
+	}
+
+	const n = 200
+
+	completions := make(chan string, n)
+	iom.NotifyComplete(completions)
+
+	// stage n single-part transfers ready to assemble
+	for i := 0; i < n; i++ {
+		dest := fmt.Sprintf("file_%v", i)
+
+		tdir, err := ioutil.TempDir(dir, "transfer_")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		part := filepath.Join(tdir, dest+".part_0")
+		if err := ioutil.WriteFile(part, []byte(dest), 0664); err != nil {
+			t.Fatal(err)
+		}
+
+		iom.transfers[dest] = &Transfer{
+			Dir:      tdir,
+			Filename: dest,
+			Dest:     dest,
+			Parts:    map[int64]bool{0: true},
+			NumParts: 1,
+			Inflight: make(map[int64]bool),
+			Sources:  make(map[string]int),
+		}
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+
+		go func(i int) {
+			defer wg.Done()
+
+			dest := fmt.Sprintf("file_%v", i)
+			if !iom.assembleParts(dest, &Message{Filename: dest, Part: 1, Perm: 0664}) {
+				t.Errorf("assembling %v failed", dest)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	// every assembled file must have produced exactly one notification
+	got := make(map[string]bool)
+	for len(got) < n {
+		select {
+		case rel := <-completions:
+			if got[rel] {
+				t.Fatalf("duplicate notification for %v", rel)
+			}
+			got[rel] = true
+		default:
+			t.Fatalf("missed notifications: got %v of %v", len(got), n)
+		}
+	}
+}
+
+func TestWait(t *testing.T) {
+	dir := t.TempDir()
+
+	iom := &IOMeshage{
+		base:      dir,
+		transfers: make(map[string]*Transfer),
+	}
+
+	// nothing in flight -- Wait returns immediately
+	if err := iom.Wait(context.Background(), "missing"); err != nil {
+		t.Fatal(err)
+	}
+
+	// stage stages an in-flight transfer with one of total parts fetched
+	stage := func(dest string, total int) {
+		tdir, err := ioutil.TempDir(dir, "transfer_")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		iom.transfers[dest] = &Transfer{
+			Dir:      tdir,
+			Filename: dest,
+			Dest:     dest,
+			Parts:    map[int64]bool{0: true},
+			NumParts: total,
+			Inflight: make(map[int64]bool),
+			Sources:  make(map[string]int),
+		}
+	}
+
+	wait := func(dest string) chan error {
+		c := make(chan error, 1)
+		go func() {
+			c <- iom.Wait(context.Background(), dest)
+		}()
+		return c
+	}
+
+	collect := func(c chan error) error {
+		select {
+		case err := <-c:
+			return err
+		case <-time.After(time.Second):
+			t.Fatal("expected Wait to return after the transfer finished")
+			return nil
+		}
+	}
+
+	// registered blocks until n waiters have joined the transfer
+	registered := func(dest string, n int) {
+		t.Helper()
+
+		for i := 0; ; i++ {
+			iom.transferLock.RLock()
+			got := len(iom.transfers[dest].waiters)
+			iom.transferLock.RUnlock()
+
+			if got == n {
+				return
+			}
+			if i > 100 {
+				t.Fatalf("expected %v registered waiters on %v, got %v", n, dest, got)
+			}
+
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	// all waiters on a completed transfer succeed together
+	stage("done", 1)
+	first, second := wait("done"), wait("done")
+	registered("done", 2)
+
+	iom.destroyTempTransfer("done")
+
+	if err := collect(first); err != nil {
+		t.Fatal(err)
+	}
+	if err := collect(second); err != nil {
+		t.Fatal(err)
+	}
+
+	// all waiters on an incomplete transfer fail together
+	stage("failed", 2)
+	first, second = wait("failed"), wait("failed")
+	registered("failed", 2)
+
+	iom.destroyTempTransfer("failed")
+
+	if err := collect(first); err == nil {
+		t.Fatal("expected waiters on a failed transfer to get an error")
+	}
+	if err := collect(second); err == nil {
+		t.Fatal("expected waiters on a failed transfer to get an error")
+	}
+
+	// a canceled context stops the wait
+	stage("stuck", 2)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if err := iom.Wait(ctx, "stuck"); err == nil {
+		t.Fatal("expected Wait with a canceled context to fail")
+	}
+}
+
+func TestListHidden(t *testing.T) {
+	dir := t.TempDir()
+
+	iom := &IOMeshage{
+		base:      dir,
+		hashes:    make(map[string]string),
+		hashTimes: make(map[string]time.Time),
+	}
+
+	if err := ioutil.WriteFile(filepath.Join(dir, "image.qc2"), []byte("image"), 0664); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, fetchedFile), []byte("{}"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tdir := filepath.Join(dir, "transfer_0")
+	if err := os.Mkdir(tdir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	part := filepath.Join(tdir, "foo.qc2.part_0")
+	if err := ioutil.WriteFile(part, []byte("part"), 0664); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, recurse := range []bool{false, true} {
+		files, err := iom.List("/", recurse)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(files) != 1 || iom.Rel(files[0]) != "image.qc2" {
+			t.Fatalf("List(/, %v) should only report image.qc2, got %v", recurse, files)
+		}
+	}
+
+	// an explicit path into a transfer directory still resolves so in-flight
+	// parts can be served
+	files, err := iom.List("transfer_0/foo.qc2.part_0", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 {
+		t.Fatalf("expected explicit part path to resolve, got %v", files)
+	}
+}
+
+func TestLinkRel(t *testing.T) {
+	dir := t.TempDir()
+
+	iom := &IOMeshage{
+		base:      dir,
+		hashes:    make(map[string]string),
+		hashTimes: make(map[string]time.Time),
+	}
+
+	if err := ioutil.WriteFile(filepath.Join(dir, "target.qc2"), []byte("image"), 0664); err != nil {
+		t.Fatal(err)
+	}
+
+	elsewhere := filepath.Join(t.TempDir(), "elsewhere")
+	if err := ioutil.WriteFile(elsewhere, []byte("outside"), 0664); err != nil {
+		t.Fatal(err)
+	}
+
+	// a direct link, a link chain, a dangling link, and an escaping link
+	links := map[string]string{
+		"latest.qc2": "target.qc2",
+		"chain.qc2":  "latest.qc2",
+		"dangling":   "missing.qc2",
+		"outside":    elsewhere,
+	}
+	for name, target := range links {
+		if err := os.Symlink(target, filepath.Join(dir, name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		link string
+		want string
+	}{
+		{"latest.qc2", "target.qc2"},
+		{"chain.qc2", "target.qc2"},
+		{"dangling", ""},
+		{"outside", ""},
+	}
+
+	for _, test := range tests {
+		if got := iom.linkRel(filepath.Join(dir, test.link)); got != test.want {
+			t.Errorf("linkRel(%v) = %q, want %q", test.link, got, test.want)
+		}
+	}
+
+	// List reports the raw link target, even for dangling links
+	files, err := iom.List("dangling", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 || files[0].LinkTarget != "missing.qc2" {
+		t.Fatalf("expected List to report the dangling link, got %v", files)
+	}
+}
+
+func TestRecreateLink(t *testing.T) {
+	dir := t.TempDir()
+
+	iom := &IOMeshage{
+		base:      dir,
+		transfers: make(map[string]*Transfer),
+		hashes:    make(map[string]string),
+		hashTimes: make(map[string]time.Time),
+		infoCache: make(map[string]*infoEntry),
+	}
+
+	if err := ioutil.WriteFile(filepath.Join(dir, "target.qc2"), []byte("image"), 0664); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+
+	// an in-tree link whose target is already local is recreated pointing at
+	// the local copy
+	use := &Message{Filename: "latest.qc2", Link: "target.qc2", LinkRel: "target.qc2"}
+	if err := iom.recreateLink(ctx, "latest.qc2", use, PRIORITY_NORMAL); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := os.Readlink(filepath.Join(dir, "latest.qc2"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != "target.qc2" {
+		t.Fatalf("expected link to target.qc2, got %v", got)
+	}
+
+	data, err := ioutil.ReadFile(filepath.Join(dir, "latest.qc2"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "image" {
+		t.Fatalf("expected link to resolve to the target's content, got %q", data)
+	}
+
+	// a dangling link is recreated with its raw target
+	use = &Message{Filename: "dangling", Link: "missing.qc2"}
+	if err := iom.recreateLink(ctx, "dangling", use, PRIORITY_NORMAL); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err = os.Readlink(filepath.Join(dir, "dangling"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != "missing.qc2" {
+		t.Fatalf("expected dangling link to missing.qc2, got %v", got)
+	}
+
+	// a stale link from an earlier fetch is replaced
+	use = &Message{Filename: "dangling", Link: "target.qc2", LinkRel: "target.qc2"}
+	if err := iom.recreateLink(ctx, "dangling", use, PRIORITY_NORMAL); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err = os.Readlink(filepath.Join(dir, "dangling"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != "target.qc2" {
+		t.Fatalf("expected replaced link to target.qc2, got %v", got)
+	}
+}
+
+func TestSemaphoreResize(t *testing.T) {
+	ctx := context.Background()
+
+	s := newSemaphore(2)
+
+	for i := 0; i < 2; i++ {
+		if err := s.acquire(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if s.tryAcquire() {
+		t.Fatal("expected the semaphore to be full")
+	}
+
+	// shrinking below the slots in use lets the holders finish but admits no
+	// new ones until under the limit
+	s.setLimit(1)
+	s.release()
+	if s.tryAcquire() {
+		t.Fatal("expected no new slots while still at the limit")
+	}
+	s.release()
+	if !s.tryAcquire() {
+		t.Fatal("expected a slot after dropping under the limit")
+	}
+
+	// growing the limit wakes a waiter
+	waited := make(chan error)
+	go func() {
+		waited <- s.acquire(ctx)
+	}()
+
+	select {
+	case <-waited:
+		t.Fatal("expected acquire to block at the limit")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	s.setLimit(2)
+
+	select {
+	case err := <-waited:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expected acquire to succeed after growing the limit")
+	}
+
+	// a canceled context aborts the wait
+	cctx, cancel := context.WithCancel(ctx)
+	cancel()
+
+	if err := s.acquire(cctx); err == nil {
+		t.Fatal("expected acquire with a canceled context to fail")
+	}
+}
@@ -31,9 +31,38 @@ type Message struct {
 	Hash     string
 	Glob     []string
 	Part     int64
+	PartSize int64
 	TID      int64
 	ACK      bool
 	Data     []byte
+
+	// Sync asks for a Manifest in the response to a TYPE_INFO request.
+	Sync bool
+
+	// Exclude lists glob patterns that a TYPE_INFO request doesn't want
+	// expanded, matched against relative paths.
+	Exclude []string
+
+	// MaxDepth bounds how many directories below the requested path a
+	// TYPE_INFO request expands. Zero means unlimited.
+	MaxDepth int
+
+	// Manifest describes the files below a directory for sync requests:
+	// relative path, size, and hash of each.
+	Manifest []FileInfo
+
+	// Checksum is the Murmur3 hash of Data in part payloads. Optional so
+	// that mixed-version meshes still work -- no checksum means accept.
+	Checksum string
+
+	// Link is the raw target of a symlink when the advertised file is one.
+	Link string
+
+	// LinkRel is the link target's path relative to the base directory when
+	// the link resolves inside it, empty when the target dangles or escapes
+	// the base. Receivers recreate in-tree links instead of copying the
+	// target's content under the link's name.
+	LinkRel string
 }
 
 func (m MessageType) String() string {
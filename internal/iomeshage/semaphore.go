@@ -0,0 +1,101 @@
+// Copyright 2017-2021 National Technology & Engineering Solutions of Sandia, LLC (NTESS).
+// Under the terms of Contract DE-NA0003525 with NTESS, the U.S. Government retains certain
+// rights in this software.
+
+package iomeshage
+
+import (
+	"context"
+	"sync"
+)
+
+// semaphore is a counting semaphore whose limit can be resized at runtime.
+// Shrinking the limit below the slots in use lets the current holders finish
+// while admitting no new ones until the count drops under the limit again.
+type semaphore struct {
+	mu    sync.Mutex
+	cond  *sync.Cond
+	limit int
+	used  int
+}
+
+func newSemaphore(limit int) *semaphore {
+	s := &semaphore{limit: limit}
+	s.cond = sync.NewCond(&s.mu)
+
+	return s
+}
+
+// acquire takes a slot, blocking until one is free or ctx is done.
+func (s *semaphore) acquire(ctx context.Context) error {
+	// wake the waiters below when ctx is canceled; the broadcast takes the
+	// lock so it can't slip between the ctx check and the wait
+	done := make(chan struct{})
+	defer close(done)
+
+	go func() {
+		select {
+		case <-ctx.Done():
+			s.mu.Lock()
+			s.cond.Broadcast()
+			s.mu.Unlock()
+		case <-done:
+		}
+	}()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for s.used >= s.limit {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		s.cond.Wait()
+	}
+
+	s.used++
+
+	return nil
+}
+
+// tryAcquire takes a slot if one is free without blocking.
+func (s *semaphore) tryAcquire() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.used >= s.limit {
+		return false
+	}
+
+	s.used++
+
+	return true
+}
+
+// release returns a slot taken by acquire or tryAcquire.
+func (s *semaphore) release() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.used--
+	s.cond.Broadcast()
+}
+
+// setLimit resizes the semaphore, waking any waiters that a larger limit can
+// now admit.
+func (s *semaphore) setLimit(limit int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.limit = limit
+	s.cond.Broadcast()
+}
+
+// status returns the slots in use and the current limit.
+func (s *semaphore) status() (used, limit int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.used, s.limit
+}
@@ -18,6 +18,11 @@ import (
 
 const BufferSize = 32768
 
+// MaxUDPPayload is the largest datagram that will be carried over a tunnel.
+// Larger datagrams are dropped and counted rather than fragmented, see
+// DroppedUDP.
+const MaxUDPPayload = BufferSize
+
 // tunnel message types
 const (
 	HANDSHAKE = iota
@@ -25,6 +30,9 @@ const (
 	CLOSED
 	DATA
 	FORWARD
+	CONNECT_UDP
+	FORWARD_UDP
+	UDP_DATA
 )
 
 var errClosing = "use of closed network connection"
@@ -36,6 +44,10 @@ type Tunnel struct {
 	quit      chan bool // tell the message pump to quit
 	chans     chans
 
+	// datagrams dropped because they exceeded MaxUDPPayload, accessed
+	// atomically
+	droppedUDP uint64
+
 	sendLock sync.Mutex
 }
 
@@ -144,6 +156,10 @@ func (t *Tunnel) Forward(source int, host string, dest int) error {
 // Create a reverse forwarded port from a source port on the remote end,
 // destination host, and destination port on the local end.
 func (t *Tunnel) Reverse(source int, host string, dest int) error {
+	return t.reverse(FORWARD, source, host, dest)
+}
+
+func (t *Tunnel) reverse(typ int, source int, host string, dest int) error {
 	// create a temporary TID registration in order to get an ACK back
 	TID := rand.Int()
 	in := t.chans.add(TID)
@@ -151,7 +167,7 @@ func (t *Tunnel) Reverse(source int, host string, dest int) error {
 
 	// send a message to invoke Forward() on the remote side
 	m := &tunnelMessage{
-		Type:   FORWARD,
+		Type:   typ,
 		TID:    TID,
 		Source: source,
 		Host:   host,
@@ -314,3 +314,131 @@ func TestReverseInvalid(t *testing.T) {
 		t.Fatalf("ListenAndServe: %v", errListen)
 	}
 }
+
+// DummyUDPServer reads a single datagram and replies to whoever sent it.
+type DummyUDPServer struct {
+	*net.UDPConn // embed
+	sync.Mutex   // embed
+
+	err error // any error that occured while being a dummy
+}
+
+func NewDummyUDPServer(port int) (*DummyUDPServer, error) {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{Port: port})
+	if err != nil {
+		return nil, err
+	}
+
+	return &DummyUDPServer{UDPConn: conn}, nil
+}
+
+func (d *DummyUDPServer) Expect(input, output string) {
+	d.Lock()
+	defer d.Unlock()
+
+	var buf = make([]byte, 10)
+	n, addr, err := d.ReadFromUDP(buf)
+	if err != nil {
+		d.err = err
+		return
+	}
+
+	if string(buf[:n]) != input {
+		d.err = fmt.Errorf("invalid message: `%v` != `%v`", string(buf[:n]), input)
+		return
+	}
+
+	_, d.err = d.WriteToUDP([]byte(output), addr)
+}
+
+func TestTunnelUDP(t *testing.T) {
+	g, h := net.Pipe()
+
+	errChan := goListenAndServe(g)
+
+	tun, errDial := Dial(h)
+	if errDial != nil {
+		t.Fatalf("Dial: %v", errDial)
+	}
+
+	s, err := NewDummyUDPServer(4453)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	go s.Expect("hello", "world")
+	defer s.Close()
+
+	err = tun.ForwardUDP(4452, "localhost", 4453)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	c, err := NewDummyClient("udp", ":4452")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer c.Close()
+
+	if err := c.Send("hello"); err != nil {
+		t.Fatalf("%v", err)
+	}
+	if err := c.Receive("world"); err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	s.Lock()
+	if s.err != nil {
+		t.Fatalf("%v", s.err)
+	}
+
+	errListen := <-errChan
+	if errListen != nil {
+		t.Fatalf("ListenAndServe: %v", errListen)
+	}
+}
+
+func TestReverseUDP(t *testing.T) {
+	g, h := net.Pipe()
+
+	errChan := goListenAndServe(g)
+
+	tun, errDial := Dial(h)
+	if errDial != nil {
+		t.Fatalf("Dial: %v", errDial)
+	}
+
+	s, err := NewDummyUDPServer(4454)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	go s.Expect("hello", "world")
+	defer s.Close()
+
+	err = tun.ReverseUDP(4455, "localhost", 4454)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	c, err := NewDummyClient("udp", ":4455")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer c.Close()
+
+	if err := c.Send("hello"); err != nil {
+		t.Fatalf("%v", err)
+	}
+	if err := c.Receive("world"); err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	s.Lock()
+	if s.err != nil {
+		t.Fatalf("%v", s.err)
+	}
+
+	errListen := <-errChan
+	if errListen != nil {
+		t.Fatalf("ListenAndServe: %v", errListen)
+	}
+}
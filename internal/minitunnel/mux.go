@@ -87,7 +87,9 @@ func (t *Tunnel) mux() {
 		// create new session if necessary
 		if m.Type == CONNECT {
 			t.handleRemote(&m)
-		} else if m.Type == FORWARD {
+		} else if m.Type == CONNECT_UDP {
+			t.handleRemoteUDP(&m)
+		} else if m.Type == FORWARD || m.Type == FORWARD_UDP {
 			t.handleReverse(&m)
 		} else if c := t.chans.get(m.TID); c != nil {
 			// route the message to the handler by TID
@@ -134,13 +136,21 @@ func (t *Tunnel) handleRemote(m *tunnelMessage) {
 }
 
 // reverse tunnels are made by simply asking the remote end to invoke 'Forward'
+// or 'ForwardUDP'
 func (t *Tunnel) handleReverse(m *tunnelMessage) {
 	resp := &tunnelMessage{
 		Type: DATA,
 		TID:  m.TID,
 		Ack:  true,
 	}
-	if err := t.Forward(m.Source, m.Host, m.Port); err != nil {
+
+	var err error
+	if m.Type == FORWARD_UDP {
+		err = t.ForwardUDP(m.Source, m.Host, m.Port)
+	} else {
+		err = t.Forward(m.Source, m.Host, m.Port)
+	}
+	if err != nil {
 		resp.Error = err.Error()
 	}
 
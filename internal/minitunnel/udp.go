@@ -0,0 +1,219 @@
+// Copyright 2015-2021 National Technology & Engineering Solutions of Sandia, LLC (NTESS).
+// Under the terms of Contract DE-NA0003525 with NTESS, the U.S. Government retains certain
+// rights in this software.
+
+package minitunnel
+
+import (
+	"fmt"
+	"math/rand"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sandia-minimega/minimega/v2/pkg/minilog"
+)
+
+// udpTimeout is how long a remote-side socket is kept around without seeing a
+// reply before its source association is dropped.
+const udpTimeout = 5 * time.Minute
+
+// DroppedUDP returns the number of datagrams dropped on this end of the
+// tunnel because they exceeded MaxUDPPayload.
+func (t *Tunnel) DroppedUDP() uint64 {
+	return atomic.LoadUint64(&t.droppedUDP)
+}
+
+// ForwardUDP forwards a local UDP port to a remote host and destination port.
+// Each datagram is carried over the tunnel tagged with its source address so
+// replies from the remote end are returned to the peer that sent it.
+func (t *Tunnel) ForwardUDP(source int, host string, dest int) error {
+	log.Info("forward udp %v -> %v:%v", source, host, dest)
+
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{Port: source})
+	if err != nil {
+		return err
+	}
+
+	TID := rand.Int()
+	in := t.chans.add(TID)
+
+	// ask the remote end to create the matching datagram session
+	m := &tunnelMessage{
+		Type: CONNECT_UDP,
+		TID:  TID,
+		Host: host,
+		Port: dest,
+	}
+	if err := t.sendMessage(m); err != nil {
+		t.chans.remove(TID)
+		conn.Close()
+		return err
+	}
+
+	go t.transferUDP(in, conn, TID)
+	return nil
+}
+
+// ReverseUDP creates a reverse forwarded UDP port from a source port on the
+// remote end, destination host, and destination port on the local end.
+func (t *Tunnel) ReverseUDP(source int, host string, dest int) error {
+	return t.reverse(FORWARD_UDP, source, host, dest)
+}
+
+// transferUDP relays datagrams between the local UDP socket and the remote
+// end of the tunnel until either closes.
+func (t *Tunnel) transferUDP(in chan *tunnelMessage, conn *net.UDPConn, TID int) {
+	defer t.chans.remove(TID)
+
+	go func() {
+		<-t.quit
+		conn.Close()
+	}()
+
+	// replies from the remote end go back to the tagged source address
+	go func() {
+		defer conn.Close()
+
+		for m := range in {
+			if m.Type == CLOSED {
+				if m.Error != "" {
+					log.Errorln(m.Error)
+				}
+				return
+			}
+
+			addr, err := net.ResolveUDPAddr("udp", m.Host)
+			if err != nil {
+				log.Error("bad source tag %v: %v", m.Host, err)
+				continue
+			}
+
+			if _, err := conn.WriteToUDP(m.Data, addr); err != nil {
+				log.Errorln(err)
+			}
+		}
+	}()
+
+	buf := make([]byte, 64*1024)
+
+	for {
+		n, addr, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+
+		if n > MaxUDPPayload {
+			atomic.AddUint64(&t.droppedUDP, 1)
+			log.Debug("dropping oversized datagram from %v: %v bytes", addr, n)
+			continue
+		}
+
+		m := &tunnelMessage{
+			Type: UDP_DATA,
+			TID:  TID,
+			Host: addr.String(),
+			Data: buf[:n],
+		}
+
+		if err := t.sendMessage(m); err != nil {
+			log.Errorln(err)
+			return
+		}
+	}
+}
+
+// handleRemoteUDP services a datagram session created by the other end of the
+// tunnel. A socket is created per source tag so that replies stay associated
+// with the peer that sent the original datagram.
+func (t *Tunnel) handleRemoteUDP(m *tunnelMessage) {
+	in := t.chans.add(m.TID)
+
+	go t.serveUDP(in, m.TID, m.Host, m.Port)
+}
+
+func (t *Tunnel) serveUDP(in chan *tunnelMessage, TID int, host string, port int) {
+	defer t.chans.remove(TID)
+
+	// per-source sockets; concurrent senders through the same forward each
+	// get their own so replies can be told apart
+	var mu sync.Mutex
+	conns := map[string]net.Conn{}
+
+	defer func() {
+		mu.Lock()
+		defer mu.Unlock()
+
+		for _, conn := range conns {
+			conn.Close()
+		}
+	}()
+
+	for m := range in {
+		if m.Type == CLOSED {
+			if m.Error != "" {
+				log.Errorln(m.Error)
+			}
+			return
+		}
+
+		mu.Lock()
+		conn, ok := conns[m.Host]
+		mu.Unlock()
+
+		if !ok {
+			var err error
+			conn, err = net.Dial("udp", fmt.Sprintf("%v:%v", host, port))
+			if err != nil {
+				log.Errorln(err)
+				continue
+			}
+
+			mu.Lock()
+			conns[m.Host] = conn
+			mu.Unlock()
+
+			// shovel replies back with the source tag preserved
+			go func(tag string, conn net.Conn) {
+				buf := make([]byte, 64*1024)
+
+				for {
+					conn.SetReadDeadline(time.Now().Add(udpTimeout))
+
+					n, err := conn.Read(buf)
+					if err != nil {
+						mu.Lock()
+						delete(conns, tag)
+						mu.Unlock()
+
+						conn.Close()
+						return
+					}
+
+					if n > MaxUDPPayload {
+						atomic.AddUint64(&t.droppedUDP, 1)
+						log.Debug("dropping oversized datagram for %v: %v bytes", tag, n)
+						continue
+					}
+
+					r := &tunnelMessage{
+						Type: UDP_DATA,
+						TID:  TID,
+						Host: tag,
+						Data: buf[:n],
+					}
+
+					if err := t.sendMessage(r); err != nil {
+						log.Errorln(err)
+						return
+					}
+				}
+			}(m.Host, conn)
+		}
+
+		if _, err := conn.Write(m.Data); err != nil {
+			log.Errorln(err)
+		}
+	}
+}
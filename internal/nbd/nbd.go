@@ -7,9 +7,7 @@ package nbd
 import (
 	"errors"
 	"fmt"
-	"io/ioutil"
 	"os"
-	"path/filepath"
 	"strings"
 	"time"
 
@@ -21,9 +19,9 @@ var (
 )
 
 const (
-	// How many times to retry connecting to a nbd device when all are
-	// currently in use.
-	maxConnectRetries = 3
+	// How long ConnectImage will wait for a device to be released when all
+	// are currently in use.
+	claimTimeout = 30 * time.Second
 )
 
 func Modprobe() error {
@@ -60,59 +58,34 @@ func Ready() error {
 	return nil
 }
 
-// GetDevice returns the first available NBD. If there are no devices
-// available, returns ErrNoDeviceAvailable.
+// GetDevice returns the first NBD that is neither connected nor claimed by
+// an in-flight operation. If there are no devices available, returns
+// ErrNoDeviceAvailable.
 func GetDevice() (string, error) {
-	// Get a list of all devices
-	devFiles, err := ioutil.ReadDir("/dev")
+	devices.mu.Lock()
+	defer devices.mu.Unlock()
+
+	devs, err := devices.available()
 	if err != nil {
 		return "", err
 	}
 
-	nbdPath := ""
-
-	// Find the first available nbd
-	for _, devInfo := range devFiles {
-		dev := devInfo.Name()
-		// we don't want to include partitions here
-		if !strings.Contains(dev, "nbd") || strings.Contains(dev, "p") {
-			continue
-		}
-
-		// check whether a pid exists for the current nbd
-		_, err = os.Stat(filepath.Join("/sys/block", dev, "pid"))
-		if err != nil {
+	for _, dev := range devs {
+		if _, ok := devices.claimed[dev]; !ok {
 			log.Debug("found available nbd: " + dev)
-			nbdPath = filepath.Join("/dev", dev)
-			break
-		} else {
-			log.Debug("nbd %v could not be used", dev)
+			return dev, nil
 		}
 	}
 
-	if nbdPath == "" {
-		return "", ErrNoDeviceAvailable
-	}
-
-	return nbdPath, nil
+	return "", ErrNoDeviceAvailable
 }
 
 // ConnectImage exports a image using the NBD protocol using the qemu-nbd. If
-// successful, returns the NBD device.
+// successful, returns the NBD device. The device is claimed from the package
+// device pool and stays claimed until DisconnectDevice; when all devices are
+// busy, ConnectImage blocks for up to claimTimeout for one to be released.
 func ConnectImage(image string) (string, error) {
-	var nbdPath string
-	var err error
-
-	for i := 0; i < maxConnectRetries; i++ {
-		nbdPath, err = GetDevice()
-		if err != ErrNoDeviceAvailable {
-			break
-		}
-
-		log.Debug("all nbds in use, sleeping before retrying")
-		time.Sleep(time.Second * 10)
-	}
-
+	nbdPath, err := devices.claimWait(image, claimTimeout)
 	if err != nil {
 		return "", err
 	}
@@ -122,6 +95,7 @@ func ConnectImage(image string) (string, error) {
 	// connect it to qemu-nbd
 	out, err := processWrapper("qemu-nbd", "-c", nbdPath, image)
 	if err != nil {
+		devices.releaseDev(nbdPath)
 		return "", fmt.Errorf("unable to connect to nbd: %v", out)
 	}
 
@@ -132,6 +106,10 @@ func ConnectImage(image string) (string, error) {
 func DisconnectDevice(dev string) error {
 	log.Debug("disconnect nbd: %v", dev)
 
+	// return the device to the pool even if the disconnect fails; a wedged
+	// device still has a pid in /sys so it won't be handed out again
+	defer devices.releaseDev(dev)
+
 	// disconnect nbd
 	out, err := processWrapper("qemu-nbd", "-d", dev)
 	if err != nil {
@@ -0,0 +1,130 @@
+// Copyright (2012) Sandia Corporation.
+// Under the terms of Contract DE-AC04-94AL85000 with Sandia Corporation,
+// the U.S. Government retains certain rights in this software.
+
+package nbd
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// pool tracks which nbd devices are claimed by an in-flight operation so that
+// concurrent disk operations don't race on device allocation or on the
+// kernel's partition rescan.
+type pool struct {
+	mu sync.Mutex
+
+	// claimed maps a device path to the image connected to it
+	claimed map[string]string
+
+	// release is signaled when a device is returned to the pool
+	release chan struct{}
+
+	// available returns candidate device paths; overridden in tests
+	available func() ([]string, error)
+}
+
+// devices is the package-wide pool that ConnectImage and DisconnectDevice
+// allocate through.
+var devices = newPool(listDevices)
+
+func newPool(available func() ([]string, error)) *pool {
+	return &pool{
+		claimed:   map[string]string{},
+		release:   make(chan struct{}, 1),
+		available: available,
+	}
+}
+
+// listDevices returns the nbd devices that are not connected to a server,
+// claimed or not.
+func listDevices() ([]string, error) {
+	// Get a list of all devices
+	devFiles, err := ioutil.ReadDir("/dev")
+	if err != nil {
+		return nil, err
+	}
+
+	var res []string
+
+	for _, devInfo := range devFiles {
+		dev := devInfo.Name()
+		// we don't want to include partitions here
+		if !strings.Contains(dev, "nbd") || strings.Contains(dev, "p") {
+			continue
+		}
+
+		// check whether a pid exists for the current nbd
+		if _, err := os.Stat(filepath.Join("/sys/block", dev, "pid")); err != nil {
+			res = append(res, filepath.Join("/dev", dev))
+		}
+	}
+
+	return res, nil
+}
+
+// claim marks the first unclaimed device as owned by image. Returns
+// ErrNoDeviceAvailable when every device is busy.
+func (p *pool) claim(image string) (string, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	devs, err := p.available()
+	if err != nil {
+		return "", err
+	}
+
+	for _, dev := range devs {
+		if _, ok := p.claimed[dev]; !ok {
+			p.claimed[dev] = image
+			return dev, nil
+		}
+	}
+
+	return "", ErrNoDeviceAvailable
+}
+
+// claimWait is claim except that it blocks, up to timeout, for a device to be
+// released when all devices are busy.
+func (p *pool) claimWait(image string, timeout time.Duration) (string, error) {
+	deadline := time.Now().Add(timeout)
+
+	for {
+		dev, err := p.claim(image)
+		if err != ErrNoDeviceAvailable {
+			return dev, err
+		}
+
+		remaining := time.Until(deadline)
+		if remaining <= 0 {
+			return "", ErrNoDeviceAvailable
+		}
+
+		// a release only wakes a single waiter so poll periodically too
+		if remaining > time.Second {
+			remaining = time.Second
+		}
+
+		select {
+		case <-p.release:
+		case <-time.After(remaining):
+		}
+	}
+}
+
+// releaseDev returns a device to the pool and wakes a waiter, if any.
+func (p *pool) releaseDev(dev string) {
+	p.mu.Lock()
+	delete(p.claimed, dev)
+	p.mu.Unlock()
+
+	select {
+	case p.release <- struct{}{}:
+	default:
+	}
+}
@@ -0,0 +1,117 @@
+// Copyright (2012) Sandia Corporation.
+// Under the terms of Contract DE-AC04-94AL85000 with Sandia Corporation,
+// the U.S. Government retains certain rights in this software.
+
+package nbd
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeDevices returns an available func backed by a fixed device list.
+func fakeDevices(n int) func() ([]string, error) {
+	devs := []string{}
+	for i := 0; i < n; i++ {
+		devs = append(devs, fmt.Sprintf("/dev/nbd%v", i))
+	}
+
+	return func() ([]string, error) {
+		return devs, nil
+	}
+}
+
+func TestPoolClaimRelease(t *testing.T) {
+	p := newPool(fakeDevices(2))
+
+	d0, err := p.claim("a.qcow2")
+	if err != nil {
+		t.Fatalf("claim: %v", err)
+	}
+
+	d1, err := p.claim("b.qcow2")
+	if err != nil {
+		t.Fatalf("claim: %v", err)
+	}
+
+	if d0 == d1 {
+		t.Fatalf("claimed the same device twice: %v", d0)
+	}
+
+	if _, err := p.claim("c.qcow2"); err != ErrNoDeviceAvailable {
+		t.Fatalf("expected ErrNoDeviceAvailable, got %v", err)
+	}
+
+	p.releaseDev(d0)
+
+	d2, err := p.claim("c.qcow2")
+	if err != nil {
+		t.Fatalf("claim after release: %v", err)
+	}
+	if d2 != d0 {
+		t.Fatalf("expected released device %v, got %v", d0, d2)
+	}
+}
+
+func TestPoolClaimWaitTimeout(t *testing.T) {
+	p := newPool(fakeDevices(1))
+
+	if _, err := p.claim("a.qcow2"); err != nil {
+		t.Fatalf("claim: %v", err)
+	}
+
+	start := time.Now()
+	if _, err := p.claimWait("b.qcow2", 100*time.Millisecond); err != ErrNoDeviceAvailable {
+		t.Fatalf("expected ErrNoDeviceAvailable, got %v", err)
+	}
+	if time.Since(start) < 100*time.Millisecond {
+		t.Fatalf("claimWait returned before the timeout")
+	}
+}
+
+// TestPoolStress runs many mock injections concurrently against a small pool
+// and checks that no device is ever handed to two operations at once.
+func TestPoolStress(t *testing.T) {
+	p := newPool(fakeDevices(4))
+
+	var mu sync.Mutex
+	held := map[string]string{}
+
+	var wg sync.WaitGroup
+
+	for i := 0; i < 32; i++ {
+		wg.Add(1)
+
+		go func(i int) {
+			defer wg.Done()
+
+			image := fmt.Sprintf("image%v.qcow2", i)
+
+			dev, err := p.claimWait(image, 10*time.Second)
+			if err != nil {
+				t.Errorf("claimWait: %v", err)
+				return
+			}
+
+			mu.Lock()
+			if other, ok := held[dev]; ok {
+				t.Errorf("%v handed out to both %v and %v", dev, other, image)
+			}
+			held[dev] = image
+			mu.Unlock()
+
+			// hold the device the way an inject would
+			time.Sleep(time.Millisecond)
+
+			mu.Lock()
+			delete(held, dev)
+			mu.Unlock()
+
+			p.releaseDev(dev)
+		}(i)
+	}
+
+	wg.Wait()
+}
@@ -384,3 +384,11 @@ name "pc-dimm", desc "DIMM memory module"
 name "sd-card", bus sd-bus
 name "tpm-tis", bus ISA
 name "xen-pvdevice", bus PCI, desc "Xen PV Device"`
+
+// kvm -version
+const versionOut = `QEMU emulator version 2.11.1(Debian 1:2.11+dfsg-1ubuntu7.23)
+Copyright (c) 2003-2017 Fabrice Bellard and the QEMU Project developers`
+
+// qemu-system-x86_64 -version
+const versionOutNew = `QEMU emulator version 6.2.0 (qemu-6.2.0-1.fc35)
+Copyright (c) 2003-2021 Fabrice Bellard and the QEMU Project developers`
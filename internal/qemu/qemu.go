@@ -10,9 +10,12 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"os"
 	"os/exec"
+	"path/filepath"
 	"strings"
 	"sync"
+	"time"
 )
 
 var (
@@ -20,11 +23,29 @@ var (
 	mu sync.Mutex
 
 	// name -> values
-	cache = map[string]map[string]bool{}
+	cache = map[string]entry{}
 )
 
+// entry is a cached capability probe. mtime is the modification time of the
+// binary when the probe ran so that we can invalidate the entry if the binary
+// changes out from under us.
+type entry struct {
+	mtime time.Time
+	vals  map[string]bool
+}
+
 type parser func(io.Reader) (map[string]bool, error)
 
+// ClearCache drops all cached capability probes, forcing the next call to
+// CPUs, Machines, or NICs to fork the binary again. This is only needed when
+// a binary is replaced in place without changing its modification time.
+func ClearCache() {
+	mu.Lock()
+	defer mu.Unlock()
+
+	cache = map[string]entry{}
+}
+
 // CPUs returns a list of supported QEMU CPUs for the specified qemu and
 // machine type.
 func CPUs(qemu, machine string) (map[string]bool, error) {
@@ -87,9 +108,11 @@ func caps(name string, cmd []string, fn parser) (map[string]bool, error) {
 	mu.Lock()
 	defer mu.Unlock()
 
-	// test if the key exists
-	if v, ok := cache[name]; ok {
-		return v, nil
+	mtime := binaryMTime(cmd[0])
+
+	// test if the key exists and the binary hasn't changed since we probed it
+	if v, ok := cache[name]; ok && v.mtime.Equal(mtime) {
+		return v.vals, nil
 	}
 
 	out, err := exec.Command(cmd[0], cmd[1:]...).CombinedOutput()
@@ -102,10 +125,31 @@ func caps(name string, cmd []string, fn parser) (map[string]bool, error) {
 		return nil, err
 	}
 
-	cache[name] = res
+	cache[name] = entry{mtime: mtime, vals: res}
 	return res, nil
 }
 
+// binaryMTime returns the modification time of the specified binary,
+// resolving relative names via $PATH the same way exec.Command does. Returns
+// the zero time if the binary cannot be found -- the exec will report a
+// better error than we can.
+func binaryMTime(path string) time.Time {
+	if !filepath.IsAbs(path) {
+		v, err := exec.LookPath(path)
+		if err != nil {
+			return time.Time{}
+		}
+		path = v
+	}
+
+	fi, err := os.Stat(path)
+	if err != nil {
+		return time.Time{}
+	}
+
+	return fi.ModTime()
+}
+
 func parseCPUs(r io.Reader) (map[string]bool, error) {
 	res := map[string]bool{}
 
@@ -5,10 +5,28 @@
 package qemu
 
 import (
+	"os"
+	"path/filepath"
 	"strings"
 	"testing"
+	"time"
 )
 
+// fakeQemu writes an executable script that prints the specified machine list
+// and returns its path.
+func fakeQemu(t testing.TB, machines string) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "fake-qemu")
+
+	script := "#!/bin/sh\necho 'Supported machines are:'\necho '" + machines + "'\n"
+	if err := os.WriteFile(path, []byte(script), 0755); err != nil {
+		t.Fatalf("failed: %v", err)
+	}
+
+	return path
+}
+
 func TestParseCPUs(t *testing.T) {
 	res, err := parseCPUs(strings.NewReader(cpusOut))
 	if err != nil {
@@ -44,3 +62,131 @@ func TestParseNICs(t *testing.T) {
 
 	t.Logf("parsed %v nics", len(res))
 }
+
+func TestParseVersion(t *testing.T) {
+	v, err := parseVersion(versionOut)
+	if err != nil {
+		t.Fatalf("failed: %v", err)
+	}
+
+	if v.raw != "2.11.1" || v.major != 2 || v.minor != 11 {
+		t.Fatalf("wrong version: %v", v)
+	}
+}
+
+func TestParseVersionNew(t *testing.T) {
+	v, err := parseVersion(versionOutNew)
+	if err != nil {
+		t.Fatalf("failed: %v", err)
+	}
+
+	if v.raw != "6.2.0" || v.major != 6 || v.minor != 2 {
+		t.Fatalf("wrong version: %v", v)
+	}
+}
+
+func TestCacheInvalidation(t *testing.T) {
+	defer ClearCache()
+
+	path := fakeQemu(t, "pc Standard PC")
+
+	res, err := Machines(path)
+	if err != nil {
+		t.Fatalf("failed: %v", err)
+	}
+	if !res["pc"] {
+		t.Fatalf("missing machine: %v", res)
+	}
+
+	// rewrite the binary with a new machine and backdate the mtime so that it
+	// differs from the cached probe
+	script := "#!/bin/sh\necho 'Supported machines are:'\necho 'q35 Q35 PC'\n"
+	if err := os.WriteFile(path, []byte(script), 0755); err != nil {
+		t.Fatalf("failed: %v", err)
+	}
+	old := time.Now().Add(-time.Hour)
+	if err := os.Chtimes(path, old, old); err != nil {
+		t.Fatalf("failed: %v", err)
+	}
+
+	res, err = Machines(path)
+	if err != nil {
+		t.Fatalf("failed: %v", err)
+	}
+	if !res["q35"] || res["pc"] {
+		t.Fatalf("stale cache: %v", res)
+	}
+}
+
+func TestClearCache(t *testing.T) {
+	defer ClearCache()
+
+	path := fakeQemu(t, "pc Standard PC")
+
+	if _, err := Machines(path); err != nil {
+		t.Fatalf("failed: %v", err)
+	}
+
+	// rewrite the binary but preserve the mtime -- only ClearCache can help
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("failed: %v", err)
+	}
+	script := "#!/bin/sh\necho 'Supported machines are:'\necho 'q35 Q35 PC'\n"
+	if err := os.WriteFile(path, []byte(script), 0755); err != nil {
+		t.Fatalf("failed: %v", err)
+	}
+	if err := os.Chtimes(path, fi.ModTime(), fi.ModTime()); err != nil {
+		t.Fatalf("failed: %v", err)
+	}
+
+	res, err := Machines(path)
+	if err != nil {
+		t.Fatalf("failed: %v", err)
+	}
+	if res["q35"] {
+		t.Fatalf("expected stale cache: %v", res)
+	}
+
+	ClearCache()
+
+	res, err = Machines(path)
+	if err != nil {
+		t.Fatalf("failed: %v", err)
+	}
+	if !res["q35"] {
+		t.Fatalf("stale cache after clear: %v", res)
+	}
+}
+
+func BenchmarkMachinesCached(b *testing.B) {
+	defer ClearCache()
+
+	path := fakeQemu(b, "pc Standard PC")
+
+	// prime the cache so that the loop never forks the binary
+	if _, err := Machines(path); err != nil {
+		b.Fatalf("failed: %v", err)
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := Machines(path); err != nil {
+			b.Fatalf("failed: %v", err)
+		}
+	}
+}
+
+func BenchmarkMachinesUncached(b *testing.B) {
+	defer ClearCache()
+
+	path := fakeQemu(b, "pc Standard PC")
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		ClearCache()
+		if _, err := Machines(path); err != nil {
+			b.Fatalf("failed: %v", err)
+		}
+	}
+}
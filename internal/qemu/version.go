@@ -0,0 +1,93 @@
+// Copyright 2018-2021 National Technology & Engineering Solutions of Sandia, LLC (NTESS).
+// Under the terms of Contract DE-NA0003525 with NTESS, the U.S. Government retains certain
+// rights in this software.
+
+package qemu
+
+import (
+	"fmt"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+var (
+	// guards below
+	versionMu sync.Mutex
+
+	// qemu path -> parsed version
+	versions = map[string]version{}
+)
+
+// version is a parsed QEMU version number such as 2.11.1.
+type version struct {
+	major, minor int
+	raw          string
+}
+
+var versionRe = regexp.MustCompile(`version (\d+)\.(\d+)(?:\.(\d+))?`)
+
+// Version returns the version of the specified QEMU binary, parsed from
+// `qemu -version` output. Results are cached per path so repeated lookups
+// don't fork the binary again.
+func Version(qemu string) (string, error) {
+	v, err := lookupVersion(qemu)
+	if err != nil {
+		return "", fmt.Errorf("unable to determine QEMU version -- %v", err)
+	}
+
+	return v.raw, nil
+}
+
+// VersionAtLeast returns true if the specified QEMU binary reports a version
+// of at least major.minor.
+func VersionAtLeast(qemu string, major, minor int) (bool, error) {
+	v, err := lookupVersion(qemu)
+	if err != nil {
+		return false, fmt.Errorf("unable to determine QEMU version -- %v", err)
+	}
+
+	return v.major > major || (v.major == major && v.minor >= minor), nil
+}
+
+func lookupVersion(qemu string) (version, error) {
+	versionMu.Lock()
+	defer versionMu.Unlock()
+
+	if v, ok := versions[qemu]; ok {
+		return v, nil
+	}
+
+	out, err := exec.Command(qemu, "-version").CombinedOutput()
+	if err != nil {
+		return version{}, err
+	}
+
+	v, err := parseVersion(string(out))
+	if err != nil {
+		return version{}, err
+	}
+
+	versions[qemu] = v
+	return v, nil
+}
+
+func parseVersion(s string) (version, error) {
+	m := versionRe.FindStringSubmatch(s)
+	if m == nil {
+		return version{}, fmt.Errorf("unable to parse QEMU version: %v", strings.TrimSpace(s))
+	}
+
+	// the regexp only matches digits
+	major, _ := strconv.Atoi(m[1])
+	minor, _ := strconv.Atoi(m[2])
+
+	raw := m[1] + "." + m[2]
+	if m[3] != "" {
+		raw += "." + m[3]
+	}
+
+	return version{major: major, minor: minor, raw: raw}, nil
+}
@@ -0,0 +1,160 @@
+// Copyright (2012) Sandia Corporation.
+// Under the terms of Contract DE-AC04-94AL85000 with Sandia Corporation,
+// the U.S. Government retains certain rights in this software.
+
+package qmp
+
+import (
+	"sync"
+	"time"
+
+	log "github.com/sandia-minimega/minimega/v2/pkg/minilog"
+)
+
+// EVENT_BUFFER is the size of each subscriber's event buffer. Events are
+// dropped for subscribers that fall this far behind the reader.
+const EVENT_BUFFER = 1024
+
+// Event is a decoded asynchronous QMP event.
+type Event struct {
+	// Name of the event, e.g. "STOP" or "BLOCK_IO_ERROR"
+	Name string
+
+	// Timestamp of the event as reported by QEMU
+	Timestamp time.Time
+
+	// Data holds any event-specific data, may be nil
+	Data map[string]interface{}
+
+	// raw is the undecoded message, kept for the Message compatibility shim
+	raw map[string]interface{}
+}
+
+type subscriber struct {
+	// events to deliver, nil means all events
+	events map[string]bool
+
+	ch chan Event
+
+	// dropped counts events dropped because ch was full
+	dropped uint64
+}
+
+// subscribers is the fan-out state for a Conn. It lives behind a pointer so
+// that copies of the Conn share it.
+type subscribers struct {
+	mu sync.Mutex
+
+	subs []*subscriber
+
+	// set when the underlying connection has closed
+	closed bool
+
+	// dropped counts events dropped across all subscribers
+	dropped uint64
+}
+
+// Subscribe returns a channel of asynchronous QMP events, filtered to the
+// specified event names. If no names are given, all events are delivered. The
+// channel has a bounded buffer -- events are dropped for subscribers that
+// don't keep up rather than blocking the reader. The returned cancel function
+// removes the subscription and closes the channel.
+func (q *Conn) Subscribe(events ...string) (<-chan Event, func()) {
+	s := &subscriber{
+		ch: make(chan Event, EVENT_BUFFER),
+	}
+
+	if len(events) > 0 {
+		s.events = make(map[string]bool)
+		for _, v := range events {
+			s.events[v] = true
+		}
+	}
+
+	q.subs.mu.Lock()
+	defer q.subs.mu.Unlock()
+
+	if q.subs.closed {
+		close(s.ch)
+		return s.ch, func() {}
+	}
+
+	q.subs.subs = append(q.subs.subs, s)
+
+	return s.ch, func() { q.subs.unsubscribe(s) }
+}
+
+// Dropped returns the total number of events dropped because subscribers
+// weren't keeping up.
+func (q *Conn) Dropped() uint64 {
+	q.subs.mu.Lock()
+	defer q.subs.mu.Unlock()
+
+	return q.subs.dropped
+}
+
+func (s *subscribers) unsubscribe(sub *subscriber) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i, v := range s.subs {
+		if v == sub {
+			s.subs = append(s.subs[:i], s.subs[i+1:]...)
+			close(sub.ch)
+			return
+		}
+	}
+}
+
+// dispatch delivers an event to all matching subscribers without blocking.
+func (s *subscribers) dispatch(e Event) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, sub := range s.subs {
+		if sub.events != nil && !sub.events[e.Name] {
+			continue
+		}
+
+		select {
+		case sub.ch <- e:
+		default:
+			sub.dropped++
+			s.dropped++
+			log.Debug("qmp subscriber full, dropping %v (%v dropped)", e.Name, sub.dropped)
+		}
+	}
+}
+
+// close closes all subscriber channels once the connection has gone away.
+func (s *subscribers) close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.closed = true
+
+	for _, sub := range s.subs {
+		close(sub.ch)
+	}
+	s.subs = nil
+}
+
+// parseEvent decodes a raw asynchronous message into an Event.
+func parseEvent(v map[string]interface{}) Event {
+	e := Event{raw: v}
+
+	e.Name, _ = v["event"].(string)
+
+	if data, ok := v["data"].(map[string]interface{}); ok {
+		e.Data = data
+	}
+
+	// qemu reports seconds and microseconds since the epoch
+	if ts, ok := v["timestamp"].(map[string]interface{}); ok {
+		sec, _ := ts["seconds"].(float64)
+		usec, _ := ts["microseconds"].(float64)
+		e.Timestamp = time.Unix(int64(sec), int64(usec)*1000)
+	}
+
+	return e
+}
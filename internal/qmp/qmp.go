@@ -11,25 +11,238 @@ import (
 	"errors"
 	"fmt"
 	"net"
+	"sync"
+	"time"
 
 	log "github.com/sandia-minimega/minimega/v2/pkg/minilog"
 )
 
-var ERR_READY = errors.New("qmp is not ready")
+var (
+	ERR_READY   = errors.New("qmp is not ready")
+	ERR_TIMEOUT = errors.New("qmp command timed out")
+)
+
+// Error is an error response from the QMP monitor, carrying the class and
+// desc fields from the error object so that callers can distinguish, say,
+// DeviceNotFound from a GenericError.
+type Error struct {
+	Class string `json:"class"`
+	Desc  string `json:"desc"`
+}
+
+func (e *Error) Error() string {
+	return e.Desc
+}
+
+// parseError converts a QMP error response into an *Error, or nil if the
+// response is not an error.
+func parseError(v map[string]interface{}) error {
+	e, ok := v["error"].(map[string]interface{})
+	if !ok {
+		return nil
+	}
+
+	res := &Error{}
+	res.Class, _ = e["class"].(string)
+	res.Desc, _ = e["desc"].(string)
+	return res
+}
+
+// isClass reports whether err is a QMP error with the given class.
+func isClass(err error, class string) bool {
+	var e *Error
+	return errors.As(err, &e) && e.Class == class
+}
+
+// IsCommandNotFound reports whether err is a QMP CommandNotFound error.
+func IsCommandNotFound(err error) bool {
+	return isClass(err, "CommandNotFound")
+}
+
+// IsDeviceNotFound reports whether err is a QMP DeviceNotFound error.
+func IsDeviceNotFound(err error) bool {
+	return isClass(err, "DeviceNotFound")
+}
+
+// IsDeviceNotActive reports whether err is a QMP DeviceNotActive error.
+func IsDeviceNotActive(err error) bool {
+	return isClass(err, "DeviceNotActive")
+}
+
+const (
+	// COMMAND_TIMEOUT is a sensible default for control commands that should
+	// respond almost immediately (stop, cont, query-*, ...).
+	COMMAND_TIMEOUT = 10 * time.Second
+
+	// LONG_COMMAND_TIMEOUT is a sensible default for commands that
+	// legitimately take a while (migrate, disk backup, screendump, ...).
+	LONG_COMMAND_TIMEOUT = 10 * time.Minute
+)
 
 type Conn struct {
-	socket       string // path to unix domain socket to connect to
-	conn         net.Conn
-	dec          *json.Decoder
-	enc          *json.Encoder
-	messageSync  chan map[string]interface{}
-	messageAsync chan map[string]interface{}
-	ready        bool
+	socket string // path to unix domain socket to connect to
+	conn   net.Conn
+	dec    *json.Decoder
+	enc    *json.Encoder
+
+	// wmu serializes writes, shared by all copies of the Conn
+	wmu *sync.Mutex
+
+	// pending correlates responses to outstanding commands by id, shared by
+	// all copies of the Conn
+	pending *pending
+
+	// subs fans out asynchronous events to subscribers, shared by all copies
+	// of the Conn
+	subs *subscribers
+
+	// events is the internal subscription that backs Message
+	events <-chan Event
+
+	// timeout is the maximum time to wait for a command response, zero (the
+	// default) means wait forever. longTimeout is used instead for commands
+	// that legitimately take a while.
+	timeout     time.Duration
+	longTimeout time.Duration
+
+	ready bool
+}
+
+// SetTimeouts sets the maximum time to wait for command responses before
+// giving up. timeout applies to control commands and longTimeout to commands
+// that legitimately take a while (migrate, disk backup, screendump). Zero
+// (the default) means wait forever. Since responses are correlated by id, a
+// late response to a timed out command is simply discarded -- other commands
+// on the connection are unaffected.
+func (q *Conn) SetTimeouts(timeout, longTimeout time.Duration) {
+	q.timeout = timeout
+	q.longTimeout = longTimeout
+}
+
+// pending tracks in-flight commands by id so that responses can be
+// correlated, allowing multiple outstanding commands per connection. It
+// lives behind a pointer so that copies of the Conn share it.
+type pending struct {
+	mu sync.Mutex
+
+	next uint64
+	m    map[uint64]chan map[string]interface{}
+
+	// set when the underlying connection has closed
+	closed bool
+}
+
+// register allocates an id for a new command and the channel its response
+// will be delivered on. The channel is pre-closed if the connection has
+// already gone away.
+func (p *pending) register() (uint64, chan map[string]interface{}) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	ch := make(chan map[string]interface{}, 1)
+	if p.closed {
+		close(ch)
+		return 0, ch
+	}
+
+	p.next++
+	p.m[p.next] = ch
+
+	return p.next, ch
+}
+
+// cancel forgets an outstanding command so that a late response to it is
+// dropped.
+func (p *pending) cancel(id uint64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	delete(p.m, id)
+}
+
+// dispatch delivers a response to the command that issued it. Responses that
+// don't match an outstanding command are dropped.
+func (p *pending) dispatch(v map[string]interface{}) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	id, ok := v["id"].(float64)
+	if !ok {
+		log.Debug("qmp response without id: %#v", v)
+		return
+	}
+
+	if ch, ok := p.m[uint64(id)]; ok {
+		delete(p.m, uint64(id))
+		ch <- v
+	}
+}
+
+// close closes the channels of all outstanding commands once the connection
+// has gone away.
+func (p *pending) close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.closed = true
+
+	for id, ch := range p.m {
+		close(ch)
+		delete(p.m, id)
+	}
+}
+
+// command issues a synchronous command, correlating the response by id so
+// that slow commands don't stall other commands on the connection.
+func (q *Conn) command(v map[string]interface{}, long bool) (map[string]interface{}, error) {
+	if !q.ready {
+		return nil, ERR_READY
+	}
+
+	id, ch := q.pending.register()
+	v["id"] = id
+
+	if err := q.write(v); err != nil {
+		q.pending.cancel(id)
+		return nil, err
+	}
+
+	res, err := q.recv(ch, id, long)
+	if res != nil {
+		// drop the id so that callers see the response they would have
+		// gotten without the multiplexing
+		delete(res, "id")
+	}
+	return res, err
+}
+
+// recv waits for a command response, giving up after the configured timeout.
+func (q *Conn) recv(ch chan map[string]interface{}, id uint64, long bool) (map[string]interface{}, error) {
+	timeout := q.timeout
+	if long {
+		timeout = q.longTimeout
+	}
+
+	if timeout == 0 {
+		return <-ch, nil
+	}
+
+	select {
+	case v := <-ch:
+		return v, nil
+	case <-time.After(timeout):
+		q.pending.cancel(id)
+		return nil, fmt.Errorf("%w after %v", ERR_TIMEOUT, timeout)
+	}
 }
 
 // return an asynchronous message, blocking until one shows up
 func (q *Conn) Message() map[string]interface{} {
-	return <-q.messageAsync
+	e, ok := <-q.events
+	if !ok {
+		return nil
+	}
+	return e.raw
 }
 
 // Connect to a qmp socket.
@@ -50,8 +263,12 @@ func (q *Conn) connect(s string) error {
 	q.conn = conn
 	q.dec = json.NewDecoder(q.conn)
 	q.enc = json.NewEncoder(q.conn)
-	q.messageSync = make(chan map[string]interface{}, 1024)
-	q.messageAsync = make(chan map[string]interface{}, 1024)
+	q.wmu = &sync.Mutex{}
+	q.pending = &pending{m: make(map[uint64]chan map[string]interface{})}
+	q.subs = &subscribers{}
+
+	// internal subscription that backs Message
+	q.events, _ = q.Subscribe()
 
 	// upon connecting we should get the qmp version etc.
 	v, err := q.read()
@@ -118,6 +335,12 @@ func (q *Conn) write(v map[string]interface{}) error {
 	if !q.ready {
 		return ERR_READY
 	}
+
+	// commands may be issued from multiple goroutines now that responses
+	// are correlated by id
+	q.wmu.Lock()
+	defer q.wmu.Unlock()
+
 	err := q.enc.Encode(&v)
 	return err
 }
@@ -127,11 +350,19 @@ func (q *Conn) Raw(input string) (string, error) {
 	if !q.ready {
 		return "", ERR_READY
 	}
-	_, err := q.conn.Write([]byte(input))
+
+	var s map[string]interface{}
+	if err := json.Unmarshal([]byte(input), &s); err != nil {
+		return "", err
+	}
+
+	v, err := q.command(s, false)
 	if err != nil {
 		return "", err
 	}
-	v := <-q.messageSync
+	if err := parseError(v); err != nil {
+		return "", err
+	}
 	status := v["return"]
 	if status == nil {
 		return "", errors.New("received nil status")
@@ -153,11 +384,13 @@ func (q *Conn) Status() (map[string]interface{}, error) {
 	s := map[string]interface{}{
 		"execute": "query-status",
 	}
-	err := q.write(s)
+	v, err := q.command(s, false)
 	if err != nil {
 		return nil, err
 	}
-	v := <-q.messageSync
+	if err := parseError(v); err != nil {
+		return nil, err
+	}
 	status := v["return"]
 	if status == nil {
 		return nil, errors.New("received nil status")
@@ -165,6 +398,30 @@ func (q *Conn) Status() (map[string]interface{}, error) {
 	return status.(map[string]interface{}), nil
 }
 
+// RunState describes the VM run state from query-status.
+type RunState struct {
+	Running bool   `json:"running"`
+	Status  string `json:"status"`
+}
+
+// QueryStatus returns the VM run state, e.g. "running", "paused",
+// "shutdown", or "inmigrate" for a VM launched with -incoming.
+func (q *Conn) QueryStatus() (RunState, error) {
+	var res RunState
+
+	v, err := q.Status()
+	if err != nil {
+		return res, err
+	}
+
+	b, err := json.Marshal(v)
+	if err != nil {
+		return res, err
+	}
+	err = json.Unmarshal(b, &res)
+	return res, err
+}
+
 func (q *Conn) Start() error {
 	if !q.ready {
 		return ERR_READY
@@ -172,11 +429,13 @@ func (q *Conn) Start() error {
 	s := map[string]interface{}{
 		"execute": "cont",
 	}
-	err := q.write(s)
+	v, err := q.command(s, false)
 	if err != nil {
 		return err
 	}
-	v := <-q.messageSync
+	if err := parseError(v); err != nil {
+		return err
+	}
 	if !success(v) {
 		return errors.New("could not start VM")
 	}
@@ -190,11 +449,13 @@ func (q *Conn) Stop() error {
 	s := map[string]interface{}{
 		"execute": "stop",
 	}
-	err := q.write(s)
+	v, err := q.command(s, false)
 	if err != nil {
 		return err
 	}
-	v := <-q.messageSync
+	if err := parseError(v); err != nil {
+		return err
+	}
 	if !success(v) {
 		return errors.New("could not stop VM")
 	}
@@ -212,11 +473,13 @@ func (q *Conn) BlockdevEject(device string, force bool) error {
 			"force":  force,
 		},
 	}
-	err := q.write(s)
+	v, err := q.command(s, false)
 	if err != nil {
 		return err
 	}
-	v := <-q.messageSync
+	if err := parseError(v); err != nil {
+		return err
+	}
 	if !success(v) {
 		return errors.New("eject")
 	}
@@ -234,11 +497,13 @@ func (q *Conn) BlockdevChange(device, path string) error {
 			"target": path,
 		},
 	}
-	err := q.write(s)
+	v, err := q.command(s, false)
 	if err != nil {
 		return err
 	}
-	v := <-q.messageSync
+	if err := parseError(v); err != nil {
+		return err
+	}
 	if !success(v) {
 		return errors.New("change")
 	}
@@ -257,11 +522,13 @@ func (q *Conn) Pmemsave(path string, size uint64) error {
 			"filename": path,
 		},
 	}
-	err := q.write(s)
+	v, err := q.command(s, true)
 	if err != nil {
 		return err
 	}
-	v := <-q.messageSync
+	if err := parseError(v); err != nil {
+		return err
+	}
 	if !success(v) {
 		return errors.New("pmemsave")
 	}
@@ -280,11 +547,13 @@ func (q *Conn) BlockdevSnapshot(path, device string) error {
 			"format":        "raw",
 		},
 	}
-	err := q.write(s)
+	v, err := q.command(s, true)
 	if err != nil {
 		return err
 	}
-	v := <-q.messageSync
+	if err := parseError(v); err != nil {
+		return err
+	}
 	if !success(v) {
 		return errors.New("blockdev_snapshot")
 	}
@@ -301,11 +570,13 @@ func (q *Conn) Screendump(path string) error {
 			"filename": fmt.Sprintf("%v", path),
 		},
 	}
-	err := q.write(s)
+	v, err := q.command(s, true)
 	if err != nil {
 		return err
 	}
-	v := <-q.messageSync
+	if err := parseError(v); err != nil {
+		return err
+	}
 	if !success(v) {
 		return errors.New("screendump")
 	}
@@ -324,11 +595,13 @@ func (q *Conn) SaveDisk(path, device string) error {
 			"target": path,
 		},
 	}
-	err := q.write(s)
+	v, err := q.command(s, true)
 	if err != nil {
 		return err
 	}
-	v := <-q.messageSync
+	if err := parseError(v); err != nil {
+		return err
+	}
 	if !success(v) {
 		return errors.New("error in qmp SaveDisk")
 	}
@@ -345,17 +618,172 @@ func (q *Conn) MigrateDisk(path string) error {
 			"uri": fmt.Sprintf("exec:cat > %v", path),
 		},
 	}
-	err := q.write(s)
+	v, err := q.command(s, true)
 	if err != nil {
 		return err
 	}
-	v := <-q.messageSync
+	if err := parseError(v); err != nil {
+		return err
+	}
 	if !success(v) {
 		return errors.New("migrate")
 	}
 	return nil
 }
 
+// BlockStream starts a block-stream job that pulls data from the backing
+// image chain into the overlay for the given device. An empty base streams
+// the entire chain. Completion is reported via a BLOCK_JOB_COMPLETED event
+// and progress can be tracked with QueryBlockJobs.
+func (q *Conn) BlockStream(device, base string) error {
+	if !q.ready {
+		return ERR_READY
+	}
+	args := map[string]interface{}{
+		"device": device,
+	}
+	if base != "" {
+		args["base"] = base
+	}
+	s := map[string]interface{}{
+		"execute":   "block-stream",
+		"arguments": args,
+	}
+	v, err := q.command(s, false)
+	if err != nil {
+		return err
+	}
+	if err := parseError(v); err != nil {
+		return err
+	}
+	if !success(v) {
+		return errors.New("block-stream")
+	}
+	return nil
+}
+
+// BlockJobCancel cancels an active block job on the given device.
+func (q *Conn) BlockJobCancel(device string) error {
+	if !q.ready {
+		return ERR_READY
+	}
+	s := map[string]interface{}{
+		"execute": "block-job-cancel",
+		"arguments": map[string]interface{}{
+			"device": device,
+		},
+	}
+	v, err := q.command(s, false)
+	if err != nil {
+		return err
+	}
+	if err := parseError(v); err != nil {
+		return err
+	}
+	if !success(v) {
+		return errors.New("block-job-cancel")
+	}
+	return nil
+}
+
+// MigrateSetCapabilities enables or disables migration capabilities such as
+// compress, auto-converge, or multifd. Capabilities that this QEMU doesn't
+// know about cause an error, which callers may choose to treat as
+// non-fatal.
+func (q *Conn) MigrateSetCapabilities(caps map[string]bool) error {
+	if !q.ready {
+		return ERR_READY
+	}
+
+	var l []interface{}
+	for name, state := range caps {
+		l = append(l, map[string]interface{}{
+			"capability": name,
+			"state":      state,
+		})
+	}
+
+	s := map[string]interface{}{
+		"execute": "migrate-set-capabilities",
+		"arguments": map[string]interface{}{
+			"capabilities": l,
+		},
+	}
+	v, err := q.command(s, false)
+	if err != nil {
+		return err
+	}
+	if err := parseError(v); err != nil {
+		return err
+	}
+	if !success(v) {
+		return errors.New("migrate-set-capabilities")
+	}
+	return nil
+}
+
+// MigrateSetParameters sets migration parameters such as multifd-channels,
+// max-bandwidth, or downtime-limit.
+func (q *Conn) MigrateSetParameters(params map[string]interface{}) error {
+	if !q.ready {
+		return ERR_READY
+	}
+	s := map[string]interface{}{
+		"execute":   "migrate-set-parameters",
+		"arguments": params,
+	}
+	v, err := q.command(s, false)
+	if err != nil {
+		return err
+	}
+	if err := parseError(v); err != nil {
+		return err
+	}
+	if !success(v) {
+		return errors.New("migrate-set-parameters")
+	}
+	return nil
+}
+
+// QueryMigrateCapabilities returns the state of all migration capabilities.
+func (q *Conn) QueryMigrateCapabilities() (map[string]bool, error) {
+	if !q.ready {
+		return nil, ERR_READY
+	}
+	s := map[string]interface{}{
+		"execute": "query-migrate-capabilities",
+	}
+	v, err := q.command(s, false)
+	if err != nil {
+		return nil, err
+	}
+	if err := parseError(v); err != nil {
+		return nil, err
+	}
+	status := v["return"]
+	if status == nil {
+		return nil, errors.New("received nil status")
+	}
+
+	b, err := json.Marshal(status)
+	if err != nil {
+		return nil, err
+	}
+	var l []struct {
+		Capability string `json:"capability"`
+		State      bool   `json:"state"`
+	}
+	if err := json.Unmarshal(b, &l); err != nil {
+		return nil, err
+	}
+
+	res := map[string]bool{}
+	for _, v := range l {
+		res[v.Capability] = v.State
+	}
+	return res, nil
+}
+
 func (q *Conn) QueryMigrate() (map[string]interface{}, error) {
 	if !q.ready {
 		return nil, ERR_READY
@@ -363,11 +791,13 @@ func (q *Conn) QueryMigrate() (map[string]interface{}, error) {
 	s := map[string]interface{}{
 		"execute": "query-migrate",
 	}
-	err := q.write(s)
+	v, err := q.command(s, false)
 	if err != nil {
 		return nil, err
 	}
-	v := <-q.messageSync
+	if err := parseError(v); err != nil {
+		return nil, err
+	}
 
 	status := v["return"]
 	if status == nil {
@@ -376,23 +806,101 @@ func (q *Conn) QueryMigrate() (map[string]interface{}, error) {
 	return status.(map[string]interface{}), nil
 }
 
-func (q *Conn) QueryBlock() ([]interface{}, error) {
+// BlockDevice describes one device from query-block. Fields that older QEMU
+// versions don't report are simply left at their zero values.
+type BlockDevice struct {
+	Device    string `json:"device"`
+	Removable bool   `json:"removable"`
+	Locked    bool   `json:"locked"`
+
+	// Inserted is nil when no medium is present
+	Inserted *struct {
+		File        string `json:"file"`
+		BackingFile string `json:"backing_file"`
+		Driver      string `json:"drv"`
+		ReadOnly    bool   `json:"ro"`
+
+		// throttle settings, zero when unthrottled
+		BPS       int64 `json:"bps"`
+		BPSRead   int64 `json:"bps_rd"`
+		BPSWrite  int64 `json:"bps_wr"`
+		IOPS      int64 `json:"iops"`
+		IOPSRead  int64 `json:"iops_rd"`
+		IOPSWrite int64 `json:"iops_wr"`
+	} `json:"inserted"`
+}
+
+// BlockStats describes one device from query-blockstats.
+type BlockStats struct {
+	Device string `json:"device"`
+
+	Stats struct {
+		ReadBytes  int64 `json:"rd_bytes"`
+		WriteBytes int64 `json:"wr_bytes"`
+		ReadOps    int64 `json:"rd_operations"`
+		WriteOps   int64 `json:"wr_operations"`
+	} `json:"stats"`
+}
+
+func (q *Conn) QueryBlock() ([]BlockDevice, error) {
 	if !q.ready {
 		return nil, ERR_READY
 	}
 	s := map[string]interface{}{
 		"execute": "query-block",
 	}
-	err := q.write(s)
+	v, err := q.command(s, false)
 	if err != nil {
 		return nil, err
 	}
-	v := <-q.messageSync
+	if err := parseError(v); err != nil {
+		return nil, err
+	}
 	status := v["return"]
 	if status == nil {
 		return nil, errors.New("received nil status")
 	}
-	return status.([]interface{}), nil
+
+	// round-trip through json to decode into the typed structs
+	b, err := json.Marshal(status)
+	if err != nil {
+		return nil, err
+	}
+	var res []BlockDevice
+	if err := json.Unmarshal(b, &res); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+func (q *Conn) QueryBlockstats() ([]BlockStats, error) {
+	if !q.ready {
+		return nil, ERR_READY
+	}
+	s := map[string]interface{}{
+		"execute": "query-blockstats",
+	}
+	v, err := q.command(s, false)
+	if err != nil {
+		return nil, err
+	}
+	if err := parseError(v); err != nil {
+		return nil, err
+	}
+	status := v["return"]
+	if status == nil {
+		return nil, errors.New("received nil status")
+	}
+
+	b, err := json.Marshal(status)
+	if err != nil {
+		return nil, err
+	}
+	var res []BlockStats
+	if err := json.Unmarshal(b, &res); err != nil {
+		return nil, err
+	}
+	return res, nil
 }
 
 func (q *Conn) QueryBlockJobs() ([]interface{}, error) {
@@ -402,11 +910,13 @@ func (q *Conn) QueryBlockJobs() ([]interface{}, error) {
 	s := map[string]interface{}{
 		"execute": "query-block-jobs",
 	}
-	err := q.write(s)
+	v, err := q.command(s, false)
 	if err != nil {
 		return nil, err
 	}
-	v := <-q.messageSync
+	if err := parseError(v); err != nil {
+		return nil, err
+	}
 
 	status := v["return"]
 	if status == nil {
@@ -415,6 +925,185 @@ func (q *Conn) QueryBlockJobs() ([]interface{}, error) {
 	return status.([]interface{}), nil
 }
 
+// CPU describes one guest vCPU from query-cpus-fast or the legacy
+// query-cpus. Fields not reported by the variant in use are left at their
+// zero values.
+type CPU struct {
+	Index    int `json:"cpu-index"`
+	ThreadID int `json:"thread-id"`
+
+	// Halted is only reported by the legacy query-cpus command
+	Halted bool `json:"halted"`
+
+	// Props holds topology properties, only reported by newer QEMU
+	Props struct {
+		SocketID int `json:"socket-id"`
+		CoreID   int `json:"core-id"`
+		ThreadID int `json:"thread-id"`
+	} `json:"props"`
+}
+
+// QueryCPUs returns the guest vCPU to host thread mapping. It prefers the
+// newer query-cpus-fast command, falling back to the legacy query-cpus on
+// monitors that don't accept it.
+func (q *Conn) QueryCPUs() ([]CPU, error) {
+	if !q.ready {
+		return nil, ERR_READY
+	}
+
+	for _, cmd := range []string{"query-cpus-fast", "query-cpus"} {
+		s := map[string]interface{}{
+			"execute": cmd,
+		}
+		v, err := q.command(s, false)
+		if err != nil {
+			return nil, err
+		}
+		if err := parseError(v); err != nil {
+			if IsCommandNotFound(err) {
+				continue
+			}
+			return nil, err
+		}
+
+		status := v["return"]
+		if status == nil {
+			return nil, errors.New("received nil status")
+		}
+
+		b, err := json.Marshal(status)
+		if err != nil {
+			return nil, err
+		}
+
+		if cmd == "query-cpus" {
+			// the legacy command uses different field names
+			var legacy []struct {
+				CPU      int  `json:"CPU"`
+				Halted   bool `json:"halted"`
+				ThreadID int  `json:"thread_id"`
+			}
+			if err := json.Unmarshal(b, &legacy); err != nil {
+				return nil, err
+			}
+
+			var res []CPU
+			for _, v := range legacy {
+				res = append(res, CPU{
+					Index:    v.CPU,
+					ThreadID: v.ThreadID,
+					Halted:   v.Halted,
+				})
+			}
+			return res, nil
+		}
+
+		var res []CPU
+		if err := json.Unmarshal(b, &res); err != nil {
+			return nil, err
+		}
+		return res, nil
+	}
+
+	return nil, errors.New("query-cpus not supported")
+}
+
+// QomListEntry describes one property from qom-list.
+type QomListEntry struct {
+	Name string `json:"name"`
+	Type string `json:"type"`
+}
+
+// QomList returns the properties of the QOM object at the given path.
+func (q *Conn) QomList(path string) ([]QomListEntry, error) {
+	if !q.ready {
+		return nil, ERR_READY
+	}
+	s := map[string]interface{}{
+		"execute": "qom-list",
+		"arguments": map[string]interface{}{
+			"path": path,
+		},
+	}
+	v, err := q.command(s, false)
+	if err != nil {
+		return nil, err
+	}
+	if err := parseError(v); err != nil {
+		return nil, err
+	}
+	status := v["return"]
+	if status == nil {
+		return nil, errors.New("received nil status")
+	}
+
+	b, err := json.Marshal(status)
+	if err != nil {
+		return nil, err
+	}
+	var res []QomListEntry
+	if err := json.Unmarshal(b, &res); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// QomGet returns the value of a property of the QOM object at the given
+// path. The value is returned as decoded JSON -- a string, bool, float64, or
+// something more complex depending on the property.
+func (q *Conn) QomGet(path, property string) (interface{}, error) {
+	if !q.ready {
+		return nil, ERR_READY
+	}
+	s := map[string]interface{}{
+		"execute": "qom-get",
+		"arguments": map[string]interface{}{
+			"path":     path,
+			"property": property,
+		},
+	}
+	v, err := q.command(s, false)
+	if err != nil {
+		return nil, err
+	}
+	if err := parseError(v); err != nil {
+		return nil, err
+	}
+
+	// note: can't test v["return"] against nil since null is a valid value
+	status, ok := v["return"]
+	if !ok {
+		return nil, errors.New("received nil status")
+	}
+	return status, nil
+}
+
+// QomSet sets a property of the QOM object at the given path.
+func (q *Conn) QomSet(path, property string, value interface{}) error {
+	if !q.ready {
+		return ERR_READY
+	}
+	s := map[string]interface{}{
+		"execute": "qom-set",
+		"arguments": map[string]interface{}{
+			"path":     path,
+			"property": property,
+			"value":    value,
+		},
+	}
+	v, err := q.command(s, false)
+	if err != nil {
+		return err
+	}
+	if err := parseError(v); err != nil {
+		return err
+	}
+	if !success(v) {
+		return errors.New("qom-set")
+	}
+	return nil
+}
+
 func (q *Conn) HumanMonitorCommand(command string) (string, error) {
 	if !q.ready {
 		return "", ERR_READY
@@ -425,11 +1114,13 @@ func (q *Conn) HumanMonitorCommand(command string) (string, error) {
 			"command-line": command,
 		},
 	}
-	err := q.write(s)
+	v, err := q.command(s, false)
 	if err != nil {
 		return "", err
 	}
-	v := <-q.messageSync
+	if err := parseError(v); err != nil {
+		return "", err
+	}
 	response := v["return"]
 	if response == nil {
 		return "", errors.New("received nil response")
@@ -479,6 +1170,126 @@ func (q *Conn) NicAdd(id, netdevID, bus, driver, mac string) (string, error) {
 	return resp, err
 }
 
+// ChardevSocket describes a unix socket backend for ChardevAdd.
+type ChardevSocket struct {
+	Path   string
+	Server bool
+	Wait   bool
+}
+
+// ChardevFile describes a file backend for ChardevAdd, writing output to the
+// named file.
+type ChardevFile struct {
+	Out string
+}
+
+// ChardevAdd hot-adds a character device with the given id. backend must be
+// a ChardevSocket or ChardevFile. Errors from QEMU, such as a duplicate id,
+// are surfaced verbatim.
+func (q *Conn) ChardevAdd(id string, backend interface{}) error {
+	if !q.ready {
+		return ERR_READY
+	}
+
+	var b map[string]interface{}
+
+	switch v := backend.(type) {
+	case ChardevSocket:
+		b = map[string]interface{}{
+			"type": "socket",
+			"data": map[string]interface{}{
+				"addr": map[string]interface{}{
+					"type": "unix",
+					"data": map[string]interface{}{
+						"path": v.Path,
+					},
+				},
+				"server": v.Server,
+				"wait":   v.Wait,
+			},
+		}
+	case ChardevFile:
+		b = map[string]interface{}{
+			"type": "file",
+			"data": map[string]interface{}{
+				"out": v.Out,
+			},
+		}
+	default:
+		return fmt.Errorf("unsupported chardev backend: %T", backend)
+	}
+
+	s := map[string]interface{}{
+		"execute": "chardev-add",
+		"arguments": map[string]interface{}{
+			"id":      id,
+			"backend": b,
+		},
+	}
+	v, err := q.command(s, false)
+	if err != nil {
+		return err
+	}
+	if err := parseError(v); err != nil {
+		return err
+	}
+	if !success(v) {
+		return errors.New("chardev-add")
+	}
+	return nil
+}
+
+// ChardevRemove hot-removes the character device with the given id.
+func (q *Conn) ChardevRemove(id string) error {
+	if !q.ready {
+		return ERR_READY
+	}
+	s := map[string]interface{}{
+		"execute": "chardev-remove",
+		"arguments": map[string]interface{}{
+			"id": id,
+		},
+	}
+	v, err := q.command(s, false)
+	if err != nil {
+		return err
+	}
+	if err := parseError(v); err != nil {
+		return err
+	}
+	if !success(v) {
+		return errors.New("chardev-remove")
+	}
+	return nil
+}
+
+func (q *Conn) VirtioSerialAdd(id string) (string, error) {
+	if !q.ready {
+		return "", ERR_READY
+	}
+	arg := fmt.Sprintf("device_add virtio-serial-pci,id=%v", id)
+	resp, err := q.HumanMonitorCommand(arg)
+	return resp, err
+}
+
+func (q *Conn) VirtioPortAdd(id, bus, chardev, name string) (string, error) {
+	if !q.ready {
+		return "", ERR_READY
+	}
+	arg := fmt.Sprintf("device_add virtserialport,bus=%v.0,chardev=%v,id=%v,name=%v", bus, chardev, id, name)
+	resp, err := q.HumanMonitorCommand(arg)
+	return resp, err
+}
+
+func (q *Conn) DeviceDel(id string) (string, error) {
+	if !q.ready {
+		return "", ERR_READY
+	}
+	arg := fmt.Sprintf("device_del %v", id)
+	resp, err := q.HumanMonitorCommand(arg)
+	return resp, err
+}
+
 func (q *Conn) USBDeviceDel(id string) (string, error) {
 	if !q.ready {
 		return "", ERR_READY
@@ -497,19 +1308,21 @@ func (q *Conn) DriveDel(id string) (string, error) {
 	return resp, err
 }
 
+// reader demultiplexes incoming messages, delivering asynchronous events to
+// subscribers and command responses to whichever command issued them.
 func (q *Conn) reader() {
 	for {
 		v, err := q.read()
 		if err != nil {
-			close(q.messageAsync)
-			close(q.messageSync)
+			q.subs.close()
+			q.pending.close()
 			break
 		}
 		// split asynchronous and synchronous events.
 		if v["event"] != nil {
-			q.messageAsync <- v
+			q.subs.dispatch(parseEvent(v))
 		} else {
-			q.messageSync <- v
+			q.pending.dispatch(v)
 		}
 	}
 }
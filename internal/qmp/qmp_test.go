@@ -0,0 +1,590 @@
+// Copyright (2012) Sandia Corporation.
+// Under the terms of Contract DE-AC04-94AL85000 with Sandia Corporation,
+// the U.S. Government retains certain rights in this software.
+
+package qmp
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// mockEvent builds a raw asynchronous message the way qemu would emit it.
+func mockEvent(name string, data map[string]interface{}) map[string]interface{} {
+	v := map[string]interface{}{
+		"event": name,
+		"timestamp": map[string]interface{}{
+			"seconds":      float64(1000000000),
+			"microseconds": float64(42),
+		},
+	}
+	if data != nil {
+		v["data"] = data
+	}
+	return v
+}
+
+// mockServer listens on a unix socket, performs the QMP handshake with the
+// first client, and then runs the provided script against the connection.
+func mockServer(t *testing.T, script func(*json.Decoder, *json.Encoder)) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "qmp")
+
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatalf("failed: %v", err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		dec := json.NewDecoder(conn)
+		enc := json.NewEncoder(conn)
+
+		// greeting and qmp_capabilities
+		enc.Encode(map[string]interface{}{"QMP": map[string]interface{}{}})
+
+		var v map[string]interface{}
+		if err := dec.Decode(&v); err != nil {
+			return
+		}
+		enc.Encode(map[string]interface{}{"return": map[string]interface{}{}})
+
+		script(dec, enc)
+	}()
+
+	return path
+}
+
+// reply sends a response correlated to the given command.
+func reply(enc *json.Encoder, cmd map[string]interface{}, v map[string]interface{}) {
+	if id, ok := cmd["id"]; ok {
+		v["id"] = id
+	}
+	enc.Encode(v)
+}
+
+// recvEvent reads one event from ch, failing the test if nothing shows up.
+func recvEvent(t *testing.T, ch <-chan Event) Event {
+	t.Helper()
+
+	select {
+	case e, ok := <-ch:
+		if !ok {
+			t.Fatal("event channel closed")
+		}
+		return e
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for event")
+	}
+
+	return Event{}
+}
+
+func TestSubscribe(t *testing.T) {
+	path := mockServer(t, func(dec *json.Decoder, enc *json.Encoder) {
+		// event, then a command response, then another event -- interleaved
+		// the way a real server would
+		enc.Encode(mockEvent("STOP", nil))
+
+		var v map[string]interface{}
+		if err := dec.Decode(&v); err != nil {
+			return
+		}
+		reply(enc, v, map[string]interface{}{
+			"return": map[string]interface{}{"status": "paused"},
+		})
+
+		enc.Encode(mockEvent("RESUME", map[string]interface{}{"foo": "bar"}))
+
+		// hold the connection open until the client goes away so that the
+		// subscriber channels don't close mid-test
+		dec.Decode(&v)
+	})
+
+	q, err := Dial(path)
+	if err != nil {
+		t.Fatalf("failed: %v", err)
+	}
+
+	all, cancel := q.Subscribe()
+	defer cancel()
+
+	stops, cancelStops := q.Subscribe("STOP")
+	defer cancelStops()
+
+	status, err := q.Status()
+	if err != nil {
+		t.Fatalf("failed: %v", err)
+	}
+	if status["status"] != "paused" {
+		t.Fatalf("wrong status: %v", status)
+	}
+
+	e := recvEvent(t, all)
+	if e.Name != "STOP" {
+		t.Fatalf("wrong event: %v", e.Name)
+	}
+	if e.Timestamp != time.Unix(1000000000, 42000) {
+		t.Fatalf("wrong timestamp: %v", e.Timestamp)
+	}
+
+	e = recvEvent(t, all)
+	if e.Name != "RESUME" {
+		t.Fatalf("wrong event: %v", e.Name)
+	}
+	if e.Data["foo"] != "bar" {
+		t.Fatalf("wrong data: %v", e.Data)
+	}
+
+	// the filtered subscriber should only see the STOP
+	e = recvEvent(t, stops)
+	if e.Name != "STOP" {
+		t.Fatalf("wrong event: %v", e.Name)
+	}
+
+	select {
+	case e := <-stops:
+		t.Fatalf("unexpected event: %v", e.Name)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestMessage(t *testing.T) {
+	path := mockServer(t, func(dec *json.Decoder, enc *json.Encoder) {
+		enc.Encode(mockEvent("SHUTDOWN", nil))
+	})
+
+	q, err := Dial(path)
+	if err != nil {
+		t.Fatalf("failed: %v", err)
+	}
+
+	v := q.Message()
+	if v == nil || v["event"] != "SHUTDOWN" {
+		t.Fatalf("wrong message: %v", v)
+	}
+
+	// server hangs up after the event -- Message should return nil once the
+	// channel closes
+	if v := q.Message(); v != nil {
+		t.Fatalf("expected nil message: %v", v)
+	}
+}
+
+func TestQueryBlock(t *testing.T) {
+	path := mockServer(t, func(dec *json.Decoder, enc *json.Encoder) {
+		var v map[string]interface{}
+		if err := dec.Decode(&v); err != nil {
+			return
+		}
+		// mimic an older QEMU -- throttle and backing_file fields absent
+		reply(enc, v, map[string]interface{}{
+			"return": []interface{}{
+				map[string]interface{}{
+					"device":    "ide0-cd0",
+					"removable": true,
+				},
+				map[string]interface{}{
+					"device": "drive0",
+					"locked": false,
+					"inserted": map[string]interface{}{
+						"file": "/tmp/foo.qcow2",
+						"drv":  "qcow2",
+					},
+				},
+			},
+		})
+
+		// hold the connection open until the client goes away
+		dec.Decode(&v)
+	})
+
+	q, err := Dial(path)
+	if err != nil {
+		t.Fatalf("failed: %v", err)
+	}
+
+	devices, err := q.QueryBlock()
+	if err != nil {
+		t.Fatalf("failed: %v", err)
+	}
+
+	if len(devices) != 2 {
+		t.Fatalf("wrong number of devices: %v", len(devices))
+	}
+	if devices[0].Device != "ide0-cd0" || !devices[0].Removable {
+		t.Fatalf("wrong device: %v", devices[0])
+	}
+	if devices[0].Inserted != nil {
+		t.Fatalf("expected empty drive: %v", devices[0])
+	}
+	if devices[1].Inserted == nil || devices[1].Inserted.File != "/tmp/foo.qcow2" {
+		t.Fatalf("wrong device: %v", devices[1])
+	}
+}
+
+func TestQueryCPUsFast(t *testing.T) {
+	path := mockServer(t, func(dec *json.Decoder, enc *json.Encoder) {
+		var v map[string]interface{}
+		if err := dec.Decode(&v); err != nil {
+			return
+		}
+		if v["execute"] != "query-cpus-fast" {
+			t.Errorf("wrong command: %v", v["execute"])
+		}
+		reply(enc, v, map[string]interface{}{
+			"return": []interface{}{
+				map[string]interface{}{
+					"cpu-index": 0,
+					"thread-id": 1234,
+					"props": map[string]interface{}{
+						"socket-id": 0,
+						"core-id":   1,
+					},
+				},
+			},
+		})
+
+		// hold the connection open until the client goes away
+		dec.Decode(&v)
+	})
+
+	q, err := Dial(path)
+	if err != nil {
+		t.Fatalf("failed: %v", err)
+	}
+
+	cpus, err := q.QueryCPUs()
+	if err != nil {
+		t.Fatalf("failed: %v", err)
+	}
+
+	if len(cpus) != 1 {
+		t.Fatalf("wrong number of cpus: %v", len(cpus))
+	}
+	if cpus[0].Index != 0 || cpus[0].ThreadID != 1234 || cpus[0].Props.CoreID != 1 {
+		t.Fatalf("wrong cpu: %+v", cpus[0])
+	}
+}
+
+func TestQueryCPUsLegacy(t *testing.T) {
+	path := mockServer(t, func(dec *json.Decoder, enc *json.Encoder) {
+		// reject query-cpus-fast the way an older monitor would
+		var v map[string]interface{}
+		if err := dec.Decode(&v); err != nil {
+			return
+		}
+		reply(enc, v, map[string]interface{}{
+			"error": map[string]interface{}{
+				"class": "CommandNotFound",
+				"desc":  "The command query-cpus-fast has not been found",
+			},
+		})
+
+		if err := dec.Decode(&v); err != nil {
+			return
+		}
+		if v["execute"] != "query-cpus" {
+			t.Errorf("wrong command: %v", v["execute"])
+		}
+		reply(enc, v, map[string]interface{}{
+			"return": []interface{}{
+				map[string]interface{}{
+					"CPU":       0,
+					"current":   true,
+					"halted":    true,
+					"thread_id": 5678,
+				},
+			},
+		})
+
+		// hold the connection open until the client goes away
+		dec.Decode(&v)
+	})
+
+	q, err := Dial(path)
+	if err != nil {
+		t.Fatalf("failed: %v", err)
+	}
+
+	cpus, err := q.QueryCPUs()
+	if err != nil {
+		t.Fatalf("failed: %v", err)
+	}
+
+	if len(cpus) != 1 {
+		t.Fatalf("wrong number of cpus: %v", len(cpus))
+	}
+	if cpus[0].Index != 0 || cpus[0].ThreadID != 5678 || !cpus[0].Halted {
+		t.Fatalf("wrong cpu: %+v", cpus[0])
+	}
+}
+
+func TestErrorClassification(t *testing.T) {
+	// the error classes documented by QEMU
+	classes := []string{
+		"GenericError",
+		"CommandNotFound",
+		"DeviceNotActive",
+		"DeviceNotFound",
+		"KVMMissingCap",
+	}
+
+	for _, class := range classes {
+		err := parseError(map[string]interface{}{
+			"error": map[string]interface{}{
+				"class": class,
+				"desc":  "some description",
+			},
+		})
+		if err == nil {
+			t.Fatalf("expected error for class %v", class)
+		}
+
+		var e *Error
+		if !errors.As(err, &e) {
+			t.Fatalf("errors.As failed for class %v", class)
+		}
+		if e.Class != class {
+			t.Fatalf("wrong class: %v != %v", e.Class, class)
+		}
+		if err.Error() != "some description" {
+			t.Fatalf("wrong desc: %v", err)
+		}
+	}
+
+	err := parseError(map[string]interface{}{
+		"error": map[string]interface{}{
+			"class": "DeviceNotFound",
+			"desc":  "Device 'foo' not found",
+		},
+	})
+	if !IsDeviceNotFound(err) {
+		t.Fatalf("expected DeviceNotFound: %v", err)
+	}
+	if IsCommandNotFound(err) || IsDeviceNotActive(err) {
+		t.Fatalf("misclassified: %v", err)
+	}
+
+	// non-error responses should not produce an error
+	if err := parseError(map[string]interface{}{"return": map[string]interface{}{}}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestChardevAdd(t *testing.T) {
+	path := mockServer(t, func(dec *json.Decoder, enc *json.Encoder) {
+		var v map[string]interface{}
+		if err := dec.Decode(&v); err != nil {
+			return
+		}
+		if v["execute"] != "chardev-add" {
+			t.Errorf("wrong command: %v", v["execute"])
+		}
+		args := v["arguments"].(map[string]interface{})
+		if args["id"] != "charvserial0" {
+			t.Errorf("wrong id: %v", args["id"])
+		}
+		backend := args["backend"].(map[string]interface{})
+		if backend["type"] != "socket" {
+			t.Errorf("wrong backend: %v", backend["type"])
+		}
+		reply(enc, v, map[string]interface{}{"return": map[string]interface{}{}})
+
+		// duplicate id -- reply with an error the way qemu would
+		if err := dec.Decode(&v); err != nil {
+			return
+		}
+		reply(enc, v, map[string]interface{}{
+			"error": map[string]interface{}{
+				"class": "GenericError",
+				"desc":  "attempt to add duplicate property 'charvserial0'",
+			},
+		})
+
+		// hold the connection open until the client goes away
+		dec.Decode(&v)
+	})
+
+	q, err := Dial(path)
+	if err != nil {
+		t.Fatalf("failed: %v", err)
+	}
+
+	sock := ChardevSocket{Path: "/tmp/foo", Server: true}
+	if err := q.ChardevAdd("charvserial0", sock); err != nil {
+		t.Fatalf("failed: %v", err)
+	}
+
+	err = q.ChardevAdd("charvserial0", sock)
+	if err == nil || err.Error() != "attempt to add duplicate property 'charvserial0'" {
+		t.Fatalf("expected qemu's error verbatim, got: %v", err)
+	}
+}
+
+func TestChardevRemove(t *testing.T) {
+	path := mockServer(t, func(dec *json.Decoder, enc *json.Encoder) {
+		var v map[string]interface{}
+		if err := dec.Decode(&v); err != nil {
+			return
+		}
+		if v["execute"] != "chardev-remove" {
+			t.Errorf("wrong command: %v", v["execute"])
+		}
+		reply(enc, v, map[string]interface{}{"return": map[string]interface{}{}})
+
+		// hold the connection open until the client goes away
+		dec.Decode(&v)
+	})
+
+	q, err := Dial(path)
+	if err != nil {
+		t.Fatalf("failed: %v", err)
+	}
+
+	if err := q.ChardevRemove("charvserial0"); err != nil {
+		t.Fatalf("failed: %v", err)
+	}
+}
+
+func TestInterleaved(t *testing.T) {
+	path := mockServer(t, func(dec *json.Decoder, enc *json.Encoder) {
+		// read two commands before answering either
+		var cmd1, cmd2 map[string]interface{}
+		if err := dec.Decode(&cmd1); err != nil {
+			return
+		}
+		if err := dec.Decode(&cmd2); err != nil {
+			return
+		}
+
+		// an event arriving while both commands are outstanding
+		enc.Encode(mockEvent("STOP", nil))
+
+		// respond out of order -- the second command finishes first
+		reply(enc, cmd2, map[string]interface{}{"return": "hello"})
+		reply(enc, cmd1, map[string]interface{}{
+			"return": map[string]interface{}{"status": "running"},
+		})
+
+		// hold the connection open until the client goes away
+		var v map[string]interface{}
+		dec.Decode(&v)
+	})
+
+	q, err := Dial(path)
+	if err != nil {
+		t.Fatalf("failed: %v", err)
+	}
+
+	events, cancel := q.Subscribe()
+	defer cancel()
+
+	type result struct {
+		v   map[string]interface{}
+		err error
+	}
+	statusCh := make(chan result, 1)
+
+	go func() {
+		v, err := q.Status()
+		statusCh <- result{v, err}
+	}()
+
+	// make sure the slow command goes out first
+	time.Sleep(100 * time.Millisecond)
+
+	out, err := q.HumanMonitorCommand("info status")
+	if err != nil {
+		t.Fatalf("failed: %v", err)
+	}
+	if out != "hello" {
+		t.Fatalf("wrong response: %v", out)
+	}
+
+	r := <-statusCh
+	if r.err != nil {
+		t.Fatalf("failed: %v", r.err)
+	}
+	if r.v["status"] != "running" {
+		t.Fatalf("wrong status: %v", r.v)
+	}
+
+	if e := recvEvent(t, events); e.Name != "STOP" {
+		t.Fatalf("wrong event: %v", e.Name)
+	}
+}
+
+func TestTeardown(t *testing.T) {
+	path := mockServer(t, func(dec *json.Decoder, enc *json.Encoder) {
+		// read a command and hang up with it outstanding
+		var v map[string]interface{}
+		dec.Decode(&v)
+	})
+
+	q, err := Dial(path)
+	if err != nil {
+		t.Fatalf("failed: %v", err)
+	}
+
+	if _, err := q.Status(); err == nil {
+		t.Fatal("expected error with connection torn down")
+	}
+}
+
+func TestTimeout(t *testing.T) {
+	path := mockServer(t, func(dec *json.Decoder, enc *json.Encoder) {
+		// read commands but never reply, like a wedged guest
+		var v map[string]interface{}
+		for dec.Decode(&v) == nil {
+		}
+	})
+
+	q, err := Dial(path)
+	if err != nil {
+		t.Fatalf("failed: %v", err)
+	}
+
+	q.SetTimeouts(100*time.Millisecond, 100*time.Millisecond)
+
+	if _, err := q.Status(); !errors.Is(err, ERR_TIMEOUT) {
+		t.Fatalf("expected timeout, got: %v", err)
+	}
+
+	// a timed out command doesn't break the connection -- later commands
+	// still run (and in this case time out on their own)
+	if err := q.Stop(); !errors.Is(err, ERR_TIMEOUT) {
+		t.Fatalf("expected timeout, got: %v", err)
+	}
+}
+
+func TestSubscribeCancel(t *testing.T) {
+	path := mockServer(t, func(dec *json.Decoder, enc *json.Encoder) {
+		// hold the connection open until the client goes away
+		var v map[string]interface{}
+		dec.Decode(&v)
+	})
+
+	q, err := Dial(path)
+	if err != nil {
+		t.Fatalf("failed: %v", err)
+	}
+
+	ch, cancel := q.Subscribe()
+	cancel()
+
+	if _, ok := <-ch; ok {
+		t.Fatal("expected closed channel after cancel")
+	}
+}
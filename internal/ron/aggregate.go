@@ -0,0 +1,439 @@
+// Copyright 2015-2021 National Technology & Engineering Solutions of Sandia, LLC (NTESS).
+// Under the terms of Contract DE-NA0003525 with NTESS, the U.S. Government retains certain
+// rights in this software.
+
+package ron
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	log "github.com/sandia-minimega/minimega/v2/pkg/minilog"
+)
+
+const (
+	// RESPONSE_INDEX_COMMANDS is the number of commands for which response
+	// groups are kept indexed in memory. The least recently touched index is
+	// evicted beyond that and rebuilt from disk if queried again.
+	RESPONSE_INDEX_COMMANDS = 32
+
+	// RESPONSE_GROUP_SAMPLE is the number of client names sampled per group
+	// in the grouped listing.
+	RESPONSE_GROUP_SAMPLE = 5
+
+	// RESPONSE_GROUP_PREVIEW is the number of representative output bytes
+	// retained in memory per group. Full output is read back from disk when a
+	// group is expanded.
+	RESPONSE_GROUP_PREVIEW = 512
+)
+
+// timestampPattern matches common timestamp renderings -- dates with times,
+// and bare times -- so that outputs differing only in when they ran can be
+// grouped together.
+var timestampPattern = regexp.MustCompile(`\d{4}[-/]\d{2}[-/]\d{2}[ T]\d{2}:\d{2}:\d{2}(\.\d+)?(Z|[+-]\d{2}:?\d{2})?|\d{1,2}:\d{2}:\d{2}(\.\d+)?`)
+
+// ResponseGroup is one distinct output among the responses to a command:
+// every client whose stdout, stderr, and exit disposition were byte-identical.
+type ResponseGroup struct {
+	// Stdout and Stderr are representative output from one member, truncated
+	// to RESPONSE_GROUP_PREVIEW bytes (see Truncated)
+	Stdout string
+	Stderr string
+
+	// Exit is the exit disposition shared by the group
+	Exit string
+
+	// Truncated is true if the representative output was cut short
+	Truncated bool
+
+	// Count is the number of clients in the group
+	Count int
+
+	// Sample holds up to RESPONSE_GROUP_SAMPLE member client names
+	Sample []string
+
+	// members are the response directories, relative to the command's
+	// response path, of every client in the group (uuid, or uuid/run for
+	// periodic commands)
+	members []string
+
+	// key and normKey group responses by exact and timestamp-normalized
+	// output respectively
+	key     string
+	normKey string
+}
+
+// responseIndex groups the recorded responses for one command by distinct
+// output, updated as responses arrive so the grouped listing doesn't re-read
+// every response file.
+type responseIndex struct {
+	groups map[string]*ResponseGroup // keyed by ResponseGroup.key
+
+	// seen maps members to their group key, to detect a client re-sending a
+	// response for the same command
+	seen map[string]string
+
+	used time.Time // for LRU eviction
+}
+
+// responseKeys hashes a response's output into its exact and
+// timestamp-normalized group keys.
+func responseKeys(stdout, stderr, exit string) (string, string) {
+	key := sha256.Sum256([]byte(fmt.Sprintf("%v\x00%v\x00%v", stdout, stderr, exit)))
+
+	nout := timestampPattern.ReplaceAllString(stdout, "<timestamp>")
+	nerr := timestampPattern.ReplaceAllString(stderr, "<timestamp>")
+	normKey := sha256.Sum256([]byte(fmt.Sprintf("%v\x00%v\x00%v", nout, nerr, exit)))
+
+	return fmt.Sprintf("%x", key), fmt.Sprintf("%x", normKey)
+}
+
+// responseSampleName renders a client name for the grouped listing.
+func responseSampleName(hostname, member string) string {
+	if hostname != "" {
+		return fmt.Sprintf("%v (%v)", hostname, member)
+	}
+
+	return member
+}
+
+// truncatePreview cuts representative output down to the in-memory cap.
+func truncatePreview(out string) (string, bool) {
+	if len(out) > RESPONSE_GROUP_PREVIEW {
+		return out[:RESPONSE_GROUP_PREVIEW], true
+	}
+
+	return out, false
+}
+
+// indexResponse folds one arriving response into the in-memory group index
+// for its command, creating the index if this is the command's first
+// response. member is the response directory relative to the command's
+// response path.
+func (s *Server) indexResponse(id int, hostname, member, stdout, stderr, exit string) {
+	s.respIndexLock.Lock()
+	defer s.respIndexLock.Unlock()
+
+	idx, ok := s.respIndex[id]
+	if !ok {
+		s.evictResponseIndex()
+
+		idx = &responseIndex{
+			groups: make(map[string]*ResponseGroup),
+			seen:   make(map[string]string),
+		}
+		s.respIndex[id] = idx
+	}
+	idx.used = time.Now()
+
+	key, normKey := responseKeys(stdout, stderr, exit)
+
+	if prev, ok := idx.seen[member]; ok {
+		if prev == key {
+			// a duplicate of a response we already indexed
+			return
+		}
+
+		// the client re-sent the command's response with different output,
+		// which the on-disk record overwrote. Rather than unpick the old
+		// group, drop the index and lazily rebuild from disk.
+		log.Debug("response for %v from %v changed, dropping index", id, member)
+		delete(s.respIndex, id)
+		return
+	}
+	idx.seen[member] = key
+
+	g, ok := idx.groups[key]
+	if !ok {
+		g = &ResponseGroup{
+			Exit:    exit,
+			key:     key,
+			normKey: normKey,
+		}
+		g.Stdout, g.Truncated = truncatePreview(stdout)
+
+		var t bool
+		g.Stderr, t = truncatePreview(stderr)
+		g.Truncated = g.Truncated || t
+
+		idx.groups[key] = g
+	}
+
+	g.Count++
+	g.members = append(g.members, member)
+	if len(g.Sample) < RESPONSE_GROUP_SAMPLE {
+		g.Sample = append(g.Sample, responseSampleName(hostname, member))
+	}
+}
+
+// evictResponseIndex drops the least recently used command index once the
+// bound on indexed commands is reached. Must be called with respIndexLock
+// held.
+func (s *Server) evictResponseIndex() {
+	if len(s.respIndex) < RESPONSE_INDEX_COMMANDS {
+		return
+	}
+
+	var oldest int
+	var when time.Time
+
+	for id, idx := range s.respIndex {
+		if when.IsZero() || idx.used.Before(when) {
+			oldest = id
+			when = idx.used
+		}
+	}
+
+	log.Debug("evicting response index for %v", oldest)
+	delete(s.respIndex, oldest)
+}
+
+// dropResponseIndex discards the in-memory group index for a command, called
+// when its responses are deleted.
+func (s *Server) dropResponseIndex(id int) {
+	s.respIndexLock.Lock()
+	defer s.respIndexLock.Unlock()
+
+	delete(s.respIndex, id)
+}
+
+// dropResponseIndexes discards all in-memory group indexes.
+func (s *Server) dropResponseIndexes() {
+	s.respIndexLock.Lock()
+	defer s.respIndexLock.Unlock()
+
+	s.respIndex = make(map[int]*responseIndex)
+}
+
+// rebuildResponseIndex reconstructs the group index for a command from the
+// recorded response files, for commands whose responses arrived before a
+// restart. Hostnames are filled in for clients that are currently active.
+func (s *Server) rebuildResponseIndex(id int, hostnames map[string]string) (*responseIndex, error) {
+	base := s.responsePath(&id)
+
+	// gather the response files by directory; each directory holding output
+	// files is one member
+	found := make(map[string]map[string]string)
+
+	walker := func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if info.IsDir() {
+			return nil
+		}
+
+		name := filepath.Base(path)
+		switch name {
+		case "stdout", "stderr", "exit":
+			// these determine the group
+		case "stdin":
+			return nil
+		default:
+			return nil
+		}
+
+		member, err := filepath.Rel(base, filepath.Dir(path))
+		if err != nil {
+			return err
+		}
+
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+
+		if found[member] == nil {
+			found[member] = make(map[string]string)
+		}
+		found[member][name] = string(data)
+
+		return nil
+	}
+
+	if err := filepath.Walk(base, walker); err != nil {
+		return nil, err
+	}
+
+	idx := &responseIndex{
+		groups: make(map[string]*ResponseGroup),
+		seen:   make(map[string]string),
+		used:   time.Now(),
+	}
+
+	// sort members so rebuilt samples are stable across rebuilds
+	members := make([]string, 0, len(found))
+	for member := range found {
+		members = append(members, member)
+	}
+	sort.Strings(members)
+
+	for _, member := range members {
+		files := found[member]
+
+		// the exit file is recorded with a trailing newline
+		exit := strings.TrimSuffix(files["exit"], "\n")
+
+		key, normKey := responseKeys(files["stdout"], files["stderr"], exit)
+
+		g, ok := idx.groups[key]
+		if !ok {
+			g = &ResponseGroup{
+				Exit:    exit,
+				key:     key,
+				normKey: normKey,
+			}
+			g.Stdout, g.Truncated = truncatePreview(files["stdout"])
+
+			var t bool
+			g.Stderr, t = truncatePreview(files["stderr"])
+			g.Truncated = g.Truncated || t
+
+			idx.groups[key] = g
+		}
+
+		g.Count++
+		g.members = append(g.members, member)
+		if len(g.Sample) < RESPONSE_GROUP_SAMPLE {
+			// member is uuid or uuid/run
+			uuid := member
+			if i := strings.Index(member, string(filepath.Separator)); i != -1 {
+				uuid = member[:i]
+			}
+
+			g.Sample = append(g.Sample, responseSampleName(hostnames[uuid], member))
+		}
+
+		idx.seen[member] = key
+	}
+
+	return idx, nil
+}
+
+// GetResponseGroups returns the responses to a command grouped by distinct
+// stdout, stderr, and exit disposition, most common group first. With
+// normalize, outputs that differ only in timestamps are folded into one
+// group. The groups are served from an in-memory index maintained as
+// responses arrive, rebuilt from the recorded response files if the index was
+// lost to a restart or eviction.
+func (s *Server) GetResponseGroups(id int, normalize bool) ([]*ResponseGroup, error) {
+	// snag hostnames before taking the index lock in case we need to rebuild
+	hostnames := make(map[string]string)
+	for uuid, c := range s.GetClients() {
+		hostnames[uuid] = c.Hostname
+	}
+
+	s.respIndexLock.Lock()
+	defer s.respIndexLock.Unlock()
+
+	idx, ok := s.respIndex[id]
+	if !ok {
+		var err error
+
+		idx, err = s.rebuildResponseIndex(id, hostnames)
+		if os.IsNotExist(err) {
+			return nil, fmt.Errorf("no responses for %v", id)
+		} else if err != nil {
+			return nil, err
+		}
+
+		s.evictResponseIndex()
+		s.respIndex[id] = idx
+	}
+	idx.used = time.Now()
+
+	// copy out of the index, merging groups by normalized key if requested
+	merged := make(map[string]*ResponseGroup)
+
+	for _, g := range idx.groups {
+		key := g.key
+		if normalize {
+			key = g.normKey
+		}
+
+		m, ok := merged[key]
+		if !ok {
+			m = &ResponseGroup{
+				Stdout:    g.Stdout,
+				Stderr:    g.Stderr,
+				Exit:      g.Exit,
+				Truncated: g.Truncated,
+				key:       g.key,
+				normKey:   g.normKey,
+			}
+			merged[key] = m
+		}
+
+		m.Count += g.Count
+		m.members = append(m.members, g.members...)
+		for _, v := range g.Sample {
+			if len(m.Sample) < RESPONSE_GROUP_SAMPLE {
+				m.Sample = append(m.Sample, v)
+			}
+		}
+	}
+
+	res := make([]*ResponseGroup, 0, len(merged))
+	for _, g := range merged {
+		res = append(res, g)
+	}
+
+	sort.Slice(res, func(i, j int) bool {
+		if res[i].Count != res[j].Count {
+			return res[i].Count > res[j].Count
+		}
+
+		return res[i].key < res[j].key
+	})
+
+	return res, nil
+}
+
+// ExpandResponseGroup renders the full output and complete client list for
+// one group from GetResponseGroups, identified by its position in the
+// grouped listing (starting at 1). The full output is read back from disk, so
+// it is not subject to the in-memory preview cap.
+func (s *Server) ExpandResponseGroup(id, group int, normalize bool) (string, error) {
+	groups, err := s.GetResponseGroups(id, normalize)
+	if err != nil {
+		return "", err
+	}
+
+	if group < 1 || group > len(groups) {
+		return "", fmt.Errorf("no such group: %v", group)
+	}
+
+	g := groups[group-1]
+	members := append([]string(nil), g.members...)
+	sort.Strings(members)
+
+	res := fmt.Sprintf("%v clients: %v\n", g.Count, strings.Join(members, ", "))
+
+	// read the full output back from the first member's response files
+	base := filepath.Join(s.responsePath(&id), g.members[0])
+
+	for _, name := range []string{"stdout", "stderr"} {
+		data, err := ioutil.ReadFile(filepath.Join(base, name))
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return "", err
+		}
+
+		res += fmt.Sprintf("\n%v:\n%v", name, string(data))
+	}
+
+	if g.Exit != "" {
+		res += fmt.Sprintf("\nexit: %v\n", g.Exit)
+	}
+
+	return res, nil
+}
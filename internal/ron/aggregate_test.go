@@ -0,0 +1,183 @@
+// Copyright 2015-2021 National Technology & Engineering Solutions of Sandia, LLC (NTESS).
+// Under the terms of Contract DE-NA0003525 with NTESS, the U.S. Government retains certain
+// rights in this software.
+
+package ron
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// writeResponse records a response on disk the way responseHandler does, for
+// testing the rebuild-from-disk path.
+func writeResponse(t *testing.T, s *Server, id int, uuid, stdout, exit string) {
+	path := filepath.Join(s.responsePath(&id), uuid)
+	if err := os.MkdirAll(path, 0770); err != nil {
+		t.Fatal(err)
+	}
+
+	if stdout != "" {
+		if err := ioutil.WriteFile(filepath.Join(path, "stdout"), []byte(stdout), 0660); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if exit != "" {
+		if err := ioutil.WriteFile(filepath.Join(path, "exit"), []byte(exit+"\n"), 0660); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestResponseGroups(t *testing.T) {
+	s, cleanup := newTestServer(t)
+	defer cleanup()
+
+	// most clients agree, one dissents
+	for i := 0; i < 8; i++ {
+		uuid := fmt.Sprintf("uuid-%v", i)
+		s.indexResponse(1, fmt.Sprintf("host-%v", i), uuid, "ok\n", "", "0")
+	}
+	s.indexResponse(1, "host-9", "uuid-9", "", "no such file\n", "1")
+
+	groups, err := s.GetResponseGroups(1, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(groups) != 2 {
+		t.Fatalf("expected 2 groups, got %v", len(groups))
+	}
+
+	// most common group first
+	if groups[0].Count != 8 || groups[0].Stdout != "ok\n" || groups[0].Exit != "0" {
+		t.Errorf("bad majority group: %+v", groups[0])
+	}
+	if groups[1].Count != 1 || groups[1].Stderr != "no such file\n" || groups[1].Exit != "1" {
+		t.Errorf("bad minority group: %+v", groups[1])
+	}
+
+	if len(groups[0].Sample) != RESPONSE_GROUP_SAMPLE {
+		t.Errorf("expected %v samples, got %v", RESPONSE_GROUP_SAMPLE, len(groups[0].Sample))
+	}
+	if groups[0].Sample[0] != "host-0 (uuid-0)" {
+		t.Errorf("bad sample: %v", groups[0].Sample[0])
+	}
+
+	// a duplicate check-in must not double count
+	s.indexResponse(1, "host-0", "uuid-0", "ok\n", "", "0")
+
+	groups, err = s.GetResponseGroups(1, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if groups[0].Count != 8 {
+		t.Errorf("duplicate was double counted: %v", groups[0].Count)
+	}
+}
+
+func TestResponseGroupsNormalize(t *testing.T) {
+	s, cleanup := newTestServer(t)
+	defer cleanup()
+
+	s.indexResponse(1, "a", "uuid-a", "synced at 2021-01-01 10:00:01\n", "", "0")
+	s.indexResponse(1, "b", "uuid-b", "synced at 2021-01-01 10:00:02\n", "", "0")
+	s.indexResponse(1, "c", "uuid-c", "sync failed\n", "", "1")
+
+	groups, err := s.GetResponseGroups(1, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(groups) != 3 {
+		t.Fatalf("expected 3 exact groups, got %v", len(groups))
+	}
+
+	// outputs differing only in timestamps fold together
+	groups, err = s.GetResponseGroups(1, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(groups) != 2 {
+		t.Fatalf("expected 2 normalized groups, got %v", len(groups))
+	}
+	if groups[0].Count != 2 {
+		t.Errorf("expected folded count 2, got %v", groups[0].Count)
+	}
+}
+
+func TestResponseGroupsRebuild(t *testing.T) {
+	s, cleanup := newTestServer(t)
+	defer cleanup()
+
+	// responses recorded before a restart: nothing in the index, only files
+	writeResponse(t, s, 2, "uuid-a", "ok\n", "0")
+	writeResponse(t, s, 2, "uuid-b", "ok\n", "0")
+	writeResponse(t, s, 2, "uuid-c", "fail\n", "1")
+
+	groups, err := s.GetResponseGroups(2, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(groups) != 2 {
+		t.Fatalf("expected 2 groups, got %v", len(groups))
+	}
+	if groups[0].Count != 2 || groups[0].Stdout != "ok\n" {
+		t.Errorf("bad rebuilt group: %+v", groups[0])
+	}
+	if groups[1].Exit != "1" {
+		t.Errorf("exit not recovered from disk: %+v", groups[1])
+	}
+
+	// expanding reads the full output back from disk
+	out, err := s.ExpandResponseGroup(2, 1, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out, "2 clients: uuid-a, uuid-b") || !strings.Contains(out, "ok\n") {
+		t.Errorf("bad expansion:\n%v", out)
+	}
+
+	if _, err := s.ExpandResponseGroup(2, 3, false); err == nil {
+		t.Error("expected error expanding missing group")
+	}
+
+	// no responses at all is an error, not a crash
+	if _, err := s.GetResponseGroups(3, false); err == nil {
+		t.Error("expected error for unknown command")
+	}
+}
+
+func TestResponseGroupsBounded(t *testing.T) {
+	s, cleanup := newTestServer(t)
+	defer cleanup()
+
+	// the representative output held in memory is capped
+	long := strings.Repeat("x", 4*RESPONSE_GROUP_PREVIEW)
+	s.indexResponse(1, "a", "uuid-a", long, "", "0")
+
+	groups, err := s.GetResponseGroups(1, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(groups[0].Stdout) != RESPONSE_GROUP_PREVIEW || !groups[0].Truncated {
+		t.Errorf("preview not truncated: %v bytes", len(groups[0].Stdout))
+	}
+
+	// so is the number of indexed commands
+	for id := 10; id < 10+2*RESPONSE_INDEX_COMMANDS; id++ {
+		s.indexResponse(id, "a", "uuid-a", "ok\n", "", "0")
+	}
+
+	s.respIndexLock.Lock()
+	n := len(s.respIndex)
+	s.respIndexLock.Unlock()
+
+	if n > RESPONSE_INDEX_COMMANDS {
+		t.Errorf("index grew past the bound: %v commands", n)
+	}
+}
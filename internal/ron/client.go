@@ -9,8 +9,10 @@ import (
 	"fmt"
 	"io"
 	"net"
+	"path"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/sandia-minimega/minimega/v2/internal/miniplumber"
@@ -39,6 +41,47 @@ type Client struct {
 
 	// LastCommandID is the last command ID that the client processed.
 	LastCommandID int
+
+	// Streaming is set at check-in by clients that stream command output
+	// back to the server incrementally while commands run, rather than only
+	// in the final response. See Response.Seq.
+	Streaming bool
+
+	// Transport the client connected over ("tcp", "tls", "unix", or
+	// "serial"). Set by the server from the connection, not reported by the
+	// client.
+	Transport string
+
+	// Host is the minimega host the client is attached to: the host its VM
+	// is scheduled on, or, for clients connected directly over the network,
+	// the source host of the connection. Set by the server, not reported by
+	// the client.
+	Host string
+
+	// Checkin is when the server last heard from the client. Set by the
+	// server, not reported by the client.
+	Checkin time.Time
+
+	// Reconnects counts the times the client has reattached after its first
+	// connection, such as after a guest reboot. Set by the server, not
+	// reported by the client.
+	Reconnects int
+
+	// Inventory is a slower-changing snapshot of the client's system state,
+	// refreshed by the client at a slower cadence than the heartbeat. Nil
+	// for clients that predate inventory reporting.
+	Inventory *Inventory
+}
+
+// Inventory is a structured snapshot of slower-changing client system state,
+// gathered so that triage doesn't require "cc exec" round trips. Probes that
+// fail leave their field empty rather than failing the check-in.
+type Inventory struct {
+	OSVersion string        // OS or distribution version, e.g. "Ubuntu 20.04.1 LTS"
+	Kernel    string        // kernel release or build number
+	Uptime    time.Duration // time since boot
+	Users     []string      // logged-in users
+	DiskFree  uint64        // free bytes on the volume holding the client's base path
 }
 
 type client struct {
@@ -47,6 +90,10 @@ type client struct {
 
 	checkin time.Time // when the client last checked in
 
+	// stale is set once the client has missed several check-ins and cleared
+	// when it checks in again, see Server.StaleHandler
+	stale bool
+
 	tunnel *minitunnel.Tunnel
 
 	// writeMu serializes calls to enc.Encode
@@ -63,6 +110,19 @@ type client struct {
 	// mangled is true if qemu flipped octets on us
 	mangled bool
 
+	// transport the client connected over, see Client.Transport
+	transport string
+
+	// host the client is attached to, see Client.Host. Set during handshake.
+	host string
+
+	// compress is true if the client's message version supports compressed
+	// payloads, see SupportsCompression
+	compress bool
+
+	// stats points at the server's compression counters
+	stats *CompressionStats
+
 	// Namespace for the VM, set during handshake
 	Namespace string
 
@@ -71,6 +131,15 @@ type client struct {
 	pipeReaders map[string]*miniplumber.Reader
 	pipeWriters map[string]chan<- string
 
+	// pipeSenders gates pipe data forwarded down to the client on credit
+	// the client grants, keyed like pipeReaders. Only populated for clients
+	// whose message version supports flow control, see SupportsPipeCredits.
+	pipeSenders map[string]*PipeSender
+
+	// pipeCredit is true if the client's message version supports
+	// credit-based pipe flow control, see SupportsPipeCredits
+	pipeCredit bool
+
 	ufsListener net.Listener
 	ufsConn     net.Conn
 
@@ -79,12 +148,31 @@ type client struct {
 }
 
 func (c *client) sendMessage(m *Message) error {
+	if c.compress {
+		raw, compressed := m.Compress()
+		if m.Compressed && c.stats != nil {
+			atomic.AddInt64(&c.stats.RawOut, int64(raw))
+			atomic.AddInt64(&c.stats.CompressedOut, int64(compressed))
+		}
+	}
+
 	c.writeMu.Lock()
 	defer c.writeMu.Unlock()
 
 	return c.enc.Encode(m)
 }
 
+// matches tests the filter against the client, including the server-side
+// host field, which lives on the wrapper rather than the shared Client.
+func (c *client) matches(f *Filter) bool {
+	if f != nil && f.Host != "" && !matchesHostname(f.Host, c.host) {
+		log.Debug("failed match on host: %v != %v", f.Host, c.host)
+		return false
+	}
+
+	return c.Client.Matches(f)
+}
+
 // Matches tests whether all the filters match the client.
 func (c *Client) Matches(f *Filter) bool {
 	if f == nil {
@@ -95,7 +183,7 @@ func (c *Client) Matches(f *Filter) bool {
 		log.Debug("failed match on UUID: %v != %v", f.UUID, c.UUID)
 		return false
 	}
-	if f.Hostname != "" && f.Hostname != c.Hostname {
+	if f.Hostname != "" && !matchesHostname(f.Hostname, c.Hostname) {
 		log.Debug("failed match on hostname: %v != %v", f.Hostname, c.Hostname)
 		return false
 	}
@@ -109,6 +197,16 @@ func (c *Client) Matches(f *Filter) bool {
 	}
 
 	for k, v := range f.Tags {
+		// inventory-backed keys match against the client's reported
+		// inventory rather than its tags, with glob patterns allowed
+		if i, ok := c.inventoryField(k); ok {
+			if !matchesAny(v, i) {
+				log.Debug("failed match on %v: %v != %v", k, v, i)
+				return false
+			}
+			continue
+		}
+
 		if c.Tags[k] != v {
 			log.Debug("failed match on tag %v, %v != %v", k, v, c.Tags[k])
 			return false
@@ -118,6 +216,48 @@ func (c *Client) Matches(f *Filter) bool {
 	return c.matchesIP(f) && c.matchesMAC(f)
 }
 
+// inventoryField returns the inventory values for filterable inventory keys
+// (see Inventory). The second return is false for any other key, including
+// all keys when the client hasn't reported an inventory.
+func (c *Client) inventoryField(k string) ([]string, bool) {
+	if c.Inventory == nil {
+		return nil, false
+	}
+
+	switch k {
+	case "osversion":
+		return []string{c.Inventory.OSVersion}, true
+	case "kernel":
+		return []string{c.Inventory.Kernel}, true
+	case "user":
+		return c.Inventory.Users, true
+	}
+
+	return nil, false
+}
+
+// matchesAny tests a filter pattern against each value, matching if any does.
+func matchesAny(pattern string, values []string) bool {
+	for _, v := range values {
+		if matchesHostname(pattern, v) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// matchesHostname tests a hostname against a filter pattern, which may be a
+// glob in path.Match syntax (e.g. "web-*").
+func matchesHostname(pattern, hostname string) bool {
+	if ok, err := path.Match(pattern, hostname); err == nil {
+		return ok
+	}
+
+	// invalid patterns fall back to an exact match
+	return pattern == hostname
+}
+
 // matchesIP tests whether the IP or CIDR specified in the filter matches at
 // least one of the client's IPs.
 func (c *Client) matchesIP(f *Filter) bool {
@@ -193,15 +333,34 @@ func (c *client) pipeHandler(plumber *miniplumber.Plumber, m *Message) {
 		if _, ok := c.pipeReaders[pipe]; !ok {
 			p := plumber.NewReader(pipe)
 			c.pipeReaders[pipe] = p
+
+			// gate forwarded data on the window the client grants so a
+			// slow reader in the guest backpressures into the plumber
+			// instead of buffering in the connection
+			var ps *PipeSender
+			if c.pipeCredit {
+				ps = NewPipeSender()
+				c.pipeSenders[pipe] = ps
+			}
+
 			go func() {
 				defer func() {
 					c.pipeLock.Lock()
 					defer c.pipeLock.Unlock()
 					delete(c.pipeReaders, pipe)
+					if ps != nil {
+						ps.Close()
+						delete(c.pipeSenders, pipe)
+					}
 				}()
 				for {
 					select {
 					case v := <-p.C:
+						if ps != nil && !ps.Acquire() {
+							// the client went away -- drop the data and
+							// wait for the reader to close
+							continue
+						}
 						c.sendMessage(&Message{
 							Type:     MESSAGE_PIPE,
 							Pipe:     m.Pipe, // use the non-namespace pipe name for downstream
@@ -223,10 +382,47 @@ func (c *client) pipeHandler(plumber *miniplumber.Plumber, m *Message) {
 	case PIPE_NEW_WRITER:
 		if _, ok := c.pipeWriters[pipe]; !ok {
 			p := plumber.NewWriter(pipe)
-			c.pipeWriters[pipe] = p
+
+			if !c.pipeCredit {
+				c.pipeWriters[pipe] = p
+				break
+			}
+
+			// buffer incoming data between the connection and the plumber
+			// so a slow reader doesn't stall the whole multiplexed channel.
+			// The client gets a window of credit, replenished as the
+			// plumber drains, and stops writing when it runs out.
+			q := make(chan string, PIPE_WINDOW)
+			c.pipeWriters[pipe] = q
+
+			go func() {
+				defer close(p)
+				for v := range q {
+					p <- v
+					c.sendMessage(&Message{
+						Type:       MESSAGE_PIPE,
+						Pipe:       m.Pipe,
+						PipeMode:   PIPE_CREDIT,
+						PipeCredit: 1,
+					})
+				}
+			}()
+
+			c.sendMessage(&Message{
+				Type:       MESSAGE_PIPE,
+				Pipe:       m.Pipe,
+				PipeMode:   PIPE_CREDIT,
+				PipeCredit: PIPE_WINDOW,
+			})
 		}
 	case PIPE_CLOSE_READER:
 		if p, ok := c.pipeReaders[pipe]; ok {
+			// unblock the forwarding goroutine if it is waiting on credit;
+			// it cleans up the sender map entry itself
+			if ps, ok := c.pipeSenders[pipe]; ok {
+				ps.Close()
+			}
+
 			// the reader goroutine will delete the reader from the
 			// map. We do this because miniplumber can close the
 			// reader for us asynchronously, and we want to clean
@@ -246,6 +442,12 @@ func (c *client) pipeHandler(plumber *miniplumber.Plumber, m *Message) {
 		} else {
 			log.Error("no such pipe: %v", pipe)
 		}
+	case PIPE_CREDIT:
+		if ps, ok := c.pipeSenders[pipe]; ok {
+			ps.Grant(m.PipeCredit)
+		} else {
+			log.Debug("credit for unknown pipe: %v", pipe)
+		}
 	default:
 		log.Error("unknown message type: %v", m.PipeMode)
 		return
@@ -20,6 +20,11 @@ type Filter struct {
 	MAC      string
 	IP       string
 	Tags     map[string]string
+
+	// Host matches the minimega host a client is attached to: the host its
+	// VM is scheduled on, or, for clients connected directly over the
+	// network, the source host of the connection. May be a glob.
+	Host string
 }
 
 type Command struct {
@@ -28,6 +33,12 @@ type Command struct {
 	// run command in the background and return immediately
 	Background bool
 
+	// Once limits the command to at most one delivery per client. Normally
+	// a client that reconnects with fresh state (e.g. after a reboot or
+	// re-image) is resent the entire active command list; commands with
+	// Once set are skipped for clients that have already received them.
+	Once bool
+
 	// The command is a slice of strings with the first element being the
 	// command, and any other elements as the arguments
 	Command []string
@@ -36,9 +47,24 @@ type Command struct {
 	// here will be rooted at <BASE>/files
 	FilesSend []string
 
-	// Files to transfer back to the master
+	// FilesSendHashes maps each entry in FilesSend to the hex SHA-256 of its
+	// contents when the command was created. Clients use it to skip transfers
+	// for files they already hold with identical content; clients that
+	// predate it ignore it and transfer as usual.
+	FilesSendHashes map[string]string
+
+	// Files to transfer back to the master. Entries may be glob patterns,
+	// which the client expands locally, and directories, which are walked
+	// recursively. The relative directory structure is preserved under the
+	// per-client response directory.
 	FilesRecv []string
 
+	// RecvMaxFiles and RecvMaxBytes bound how much a FilesRecv request may
+	// send back: at most RecvMaxFiles files and RecvMaxBytes total bytes
+	// per command. Zero values use the client defaults.
+	RecvMaxFiles int
+	RecvMaxBytes int64
+
 	// Connectivity test to execute
 	ConnTest *ConnTest
 
@@ -48,9 +74,34 @@ type Command struct {
 	// KillAll kills all processes by name
 	KillAll string
 
+	// KillCID kills the process started by the command with this ID on
+	// clients that are still running it. Clients that have already completed
+	// the command ignore it.
+	KillCID int
+
+	// Timeout is the maximum runtime to allow the command. When it expires
+	// the client kills the process group and reports an exit status of
+	// "timeout". Zero means no timeout.
+	Timeout time.Duration
+
+	// After delays execution relative to when the client receives the
+	// command. At is an absolute start time in the server's clock; clients
+	// compensate for skew using the server timestamp distributed at each
+	// check-in. Interval repeats the command and Count bounds the number of
+	// runs (zero repeats until the command is deleted). Deleting a
+	// scheduled command cancels any future runs on clients.
+	After    time.Duration
+	At       time.Time
+	Interval time.Duration
+	Count    int
+
 	// Level adjusts the minilog level
 	Level *log.Level
 
+	// LogForward starts, adjusts, or stops forwarding of the client's own
+	// log output back to the server (see LogForward)
+	LogForward *LogForward
+
 	// Filter for clients to process commands. Not all fields in a client
 	// must be set (wildcards), but all set fields must match for a command
 	// to be processed.
@@ -59,6 +110,10 @@ type Command struct {
 	// clients that have responded to this command
 	CheckedIn []string
 
+	// clients that satisfied a file in FilesSend from a previously received
+	// copy, without any transfer (one entry per file skipped)
+	CachedSend []string
+
 	// Prefix is an optional field that can be used to track commands. It is
 	// not used by the server or client.
 	Prefix string
@@ -67,6 +122,30 @@ type Command struct {
 	Stdin  string
 	Stdout string
 	Stderr string
+
+	// Env is environment variables to apply to the command, layered over
+	// the client's own environment
+	Env map[string]string
+
+	// Input is literal data to write to the command's stdin. The client
+	// closes stdin once the data has been written so programs that read
+	// until EOF terminate. To connect stdin to a named pipe for interactive
+	// streaming, use Stdin instead.
+	Input string
+
+	// Dir is the working directory for the command. Empty runs the command
+	// wherever the client happens to be.
+	Dir string
+
+	// User is the user to run the command as. Empty runs the command as the
+	// client's own user. A client that cannot switch to the user fails the
+	// command rather than running it as itself.
+	User string
+
+	// Created is when the command was queued, set by the server. Commands
+	// are not delivered to clients more than COMMAND_MAX_AGE after creation
+	// (see Expired).
+	Created time.Time
 }
 
 type Response struct {
@@ -76,6 +155,41 @@ type Response struct {
 	// Output from responding command, if any
 	Stdout string
 	Stderr string
+
+	// InputSent reports whether literal stdin input was delivered to the
+	// command (see Command.Input)
+	InputSent bool
+
+	// Exit is the exit disposition for the command: the numeric exit code,
+	// or "timeout"/"killed" when the process was terminated. Empty for
+	// backgrounded commands and clients that predate exit reporting.
+	Exit string
+
+	// Seq is the sequence number for streamed output chunks, starting at 1.
+	// Zero, including every response from a client that doesn't set
+	// Streaming, marks a complete response, which supersedes any streamed
+	// chunks for the same command.
+	Seq int
+
+	// Run is the run number for scheduled periodic commands, starting at 1.
+	// Zero for commands that run once. The server records each run's output
+	// separately so runs don't clobber each other.
+	Run int
+
+	// Dir and User echo the working directory and user the command ran
+	// with, when the command set them (see Command.Dir and Command.User).
+	// The server records them in a "context" file alongside the output.
+	Dir  string
+	User string
+}
+
+// LogForward controls shipping of a client's minilog output over the cc
+// channel. The client forwards records at or above Level in MESSAGE_LOG
+// messages, rate-limited so a log-spamming client drops lines (reporting how
+// many) rather than flooding the channel. Stop tears forwarding down.
+type LogForward struct {
+	Level log.Level
+	Stop  bool
 }
 
 type ConnTest struct {
@@ -96,6 +210,9 @@ func (f *Filter) String() string {
 	if f.Hostname != "" {
 		res = append(res, "hostname="+f.Hostname)
 	}
+	if f.Host != "" {
+		res = append(res, "host="+f.Host)
+	}
 	if f.Arch != "" {
 		res = append(res, "arch="+f.Arch)
 	}
@@ -115,26 +232,109 @@ func (f *Filter) String() string {
 	return strings.Join(res, " && ")
 }
 
+// Expired returns whether the command has aged past COMMAND_MAX_AGE and
+// should no longer be delivered to clients that haven't received it. Commands
+// that predate age tracking never expire.
+func (c *Command) Expired() bool {
+	return !c.Created.IsZero() && time.Since(c.Created) > COMMAND_MAX_AGE
+}
+
+// Scheduled returns whether the command has a schedule attached rather than
+// running immediately on delivery.
+func (c *Command) Scheduled() bool {
+	return c.After > 0 || !c.At.IsZero() || c.Interval > 0
+}
+
+// Schedule describes the command's schedule and, for absolute schedules, the
+// next fire time in the server's clock. Empty for unscheduled commands.
+func (c *Command) Schedule() string {
+	if !c.Scheduled() {
+		return ""
+	}
+
+	var res []string
+	if !c.At.IsZero() {
+		res = append(res, "at "+c.At.Format(time.RFC3339))
+	}
+	if c.After > 0 {
+		res = append(res, "after "+c.After.String())
+	}
+	if c.Interval > 0 {
+		s := "every " + c.Interval.String()
+		if c.Count > 0 {
+			s += fmt.Sprintf(" x%v", c.Count)
+		}
+		res = append(res, s)
+	}
+
+	// the next fire time is only known server-side for absolute schedules;
+	// relative delays depend on when each client received the command
+	if !c.At.IsZero() {
+		now := time.Now()
+
+		next := c.At
+		if c.Interval > 0 {
+			for i := 1; next.Before(now) && (c.Count == 0 || i < c.Count); i++ {
+				next = next.Add(c.Interval)
+			}
+		}
+
+		if next.After(now) {
+			res = append(res, "next "+next.Format(time.RFC3339))
+		}
+	}
+
+	return strings.Join(res, ", ")
+}
+
 // Creates a copy of c.
 func (c *Command) Copy() *Command {
 	c2 := &Command{
-		ID:         c.ID,
-		Background: c.Background,
-		PID:        c.PID,
-		KillAll:    c.KillAll,
-		Prefix:     c.Prefix,
-		Stdin:      c.Stdin,
-		Stdout:     c.Stdout,
-		Stderr:     c.Stderr,
+		ID:           c.ID,
+		Background:   c.Background,
+		Once:         c.Once,
+		RecvMaxFiles: c.RecvMaxFiles,
+		RecvMaxBytes: c.RecvMaxBytes,
+		PID:          c.PID,
+		KillAll:      c.KillAll,
+		KillCID:      c.KillCID,
+		Timeout:      c.Timeout,
+		After:        c.After,
+		At:           c.At,
+		Interval:     c.Interval,
+		Count:        c.Count,
+		Prefix:       c.Prefix,
+		Stdin:        c.Stdin,
+		Stdout:       c.Stdout,
+		Stderr:       c.Stderr,
+		Input:        c.Input,
+		Dir:          c.Dir,
+		User:         c.User,
+		Created:      c.Created,
 	}
 
 	// make deep copies
 	c2.Command = append(c2.Command, c.Command...)
 	c2.CheckedIn = append(c2.CheckedIn, c.CheckedIn...)
+	c2.CachedSend = append(c2.CachedSend, c.CachedSend...)
 
 	c2.FilesSend = append(c2.FilesSend, c.FilesSend...)
 	c2.FilesRecv = append(c2.FilesRecv, c.FilesRecv...)
 
+	if c.FilesSendHashes != nil {
+		c2.FilesSendHashes = make(map[string]string)
+		for k, v := range c.FilesSendHashes {
+			c2.FilesSendHashes[k] = v
+		}
+	}
+
+	if c.Env != nil {
+		c2.Env = make(map[string]string)
+		for k, v := range c.Env {
+			c2.Env[k] = v
+		}
+	}
+
 	if c.Filter != nil {
 		c2.Filter = new(Filter)
 		*c2.Filter = *c.Filter
@@ -145,6 +345,11 @@ func (c *Command) Copy() *Command {
 		*c2.Level = *c.Level
 	}
 
+	if c.LogForward != nil {
+		c2.LogForward = new(LogForward)
+		*c2.LogForward = *c.LogForward
+	}
+
 	if c.ConnTest != nil {
 		c2.ConnTest = new(ConnTest)
 		*c2.ConnTest = *c.ConnTest
@@ -0,0 +1,96 @@
+// Copyright 2015-2021 National Technology & Engineering Solutions of Sandia, LLC (NTESS).
+// Under the terms of Contract DE-NA0003525 with NTESS, the U.S. Government retains certain
+// rights in this software.
+
+package ron
+
+import (
+	"encoding/gob"
+	"testing"
+)
+
+// TestOnceReconnect checks that a command marked Once is not redelivered to a
+// client that reconnects with the same UUID and a reset command cursor, while
+// regular commands are resent as usual.
+func TestOnceReconnect(t *testing.T) {
+	s := &Server{
+		clients:  make(map[string]*client),
+		commands: make(map[int]*Command),
+	}
+
+	s.commandCounter = 2
+	s.commands[1] = &Command{ID: 1, Once: true, Command: []string{"setup"}}
+	s.commands[2] = &Command{ID: 2, Command: []string{"poll"}}
+
+	c, buf := newTestClient("uuid-0", "web-0", "linux")
+	s.clients[c.UUID] = c
+
+	s.sendCommands("")
+
+	var m Message
+	if err := gob.NewDecoder(buf).Decode(&m); err != nil {
+		t.Fatalf("client received no message: %v", err)
+	}
+	for _, id := range []int{1, 2} {
+		if _, ok := m.Commands[id]; !ok {
+			t.Fatalf("client missing command %v: %v", id, m.Commands)
+		}
+	}
+
+	// the client reboots and reconnects with the same UUID; its command
+	// cursor resets so every active command is eligible again
+	c2, buf2 := newTestClient("uuid-0", "web-0", "linux")
+	s.clients[c2.UUID] = c2
+
+	s.sendCommands("")
+
+	m = Message{}
+	if err := gob.NewDecoder(buf2).Decode(&m); err != nil {
+		t.Fatalf("reconnected client received no message: %v", err)
+	}
+	if _, ok := m.Commands[1]; ok {
+		t.Errorf("run-once command redelivered: %v", m.Commands)
+	}
+	if _, ok := m.Commands[2]; !ok {
+		t.Errorf("regular command not redelivered: %v", m.Commands)
+	}
+}
+
+// TestDeliveries checks the delivery counts reported for a command and that
+// the delivery state is dropped when the command is deleted.
+func TestDeliveries(t *testing.T) {
+	s := &Server{
+		path:     t.TempDir(),
+		clients:  make(map[string]*client),
+		commands: make(map[int]*Command),
+	}
+
+	s.commandCounter = 1
+	s.commands[1] = &Command{ID: 1, Command: []string{"setup"}}
+
+	for _, v := range []string{"uuid-0", "uuid-1"} {
+		c, _ := newTestClient(v, "web-0", "linux")
+		s.clients[c.UUID] = c
+	}
+
+	s.sendCommands("")
+
+	if sent, acked := s.Deliveries(1); sent != 2 || acked != 0 {
+		t.Errorf("got %v sent, %v acked, want 2, 0", sent, acked)
+	}
+
+	// one client checks in having processed the command
+	s.markAcked("uuid-0", 1)
+
+	if sent, acked := s.Deliveries(1); sent != 2 || acked != 1 {
+		t.Errorf("got %v sent, %v acked, want 2, 1", sent, acked)
+	}
+
+	if err := s.DeleteCommand(1); err != nil {
+		t.Fatalf("delete command: %v", err)
+	}
+
+	if sent, acked := s.Deliveries(1); sent != 0 || acked != 0 {
+		t.Errorf("delivery state not cleaned up: %v sent, %v acked", sent, acked)
+	}
+}
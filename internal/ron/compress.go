@@ -0,0 +1,158 @@
+// Copyright 2015-2021 National Technology & Engineering Solutions of Sandia, LLC (NTESS).
+// Under the terms of Contract DE-NA0003525 with NTESS, the U.S. Government retains certain
+// rights in this software.
+
+package ron
+
+import (
+	"bytes"
+	"compress/flate"
+	"io/ioutil"
+	"sync/atomic"
+)
+
+// CompressThreshold is the total payload size, in bytes, above which a
+// message's payloads are compressed for peers that support it (see
+// SupportsCompression). Small payloads aren't worth the CPU.
+const CompressThreshold = 4 * 1024
+
+// CompressionStats tracks payload bytes before and after compression in each
+// direction so the win can be measured. Fields are updated atomically.
+type CompressionStats struct {
+	RawOut        int64 // sent payload bytes before compression
+	CompressedOut int64 // sent payload bytes after compression
+	RawIn         int64 // received payload bytes after decompression
+	CompressedIn  int64 // received payload bytes before decompression
+}
+
+// compressible returns the total size of the message's compressible payloads:
+// file data, pipe data, and command output.
+func (m *Message) compressible() int {
+	n := len(m.PipeData)
+
+	if m.File != nil {
+		n += len(m.File.Data)
+	}
+
+	if m.Client != nil {
+		for _, r := range m.Client.Responses {
+			n += len(r.Stdout) + len(r.Stderr)
+		}
+	}
+
+	return n
+}
+
+// Compress compresses the message's payloads in place when they together
+// exceed CompressThreshold, flagging the message so the receiver knows to
+// expand them. Either all payloads in a message are compressed or none are.
+// Returns the payload sizes before and after for accounting.
+func (m *Message) Compress() (raw, compressed int) {
+	raw = m.compressible()
+
+	if m.Compressed || raw < CompressThreshold {
+		return raw, raw
+	}
+
+	if m.PipeData != "" {
+		m.PipeData = string(deflate([]byte(m.PipeData)))
+	}
+
+	if m.File != nil && len(m.File.Data) > 0 {
+		m.File.Data = deflate(m.File.Data)
+	}
+
+	if m.Client != nil {
+		for _, r := range m.Client.Responses {
+			if r.Stdout != "" {
+				r.Stdout = string(deflate([]byte(r.Stdout)))
+			}
+			if r.Stderr != "" {
+				r.Stderr = string(deflate([]byte(r.Stderr)))
+			}
+		}
+	}
+
+	m.Compressed = true
+
+	return raw, m.compressible()
+}
+
+// Decompress expands the payloads of a message compressed by Compress.
+// Messages from peers that don't compress pass through untouched. Returns the
+// payload sizes before and after for accounting.
+func (m *Message) Decompress() (compressed, raw int, err error) {
+	compressed = m.compressible()
+
+	if !m.Compressed {
+		return compressed, compressed, nil
+	}
+
+	if m.PipeData != "" {
+		data, err := inflate([]byte(m.PipeData))
+		if err != nil {
+			return compressed, compressed, err
+		}
+		m.PipeData = string(data)
+	}
+
+	if m.File != nil && len(m.File.Data) > 0 {
+		data, err := inflate(m.File.Data)
+		if err != nil {
+			return compressed, compressed, err
+		}
+		m.File.Data = data
+	}
+
+	if m.Client != nil {
+		for _, r := range m.Client.Responses {
+			if r.Stdout != "" {
+				data, err := inflate([]byte(r.Stdout))
+				if err != nil {
+					return compressed, compressed, err
+				}
+				r.Stdout = string(data)
+			}
+			if r.Stderr != "" {
+				data, err := inflate([]byte(r.Stderr))
+				if err != nil {
+					return compressed, compressed, err
+				}
+				r.Stderr = string(data)
+			}
+		}
+	}
+
+	m.Compressed = false
+
+	return compressed, m.compressible(), nil
+}
+
+func deflate(data []byte) []byte {
+	var buf bytes.Buffer
+
+	// BestSpeed -- guest CPU is cheap relative to channel bandwidth, but not
+	// free
+	w, _ := flate.NewWriter(&buf, flate.BestSpeed)
+	w.Write(data)
+	w.Close()
+
+	return buf.Bytes()
+}
+
+func inflate(data []byte) ([]byte, error) {
+	r := flate.NewReader(bytes.NewReader(data))
+	defer r.Close()
+
+	return ioutil.ReadAll(r)
+}
+
+// CompressionStats returns a snapshot of the server's compression counters.
+func (s *Server) CompressionStats() CompressionStats {
+	return CompressionStats{
+		RawOut:        atomic.LoadInt64(&s.compressionStats.RawOut),
+		CompressedOut: atomic.LoadInt64(&s.compressionStats.CompressedOut),
+		RawIn:         atomic.LoadInt64(&s.compressionStats.RawIn),
+		CompressedIn:  atomic.LoadInt64(&s.compressionStats.CompressedIn),
+	}
+}
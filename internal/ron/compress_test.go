@@ -0,0 +1,134 @@
+// Copyright 2015-2021 National Technology & Engineering Solutions of Sandia, LLC (NTESS).
+// Under the terms of Contract DE-NA0003525 with NTESS, the U.S. Government retains certain
+// rights in this software.
+
+package ron
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+// logData builds log-like text of roughly n bytes, the typical payload pulled
+// back from clients.
+func logData(n int) string {
+	line := "2021-01-01 00:00:00 INFO some component: everything is fine\n"
+
+	return strings.Repeat(line, n/len(line)+1)
+}
+
+func TestCompressRoundTrip(t *testing.T) {
+	stdout := logData(64 * 1024)
+	data := bytes.Repeat([]byte("file data "), 8*1024)
+
+	m := &Message{
+		Type: MESSAGE_CLIENT,
+		Client: &Client{
+			UUID: "uuid-0",
+			Responses: []*Response{
+				{ID: 1, Stdout: stdout},
+			},
+		},
+		File: &File{Name: "foo", Data: append([]byte{}, data...)},
+	}
+
+	raw, compressed := m.Compress()
+	if !m.Compressed {
+		t.Fatal("message was not compressed")
+	}
+	if compressed >= raw {
+		t.Errorf("no win: %v -> %v bytes", raw, compressed)
+	}
+
+	compressed2, raw2, err := m.Decompress()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Compressed {
+		t.Error("message still flagged as compressed")
+	}
+	if compressed2 != compressed || raw2 != raw {
+		t.Errorf("mismatched accounting: %v/%v != %v/%v", compressed2, raw2, compressed, raw)
+	}
+
+	if m.Client.Responses[0].Stdout != stdout {
+		t.Error("stdout mangled in round trip")
+	}
+	if !bytes.Equal(m.File.Data, data) {
+		t.Error("file data mangled in round trip")
+	}
+}
+
+func TestCompressThreshold(t *testing.T) {
+	m := &Message{
+		Type:     MESSAGE_PIPE,
+		PipeData: "small\n",
+	}
+
+	raw, compressed := m.Compress()
+	if m.Compressed {
+		t.Error("payload below the threshold was compressed")
+	}
+	if raw != compressed || raw != len("small\n") {
+		t.Errorf("bad accounting: %v/%v", raw, compressed)
+	}
+
+	// messages from peers that don't compress pass through untouched
+	if _, _, err := m.Decompress(); err != nil {
+		t.Fatal(err)
+	}
+	if m.PipeData != "small\n" {
+		t.Error("uncompressed payload mangled")
+	}
+}
+
+// BenchmarkCompress measures compressing command output, for the serial-port
+// case where guest CPU is cheap relative to channel bandwidth.
+func BenchmarkCompress(b *testing.B) {
+	stdout := logData(256 * 1024)
+
+	b.SetBytes(int64(len(stdout)))
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		m := &Message{
+			Type: MESSAGE_CLIENT,
+			Client: &Client{
+				Responses: []*Response{{ID: 1, Stdout: stdout}},
+			},
+		}
+
+		m.Compress()
+	}
+}
+
+func BenchmarkDecompress(b *testing.B) {
+	stdout := logData(256 * 1024)
+
+	m := &Message{
+		Type: MESSAGE_CLIENT,
+		Client: &Client{
+			Responses: []*Response{{ID: 1, Stdout: stdout}},
+		},
+	}
+	m.Compress()
+	compressed := m.Client.Responses[0].Stdout
+
+	b.SetBytes(int64(len(stdout)))
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		m2 := &Message{
+			Type:       MESSAGE_CLIENT,
+			Compressed: true,
+			Client: &Client{
+				Responses: []*Response{{ID: 1, Stdout: compressed}},
+			},
+		}
+
+		if _, _, err := m2.Decompress(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,263 @@
+// Copyright 2015-2021 National Technology & Engineering Solutions of Sandia, LLC (NTESS).
+// Under the terms of Contract DE-NA0003525 with NTESS, the U.S. Government retains certain
+// rights in this software.
+
+package ron
+
+import "fmt"
+
+// DeliveryState tracks how far a command has progressed toward one client.
+// States only advance (a reconnecting client being resent a command does not
+// demote it), except that repeated send failures move a client to
+// DELIVERY_FAILED.
+type DeliveryState int
+
+const (
+	// the client matched the command but sending it failed; it is retried
+	// when the client reconnects
+	DELIVERY_QUEUED DeliveryState = iota
+	// the command was written to the client's connection
+	DELIVERY_SENT
+	// the client explicitly acknowledged receipt, or its check-in cursor
+	// passed the command
+	DELIVERY_ACKED
+	// the client recorded a response
+	DELIVERY_RESPONDED
+	// sending failed DELIVERY_MAX_ATTEMPTS times; the command is no longer
+	// retried for this client
+	DELIVERY_FAILED
+	// the command aged past COMMAND_MAX_AGE before the client received it
+	DELIVERY_EXPIRED
+)
+
+// DELIVERY_MAX_ATTEMPTS bounds redelivery: after this many failed sends to a
+// client, the command is marked failed for it and not retried.
+const DELIVERY_MAX_ATTEMPTS = 3
+
+func (d DeliveryState) String() string {
+	switch d {
+	case DELIVERY_QUEUED:
+		return "queued"
+	case DELIVERY_SENT:
+		return "sent"
+	case DELIVERY_ACKED:
+		return "acked"
+	case DELIVERY_RESPONDED:
+		return "responded"
+	case DELIVERY_FAILED:
+		return "failed"
+	case DELIVERY_EXPIRED:
+		return "expired"
+	}
+
+	return "unknown"
+}
+
+// ParseDeliveryState converts a state name as rendered by String back to a
+// DeliveryState.
+func ParseDeliveryState(s string) (DeliveryState, error) {
+	for _, d := range []DeliveryState{DELIVERY_QUEUED, DELIVERY_SENT, DELIVERY_ACKED, DELIVERY_RESPONDED, DELIVERY_FAILED, DELIVERY_EXPIRED} {
+		if s == d.String() {
+			return d, nil
+		}
+	}
+
+	return 0, fmt.Errorf("invalid delivery state: `%v`", s)
+}
+
+// delivery records each client's delivery state for one command. It is shared
+// infrastructure: run-once skipping, kill targeting, and the status table all
+// read it.
+type delivery struct {
+	states   map[string]DeliveryState
+	attempts map[string]int
+}
+
+// getDelivery returns the delivery table for a command, creating it if
+// needed. The caller must hold deliveryLock.
+func (s *Server) getDelivery(id int) *delivery {
+	if s.deliveries == nil {
+		s.deliveries = make(map[int]*delivery)
+	}
+
+	d, ok := s.deliveries[id]
+	if !ok {
+		d = &delivery{
+			states:   make(map[string]DeliveryState),
+			attempts: make(map[string]int),
+		}
+		s.deliveries[id] = d
+	}
+
+	return d
+}
+
+// sentTo returns whether the command with the given ID has already been
+// delivered to the client with the given UUID.
+func (s *Server) sentTo(id int, uuid string) bool {
+	s.deliveryLock.Lock()
+	defer s.deliveryLock.Unlock()
+
+	if d, ok := s.deliveries[id]; ok {
+		st, ok := d.states[uuid]
+		return ok && st >= DELIVERY_SENT && st < DELIVERY_FAILED
+	}
+
+	return false
+}
+
+// failedTo returns whether delivery of the command to the client has been
+// abandoned after too many failed sends.
+func (s *Server) failedTo(id int, uuid string) bool {
+	s.deliveryLock.Lock()
+	defer s.deliveryLock.Unlock()
+
+	if d, ok := s.deliveries[id]; ok {
+		return d.states[uuid] == DELIVERY_FAILED
+	}
+
+	return false
+}
+
+// markSent records that the command with the given ID was delivered to the
+// client with the given UUID.
+func (s *Server) markSent(id int, uuid string) {
+	s.deliveryLock.Lock()
+	defer s.deliveryLock.Unlock()
+
+	d := s.getDelivery(id)
+
+	if st, ok := d.states[uuid]; !ok || st < DELIVERY_SENT {
+		d.states[uuid] = DELIVERY_SENT
+	}
+}
+
+// markQueued records a failed send of the command to the client. The command
+// stays queued for redelivery until the send has failed DELIVERY_MAX_ATTEMPTS
+// times, after which the client is marked failed and no longer retried.
+func (s *Server) markQueued(id int, uuid string) {
+	s.deliveryLock.Lock()
+	defer s.deliveryLock.Unlock()
+
+	d := s.getDelivery(id)
+
+	d.attempts[uuid]++
+
+	if st, ok := d.states[uuid]; ok && st > DELIVERY_QUEUED {
+		// a previous send already succeeded; don't demote
+		return
+	}
+
+	if d.attempts[uuid] >= DELIVERY_MAX_ATTEMPTS {
+		d.states[uuid] = DELIVERY_FAILED
+	} else {
+		d.states[uuid] = DELIVERY_QUEUED
+	}
+}
+
+// markAcked records that the client with the given UUID has acknowledged
+// every command up to and including lastID, which clients report with each
+// check-in.
+func (s *Server) markAcked(uuid string, lastID int) {
+	s.deliveryLock.Lock()
+	defer s.deliveryLock.Unlock()
+
+	for id, d := range s.deliveries {
+		if id > lastID {
+			continue
+		}
+
+		if st, ok := d.states[uuid]; ok && st >= DELIVERY_SENT && st < DELIVERY_ACKED {
+			d.states[uuid] = DELIVERY_ACKED
+		}
+	}
+}
+
+// markAckedID records an explicit acknowledgment of a single command, which
+// newer clients send as soon as a command message arrives.
+func (s *Server) markAckedID(uuid string, id int) {
+	s.deliveryLock.Lock()
+	defer s.deliveryLock.Unlock()
+
+	d := s.getDelivery(id)
+
+	if st, ok := d.states[uuid]; !ok || st < DELIVERY_ACKED || st >= DELIVERY_FAILED {
+		d.states[uuid] = DELIVERY_ACKED
+	}
+}
+
+// markResponded records that the client recorded a response for the command.
+func (s *Server) markResponded(uuid string, id int) {
+	s.deliveryLock.Lock()
+	defer s.deliveryLock.Unlock()
+
+	d := s.getDelivery(id)
+
+	if st, ok := d.states[uuid]; !ok || st < DELIVERY_RESPONDED || st >= DELIVERY_FAILED {
+		d.states[uuid] = DELIVERY_RESPONDED
+	}
+}
+
+// markExpired records that the command aged past COMMAND_MAX_AGE before it
+// could be delivered to the client.
+func (s *Server) markExpired(id int, uuid string) {
+	s.deliveryLock.Lock()
+	defer s.deliveryLock.Unlock()
+
+	d := s.getDelivery(id)
+
+	if st, ok := d.states[uuid]; !ok || st < DELIVERY_SENT {
+		d.states[uuid] = DELIVERY_EXPIRED
+	}
+}
+
+// deleteDelivery drops the delivery state for a command that has been removed
+// from the active command list.
+func (s *Server) deleteDelivery(id int) {
+	s.deliveryLock.Lock()
+	defer s.deliveryLock.Unlock()
+
+	delete(s.deliveries, id)
+}
+
+// Deliveries returns the number of clients the command with the given ID has
+// been sent to and the number that have acknowledged receiving it.
+func (s *Server) Deliveries(id int) (sent, acked int) {
+	s.deliveryLock.Lock()
+	defer s.deliveryLock.Unlock()
+
+	if d, ok := s.deliveries[id]; ok {
+		for _, st := range d.states {
+			if st >= DELIVERY_SENT && st < DELIVERY_FAILED {
+				sent++
+			}
+			if st >= DELIVERY_ACKED && st < DELIVERY_FAILED {
+				acked++
+			}
+		}
+	}
+
+	return
+}
+
+// DeliveryStatus returns each known client's delivery state for the command
+// with the given ID, keyed by client UUID. Clients the server has never tried
+// to send the command to don't appear.
+func (s *Server) DeliveryStatus(id int) (map[string]DeliveryState, error) {
+	if s.GetCommand(id) == nil {
+		return nil, fmt.Errorf("command %v not found", id)
+	}
+
+	s.deliveryLock.Lock()
+	defer s.deliveryLock.Unlock()
+
+	res := make(map[string]DeliveryState)
+
+	if d, ok := s.deliveries[id]; ok {
+		for uuid, st := range d.states {
+			res[uuid] = st
+		}
+	}
+
+	return res, nil
+}
@@ -0,0 +1,79 @@
+// Copyright 2015-2021 National Technology & Engineering Solutions of Sandia, LLC (NTESS).
+// Under the terms of Contract DE-NA0003525 with NTESS, the U.S. Government retains certain
+// rights in this software.
+
+package ron
+
+import "testing"
+
+// TestDeliveryStates walks a command through the per-client delivery states
+// and checks the transitions and counts.
+func TestDeliveryStates(t *testing.T) {
+	s := &Server{
+		commands: map[int]*Command{
+			1: &Command{ID: 1, Command: []string{"setup"}},
+		},
+	}
+
+	// uuid-0 fails a send and is queued for retry
+	s.markQueued(1, "uuid-0")
+
+	status, err := s.DeliveryStatus(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status["uuid-0"] != DELIVERY_QUEUED {
+		t.Errorf("got %v, want queued", status["uuid-0"])
+	}
+
+	// after too many failed sends, delivery is abandoned
+	for i := 1; i < DELIVERY_MAX_ATTEMPTS; i++ {
+		s.markQueued(1, "uuid-0")
+	}
+	if !s.failedTo(1, "uuid-0") {
+		t.Error("expected delivery abandoned after max attempts")
+	}
+
+	// uuid-1 advances through sent, acked, and responded
+	s.markSent(1, "uuid-1")
+	if !s.sentTo(1, "uuid-1") {
+		t.Error("expected command sent to uuid-1")
+	}
+
+	s.markAckedID("uuid-1", 1)
+	s.markResponded("uuid-1", 1)
+
+	status, _ = s.DeliveryStatus(1)
+	if status["uuid-1"] != DELIVERY_RESPONDED {
+		t.Errorf("got %v, want responded", status["uuid-1"])
+	}
+
+	// a failed send after a response doesn't demote the client
+	s.markQueued(1, "uuid-1")
+	status, _ = s.DeliveryStatus(1)
+	if status["uuid-1"] != DELIVERY_RESPONDED {
+		t.Errorf("demoted to %v after failed resend", status["uuid-1"])
+	}
+
+	// failed clients count as neither sent nor acked
+	if sent, acked := s.Deliveries(1); sent != 1 || acked != 1 {
+		t.Errorf("got %v sent, %v acked, want 1, 1", sent, acked)
+	}
+}
+
+// TestParseDeliveryState round-trips each state through its name.
+func TestParseDeliveryState(t *testing.T) {
+	for _, d := range []DeliveryState{DELIVERY_QUEUED, DELIVERY_SENT, DELIVERY_ACKED, DELIVERY_RESPONDED, DELIVERY_FAILED} {
+		got, err := ParseDeliveryState(d.String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != d {
+			t.Errorf("got %v, want %v", got, d)
+		}
+	}
+
+	if _, err := ParseDeliveryState("bogus"); err == nil {
+		t.Error("expected error for bogus state")
+	}
+}
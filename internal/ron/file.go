@@ -5,7 +5,9 @@
 package ron
 
 import (
+	"crypto/sha256"
 	"errors"
+	"fmt"
 	"io"
 	"os"
 	"path/filepath"
@@ -23,7 +25,14 @@ type File struct {
 
 	Data   []byte // data chunk
 	Offset int64  // offset for this chunk
+	Size   int64  // total size of the file, for progress reporting
 	EOF    bool   // final chunk in file
+
+	// Hash is the SHA-256 of the complete file contents, hex encoded (see
+	// Command.FilesSendHashes). Cached acknowledges a send the client
+	// satisfied from a previously received copy, without any transfer.
+	Hash   string
+	Cached bool
 }
 
 // Recv part of a file, writing it to <fpath>.partial. Once the last piece of
@@ -70,8 +79,26 @@ func (f *File) Write(fpath string) error {
 	return err
 }
 
-// SendFile sends a file in chunks using the send func.
-func SendFile(dir, fpath string, ID int, chunkSize int64, send func(m *Message) error) error {
+// HashFile returns the hex-encoded SHA-256 of the file's contents.
+func HashFile(fpath string) (string, error) {
+	f, err := os.Open(fpath)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf("%x", h.Sum(nil)), nil
+}
+
+// SendFile sends a file in chunks using the send func, starting at the given
+// offset. A non-zero offset resumes an interrupted transfer -- the receiver
+// already has the earlier bytes in its partial file.
+func SendFile(dir, fpath string, ID int, offset, chunkSize int64, send func(m *Message) error) error {
 	rel, err := filepath.Rel(dir, fpath)
 	if err != nil {
 		return err
@@ -107,7 +134,16 @@ func SendFile(dir, fpath string, ID int, chunkSize int64, send func(m *Message)
 		return sendError(errors.New("cannot send directory"))
 	}
 
-	var offset int64
+	if offset > 0 {
+		if offset > fi.Size() {
+			return sendError(errors.New("resume offset beyond end of file"))
+		}
+
+		if _, err := f.Seek(offset, io.SeekStart); err != nil {
+			log.Error("cannot seek file %v: %v", fpath, err)
+			return sendError(err)
+		}
+	}
 
 	for {
 		data := make([]byte, chunkSize)
@@ -127,6 +163,7 @@ func SendFile(dir, fpath string, ID int, chunkSize int64, send func(m *Message)
 				Data:   data[:n],
 				EOF:    err == io.EOF,
 				Offset: offset,
+				Size:   fi.Size(),
 			},
 		}
 
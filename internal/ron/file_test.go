@@ -0,0 +1,176 @@
+// Copyright 2019-2021 National Technology & Engineering Solutions of Sandia, LLC (NTESS).
+// Under the terms of Contract DE-NA0003525 with NTESS, the U.S. Government retains certain
+// rights in this software.
+
+package ron
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSendFileRecv(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ron")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	src := filepath.Join(dir, "src")
+	if err := ioutil.WriteFile(src, []byte("0123456789"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	var msgs []*Message
+	send := func(m *Message) error {
+		msgs = append(msgs, m)
+		return nil
+	}
+
+	if err := SendFile(dir, src, 1, 0, 4, send); err != nil {
+		t.Fatal(err)
+	}
+
+	dst := filepath.Join(dir, "dst")
+
+	for _, m := range msgs {
+		if m.Error != "" {
+			t.Fatalf("unexpected error chunk: %v", m.Error)
+		}
+
+		if m.File.Size != 10 {
+			t.Fatalf("expected size 10, got %v", m.File.Size)
+		}
+
+		if err := m.File.Recv(dst); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	data, err := ioutil.ReadFile(dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(data) != "0123456789" {
+		t.Fatalf("reassembled `%v`", string(data))
+	}
+}
+
+func TestSendFileResume(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ron")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	src := filepath.Join(dir, "src")
+	if err := ioutil.WriteFile(src, []byte("0123456789"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// the receiver already has the first four bytes from an interrupted
+	// transfer
+	dst := filepath.Join(dir, "dst")
+	if err := ioutil.WriteFile(dst+".partial", []byte("0123"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	var msgs []*Message
+	send := func(m *Message) error {
+		msgs = append(msgs, m)
+		return nil
+	}
+
+	if err := SendFile(dir, src, 1, 4, 4, send); err != nil {
+		t.Fatal(err)
+	}
+
+	if msgs[0].File.Offset != 4 {
+		t.Fatalf("expected first chunk at offset 4, got %v", msgs[0].File.Offset)
+	}
+
+	for _, m := range msgs {
+		if m.Error != "" {
+			t.Fatalf("unexpected error chunk: %v", m.Error)
+		}
+
+		if err := m.File.Recv(dst); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	data, err := ioutil.ReadFile(dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(data) != "0123456789" {
+		t.Fatalf("reassembled `%v`", string(data))
+	}
+
+	if _, err := os.Stat(dst + ".partial"); !os.IsNotExist(err) {
+		t.Fatal("expected partial file to be renamed away")
+	}
+
+	// resuming past the end of the file is an error chunk, not a crash
+	msgs = nil
+	if err := SendFile(dir, src, 1, 11, 4, send); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(msgs) != 1 || msgs[0].Error == "" {
+		t.Fatalf("expected a single error chunk, got %v", msgs)
+	}
+}
+
+func TestFilesSendHashes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ron")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	data := []byte("toolkit contents")
+	if err := ioutil.WriteFile(filepath.Join(dir, "toolkit"), data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	s := &Server{path: dir}
+
+	cmd, err := s.NewFilesSendCommand([]string{"toolkit"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(cmd.FilesSend) != 1 {
+		t.Fatalf("expected 1 file, got %v", cmd.FilesSend)
+	}
+
+	want := fmt.Sprintf("%x", sha256.Sum256(data))
+	if got := cmd.FilesSendHashes["toolkit"]; got != want {
+		t.Errorf("bad hash: %v != %v", got, want)
+	}
+
+	// a corrupt local copy must not match the command's hash
+	if err := ioutil.WriteFile(filepath.Join(dir, "toolkit"), []byte("trunc"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	hash, err := HashFile(filepath.Join(dir, "toolkit"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hash == want {
+		t.Error("corrupt copy hashed the same")
+	}
+
+	// hashes survive the copy made for each client
+	if got := cmd.Copy().FilesSendHashes["toolkit"]; got != want {
+		t.Errorf("hash lost in copy: %v", got)
+	}
+}
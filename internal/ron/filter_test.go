@@ -0,0 +1,137 @@
+// Copyright 2015-2021 National Technology & Engineering Solutions of Sandia, LLC (NTESS).
+// Under the terms of Contract DE-NA0003525 with NTESS, the U.S. Government retains certain
+// rights in this software.
+
+package ron
+
+import (
+	"bytes"
+	"encoding/gob"
+	"testing"
+)
+
+func TestFilterMatches(t *testing.T) {
+	c := &Client{
+		UUID:     "uuid-0",
+		Hostname: "web-0",
+		Arch:     "amd64",
+		OS:       "linux",
+		IPs:      []string{"10.0.0.5"},
+		MACs:     []string{"00:11:22:33:44:55"},
+		Tags:     map[string]string{"role": "victim"},
+	}
+
+	tests := []struct {
+		name   string
+		filter *Filter
+		want   bool
+	}{
+		{"nil", nil, true},
+		{"empty", &Filter{}, true},
+		{"hostname", &Filter{Hostname: "web-0"}, true},
+		{"hostname glob", &Filter{Hostname: "web-*"}, true},
+		{"hostname glob miss", &Filter{Hostname: "db-*"}, false},
+		{"os", &Filter{OS: "linux"}, true},
+		{"ip", &Filter{IP: "10.0.0.5"}, true},
+		{"cidr", &Filter{IP: "10.0.0.0/24"}, true},
+		{"cidr miss", &Filter{IP: "10.1.0.0/24"}, false},
+		{"mac", &Filter{MAC: "00:11:22:33:44:55"}, true},
+		{"tag", &Filter{Tags: map[string]string{"role": "victim"}}, true},
+		{"tag miss", &Filter{Tags: map[string]string{"role": "server"}}, false},
+		{"and", &Filter{OS: "linux", Hostname: "web-*", Tags: map[string]string{"role": "victim"}}, true},
+		{"and miss", &Filter{OS: "windows", Hostname: "web-*"}, false},
+	}
+
+	for _, tt := range tests {
+		if got := c.Matches(tt.filter); got != tt.want {
+			t.Errorf("%v: got %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+// TestFilterHost checks matching on the server-side host field, which lives
+// on the client wrapper rather than the shared Client struct.
+func TestFilterHost(t *testing.T) {
+	c := &client{
+		Client: &Client{UUID: "uuid-0", Hostname: "web-0"},
+		host:   "node5",
+	}
+
+	tests := []struct {
+		name   string
+		filter *Filter
+		want   bool
+	}{
+		{"host", &Filter{Host: "node5"}, true},
+		{"host glob", &Filter{Host: "node*"}, true},
+		{"host miss", &Filter{Host: "node6"}, false},
+		{"host and hostname", &Filter{Host: "node5", Hostname: "web-*"}, true},
+		{"host and hostname miss", &Filter{Host: "node5", Hostname: "db-*"}, false},
+	}
+
+	for _, tt := range tests {
+		if got := c.matches(tt.filter); got != tt.want {
+			t.Errorf("%v: got %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+// newTestClient returns a connected test client whose outgoing messages are
+// recorded in the returned buffer.
+func newTestClient(uuid, hostname, os string) (*client, *bytes.Buffer) {
+	var buf bytes.Buffer
+
+	return &client{
+		Client: &Client{UUID: uuid, Hostname: hostname, OS: os},
+		enc:    gob.NewEncoder(&buf),
+	}, &buf
+}
+
+// TestFilterLateCheckin queues a filtered command before any clients exist and
+// then checks that a matching client that arrives later still receives it.
+func TestFilterLateCheckin(t *testing.T) {
+	s := &Server{
+		clients:  make(map[string]*client),
+		commands: make(map[int]*Command),
+	}
+
+	s.commandCounter = 1
+	s.commands[1] = &Command{
+		ID:      1,
+		Command: []string{"touch", "foo"},
+		Filter:  &Filter{OS: "linux", Hostname: "web-*"},
+	}
+
+	// no clients yet, shouldn't panic
+	s.sendCommands("")
+
+	// a matching and a non-matching client check in after the command was
+	// queued
+	match, matchBuf := newTestClient("uuid-0", "web-0", "linux")
+	miss, missBuf := newTestClient("uuid-1", "db-0", "linux")
+
+	s.clients[match.UUID] = match
+	s.clients[miss.UUID] = miss
+
+	s.sendCommands("")
+
+	var m Message
+	if err := gob.NewDecoder(matchBuf).Decode(&m); err != nil {
+		t.Fatalf("matching client received no message: %v", err)
+	}
+	if _, ok := m.Commands[1]; !ok {
+		t.Fatalf("matching client missing command: %v", m.Commands)
+	}
+
+	if missBuf.Len() != 0 {
+		t.Errorf("non-matching client received %v bytes", missBuf.Len())
+	}
+
+	// the command should not be sent to the matching client again
+	matchBuf.Reset()
+	s.sendCommands("")
+
+	if matchBuf.Len() != 0 {
+		t.Errorf("matching client received command twice")
+	}
+}
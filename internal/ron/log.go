@@ -0,0 +1,47 @@
+// Copyright 2015-2021 National Technology & Engineering Solutions of Sandia, LLC (NTESS).
+// Under the terms of Contract DE-NA0003525 with NTESS, the U.S. Government retains certain
+// rights in this software.
+
+package ron
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// LOG_ROTATE_SIZE is the size at which a forwarded client log file is rotated.
+// One previous generation is kept as <uuid>.log.1.
+const LOG_ROTATE_SIZE = 10 << 20
+
+// logPath returns the directory that forwarded client logs are recorded in.
+func (s *Server) logPath() string {
+	return filepath.Join(s.path, s.subpath, LOG_PATH)
+}
+
+// writeClientLog appends forwarded log lines from a client to that client's
+// log file under logPath, rotating the file by size. When the client's rate
+// limit dropped lines since the last message, a marker noting how many is
+// recorded in their place.
+func (s *Server) writeClientLog(uuid string, lines []string, dropped int64) error {
+	dir := s.logPath()
+	if err := os.MkdirAll(dir, os.FileMode(0770)); err != nil {
+		return err
+	}
+
+	fpath := filepath.Join(dir, uuid+".log")
+
+	if fi, err := os.Stat(fpath); err == nil && fi.Size() >= LOG_ROTATE_SIZE {
+		if err := os.Rename(fpath, fpath+".1"); err != nil {
+			return err
+		}
+	}
+
+	data := strings.Join(lines, "")
+	if dropped > 0 {
+		data += fmt.Sprintf("-- dropped %v log lines --\n", dropped)
+	}
+
+	return appendFile(fpath, data)
+}
@@ -0,0 +1,67 @@
+// Copyright 2015-2021 National Technology & Engineering Solutions of Sandia, LLC (NTESS).
+// Under the terms of Contract DE-NA0003525 with NTESS, the U.S. Government retains certain
+// rights in this software.
+
+package ron
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestWriteClientLog(t *testing.T) {
+	s, cleanup := newTestServer(t)
+	defer cleanup()
+
+	if err := s.writeClientLog("foo", []string{"one\n", "two\n"}, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.writeClientLog("foo", []string{"three\n"}, 3); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := ioutil.ReadFile(filepath.Join(s.logPath(), "foo.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := "one\ntwo\nthree\n-- dropped 3 log lines --\n"
+	if string(data) != want {
+		t.Errorf("got %q, want %q", string(data), want)
+	}
+}
+
+func TestWriteClientLogRotate(t *testing.T) {
+	s, cleanup := newTestServer(t)
+	defer cleanup()
+
+	// fill the log past the rotation size, then write once more
+	big := strings.Repeat("x", LOG_ROTATE_SIZE) + "\n"
+	if err := s.writeClientLog("foo", []string{big}, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.writeClientLog("foo", []string{"fresh\n"}, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	fpath := filepath.Join(s.logPath(), "foo.log")
+
+	data, err := ioutil.ReadFile(fpath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "fresh\n" {
+		t.Errorf("expected rotated log to hold only the new line, got %v bytes", len(data))
+	}
+
+	fi, err := os.Stat(fpath + ".1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Size() != int64(len(big)) {
+		t.Errorf("previous generation is %v bytes, want %v", fi.Size(), len(big))
+	}
+}
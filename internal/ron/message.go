@@ -4,6 +4,8 @@
 
 package ron
 
+import "time"
+
 type Type int
 
 // Message types to inform the mux on either end how to route the message
@@ -15,6 +17,7 @@ const (
 	MESSAGE_PIPE
 	MESSAGE_UFS
 	MESSAGE_HEARTBEAT
+	MESSAGE_LOG
 )
 
 // Pipe modes
@@ -24,6 +27,7 @@ const (
 	PIPE_CLOSE_READER
 	PIPE_CLOSE_WRITER
 	PIPE_DATA
+	PIPE_CREDIT
 )
 
 // UFS modes
@@ -41,6 +45,12 @@ type Message struct {
 	// MESSAGE_COMMAND
 	Commands map[int]*Command
 
+	// CommandAck explicitly acknowledges receipt of the listed commands.
+	// Newer clients send it as soon as a command message arrives, ahead of
+	// any response, so the server can tell delivered-but-silent clients
+	// from ones that never got the command.
+	CommandAck []int
+
 	// MESSAGE_CLIENT
 	Client *Client
 
@@ -55,9 +65,39 @@ type Message struct {
 	PipeMode int
 	PipeData string
 
+	// PipeCredit grants the peer a window of PIPE_DATA messages it may send
+	// on Pipe, see PIPE_WINDOW. Sent with PIPE_CREDIT.
+	PipeCredit int
+
+	// MESSAGE_LOG: forwarded client log lines and how many more were
+	// dropped by the client's rate limit since the last message
+	Log        []string
+	LogDropped int64
+
 	// MESSAGE_UFS
 	UfsMode int
 
+	// UfsWritable is sent with UFS_OPEN to request a writable filesystem.
+	// Clients serve a read-only filesystem when it is unset, including for
+	// servers that predate the field.
+	UfsWritable bool
+
+	// Compressed is set when the message's payloads (file data, pipe data,
+	// and command output) have been compressed, see Compress. Only sent to
+	// peers whose message version supports it.
+	Compressed bool
+
+	// HeartbeatRate is the check-in interval the server wants clients to
+	// use. Sent in the handshake ACK and in server heartbeats so that
+	// runtime changes propagate; clients ignore a zero value.
+	HeartbeatRate time.Duration
+
+	// ServerTime is the server's clock when the message was sent. Carried
+	// on the handshake ACK and server heartbeats so clients can compensate
+	// for clock skew when running scheduled commands (see Command.At). Zero
+	// for servers that predate schedules.
+	ServerTime time.Time
+
 	// version of message
 	// (initially added to help determine if server should send periodic
 	// heartbeats to client in support of serial reconnect)
@@ -80,6 +120,8 @@ func (t Type) String() string {
 		return "UFS"
 	case MESSAGE_HEARTBEAT:
 		return "HEARTBEAT"
+	case MESSAGE_LOG:
+		return "LOG"
 	}
 
 	return "UNKNOWN"
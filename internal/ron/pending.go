@@ -0,0 +1,124 @@
+// Copyright 2015-2021 National Technology & Engineering Solutions of Sandia, LLC (NTESS).
+// Under the terms of Contract DE-NA0003525 with NTESS, the U.S. Government retains certain
+// rights in this software.
+
+package ron
+
+import (
+	"encoding/gob"
+	"os"
+	"path/filepath"
+	"time"
+
+	log "github.com/sandia-minimega/minimega/v2/pkg/minilog"
+)
+
+// COMMAND_MAX_AGE caps how long a command stays queued for clients that have
+// not received it. A client that reconnects later than this -- or never --
+// shows an "expired" delivery state instead of being sent a stale command.
+const COMMAND_MAX_AGE = time.Hour
+
+// commandsFile is where the active command list is persisted, under the
+// namespace runtime path, so queued commands survive a server restart.
+const commandsFile = "commands.gob"
+
+// persistedCommands is the on-disk snapshot of the command state.
+type persistedCommands struct {
+	Counter  int
+	Commands map[int]*Command
+
+	// Sent records which clients each command has been delivered to, so
+	// run-once commands are not redelivered after a restart
+	Sent map[int][]string
+}
+
+// commandsPath returns the file the active command list is persisted in.
+func (s *Server) commandsPath() string {
+	return filepath.Join(s.path, s.subpath, commandsFile)
+}
+
+// saveCommands persists the active command list so that commands queued for
+// disconnected clients survive a server restart. Must be called with the
+// command lock held.
+func (s *Server) saveCommands() {
+	p := persistedCommands{
+		Counter:  s.commandCounter,
+		Commands: s.commands,
+		Sent:     make(map[int][]string),
+	}
+
+	s.deliveryLock.Lock()
+	for id, d := range s.deliveries {
+		for uuid, st := range d.states {
+			if st >= DELIVERY_SENT && st < DELIVERY_FAILED {
+				p.Sent[id] = append(p.Sent[id], uuid)
+			}
+		}
+	}
+	s.deliveryLock.Unlock()
+
+	fpath := s.commandsPath()
+
+	f, err := os.OpenFile(fpath+".tmp", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, os.FileMode(0660))
+	if err != nil {
+		log.Error("could not persist commands: %v", err)
+		return
+	}
+
+	if err := gob.NewEncoder(f).Encode(&p); err != nil {
+		log.Error("could not persist commands: %v", err)
+		f.Close()
+		os.Remove(fpath + ".tmp")
+		return
+	}
+	f.Close()
+
+	if err := os.Rename(fpath+".tmp", fpath); err != nil {
+		log.Error("could not persist commands: %v", err)
+	}
+}
+
+// loadCommands restores the persisted command list, if any, including which
+// clients each command had been delivered to. Called before the server starts
+// accepting connections.
+func (s *Server) loadCommands() {
+	f, err := os.Open(s.commandsPath())
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Error("could not restore commands: %v", err)
+		}
+		return
+	}
+	defer f.Close()
+
+	var p persistedCommands
+
+	if err := gob.NewDecoder(f).Decode(&p); err != nil {
+		log.Error("could not restore commands: %v", err)
+		return
+	}
+
+	s.commandLock.Lock()
+	defer s.commandLock.Unlock()
+
+	s.commandCounter = p.Counter
+	for id, c := range p.Commands {
+		s.commands[id] = c
+	}
+
+	for id, uuids := range p.Sent {
+		for _, uuid := range uuids {
+			s.markSent(id, uuid)
+		}
+	}
+
+	log.Info("restored %v queued commands", len(p.Commands))
+}
+
+// clearSavedCommands removes the persisted command list, for use when the
+// command list is cleared.
+func (s *Server) clearSavedCommands() {
+	if err := os.Remove(s.commandsPath()); err != nil && !os.IsNotExist(err) {
+		log.Error("could not remove persisted commands: %v", err)
+	}
+}
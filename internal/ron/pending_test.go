@@ -0,0 +1,159 @@
+// Copyright 2015-2021 National Technology & Engineering Solutions of Sandia, LLC (NTESS).
+// Under the terms of Contract DE-NA0003525 with NTESS, the U.S. Government retains certain
+// rights in this software.
+
+package ron
+
+import (
+	"encoding/gob"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+// TestCommandBounce simulates a client disconnecting during a burst of
+// commands and checks that everything queued while it was away is delivered
+// when it reconnects.
+func TestCommandBounce(t *testing.T) {
+	s := &Server{
+		clients:  make(map[string]*client),
+		commands: make(map[int]*Command),
+	}
+
+	s.commandCounter = 1
+	s.commands[1] = &Command{ID: 1, Command: []string{"touch", "a"}}
+
+	c, buf := newTestClient("uuid-0", "web-0", "linux")
+	s.clients[c.UUID] = c
+
+	s.sendCommands("")
+
+	var m Message
+	if err := gob.NewDecoder(buf).Decode(&m); err != nil {
+		t.Fatalf("client received no message: %v", err)
+	}
+	if _, ok := m.Commands[1]; !ok {
+		t.Fatalf("client missing command 1: %v", m.Commands)
+	}
+
+	// the client disconnects mid-burst
+	delete(s.clients, c.UUID)
+
+	s.commandCounter = 3
+	s.commands[2] = &Command{ID: 2, Command: []string{"touch", "b"}}
+	s.commands[3] = &Command{ID: 3, Command: []string{"touch", "c"}}
+
+	// no clients connected, shouldn't panic
+	s.sendCommands("")
+
+	// the client reconnects with a fresh command cursor
+	c, buf = newTestClient("uuid-0", "web-0", "linux")
+	s.clients[c.UUID] = c
+
+	s.sendCommands("")
+
+	m = Message{}
+	if err := gob.NewDecoder(buf).Decode(&m); err != nil {
+		t.Fatalf("reconnected client received no message: %v", err)
+	}
+	for _, id := range []int{1, 2, 3} {
+		if _, ok := m.Commands[id]; !ok {
+			t.Errorf("reconnected client missing command %v: %v", id, m.Commands)
+		}
+	}
+}
+
+// TestCommandExpiry checks that a command older than COMMAND_MAX_AGE is not
+// delivered to a client that never received it and shows up as expired.
+func TestCommandExpiry(t *testing.T) {
+	s := &Server{
+		clients:  make(map[string]*client),
+		commands: make(map[int]*Command),
+	}
+
+	s.commandCounter = 1
+	s.commands[1] = &Command{
+		ID:      1,
+		Command: []string{"touch", "a"},
+		Created: time.Now().Add(-2 * COMMAND_MAX_AGE),
+	}
+
+	c, buf := newTestClient("uuid-0", "web-0", "linux")
+	s.clients[c.UUID] = c
+
+	s.sendCommands("")
+
+	if buf.Len() != 0 {
+		t.Errorf("client received %v bytes for an expired command", buf.Len())
+	}
+
+	status, err := s.DeliveryStatus(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := status[c.UUID]; got != DELIVERY_EXPIRED {
+		t.Errorf("got state %v, want %v", got, DELIVERY_EXPIRED)
+	}
+}
+
+// TestCommandPersistence round-trips the command list through the persisted
+// snapshot, including the run-once delivery state.
+func TestCommandPersistence(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ron")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	s1 := &Server{
+		path:     dir,
+		clients:  make(map[string]*client),
+		commands: make(map[int]*Command),
+	}
+
+	s1.commandLock.Lock()
+	s1.commandCounter = 2
+	s1.commands[1] = &Command{
+		ID:      1,
+		Once:    true,
+		Command: []string{"touch", "a"},
+		Created: time.Now(),
+	}
+	s1.commands[2] = &Command{
+		ID:      2,
+		Command: []string{"touch", "b"},
+		Created: time.Now(),
+	}
+	s1.markSent(1, "uuid-0")
+	s1.saveCommands()
+	s1.commandLock.Unlock()
+
+	// a fresh server on the same path picks up where the old one left off
+	s2 := &Server{
+		path:     dir,
+		clients:  make(map[string]*client),
+		commands: make(map[int]*Command),
+	}
+	s2.loadCommands()
+
+	if s2.commandCounter != 2 {
+		t.Errorf("got counter %v, want 2", s2.commandCounter)
+	}
+	if len(s2.commands) != 2 {
+		t.Fatalf("got %v commands, want 2", len(s2.commands))
+	}
+	if !s2.sentTo(1, "uuid-0") {
+		t.Errorf("run-once delivery state not restored")
+	}
+	if s2.sentTo(2, "uuid-0") {
+		t.Errorf("command 2 incorrectly marked sent")
+	}
+
+	// clearing drops the persisted copy too
+	s2.ClearCommands()
+
+	if _, err := os.Stat(s2.commandsPath()); !os.IsNotExist(err) {
+		t.Errorf("persisted commands not removed on clear: %v", err)
+	}
+}
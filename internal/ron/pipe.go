@@ -0,0 +1,68 @@
+// Copyright 2015-2021 National Technology & Engineering Solutions of Sandia, LLC (NTESS).
+// Under the terms of Contract DE-NA0003525 with NTESS, the U.S. Government retains certain
+// rights in this software.
+
+package ron
+
+import "sync"
+
+// PIPE_WINDOW is the number of pipe messages a receiver is prepared to buffer
+// per pipe. The receiving side grants this window when a pipe is announced
+// and replenishes it one message at a time as data drains to its readers.
+const PIPE_WINDOW = 64
+
+// PipeSender gates outgoing PIPE_DATA messages on credit granted by the
+// receiving side. Credit starts at zero; the receiver grants an initial
+// window and replenishes it as data drains, so a writer feeding a slow reader
+// blocks in Acquire instead of ballooning buffers in the multiplexed
+// connection. Data sent to peers that predate flow control (see
+// SupportsPipeCredits) is not gated.
+type PipeSender struct {
+	mu     sync.Mutex
+	cond   *sync.Cond
+	credit int
+	closed bool
+}
+
+func NewPipeSender() *PipeSender {
+	s := &PipeSender{}
+	s.cond = sync.NewCond(&s.mu)
+
+	return s
+}
+
+// Grant adds credit for n more messages, waking any blocked Acquire.
+func (s *PipeSender) Grant(n int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.credit += n
+	s.cond.Broadcast()
+}
+
+// Acquire blocks until credit for one message is available. Returns false if
+// the sender was closed, in which case the message should be dropped.
+func (s *PipeSender) Acquire() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for s.credit == 0 && !s.closed {
+		s.cond.Wait()
+	}
+
+	if s.closed {
+		return false
+	}
+
+	s.credit--
+	return true
+}
+
+// Close releases any blocked Acquire. Safe to call more than once.
+func (s *PipeSender) Close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.closed = true
+	s.cond.Broadcast()
+}
@@ -0,0 +1,95 @@
+// Copyright 2015-2021 National Technology & Engineering Solutions of Sandia, LLC (NTESS).
+// Under the terms of Contract DE-NA0003525 with NTESS, the U.S. Government retains certain
+// rights in this software.
+
+package ron
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// TestPipeSenderBackpressure pumps data through a deliberately slow reader and
+// checks that the amount in flight never exceeds the granted window, i.e. a
+// fast writer can't balloon buffers ahead of a slow reader.
+func TestPipeSenderBackpressure(t *testing.T) {
+	const messages = 10 * PIPE_WINDOW
+
+	ps := NewPipeSender()
+
+	// inFlight counts messages acquired by the writer but not yet drained by
+	// the reader -- the buffering flow control is meant to bound
+	var inFlight int64
+	var peak int64
+
+	q := make(chan struct{}, messages)
+
+	go func() {
+		for i := 0; i < messages; i++ {
+			if !ps.Acquire() {
+				return
+			}
+
+			n := atomic.AddInt64(&inFlight, 1)
+			for {
+				p := atomic.LoadInt64(&peak)
+				if n <= p || atomic.CompareAndSwapInt64(&peak, p, n) {
+					break
+				}
+			}
+
+			q <- struct{}{}
+		}
+		close(q)
+	}()
+
+	// the slow reader: grant the initial window, then replenish one credit
+	// per message drained, as the receiving side does
+	ps.Grant(PIPE_WINDOW)
+
+	for range q {
+		time.Sleep(100 * time.Microsecond)
+		atomic.AddInt64(&inFlight, -1)
+		ps.Grant(1)
+	}
+
+	if p := atomic.LoadInt64(&peak); p > PIPE_WINDOW {
+		t.Errorf("writer ran %v messages ahead of the reader, window is %v", p, PIPE_WINDOW)
+	}
+}
+
+// TestPipeSenderClose checks that closing the sender releases a writer blocked
+// waiting for credit, as happens when a pipe's last reader goes away.
+func TestPipeSenderClose(t *testing.T) {
+	ps := NewPipeSender()
+
+	done := make(chan bool)
+	go func() {
+		done <- ps.Acquire()
+	}()
+
+	// the writer has no credit, so it must be blocked
+	select {
+	case <-done:
+		t.Fatal("Acquire returned without credit")
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	ps.Close()
+
+	select {
+	case ok := <-done:
+		if ok {
+			t.Error("Acquire succeeded on a closed sender")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Acquire still blocked after Close")
+	}
+
+	// Close is idempotent and Acquire keeps failing
+	ps.Close()
+	if ps.Acquire() {
+		t.Error("Acquire succeeded on a closed sender")
+	}
+}
@@ -0,0 +1,109 @@
+// Copyright 2015-2021 National Technology & Engineering Solutions of Sandia, LLC (NTESS).
+// Under the terms of Contract DE-NA0003525 with NTESS, the U.S. Government retains certain
+// rights in this software.
+
+package ron
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+
+	log "github.com/sandia-minimega/minimega/v2/pkg/minilog"
+)
+
+// Default quotas on files received from clients, in bytes: per file and total
+// per client. A quota of zero is unlimited. These guard the host filesystem
+// against a buggy or malicious guest responding with arbitrarily large data.
+const (
+	RECV_QUOTA_FILE   = 100 << 20
+	RECV_QUOTA_CLIENT = 1 << 30
+)
+
+// SetRecvQuotas sets the per-file and per-client byte quotas for files
+// received from clients. Zero is unlimited. Raising a quota at runtime allows
+// clients to retry transfers that were previously rejected.
+func (s *Server) SetRecvQuotas(file, client int64) error {
+	if file < 0 || client < 0 {
+		return fmt.Errorf("invalid quota: %v / %v", file, client)
+	}
+
+	atomic.StoreInt64(&s.recvFileQuota, file)
+	atomic.StoreInt64(&s.recvClientQuota, client)
+	return nil
+}
+
+// RecvQuotas returns the per-file and per-client byte quotas.
+func (s *Server) RecvQuotas() (file, client int64) {
+	return atomic.LoadInt64(&s.recvFileQuota), atomic.LoadInt64(&s.recvClientQuota)
+}
+
+// RecvQuotaViolations returns the number of transfers from clients that have
+// been rejected over quota.
+func (s *Server) RecvQuotaViolations() int64 {
+	return atomic.LoadInt64(&s.recvViolations)
+}
+
+// recvFile records a file chunk sent by a client under the per-client
+// response directory, enforcing the receive quotas. Chunks of a transfer that
+// goes over quota are discarded as they arrive rather than reassembled, the
+// partial file is removed, and the rejection is logged and counted.
+func (s *Server) recvFile(uuid string, f *File) error {
+	fpath := filepath.Join(s.responsePath(&f.ID), uuid, f.Name)
+
+	if !s.admitChunk(uuid, f) {
+		// drop the in-flight record and anything reassembled so far
+		s.updateFileTransfer(uuid, f.Name, "recv", 0, 0, true)
+		os.Remove(fpath + ".partial")
+		os.Remove(fpath)
+		return nil
+	}
+
+	s.updateFileTransfer(uuid, f.Name, "recv", f.Offset+int64(len(f.Data)), f.Size, f.EOF)
+
+	return f.Recv(fpath)
+}
+
+// admitChunk charges a chunk against the receive quotas, returning whether it
+// should be written. Once a transfer has been rejected, its remaining chunks
+// are dropped without further accounting.
+func (s *Server) admitChunk(uuid string, f *File) bool {
+	n := int64(len(f.Data))
+
+	s.quotaLock.Lock()
+	defer s.quotaLock.Unlock()
+
+	key := uuid + "/" + f.Name
+
+	if s.recvRejected[key] {
+		// remainder of an already rejected transfer
+		if f.EOF {
+			delete(s.recvRejected, key)
+		}
+		return false
+	}
+
+	fileQuota := atomic.LoadInt64(&s.recvFileQuota)
+	clientQuota := atomic.LoadInt64(&s.recvClientQuota)
+
+	var over string
+	if fileQuota > 0 && f.Offset+n > fileQuota {
+		over = fmt.Sprintf("file quota (%v bytes)", fileQuota)
+	} else if clientQuota > 0 && s.recvBytes[uuid]+n > clientQuota {
+		over = fmt.Sprintf("client quota (%v bytes)", clientQuota)
+	}
+
+	if over != "" {
+		log.Warn("rejecting file %v from %v: exceeds %v", f.Name, uuid, over)
+
+		if !f.EOF {
+			s.recvRejected[key] = true
+		}
+		atomic.AddInt64(&s.recvViolations, 1)
+		return false
+	}
+
+	s.recvBytes[uuid] += n
+	return true
+}
@@ -0,0 +1,118 @@
+// Copyright 2015-2021 National Technology & Engineering Solutions of Sandia, LLC (NTESS).
+// Under the terms of Contract DE-NA0003525 with NTESS, the U.S. Government retains certain
+// rights in this software.
+
+package ron
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// sendChunks streams a payload to the server as fixed-size file chunks, the
+// way a client would.
+func sendChunks(t *testing.T, s *Server, uuid, name string, payload []byte, chunk int) {
+	t.Helper()
+
+	for off := 0; off < len(payload); off += chunk {
+		end := off + chunk
+		if end > len(payload) {
+			end = len(payload)
+		}
+
+		f := &File{
+			ID:     1,
+			Name:   name,
+			Perm:   0660,
+			Data:   payload[off:end],
+			Offset: int64(off),
+			Size:   int64(len(payload)),
+			EOF:    end == len(payload),
+		}
+
+		if err := s.recvFile(uuid, f); err != nil {
+			t.Fatalf("recvFile: %v", err)
+		}
+	}
+}
+
+// TestRecvFileQuota streams a payload past the per-file quota and checks that
+// nothing is left on disk, the in-flight record is dropped, and the rejection
+// is counted, while a file within quota is still accepted.
+func TestRecvFileQuota(t *testing.T) {
+	s, cleanup := newTestServer(t)
+	defer cleanup()
+
+	if err := s.SetRecvQuotas(16, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	sendChunks(t, s, "uuid-0", "big", make([]byte, 64), 8)
+
+	id := 1
+	fpath := filepath.Join(s.responsePath(&id), "uuid-0", "big")
+	for _, p := range []string{fpath, fpath + ".partial"} {
+		if _, err := os.Stat(p); err == nil {
+			t.Errorf("over-quota payload left on disk: %v", p)
+		}
+	}
+
+	if n := len(s.GetFileTransfers()); n != 0 {
+		t.Errorf("got %v in-flight transfers, want 0", n)
+	}
+
+	if v := s.RecvQuotaViolations(); v != 1 {
+		t.Errorf("got %v violations, want 1", v)
+	}
+
+	// a small file still fits
+	sendChunks(t, s, "uuid-0", "small", []byte("hello"), 8)
+
+	fpath = filepath.Join(s.responsePath(&id), "uuid-0", "small")
+	if data, err := ioutil.ReadFile(fpath); err != nil || string(data) != "hello" {
+		t.Errorf("small file not recorded: %v %q", err, data)
+	}
+}
+
+// TestRecvClientQuota checks the cumulative per-client quota and that raising
+// it at runtime allows a retry to succeed.
+func TestRecvClientQuota(t *testing.T) {
+	s, cleanup := newTestServer(t)
+	defer cleanup()
+
+	if err := s.SetRecvQuotas(0, 20); err != nil {
+		t.Fatal(err)
+	}
+
+	sendChunks(t, s, "uuid-0", "first", make([]byte, 16), 8)
+	sendChunks(t, s, "uuid-0", "second", make([]byte, 16), 8)
+
+	id := 1
+	fpath := filepath.Join(s.responsePath(&id), "uuid-0", "second")
+	if _, err := os.Stat(fpath); err == nil {
+		t.Error("second file accepted over client quota")
+	}
+	if v := s.RecvQuotaViolations(); v != 1 {
+		t.Errorf("got %v violations, want 1", v)
+	}
+
+	// another client has its own allowance
+	sendChunks(t, s, "uuid-1", "first", make([]byte, 16), 8)
+	fpath = filepath.Join(s.responsePath(&id), "uuid-1", "first")
+	if _, err := os.Stat(fpath); err != nil {
+		t.Errorf("other client's file rejected: %v", err)
+	}
+
+	// raising the quota lets the client retry
+	if err := s.SetRecvQuotas(0, 100); err != nil {
+		t.Fatal(err)
+	}
+
+	sendChunks(t, s, "uuid-0", "second", make([]byte, 16), 8)
+	fpath = filepath.Join(s.responsePath(&id), "uuid-0", "second")
+	if _, err := os.Stat(fpath); err != nil {
+		t.Errorf("retry after raising quota rejected: %v", err)
+	}
+}
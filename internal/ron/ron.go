@@ -7,6 +7,7 @@ package ron
 import (
 	"regexp"
 	"strings"
+	"time"
 
 	log "github.com/sandia-minimega/minimega/v2/pkg/minilog"
 )
@@ -16,12 +17,29 @@ const (
 	REAPER_RATE           = 30
 	CLIENT_RECONNECT_RATE = 5
 	CLIENT_EXPIRED        = 30
-	RESPONSE_PATH         = "miniccc_responses"
+	// SERIAL_BACKOFF_MAX caps the exponential backoff between serial redial
+	// attempts, in seconds
+	SERIAL_BACKOFF_MAX = 60
+	RESPONSE_PATH      = "miniccc_responses"
+	LOG_PATH           = "miniccc_logs"
 )
 
 type Process struct {
+	// ID is a client-assigned identifier for the process, stable across
+	// check-ins
+	ID int
+
 	PID     int
 	Command []string
+
+	// Started is when the client launched the process
+	Started time.Time
+
+	// Exited and ExitCode report a process that has exited on its own. Such
+	// processes appear in exactly one check-in and then disappear from the
+	// client's process list.
+	Exited   bool
+	ExitCode int
 }
 
 type VM interface {
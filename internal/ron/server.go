@@ -31,6 +31,12 @@ type Server struct {
 	// UseVMs controls whether ron uses VM callbacks or not (see ron.VM)
 	UseVMs bool
 
+	// StaleHandler, if set, is called whenever a client that belongs to a
+	// registered VM misses several check-ins in a row. It is called again
+	// only if the client recovers and goes stale a second time. Called
+	// without any server locks held.
+	StaleHandler func(vm VM)
+
 	// conns stores connected but not necessarily active connections. Includes
 	// serial connections.
 	conns map[string]net.Conn
@@ -50,9 +56,29 @@ type Server struct {
 	// commandLock synchronizes access to commands and commandCounter
 	commandLock sync.Mutex
 
+	// deliveries tracks, per command ID, each client's delivery state (see
+	// DeliveryState). Entries are removed when the corresponding command is
+	// deleted.
+	deliveries map[int]*delivery
+	// deliveryLock synchronizes access to deliveries
+	deliveryLock sync.Mutex
+
 	clients    map[string]*client // map of active clients, each of which have a running handler
 	vms        map[string]VM      // map of uuid -> VM
-	clientLock sync.Mutex         // lock for clients and vms
+	clientLock sync.Mutex         // lock for clients, vms, reconnects, and checkinWaiters
+
+	// reconnects counts, per client UUID, how many times a client has
+	// reattached after its first connection. Entries for VM-backed clients
+	// are removed when the VM is unregistered.
+	reconnects map[string]int
+
+	// checkinWaiters stores channels to close the next time a client with the
+	// matching UUID checks in, keyed by UUID
+	checkinWaiters map[string][]chan bool
+
+	// hostname of the machine the server is running on, matched against
+	// Filter.Host for VM-backed clients
+	hostname string
 
 	path string // path for serving files
 
@@ -65,6 +91,49 @@ type Server struct {
 
 	responses chan *Client // queue of incoming responses, consumed by the response processor
 
+	// streams stores in-progress output streams from clients that stream
+	// command output (see Client.Streaming), keyed by command ID and client
+	// UUID
+	streams map[streamKey]*stream
+	// streamLock synchronizes access to streams
+	streamLock sync.Mutex
+
+	// fileTransfers stores in-progress file transfers to and from clients
+	fileTransfers map[string]*FileTransfer
+	// fileTransferLock synchronizes access to fileTransfers
+	fileTransferLock sync.Mutex
+
+	// recvFileQuota and recvClientQuota bound files received from clients,
+	// in bytes, accessed atomically; zero is unlimited (see recvFile)
+	recvFileQuota   int64
+	recvClientQuota int64
+	// recvBytes counts bytes accepted from each client and recvRejected
+	// marks in-flight transfers that have been rejected over quota
+	recvBytes    map[string]int64
+	recvRejected map[string]bool
+	// recvViolations counts rejected transfers, accessed atomically
+	recvViolations int64
+	// quotaLock synchronizes access to recvBytes and recvRejected
+	quotaLock sync.Mutex
+
+	// respIndex groups recorded responses by distinct output, per command,
+	// updated as responses arrive (see GetResponseGroups)
+	respIndex map[int]*responseIndex
+	// respIndexLock synchronizes access to respIndex
+	respIndexLock sync.Mutex
+
+	// chunkSize is the file transfer chunk size in bytes, accessed
+	// atomically
+	chunkSize int64
+
+	// heartbeatRate is the client check-in interval in nanoseconds,
+	// accessed atomically
+	heartbeatRate int64
+
+	// compressionStats counts payload bytes before and after compression,
+	// fields accessed atomically
+	compressionStats CompressionStats
+
 	plumber *miniplumber.Plumber
 
 	// set to non-zero value by Server.Destroy
@@ -75,23 +144,41 @@ type Server struct {
 // start accepting connections from clients.
 func NewServer(path, subpath string, plumber *miniplumber.Plumber) (*Server, error) {
 	s := &Server{
-		UseVMs:        true,
-		conns:         make(map[string]net.Conn),
-		listeners:     make(map[string]net.Listener),
-		commands:      make(map[int]*Command),
-		clients:       make(map[string]*client),
-		vms:           make(map[string]VM),
-		path:          path,
-		subpath:       subpath,
-		lastBroadcast: time.Now(),
-		responses:     make(chan *Client, 1024),
-		plumber:       plumber,
+		UseVMs:          true,
+		conns:           make(map[string]net.Conn),
+		listeners:       make(map[string]net.Listener),
+		commands:        make(map[int]*Command),
+		deliveries:      make(map[int]*delivery),
+		clients:         make(map[string]*client),
+		vms:             make(map[string]VM),
+		reconnects:      make(map[string]int),
+		checkinWaiters:  make(map[string][]chan bool),
+		path:            path,
+		subpath:         subpath,
+		lastBroadcast:   time.Now(),
+		responses:       make(chan *Client, 1024),
+		streams:         make(map[streamKey]*stream),
+		fileTransfers:   make(map[string]*FileTransfer),
+		respIndex:       make(map[int]*responseIndex),
+		recvBytes:       make(map[string]int64),
+		recvRejected:    make(map[string]bool),
+		recvFileQuota:   RECV_QUOTA_FILE,
+		recvClientQuota: RECV_QUOTA_CLIENT,
+		chunkSize:       PART_SIZE,
+		heartbeatRate:   int64(HEARTBEAT_RATE * time.Second),
+		plumber:         plumber,
 	}
 
+	s.hostname, _ = os.Hostname()
+
 	if err := os.MkdirAll(s.responsePath(nil), 0775); err != nil {
 		return nil, err
 	}
 
+	// restore commands queued before a restart so clients that reconnect
+	// still receive them
+	s.loadCommands()
+
 	go s.responseHandler()
 	go s.clientReaper()
 
@@ -230,6 +317,10 @@ func (s *Server) DialSerial(path, uuid string) error {
 	// Monitor this client connection, reconnecting when the client handler
 	// completes if the VM still exists.
 	go func() {
+		// backoff between redial attempts, reset after a successful
+		// handshake
+		backoff := CLIENT_RECONNECT_RATE * time.Second
+
 		for {
 			s.clientLock.Lock()
 			_, exists := s.vms[uuid]
@@ -250,8 +341,17 @@ func (s *Server) DialSerial(path, uuid string) error {
 
 			conn, err := dial(path)
 			if err != nil {
-				log.Error("dialing serial port %v failed: %v", path, err)
-				return
+				// the socket may be missing while the guest reboots or the
+				// VM is relaunched, so retry rather than giving up
+				log.Error("dialing serial port %v failed (retrying in %v): %v", path, backoff, err)
+
+				time.Sleep(backoff)
+
+				if backoff *= 2; backoff > SERIAL_BACKOFF_MAX*time.Second {
+					backoff = SERIAL_BACKOFF_MAX * time.Second
+				}
+
+				continue
 			}
 
 			cli, err := s.handshake(conn)
@@ -263,6 +363,12 @@ func (s *Server) DialSerial(path, uuid string) error {
 				continue
 			}
 
+			backoff = CLIENT_RECONNECT_RATE * time.Second
+
+			// we know this is a serial connection, even though it looks like
+			// a plain unix socket
+			cli.transport = "serial"
+
 			// This blocks, but will return on a loss of connection to the client.
 			s.clientHandler(cli)
 
@@ -273,6 +379,19 @@ func (s *Server) DialSerial(path, uuid string) error {
 	return nil
 }
 
+// DisconnectSerial closes the server side of a serial connection created via
+// DialSerial, forcing the monitor goroutine to redial. Used when the caller
+// knows the session is stale, such as after a guest reboot.
+func (s *Server) DisconnectSerial(path string) {
+	s.connsLock.Lock()
+	defer s.connsLock.Unlock()
+
+	if conn, ok := s.conns[path]; ok {
+		log.Info("disconnecting serial client: %v", path)
+		conn.Close()
+	}
+}
+
 // CloseUnix closes a unix domain socket created via ListenUnix.
 func (s *Server) CloseUnix(path string) error {
 	log.Info("close UNIX: %v", path)
@@ -304,9 +423,12 @@ func (s *Server) NewCommand(c *Command) int {
 
 	s.commandCounter++
 	c.ID = s.commandCounter
+	c.Created = time.Now()
 
 	s.commands[c.ID] = c
 
+	s.saveCommands()
+
 	go s.sendCommands("")
 	return c.ID
 }
@@ -337,6 +459,89 @@ func (s *Server) GetCommands() map[int]*Command {
 	return res
 }
 
+// FileTransfer describes an in-progress file transfer to or from a client.
+type FileTransfer struct {
+	UUID string // client
+	Name string // name of the file
+	Dir  string // direction, "send" to the client or "recv" from it
+	Sent int64  // bytes transferred so far
+	Size int64  // total size, zero if the peer doesn't report one
+}
+
+// SetChunkSize sets the file transfer chunk size in bytes.
+func (s *Server) SetChunkSize(size int64) error {
+	if size <= 0 {
+		return fmt.Errorf("invalid chunk size: %v", size)
+	}
+
+	atomic.StoreInt64(&s.chunkSize, size)
+	return nil
+}
+
+// ChunkSize returns the file transfer chunk size in bytes.
+func (s *Server) ChunkSize() int64 {
+	return atomic.LoadInt64(&s.chunkSize)
+}
+
+// SetHeartbeatRate sets the interval clients should check in at. The new rate
+// reaches connected clients in the next server heartbeat; clients that are
+// too old to understand it keep checking in at the default rate.
+func (s *Server) SetHeartbeatRate(d time.Duration) error {
+	if d < time.Second {
+		return fmt.Errorf("invalid heartbeat rate: %v", d)
+	}
+
+	atomic.StoreInt64(&s.heartbeatRate, int64(d))
+	return nil
+}
+
+// HeartbeatRate returns the interval clients are asked to check in at.
+func (s *Server) HeartbeatRate() time.Duration {
+	return time.Duration(atomic.LoadInt64(&s.heartbeatRate))
+}
+
+// updateFileTransfer records progress for a transfer, dropping the record
+// once the final chunk has been handled.
+func (s *Server) updateFileTransfer(uuid, name, dir string, sent, size int64, eof bool) {
+	s.fileTransferLock.Lock()
+	defer s.fileTransferLock.Unlock()
+
+	key := fmt.Sprintf("%v/%v/%v", uuid, dir, name)
+
+	if eof {
+		delete(s.fileTransfers, key)
+		return
+	}
+
+	t, ok := s.fileTransfers[key]
+	if !ok {
+		t = &FileTransfer{
+			UUID: uuid,
+			Name: name,
+			Dir:  dir,
+		}
+		s.fileTransfers[key] = t
+	}
+
+	t.Sent = sent
+	t.Size = size
+}
+
+// GetFileTransfers returns a copy of the in-progress file transfers.
+func (s *Server) GetFileTransfers() []*FileTransfer {
+	s.fileTransferLock.Lock()
+	defer s.fileTransferLock.Unlock()
+
+	res := make([]*FileTransfer, 0, len(s.fileTransfers))
+
+	for _, t := range s.fileTransfers {
+		t2 := *t
+		res = append(res, &t2)
+	}
+
+	return res
+}
+
 func (s *Server) GetProcesses(uuid string) ([]*Process, error) {
 	s.clientLock.Lock()
 	defer s.clientLock.Unlock()
@@ -400,6 +605,11 @@ func (s *Server) GetClients() map[string]*Client {
 			Version:       c.Version,
 			Hostname:      c.Hostname,
 			LastCommandID: c.LastCommandID,
+			Streaming:     c.Streaming,
+			Transport:     c.transport,
+			Host:          c.host,
+			Checkin:       c.checkin,
+			Reconnects:    s.reconnects[u],
 			Processes:     make(map[int]*Process),
 		}
 		for _, ip := range c.IPs {
@@ -411,6 +621,43 @@ func (s *Server) GetClients() map[string]*Client {
 		for k, v := range c.Processes {
 			res[u].Processes[k] = v
 		}
+		if c.Inventory != nil {
+			inv := *c.Inventory
+			inv.Users = append([]string(nil), c.Inventory.Users...)
+			res[u].Inventory = &inv
+		}
+	}
+
+	return res
+}
+
+// MatchingClients returns the active clients that currently match the given
+// filter, for previewing who would process a command queued with it. Clients
+// that check in later are matched against command filters as they arrive, so
+// the preview is only a snapshot.
+func (s *Server) MatchingClients(f *Filter) []*Client {
+	s.clientLock.Lock()
+	defer s.clientLock.Unlock()
+
+	var res []*Client
+
+	for _, c := range s.clients {
+		if !c.matches(f) {
+			continue
+		}
+
+		c2 := &Client{
+			UUID:     c.UUID,
+			Arch:     c.Arch,
+			OS:       c.OS,
+			Version:  c.Version,
+			Hostname: c.Hostname,
+			Host:     c.host,
+		}
+		c2.IPs = append(c2.IPs, c.IPs...)
+		c2.MACs = append(c2.MACs, c.MACs...)
+
+		res = append(res, c2)
 	}
 
 	return res
@@ -425,6 +672,24 @@ func (s *Server) HasClient(c string) bool {
 	return ok
 }
 
+// NotifyCheckin returns a channel that is closed the next time a client with
+// the specified UUID checks in. If the client is already active, the channel
+// is closed immediately.
+func (s *Server) NotifyCheckin(uuid string) <-chan bool {
+	s.clientLock.Lock()
+	defer s.clientLock.Unlock()
+
+	ch := make(chan bool)
+
+	if _, ok := s.clients[uuid]; ok {
+		close(ch)
+		return ch
+	}
+
+	s.checkinWaiters[uuid] = append(s.checkinWaiters[uuid], ch)
+	return ch
+}
+
 // Clients returns the number of clients connected to the server.
 func (s *Server) Clients() int {
 	s.clientLock.Lock()
@@ -433,6 +698,28 @@ func (s *Server) Clients() int {
 	return len(s.clients)
 }
 
+// KillCommand creates a command instructing clients that are still running
+// the command with the given ID to kill it. The kill carries the original
+// command's filter; clients that have already completed it (those in its
+// CheckedIn list) ignore the kill.
+func (s *Server) KillCommand(id int) (*Command, error) {
+	s.commandLock.Lock()
+	defer s.commandLock.Unlock()
+
+	if c, ok := s.commands[id]; ok {
+		kill := &Command{KillCID: id}
+
+		if c.Filter != nil {
+			kill.Filter = new(Filter)
+			*kill.Filter = *c.Filter
+		}
+
+		return kill, nil
+	}
+
+	return nil, fmt.Errorf("command %v not found", id)
+}
+
 // DeleteCommand removes a command from the active command list. Any in-flight
 // messages held by any clients may still return a response to the deleted
 // command.
@@ -442,8 +729,16 @@ func (s *Server) DeleteCommand(id int) error {
 	s.commandLock.Lock()
 	defer s.commandLock.Unlock()
 
-	if _, ok := s.commands[id]; ok {
+	if c, ok := s.commands[id]; ok {
 		delete(s.commands, id)
+		s.deleteDelivery(id)
+
+		if c.Scheduled() {
+			s.cancelSchedule(c)
+		}
+
+		s.saveCommands()
+
 		return nil
 	} else {
 		return fmt.Errorf("command %v not found", id)
@@ -463,6 +758,11 @@ func (s *Server) DeleteCommands(prefix string) error {
 		if c.Prefix == prefix {
 			matched = true
 			delete(s.commands, id)
+			s.deleteDelivery(id)
+
+			if c.Scheduled() {
+				s.cancelSchedule(c)
+			}
 		}
 	}
 
@@ -470,9 +770,30 @@ func (s *Server) DeleteCommands(prefix string) error {
 		return fmt.Errorf("no such prefix: `%v`", s)
 	}
 
+	s.saveCommands()
+
 	return nil
 }
 
+// cancelSchedule queues a kill for a deleted scheduled command so that
+// clients cancel any pending runs. Must be called with the command lock held.
+func (s *Server) cancelSchedule(c *Command) {
+	log.Debug("cancelling schedule for command %v", c.ID)
+
+	kill := &Command{KillCID: c.ID}
+
+	if c.Filter != nil {
+		kill.Filter = new(Filter)
+		*kill.Filter = *c.Filter
+	}
+
+	s.commandCounter++
+	kill.ID = s.commandCounter
+	s.commands[kill.ID] = kill
+
+	go s.sendCommands("")
+}
+
 // ClearCommands deletes all commands and sets the command ID counter back to
 // zero. As with DeleteCommand, any in-flight responses may still be returned.
 func (s *Server) ClearCommands() {
@@ -487,6 +808,14 @@ func (s *Server) ClearCommands() {
 	s.commandCounter = 0
 	s.commands = make(map[int]*Command)
 
+	s.deliveryLock.Lock()
+	s.deliveries = make(map[int]*delivery)
+	s.deliveryLock.Unlock()
+
+	// clearing also discards anything queued for disconnected clients,
+	// including the persisted copy
+	s.clearSavedCommands()
+
 	for _, c := range s.clients {
 		c.maxCommandID = 0
 	}
@@ -502,6 +831,8 @@ func (s *Server) DeleteResponse(id int) error {
 	s.clientLock.Lock()
 	defer s.clientLock.Unlock()
 
+	s.dropResponseIndex(id)
+
 	path := filepath.Join(s.responsePath(&id))
 
 	return os.RemoveAll(path)
@@ -523,6 +854,8 @@ func (s *Server) DeleteResponses(prefix string) error {
 
 	for id, c := range s.commands {
 		if c.Prefix == prefix {
+			s.dropResponseIndex(id)
+
 			if err := os.RemoveAll(s.responsePath(&id)); err != nil {
 				return err
 			}
@@ -548,6 +881,8 @@ func (s *Server) ClearResponses() error {
 	s.clientLock.Lock()
 	defer s.clientLock.Unlock()
 
+	s.dropResponseIndexes()
+
 	log.Info("cleared responses")
 
 	return os.RemoveAll(s.responsePath(nil))
@@ -565,6 +900,7 @@ func (s *Server) UnregisterVM(vm VM) {
 	defer s.clientLock.Unlock()
 
 	delete(s.vms, vm.GetUUID())
+	delete(s.reconnects, vm.GetUUID())
 }
 
 func (s *Server) setDestroyed() {
@@ -651,10 +987,12 @@ func (s *Server) handshake(conn net.Conn) (*client, error) {
 
 	c := &client{
 		conn:            conn,
+		transport:       connTransport(conn),
 		enc:             gob.NewEncoder(conn),
 		dec:             gob.NewDecoder(conn),
 		pipeReaders:     make(map[string]*miniplumber.Reader),
 		pipeWriters:     make(map[string]chan<- string),
+		pipeSenders:     make(map[string]*PipeSender),
 		cancelHeartbeat: make(chan struct{}),
 	}
 
@@ -690,10 +1028,25 @@ func (s *Server) handshake(conn net.Conn) (*client, error) {
 
 	c.Namespace = namespace
 
+	// the host the client is attached to: VM-backed clients belong to this
+	// host, while clients that dialed in over the network (and so have no
+	// local VM) fall back to the source host of their connection
+	c.host = s.hostname
+	if !s.UseVMs && (c.transport == "tcp" || c.transport == "tls") {
+		if host, _, err := net.SplitHostPort(conn.RemoteAddr().String()); err == nil && host != "" {
+			c.host = host
+		}
+	}
+
 	if m.Client.Version != version.Revision {
 		log.Warn("mismatched miniccc version: %v", m.Client.Version)
 	}
 
+	// negotiate optional capabilities from the client's message version
+	c.compress = SupportsCompression(m.Version)
+	c.pipeCredit = SupportsPipeCredits(m.Version)
+	c.stats = &s.compressionStats
+
 	if majorVersion(m.Version) > 0 {
 		log.Info("starting heartbeat to client %s", m.Client.UUID)
 
@@ -712,7 +1065,10 @@ func (s *Server) handshake(conn net.Conn) (*client, error) {
 					return
 				case <-t.C:
 					log.Debug("sending HEARTBEAT to client %s", m.Client.UUID)
-					m := Message{Type: MESSAGE_HEARTBEAT, Version: "v1"}
+					// include the current check-in rate so runtime changes
+					// propagate to connected clients, and our clock so they
+					// can compensate for skew in scheduled commands
+					m := Message{Type: MESSAGE_HEARTBEAT, Version: MessageVersion, HeartbeatRate: s.HeartbeatRate(), ServerTime: time.Now()}
 					c.enc.Encode(&m) // no need to worry about errors here
 				}
 			}
@@ -721,6 +1077,13 @@ func (s *Server) handshake(conn net.Conn) (*client, error) {
 		log.Warn("client %s is missing message version -- not starting heartbeat", m.Client.UUID)
 	}
 
+	// advertise our message version, desired check-in rate, and clock in
+	// the handshake ACK so newer clients know what the server supports;
+	// older clients ignore the fields
+	m.Version = MessageVersion
+	m.HeartbeatRate = s.HeartbeatRate()
+	m.ServerTime = time.Now()
+
 	// TODO: if the client blocks, ron will hang... probably not good
 	if err := c.enc.Encode(&m); err != nil {
 		// client disconnected before it read the full handshake
@@ -780,10 +1143,29 @@ func (s *Server) clientHandler(c *client) {
 			return
 		}
 
+		// serial connections don't see a disconnect when the guest reboots so
+		// bound each read and let the serial monitor redial after a timeout
+		if c.transport == "serial" {
+			if conn, ok := c.conn.(net.Conn); ok {
+				conn.SetReadDeadline(time.Now().Add(6 * s.HeartbeatRate()))
+			}
+		}
+
 		var m Message
 		if err = c.dec.Decode(&m); err == nil {
 			log.Debug("new message: %v", m.Type)
 
+			if m.Compressed {
+				compressed, raw, derr := m.Decompress()
+				if derr != nil {
+					log.Error("decompress from %v: %v", c.UUID, derr)
+					continue
+				}
+
+				atomic.AddInt64(&s.compressionStats.CompressedIn, int64(compressed))
+				atomic.AddInt64(&s.compressionStats.RawIn, int64(raw))
+			}
+
 			// unmangle the client uuid if necessary
 			if c.mangled {
 				m.UUID = unmangle(m.UUID)
@@ -797,13 +1179,18 @@ func (s *Server) clientHandler(c *client) {
 					log.Error("file error from %v: %v", c.UUID, m.Error)
 					continue
 				}
-				if m.File.Data == nil && m.File.Offset == 0 {
-					// client requested file
-					err = s.sendFile(c, m.File.Name)
+				if m.File.Cached {
+					// the client already held identical content and skipped
+					// the transfer
+					s.commandCached(m.File.ID, m.UUID)
+				} else if m.File.Data == nil && !m.File.EOF {
+					// client requested file, possibly resuming an interrupted
+					// transfer at an offset (data chunks always carry data or
+					// set EOF, so neither is mistaken for a request)
+					err = s.sendFile(c, m.File.Name, m.File.Offset)
 				} else {
 					// client sent file
-					fpath := filepath.Join(s.responsePath(&m.File.ID), c.UUID, m.File.Name)
-					err = m.File.Recv(fpath)
+					err = s.recvFile(c.UUID, m.File)
 				}
 			case MESSAGE_CLIENT:
 				if c.mangled {
@@ -811,9 +1198,34 @@ func (s *Server) clientHandler(c *client) {
 				}
 				s.responses <- m.Client
 			case MESSAGE_COMMAND:
-				// this shouldn't be sent via the client...
+				// newer clients explicitly acknowledge commands as soon as
+				// they arrive, ahead of any response
+				for _, id := range m.CommandAck {
+					s.markAckedID(c.UUID, id)
+				}
+
+				// newer clients use this to stream output from running
+				// commands (see Client.Streaming); nothing else should be
+				// sent via the client
+				if m.Client == nil {
+					continue
+				}
+
+				if c.mangled {
+					m.Client.UUID = unmangle(m.Client.UUID)
+				}
+
+				for _, r := range m.Client.Responses {
+					if r.Seq > 0 {
+						s.writeChunk(m.Client.UUID, r)
+					}
+				}
 			case MESSAGE_PIPE:
 				c.pipeHandler(s.plumber, &m)
+			case MESSAGE_LOG:
+				if err := s.writeClientLog(c.UUID, m.Log, m.LogDropped); err != nil {
+					log.Error("could not record log from %v: %v", c.UUID, err)
+				}
 			case MESSAGE_UFS:
 				c.ufsMessage(&m)
 			default:
@@ -839,6 +1251,13 @@ func (s *Server) clientHandler(c *client) {
 		return
 	}
 
+	// A serial read timed out (see above) - the guest went silent, likely
+	// rebooting, and the serial monitor will redial.
+	if nerr, ok := err.(net.Error); ok && nerr.Timeout() {
+		log.Info("client %v timed out", c.UUID)
+		return
+	}
+
 	log.Errorln(err)
 }
 
@@ -854,6 +1273,19 @@ func (s *Server) addClient(c *client) error {
 	}
 	s.clients[c.UUID] = c
 
+	// the first connection for a UUID doesn't count as a reconnect
+	if _, ok := s.reconnects[c.UUID]; ok {
+		s.reconnects[c.UUID]++
+	} else {
+		s.reconnects[c.UUID] = 0
+	}
+
+	// wake up anyone waiting on this client to check in
+	for _, ch := range s.checkinWaiters[c.UUID] {
+		close(ch)
+	}
+	delete(s.checkinWaiters, c.UUID)
+
 	return nil
 }
 
@@ -876,10 +1308,17 @@ func (s *Server) removeClient(uuid string) {
 		for _, p := range c.pipeWriters {
 			close(p)
 		}
+		// unblock any pipe forwarders waiting on credit
+		for _, p := range c.pipeSenders {
+			p.Close()
+		}
 
 		// stop Goroutine sending heartbeats to this client
 		close(c.cancelHeartbeat)
 
+		// truncate any output streams the client had in flight
+		s.closeStreams(uuid)
+
 		delete(s.clients, uuid)
 	}
 }
@@ -951,24 +1390,56 @@ func (s *Server) NewFilesSendCommand(files []string) (*Command, error) {
 		cmd.FilesSend = send
 	}
 
+	// hash each file so clients that already hold identical content can
+	// acknowledge without a transfer (see Command.FilesSendHashes)
+	cmd.FilesSendHashes = make(map[string]string)
+	for _, f := range cmd.FilesSend {
+		// resolve the name the same way sendFile will: subpath first, then
+		// the global directory
+		fpath := f
+		if !filepath.IsAbs(f) {
+			fpath = filepath.Join(s.path, s.subpath, f)
+			if _, err := os.Stat(fpath); err != nil {
+				fpath = filepath.Join(s.path, f)
+			}
+		}
+
+		hash, err := HashFile(fpath)
+		if err != nil {
+			return nil, err
+		}
+
+		cmd.FilesSendHashes[f] = hash
+	}
+
 	return cmd, nil
 }
 
-// sendFile reads the file and sends it in multiple chunks to the client.
-func (s *Server) sendFile(c *client, filename string) error {
-	log.Debug("sendFile: %v to %v", filename, c.UUID)
+// sendFile reads the file and sends it in multiple chunks to the client,
+// starting at the given offset when resuming an interrupted transfer.
+func (s *Server) sendFile(c *client, filename string, offset int64) error {
+	log.Debug("sendFile: %v to %v at offset %v", filename, c.UUID, offset)
+
+	// track progress as chunks go out
+	send := func(m *Message) error {
+		if m.File != nil && m.Error == "" {
+			s.updateFileTransfer(c.UUID, m.File.Name, "send", m.File.Offset+int64(len(m.File.Data)), m.File.Size, m.File.EOF)
+		}
+
+		return c.sendMessage(m)
+	}
 
 	// try to send version from subpath first
 	dir := filepath.Join(s.path, s.subpath)
 	fpath := filepath.Join(dir, filename)
 	if _, err := os.Stat(fpath); err == nil {
 		// found file in subpath
-		return SendFile(dir, fpath, 0, PART_SIZE, c.sendMessage)
+		return SendFile(dir, fpath, 0, offset, s.ChunkSize(), send)
 	}
 
 	dir = s.path
 	fpath = filepath.Join(dir, filename)
-	return SendFile(dir, fpath, 0, PART_SIZE, c.sendMessage)
+	return SendFile(dir, fpath, 0, offset, s.ChunkSize(), send)
 }
 
 // route an outgoing message to one or all clients, according to UUID
@@ -1026,9 +1497,29 @@ func (s *Server) route(m *Message) {
 
 			// filter the commands to relevant ones
 			for i, cmd := range m.Commands {
-				if c.Matches(cmd.Filter) && i > c.maxCommandID {
-					m2.Commands[i] = cmd
+				if !c.matches(cmd.Filter) || i <= c.maxCommandID {
+					continue
+				}
+
+				// run-once commands are never redelivered, even when a
+				// reconnecting client resets its command cursor
+				if cmd.Once && s.sentTo(i, uuid) {
+					continue
+				}
+
+				// give up on clients that repeatedly failed delivery
+				if s.failedTo(i, uuid) {
+					continue
 				}
+
+				// commands that have been queued longer than the age cap
+				// expire rather than reaching clients that never saw them
+				if cmd.Expired() && !s.sentTo(i, uuid) {
+					s.markExpired(i, uuid)
+					continue
+				}
+
+				m2.Commands[i] = cmd
 			}
 
 			c.maxCommandID = maxCommandID
@@ -1047,6 +1538,20 @@ func (s *Server) route(m *Message) {
 			} else {
 				log.Info("unable to send message to %v: %v", uuid, err)
 			}
+
+			// leave the commands queued for redelivery, bounded by
+			// DELIVERY_MAX_ATTEMPTS
+			for i := range m.Commands {
+				s.markQueued(i, uuid)
+			}
+
+			return
+		}
+
+		// record successful deliveries so that run-once commands are not
+		// resent and so that `cc commands` can report delivery counts
+		for i := range m.Commands {
+			s.markSent(i, uuid)
 		}
 	}
 
@@ -1083,12 +1588,34 @@ func (s *Server) responseHandler() {
 		// update all the client fields
 		s.updateClient(cin)
 
+		// the client's command cursor acknowledges receipt of every command
+		// up to LastCommandID
+		s.markAcked(cin.UUID, cin.LastCommandID)
+
 		// ingest responses from this client
 		for _, v := range cin.Responses {
+			// streamed chunks are recorded as they arrive, not via check-in
+			if v.Seq > 0 {
+				continue
+			}
+
 			log.Debug("got response %v : %v", cin.UUID, v.ID)
-			s.commandCheckIn(v.ID, cin.UUID)
+
+			s.markResponded(cin.UUID, v.ID)
+
+			// scheduled commands check in once when the client accepts the
+			// schedule; responses from individual runs carry a run number
+			if v.Run == 0 {
+				s.commandCheckIn(v.ID, cin.UUID)
+			}
 
 			path := filepath.Join(s.responsePath(&v.ID), cin.UUID)
+
+			// record each run of a periodic command separately so that runs
+			// don't clobber each other
+			if v.Run > 0 {
+				path = filepath.Join(path, strconv.Itoa(v.Run))
+			}
 			err := os.MkdirAll(path, os.FileMode(0770))
 			if err != nil {
 				log.Error("could not record response %v for %v: %v", v.ID, cin.UUID, err)
@@ -1108,6 +1635,51 @@ func (s *Server) responseHandler() {
 					log.Error("could not record stderr %v for %v: %v", v.ID, cin.UUID, err)
 				}
 			}
+
+			// note alongside the output whether stdin input made it to the
+			// command (see Command.Input)
+			if v.InputSent {
+				err := ioutil.WriteFile(filepath.Join(path, "stdin"), []byte("delivered\n"), os.FileMode(0660))
+				if err != nil {
+					log.Error("could not record stdin %v for %v: %v", v.ID, cin.UUID, err)
+				}
+			}
+
+			// note the working directory and user the command ran with, when
+			// the command set them
+			if v.Dir != "" || v.User != "" {
+				var ctx string
+				if v.Dir != "" {
+					ctx += "dir: " + v.Dir + "\n"
+				}
+				if v.User != "" {
+					ctx += "user: " + v.User + "\n"
+				}
+
+				err := ioutil.WriteFile(filepath.Join(path, "context"), []byte(ctx), os.FileMode(0660))
+				if err != nil {
+					log.Error("could not record context %v for %v: %v", v.ID, cin.UUID, err)
+				}
+			}
+
+			// record the exit disposition, if the client reported one
+			if v.Exit != "" {
+				err := ioutil.WriteFile(filepath.Join(path, "exit"), []byte(v.Exit+"\n"), os.FileMode(0660))
+				if err != nil {
+					log.Error("could not record exit %v for %v: %v", v.ID, cin.UUID, err)
+				}
+			}
+
+			// fold the response into the per-command group index so grouped
+			// queries don't have to re-read every file
+			member := cin.UUID
+			if v.Run > 0 {
+				member = filepath.Join(member, strconv.Itoa(v.Run))
+			}
+			s.indexResponse(v.ID, cin.Hostname, member, v.Stdout, v.Stderr, v.Exit)
+
+			// the complete response supersedes any streamed chunks
+			s.closeStream(v.ID, cin.UUID)
 		}
 	}
 }
@@ -1128,6 +1700,7 @@ func (s *Server) updateClient(cin *Client) {
 
 	c.Client = cin
 	c.checkin = time.Now()
+	c.stale = false
 
 	if !s.UseVMs {
 		return
@@ -1159,6 +1732,21 @@ func (s *Server) commandCheckIn(id int, uuid string) {
 	}
 }
 
+// commandCached records that a client satisfied one of a command's sent files
+// from a previously received copy, without any transfer.
+func (s *Server) commandCached(id int, uuid string) {
+	log.Debug("commandCached %v %v", id, uuid)
+
+	s.commandLock.Lock()
+	defer s.commandLock.Unlock()
+
+	if c, ok := s.commands[id]; ok {
+		c.CachedSend = append(c.CachedSend, uuid)
+	} else {
+		log.Error("command cached: command %v does not exist", id)
+	}
+}
+
 // clientReaper periodically flushes old entries from the client list
 func (s *Server) clientReaper() {
 	for {
@@ -1169,24 +1757,52 @@ func (s *Server) clientReaper() {
 
 		time.Sleep(time.Duration(REAPER_RATE) * time.Second)
 
+		// scale staleness and expiration with the configured check-in rate
+		// so that slow check-ins aren't mistaken for dead clients
+		rate := s.HeartbeatRate()
+
+		staleAfter := 3 * rate
+		expireAfter := CLIENT_EXPIRED * time.Second
+		if 6*rate > expireAfter {
+			expireAfter = 6 * rate
+		}
+
+		var stale []VM
+
 		s.clientLock.Lock()
 		for k, v := range s.clients {
+			age := time.Now().Sub(v.checkin)
+
 			// checked in more recently than expiration time
-			active := time.Now().Sub(v.checkin) < CLIENT_EXPIRED*time.Second
+			active := age < expireAfter
 
 			if !active {
 				log.Debug("client %v expired", k)
 				// the same as removeClient except we already hold clientLock
 				v.conn.Close()
 				close(v.cancelHeartbeat)
+				s.closeStreams(k)
 				delete(s.clients, k)
 			}
 
 			if vm, ok := s.vms[k]; ok {
 				vm.SetCCActive(active)
+
+				// expired clients are stale too; a client that dies
+				// between passes still generates one event
+				if age > staleAfter && !v.stale {
+					v.stale = true
+					stale = append(stale, vm)
+				}
 			}
 		}
 		s.clientLock.Unlock()
+
+		if s.StaleHandler != nil {
+			for _, vm := range stale {
+				s.StaleHandler(vm)
+			}
+		}
 	}
 }
 
@@ -0,0 +1,227 @@
+// Copyright 2015-2021 National Technology & Engineering Solutions of Sandia, LLC (NTESS).
+// Under the terms of Contract DE-NA0003525 with NTESS, the U.S. Government retains certain
+// rights in this software.
+
+package ron
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	log "github.com/sandia-minimega/minimega/v2/pkg/minilog"
+)
+
+// how often FollowResponse checks for newly recorded output
+const FOLLOW_RATE = 500 * time.Millisecond
+
+// streamKey identifies the output stream for one command on one client
+type streamKey struct {
+	id   int
+	uuid string
+}
+
+// stream tracks in-order delivery of output chunks for a single streamKey.
+// Chunks that arrive ahead of a gap are buffered in pending until the gap
+// fills.
+type stream struct {
+	next    int
+	pending map[int]*Response
+}
+
+// writeChunk ingests a streamed output chunk from a client, appending it to
+// the response files once all earlier chunks have been recorded. Chunks at or
+// below the next expected sequence number are duplicates and are dropped.
+func (s *Server) writeChunk(uuid string, r *Response) {
+	s.streamLock.Lock()
+	defer s.streamLock.Unlock()
+
+	key := streamKey{r.ID, uuid}
+
+	st, ok := s.streams[key]
+	if !ok {
+		st = &stream{
+			next:    1,
+			pending: make(map[int]*Response),
+		}
+		s.streams[key] = st
+	}
+
+	if r.Seq != st.next {
+		if r.Seq > st.next {
+			st.pending[r.Seq] = r
+		}
+
+		return
+	}
+
+	for r != nil {
+		if err := s.appendChunk(uuid, r); err != nil {
+			log.Error("could not record chunk %v.%v for %v: %v", r.ID, r.Seq, uuid, err)
+		}
+
+		st.next++
+
+		r = st.pending[st.next]
+		delete(st.pending, st.next)
+	}
+}
+
+// appendChunk appends a chunk's output to the stdout/stderr response files.
+func (s *Server) appendChunk(uuid string, r *Response) error {
+	path := filepath.Join(s.responsePath(&r.ID), uuid)
+	if err := os.MkdirAll(path, os.FileMode(0770)); err != nil {
+		return err
+	}
+
+	if r.Stdout != "" {
+		if err := appendFile(filepath.Join(path, "stdout"), r.Stdout); err != nil {
+			return err
+		}
+	}
+	if r.Stderr != "" {
+		if err := appendFile(filepath.Join(path, "stderr"), r.Stderr); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func appendFile(path, data string) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, os.FileMode(0660))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, err = f.WriteString(data)
+	return err
+}
+
+// closeStream drops the stream state for a single command on a single client,
+// called once the complete response has been recorded.
+func (s *Server) closeStream(id int, uuid string) {
+	s.streamLock.Lock()
+	defer s.streamLock.Unlock()
+
+	delete(s.streams, streamKey{id, uuid})
+}
+
+// closeStreams drops all stream state for a client. Any chunks buffered
+// waiting for a gap to fill are discarded, so a stream truncated by a client
+// disconnect ends at the last chunk received in order.
+func (s *Server) closeStreams(uuid string) {
+	s.streamLock.Lock()
+	defer s.streamLock.Unlock()
+
+	for k := range s.streams {
+		if k.uuid == uuid {
+			delete(s.streams, k)
+		}
+	}
+}
+
+// ActiveStreams returns the number of clients currently streaming output for
+// the given command.
+func (s *Server) ActiveStreams(id int) int {
+	s.streamLock.Lock()
+	defer s.streamLock.Unlock()
+
+	var res int
+
+	for k := range s.streams {
+		if k.id == id {
+			res++
+		}
+	}
+
+	return res
+}
+
+// FollowResponse tails the response output for the given command, invoking
+// out with new output as it is recorded. It returns once at least one client
+// has responded and no clients are still streaming, or when the command is
+// deleted. Output from clients that don't stream shows up when their complete
+// response is recorded.
+func (s *Server) FollowResponse(id int, out func(string)) error {
+	if s.GetCommand(id) == nil {
+		return fmt.Errorf("command %v not found", id)
+	}
+
+	base := s.responsePath(&id)
+	offsets := make(map[string]int64)
+
+	for {
+		cmd := s.GetCommand(id)
+		done := s.destroyed() || cmd == nil || (len(cmd.CheckedIn) > 0 && s.ActiveStreams(id) == 0)
+
+		// sweep after deciding whether we're done so that output recorded in
+		// between still gets reported before we return
+		if err := s.sweepResponses(base, offsets, out); err != nil {
+			return err
+		}
+
+		if done {
+			return nil
+		}
+
+		time.Sleep(FOLLOW_RATE)
+	}
+}
+
+// sweepResponses reports any response file contents past the recorded
+// offsets, updating the offsets as it goes.
+func (s *Server) sweepResponses(base string, offsets map[string]int64, out func(string)) error {
+	walker := func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if info.IsDir() || info.Size() <= offsets[path] {
+			return nil
+		}
+
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		offset := offsets[path]
+		if _, err := f.Seek(offset, io.SeekStart); err != nil {
+			return err
+		}
+
+		data, err := ioutil.ReadAll(f)
+		if err != nil {
+			return err
+		}
+
+		offsets[path] = offset + int64(len(data))
+
+		if offset == 0 {
+			relPath, err := filepath.Rel(s.responsePath(nil), path)
+			if err != nil {
+				return err
+			}
+
+			out(fmt.Sprintf("%v:\n", relPath))
+		}
+
+		out(string(data))
+
+		return nil
+	}
+
+	err := filepath.Walk(base, walker)
+	if os.IsNotExist(err) {
+		// no responses recorded yet
+		return nil
+	}
+
+	return err
+}
@@ -0,0 +1,111 @@
+// Copyright 2015-2021 National Technology & Engineering Solutions of Sandia, LLC (NTESS).
+// Under the terms of Contract DE-NA0003525 with NTESS, the U.S. Government retains certain
+// rights in this software.
+
+package ron
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// newTestServer creates a server with just enough state for ingesting
+// streamed output chunks and indexing responses.
+func newTestServer(t *testing.T) (*Server, func()) {
+	dir, err := ioutil.TempDir("", "ron")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := &Server{
+		path:          dir,
+		streams:       make(map[streamKey]*stream),
+		respIndex:     make(map[int]*responseIndex),
+		fileTransfers: make(map[string]*FileTransfer),
+		recvBytes:     make(map[string]int64),
+		recvRejected:  make(map[string]bool),
+	}
+
+	return s, func() { os.RemoveAll(dir) }
+}
+
+// readResponse returns the contents of a response file for the given command
+// and client, or "" if it hasn't been written.
+func readResponse(s *Server, id int, uuid, name string) string {
+	data, err := ioutil.ReadFile(filepath.Join(s.responsePath(&id), uuid, name))
+	if err != nil {
+		return ""
+	}
+
+	return string(data)
+}
+
+func TestChunkOrdering(t *testing.T) {
+	s, cleanup := newTestServer(t)
+	defer cleanup()
+
+	uuid := "uuid0"
+
+	// deliver chunks out of order -- 3 and 4 should be held back until 2
+	// fills the gap
+	s.writeChunk(uuid, &Response{ID: 1, Seq: 1, Stdout: "a"})
+	s.writeChunk(uuid, &Response{ID: 1, Seq: 3, Stdout: "c"})
+	s.writeChunk(uuid, &Response{ID: 1, Seq: 4, Stderr: "x"})
+
+	if got := readResponse(s, 1, uuid, "stdout"); got != "a" {
+		t.Fatalf("expected `a` before gap filled, got `%v`", got)
+	}
+
+	if got := s.ActiveStreams(1); got != 1 {
+		t.Fatalf("expected 1 active stream, got %v", got)
+	}
+
+	s.writeChunk(uuid, &Response{ID: 1, Seq: 2, Stdout: "b"})
+
+	if got := readResponse(s, 1, uuid, "stdout"); got != "abc" {
+		t.Fatalf("expected `abc`, got `%v`", got)
+	}
+
+	if got := readResponse(s, 1, uuid, "stderr"); got != "x" {
+		t.Fatalf("expected `x`, got `%v`", got)
+	}
+
+	// a duplicated chunk must not be appended twice
+	s.writeChunk(uuid, &Response{ID: 1, Seq: 2, Stdout: "b"})
+
+	if got := readResponse(s, 1, uuid, "stdout"); got != "abc" {
+		t.Fatalf("expected `abc` after duplicate, got `%v`", got)
+	}
+}
+
+func TestChunkTruncation(t *testing.T) {
+	s, cleanup := newTestServer(t)
+	defer cleanup()
+
+	uuid := "uuid0"
+
+	s.writeChunk(uuid, &Response{ID: 1, Seq: 1, Stdout: "a"})
+	s.writeChunk(uuid, &Response{ID: 1, Seq: 3, Stdout: "c"})
+
+	// client disconnected -- the buffered chunk is discarded and the stream
+	// ends at the last chunk received in order
+	s.closeStreams(uuid)
+
+	if got := s.ActiveStreams(1); got != 0 {
+		t.Fatalf("expected 0 active streams, got %v", got)
+	}
+
+	if got := readResponse(s, 1, uuid, "stdout"); got != "a" {
+		t.Fatalf("expected truncated `a`, got `%v`", got)
+	}
+
+	// a stale chunk after the disconnect starts a fresh stream and can't
+	// fill the old gap
+	s.writeChunk(uuid, &Response{ID: 1, Seq: 2, Stdout: "b"})
+
+	if got := readResponse(s, 1, uuid, "stdout"); got != "a" {
+		t.Fatalf("expected `a` after stale chunk, got `%v`", got)
+	}
+}
@@ -0,0 +1,234 @@
+// Copyright 2015-2021 National Technology & Engineering Solutions of Sandia, LLC (NTESS).
+// Under the terms of Contract DE-NA0003525 with NTESS, the U.S. Government retains certain
+// rights in this software.
+
+package ron
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	log "github.com/sandia-minimega/minimega/v2/pkg/minilog"
+)
+
+// ListenTLS starts accepting TLS connections on the specified port, accepting
+// connections in a goroutine. It can be used alongside Listen on a different
+// port for mixed deployments where some clients haven't been issued
+// certificates yet. Returns an error if the server is already listening on
+// that port or if there was another error.
+func (s *Server) ListenTLS(port int, config *tls.Config) error {
+	log.Info("listening for TLS on :%v", port)
+
+	s.listenersLock.Lock()
+	defer s.listenersLock.Unlock()
+
+	addr := ":" + strconv.Itoa(port)
+
+	if _, ok := s.listeners[addr]; ok {
+		return fmt.Errorf("already listening on %v", addr)
+	}
+
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+
+	ln = tls.NewListener(ln, config)
+
+	s.listeners[addr] = ln
+	go s.serve(addr, ln)
+
+	return nil
+}
+
+// NewTLSConfig builds a TLS configuration for the ron server or client from
+// the given certificate, key, and CA files. Both sides authenticate each
+// other against the CA. Peer certificates are only verified against the CA
+// chain -- clients dial servers by experiment IPs that don't appear in the
+// certificates, so hostname checks don't apply.
+func NewTLSConfig(certFile, keyFile, caFile string, server bool) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := ioutil.ReadFile(caFile)
+	if err != nil {
+		return nil, err
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("no CA certificates in %v", caFile)
+	}
+
+	config := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+
+	if server {
+		config.ClientCAs = pool
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+
+		return config, nil
+	}
+
+	// InsecureSkipVerify only skips the default verification -- we supply our
+	// own that checks the chain but not the hostname.
+	config.InsecureSkipVerify = true
+	config.VerifyPeerCertificate = func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+		if len(rawCerts) == 0 {
+			return errors.New("no server certificate")
+		}
+
+		var certs []*x509.Certificate
+		for _, raw := range rawCerts {
+			c, err := x509.ParseCertificate(raw)
+			if err != nil {
+				return err
+			}
+
+			certs = append(certs, c)
+		}
+
+		opts := x509.VerifyOptions{
+			Roots:         pool,
+			Intermediates: x509.NewCertPool(),
+			KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		}
+		for _, c := range certs[1:] {
+			opts.Intermediates.AddCert(c)
+		}
+
+		_, err := certs[0].Verify(opts)
+		return err
+	}
+
+	return config, nil
+}
+
+// GenerateCerts creates a CA for the given name and certificate pairs for the
+// server and clients signed by it, writing ca.pem, server.pem,
+// server-key.pem, client.pem, and client-key.pem to dir. The client pair is
+// meant to be baked into images or delivered over virtio-serial. If a CA
+// already exists in dir, GenerateCerts leaves it alone.
+func GenerateCerts(dir, name string) error {
+	if _, err := os.Stat(filepath.Join(dir, "ca.pem")); err == nil {
+		return nil
+	}
+
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+
+	log.Info("generating cc certificates for %v in %v", name, dir)
+
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+
+	caTmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name + " cc CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().AddDate(10, 0, 0),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+	}
+
+	caDER, err := x509.CreateCertificate(rand.Reader, caTmpl, caTmpl, &caKey.PublicKey, caKey)
+	if err != nil {
+		return err
+	}
+
+	caCert, err := x509.ParseCertificate(caDER)
+	if err != nil {
+		return err
+	}
+
+	if err := writePEM(filepath.Join(dir, "ca.pem"), "CERTIFICATE", caDER, 0644); err != nil {
+		return err
+	}
+
+	sign := func(cn string, usage x509.ExtKeyUsage, certFile, keyFile string) error {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			return err
+		}
+
+		serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+		if err != nil {
+			return err
+		}
+
+		tmpl := &x509.Certificate{
+			SerialNumber: serial,
+			Subject:      pkix.Name{CommonName: cn},
+			NotBefore:    time.Now().Add(-time.Hour),
+			NotAfter:     time.Now().AddDate(10, 0, 0),
+			KeyUsage:     x509.KeyUsageDigitalSignature,
+			ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+		}
+
+		der, err := x509.CreateCertificate(rand.Reader, tmpl, caCert, &key.PublicKey, caKey)
+		if err != nil {
+			return err
+		}
+
+		if err := writePEM(filepath.Join(dir, certFile), "CERTIFICATE", der, 0644); err != nil {
+			return err
+		}
+
+		keyDER, err := x509.MarshalECPrivateKey(key)
+		if err != nil {
+			return err
+		}
+
+		return writePEM(filepath.Join(dir, keyFile), "EC PRIVATE KEY", keyDER, 0600)
+	}
+
+	if err := sign(name+" cc server", x509.ExtKeyUsageServerAuth, "server.pem", "server-key.pem"); err != nil {
+		return err
+	}
+
+	return sign(name+" cc client", x509.ExtKeyUsageClientAuth, "client.pem", "client-key.pem")
+}
+
+// writePEM writes a single PEM block to the named file.
+func writePEM(fpath, blockType string, der []byte, perm os.FileMode) error {
+	data := pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der})
+
+	return ioutil.WriteFile(fpath, data, perm)
+}
+
+// connTransport names the transport for a client connection, for display in
+// client listings.
+func connTransport(conn net.Conn) string {
+	switch conn.(type) {
+	case *tls.Conn:
+		return "tls"
+	case *net.TCPConn:
+		return "tcp"
+	case *net.UnixConn:
+		return "unix"
+	}
+
+	return "serial"
+}
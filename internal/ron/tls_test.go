@@ -0,0 +1,85 @@
+// Copyright 2015-2021 National Technology & Engineering Solutions of Sandia, LLC (NTESS).
+// Under the terms of Contract DE-NA0003525 with NTESS, the U.S. Government retains certain
+// rights in this software.
+
+package ron
+
+import (
+	"crypto/tls"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TestTLSMutualAuth generates certificates and checks that a client and
+// server configured from them can complete a mutually authenticated
+// handshake, and that a client without a certificate is rejected.
+func TestTLSMutualAuth(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ron_test_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if err := GenerateCerts(dir, "test"); err != nil {
+		t.Fatal(err)
+	}
+
+	// generating again should be a no-op
+	if err := GenerateCerts(dir, "test"); err != nil {
+		t.Fatal(err)
+	}
+
+	serverConfig, err := NewTLSConfig(
+		filepath.Join(dir, "server.pem"),
+		filepath.Join(dir, "server-key.pem"),
+		filepath.Join(dir, "ca.pem"),
+		true,
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	clientConfig, err := NewTLSConfig(
+		filepath.Join(dir, "client.pem"),
+		filepath.Join(dir, "client-key.pem"),
+		filepath.Join(dir, "ca.pem"),
+		false,
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	handshake := func(config *tls.Config) error {
+		sconn, cconn := net.Pipe()
+
+		errs := make(chan error, 1)
+		go func() {
+			s := tls.Server(sconn, serverConfig)
+			errs <- s.Handshake()
+			s.Close()
+		}()
+
+		c := tls.Client(cconn, config)
+		err := c.Handshake()
+		c.Close()
+
+		if err2 := <-errs; err == nil {
+			err = err2
+		}
+
+		return err
+	}
+
+	if err := handshake(clientConfig); err != nil {
+		t.Errorf("mutual auth handshake failed: %v", err)
+	}
+
+	// a client without a certificate should be rejected
+	anon := &tls.Config{InsecureSkipVerify: true}
+	if err := handshake(anon); err == nil {
+		t.Error("handshake without a client certificate succeeded")
+	}
+}
@@ -33,6 +33,24 @@ func (s *Server) Forward(uuid string, source int, host string, dest int) error {
 	return c.tunnel.Forward(source, host, dest)
 }
 
+// ForwardUDP creates a datagram tunnel from host->guest, based on UUID,
+// source, host, and destination port.
+func (s *Server) ForwardUDP(uuid string, source int, host string, dest int) error {
+	s.clientLock.Lock()
+	defer s.clientLock.Unlock()
+
+	c, ok := s.clients[uuid]
+	if !ok {
+		return fmt.Errorf("no such client: %v", uuid)
+	}
+
+	if c.tunnel == nil {
+		return fmt.Errorf("tunnel has not been initialized for %v", uuid)
+	}
+
+	return c.tunnel.ForwardUDP(source, host, dest)
+}
+
 // Reverse creates a reverse tunnel from guest->host. It is possible to have
 // multiple clients create a reverse tunnel simultaneously. filter allows
 // specifying which clients to have create the tunnel.
@@ -41,7 +59,7 @@ func (s *Server) Reverse(filter *Filter, source int, host string, dest int) erro
 	defer s.clientLock.Unlock()
 
 	for _, c := range s.clients {
-		if !c.Matches(filter) {
+		if !c.matches(filter) {
 			continue
 		}
 
@@ -57,6 +75,29 @@ func (s *Server) Reverse(filter *Filter, source int, host string, dest int) erro
 	return nil
 }
 
+// ReverseUDP creates a reverse datagram tunnel from guest->host for each
+// client matching filter, mirroring Reverse.
+func (s *Server) ReverseUDP(filter *Filter, source int, host string, dest int) error {
+	s.clientLock.Lock()
+	defer s.clientLock.Unlock()
+
+	for _, c := range s.clients {
+		if !c.matches(filter) {
+			continue
+		}
+
+		if c.tunnel == nil {
+			return fmt.Errorf("tunnel has not been initialized for %v", c.UUID)
+		}
+
+		if err := c.tunnel.ReverseUDP(source, host, dest); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
 // Trunk reads data from remote, constructs a *Message, and sends it using fn.
 // Returns the first error.
 func Trunk(remote io.ReadCloser, uuid string, fn func(*Message) error) {
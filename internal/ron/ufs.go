@@ -13,8 +13,9 @@ import (
 )
 
 // ListenUFS starts a listener to connect to UFS running on the VM specified by
-// the UUID. Returns the TCP port or an error.
-func (s *Server) ListenUFS(uuid string) (int, error) {
+// the UUID. The client serves a read-only filesystem unless writable is set.
+// Returns the TCP port or an error.
+func (s *Server) ListenUFS(uuid string, writable bool) (int, error) {
 	s.clientLock.Lock()
 	defer s.clientLock.Unlock()
 
@@ -24,9 +25,10 @@ func (s *Server) ListenUFS(uuid string) (int, error) {
 	}
 
 	m := &Message{
-		Type:    MESSAGE_UFS,
-		UUID:    uuid,
-		UfsMode: UFS_OPEN,
+		Type:        MESSAGE_UFS,
+		UUID:        uuid,
+		UfsMode:     UFS_OPEN,
+		UfsWritable: writable,
 	}
 	if err := c.sendMessage(m); err != nil {
 		return 0, err
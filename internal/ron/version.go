@@ -6,8 +6,39 @@ import (
 	"strings"
 )
 
+// MessageVersion is the current version of the ron message protocol. v1
+// added server heartbeats in support of serial reconnect. v1.1 added
+// resumable file transfers -- a file request may carry a non-zero Offset to
+// resume an interrupted transfer. v1.2 added transparent payload compression
+// (see Message.Compressed). v1.3 added credit-based pipe flow control (see
+// PIPE_CREDIT). v1.4 added content-hash dedup for files sent to clients (see
+// Command.FilesSendHashes); no gating is needed since older peers simply
+// ignore the hashes.
+const MessageVersion = "v1.4"
+
 var regex = regexp.MustCompile(`^(v|V)`)
 
+// SupportsResume reports whether a peer speaking the given message version
+// understands file requests with a resume offset. Peers that don't must be
+// sent requests with a zero offset so they restart the transfer.
+func SupportsResume(v string) bool {
+	return majorVersion(v) > 1 || (majorVersion(v) == 1 && minorVersion(v) >= 1)
+}
+
+// SupportsCompression reports whether a peer speaking the given message
+// version understands compressed message payloads. Messages to peers that
+// don't must be sent uncompressed.
+func SupportsCompression(v string) bool {
+	return majorVersion(v) > 1 || (majorVersion(v) == 1 && minorVersion(v) >= 2)
+}
+
+// SupportsPipeCredits reports whether a peer speaking the given message
+// version understands credit-based pipe flow control. Pipe data sent to
+// peers that don't is not gated, matching the old protocol.
+func SupportsPipeCredits(v string) bool {
+	return majorVersion(v) > 1 || (majorVersion(v) == 1 && minorVersion(v) >= 3)
+}
+
 func majorVersion(v string) int {
 	parts := versionParts(v)
 
@@ -14,4 +14,6 @@ const (
 	LoadFile
 	WaitForIt
 	ClickIt
+	Rate
+	Seek
 )
@@ -7,6 +7,7 @@ package vnc
 import (
 	"bufio"
 	"bytes"
+	"compress/gzip"
 	"encoding/base64"
 	"errors"
 	"fmt"
@@ -169,6 +170,27 @@ func parseEvent(cmd string) (interface{}, error) {
 	return nil, errors.New("invalid event specified")
 }
 
+// recordingReader wraps a playback file in a reader that transparently
+// stream-decompresses gzip-compressed recordings, detected by the gzip magic
+// bytes so that uncompressed recordings still play.
+func recordingReader(f *os.File) (io.Reader, error) {
+	var magic [2]byte
+
+	if _, err := io.ReadFull(f, magic[:]); err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return nil, err
+	}
+
+	if _, err := f.Seek(0, 0); err != nil {
+		return nil, err
+	}
+
+	if magic[0] == 0x1f && magic[1] == 0x8b {
+		return gzip.NewReader(f)
+	}
+
+	return f, nil
+}
+
 func parseDuration(s string) (time.Duration, error) {
 	// unitless integer is assumed to be in nanoseconds
 	if v, err := strconv.Atoi(s); err == nil {
@@ -183,9 +205,15 @@ func getDuration(f *os.File) time.Duration {
 	// go back to the beginning of the file
 	defer f.Seek(0, 0)
 
+	r, err := recordingReader(f)
+	if err != nil {
+		log.Errorln(err)
+		return 0
+	}
+
 	d := 0
 
-	scanner := bufio.NewScanner(f)
+	scanner := bufio.NewScanner(r)
 	for scanner.Scan() {
 		s := strings.SplitN(scanner.Text(), ":", 2)
 		// Ignore blank and malformed lines
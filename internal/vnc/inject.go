@@ -0,0 +1,100 @@
+// Copyright 2019-2021 National Technology & Engineering Solutions of Sandia, LLC (NTESS).
+// Under the terms of Contract DE-NA0003525 with NTESS, the U.S. Government retains certain
+// rights in this software.
+
+package vnc
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+// shiftedRunes are characters that need shift held on a US keyboard, beyond
+// what unicode.IsUpper catches.
+const shiftedRunes = `~!@#$%^&*()_+{}|:"<>?`
+
+// KeyPressEvents synthesizes a press and release of the named key.
+func KeyPressEvents(key string) ([]Event, error) {
+	keysym, err := xStringToKeysym(key)
+	if err != nil {
+		// allow raw keysyms too, same as playback files
+		if _, err := fmt.Sscanf(key, "%U", &keysym); err != nil {
+			return nil, fmt.Errorf("unknown key: `%s`", key)
+		}
+	}
+
+	return []Event{
+		&KeyEvent{DownFlag: 1, Key: keysym},
+		&KeyEvent{Key: keysym},
+	}, nil
+}
+
+// TextEvents synthesizes the key presses to type the given text, wrapping
+// characters that need it in shift. Newlines and tabs press Return and Tab;
+// other control characters are rejected.
+func TextEvents(s string) ([]Event, error) {
+	var res []Event
+
+	shift := keysym["Shift_L"]
+
+	for _, r := range s {
+		keysym, shifted, err := runeToKeysym(r)
+		if err != nil {
+			return nil, err
+		}
+
+		if shifted {
+			res = append(res, &KeyEvent{DownFlag: 1, Key: shift})
+		}
+
+		res = append(res,
+			&KeyEvent{DownFlag: 1, Key: keysym},
+			&KeyEvent{Key: keysym},
+		)
+
+		if shifted {
+			res = append(res, &KeyEvent{Key: shift})
+		}
+	}
+
+	return res, nil
+}
+
+// ClickEvents synthesizes a press and release of the given mouse button
+// (1-indexed, 1 is the left button) at the given position.
+func ClickEvents(x, y uint16, button uint) ([]Event, error) {
+	if button < 1 || button > 8 {
+		return nil, fmt.Errorf("invalid mouse button: %v", button)
+	}
+
+	return []Event{
+		&PointerEvent{ButtonMask: 1 << (button - 1), XPosition: x, YPosition: y},
+		&PointerEvent{XPosition: x, YPosition: y},
+	}, nil
+}
+
+// runeToKeysym maps a rune to the keysym that produces it and whether shift
+// must be held, assuming a US keyboard.
+func runeToKeysym(r rune) (uint32, bool, error) {
+	switch r {
+	case '\n':
+		return keysym["Return"], false, nil
+	case '\t':
+		return keysym["Tab"], false, nil
+	}
+
+	if unicode.IsControl(r) {
+		return 0, false, fmt.Errorf("cannot type control character %U", r)
+	}
+
+	shifted := unicode.IsUpper(r) || strings.ContainsRune(shiftedRunes, r)
+
+	// keysyms for latin-1 characters are the code point itself; everything
+	// else is the code point offset per the X11 convention
+	if r < 0x100 {
+		return uint32(r), shifted, nil
+	}
+
+	return uint32(r) + 0x01000000, shifted, nil
+}
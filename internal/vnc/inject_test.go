@@ -0,0 +1,101 @@
+// Copyright 2019-2021 National Technology & Engineering Solutions of Sandia, LLC (NTESS).
+// Under the terms of Contract DE-NA0003525 with NTESS, the U.S. Government retains certain
+// rights in this software.
+
+package vnc
+
+import (
+	"testing"
+)
+
+func TestTextEvents(t *testing.T) {
+	// "a" is a bare press and release
+	events, err := TextEvents("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 2 {
+		t.Fatalf("got %v events for `a`, want 2", len(events))
+	}
+
+	down := events[0].(*KeyEvent)
+	if down.DownFlag != 1 || down.Key != 'a' {
+		t.Errorf("unexpected key down: %v", down)
+	}
+
+	// "A" needs shift wrapped around it
+	events, err = TextEvents("A")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 4 {
+		t.Fatalf("got %v events for `A`, want 4", len(events))
+	}
+
+	shift := events[0].(*KeyEvent)
+	if shift.DownFlag != 1 || shift.Key != keysym["Shift_L"] {
+		t.Errorf("expected shift down first: %v", shift)
+	}
+	if up := events[3].(*KeyEvent); up.DownFlag != 0 || up.Key != keysym["Shift_L"] {
+		t.Errorf("expected shift up last: %v", up)
+	}
+
+	// symbols that need shift on a US keyboard
+	if events, err := TextEvents("!"); err != nil || len(events) != 4 {
+		t.Errorf("got %v events for `!` (err %v), want 4", len(events), err)
+	}
+
+	// newline presses Return
+	events, err = TextEvents("\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key := events[0].(*KeyEvent).Key; key != keysym["Return"] {
+		t.Errorf("got keysym %x for newline, want Return", key)
+	}
+
+	// control characters are rejected
+	if _, err := TextEvents("\x07"); err == nil {
+		t.Errorf("expected error for control character")
+	}
+}
+
+func TestKeyPressEvents(t *testing.T) {
+	events, err := KeyPressEvents("Return")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 2 {
+		t.Fatalf("got %v events, want 2", len(events))
+	}
+
+	if down := events[0].(*KeyEvent); down.DownFlag != 1 || down.Key != keysym["Return"] {
+		t.Errorf("unexpected key down: %v", down)
+	}
+
+	if _, err := KeyPressEvents("NoSuchKey"); err == nil {
+		t.Errorf("expected error for unknown key")
+	}
+}
+
+func TestClickEvents(t *testing.T) {
+	events, err := ClickEvents(400, 300, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 2 {
+		t.Fatalf("got %v events, want 2", len(events))
+	}
+
+	press := events[0].(*PointerEvent)
+	if press.ButtonMask != 1 || press.XPosition != 400 || press.YPosition != 300 {
+		t.Errorf("unexpected press: %v", press)
+	}
+	if release := events[1].(*PointerEvent); release.ButtonMask != 0 {
+		t.Errorf("expected button released: %v", release)
+	}
+
+	if _, err := ClickEvents(0, 0, 9); err == nil {
+		t.Errorf("expected error for invalid button")
+	}
+}
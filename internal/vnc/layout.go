@@ -0,0 +1,280 @@
+// Copyright 2019-2021 National Technology & Engineering Solutions of Sandia, LLC (NTESS).
+// Under the terms of Contract DE-NA0003525 with NTESS, the U.S. Government retains certain
+// rights in this software.
+
+package vnc
+
+import (
+	"fmt"
+	"sync/atomic"
+	"unicode"
+
+	log "github.com/sandia-minimega/minimega/v2/pkg/minilog"
+)
+
+// Layout translates character key events recorded or synthesized against one
+// keyboard layout into the events that type the same characters into a guest
+// configured for another layout. Keysyms travel to the guest through qemu's
+// en-us keymap, so translation maps each character to the en-us position of
+// the key that produces it in the guest's layout, plus the modifiers
+// (shift, AltGr) that position needs.
+type Layout struct {
+	name string
+	keys map[uint32]keystroke
+
+	unknown int64 // atomic, count of keysyms passed through untranslated
+}
+
+// keystroke is how to type one character: the keysym of the en-us label on
+// the physical key, and the modifiers to hold.
+type keystroke struct {
+	base  uint32
+	shift bool
+	altgr bool
+}
+
+// layoutKey describes one physical key in a layout: its en-us base character
+// and the characters it produces unmodified, shifted, and with AltGr held.
+// Zero means the position is unused (or a dead key we can't synthesize).
+type layoutKey struct {
+	base    rune
+	normal  rune
+	shifted rune
+	altgr   rune
+}
+
+// letterKeys builds the a-z rows, swapping the letters that moved relative to
+// the en-us layout (e.g. y and z on de).
+func letterKeys(swap map[rune]rune) []layoutKey {
+	var res []layoutKey
+
+	for r := 'a'; r <= 'z'; r++ {
+		out := r
+		if v, ok := swap[r]; ok {
+			out = v
+		}
+
+		res = append(res, layoutKey{base: r, normal: out, shifted: unicode.ToUpper(out)})
+	}
+
+	return res
+}
+
+var usKeys = []layoutKey{
+	{'`', '`', '~', 0},
+	{'1', '1', '!', 0},
+	{'2', '2', '@', 0},
+	{'3', '3', '#', 0},
+	{'4', '4', '$', 0},
+	{'5', '5', '%', 0},
+	{'6', '6', '^', 0},
+	{'7', '7', '&', 0},
+	{'8', '8', '*', 0},
+	{'9', '9', '(', 0},
+	{'0', '0', ')', 0},
+	{'-', '-', '_', 0},
+	{'=', '=', '+', 0},
+	{'[', '[', '{', 0},
+	{']', ']', '}', 0},
+	{'\\', '\\', '|', 0},
+	{';', ';', ':', 0},
+	{'\'', '\'', '"', 0},
+	{',', ',', '<', 0},
+	{'.', '.', '>', 0},
+	{'/', '/', '?', 0},
+	{' ', ' ', 0, 0},
+}
+
+// gbKeys lists only the positions that differ from en-us; the rest fall
+// through to the us rows.
+var gbKeys = []layoutKey{
+	{'`', '`', '¬', '¦'},
+	{'2', '2', '"', 0},
+	{'3', '3', '£', 0},
+	{'4', '4', '$', '€'},
+	{'\'', '\'', '@', 0},
+	{'\\', '#', '~', 0},
+}
+
+var deKeys = []layoutKey{
+	{'`', '^', '°', 0},
+	{'1', '1', '!', 0},
+	{'2', '2', '"', '²'},
+	{'3', '3', '§', '³'},
+	{'4', '4', '$', 0},
+	{'5', '5', '%', 0},
+	{'6', '6', '&', 0},
+	{'7', '7', '/', '{'},
+	{'8', '8', '(', '['},
+	{'9', '9', ')', ']'},
+	{'0', '0', '=', '}'},
+	{'-', 'ß', '?', '\\'},
+	{'[', 'ü', 'Ü', 0},
+	{']', '+', '*', '~'},
+	{';', 'ö', 'Ö', 0},
+	{'\'', 'ä', 'Ä', 0},
+	{'\\', '#', '\'', 0},
+	{',', ',', ';', 0},
+	{'.', '.', ':', 0},
+	{'/', '-', '_', 0},
+	{'q', 'q', 'Q', '@'},
+	{'e', 'e', 'E', '€'},
+	{'m', 'm', 'M', 'µ'},
+	{' ', ' ', 0, 0},
+}
+
+var frKeys = []layoutKey{
+	{'`', '²', 0, 0},
+	{'1', '&', '1', 0},
+	{'2', 'é', '2', '~'},
+	{'3', '"', '3', '#'},
+	{'4', '\'', '4', '{'},
+	{'5', '(', '5', '['},
+	{'6', '-', '6', '|'},
+	{'7', 'è', '7', '`'},
+	{'8', '_', '8', '\\'},
+	{'9', 'ç', '9', '^'},
+	{'0', 'à', '0', '@'},
+	{'-', ')', '°', ']'},
+	{'=', '=', '+', '}'},
+	{';', 'm', 'M', 0},
+	{'m', ',', '?', 0},
+	{',', ';', '.', 0},
+	{'.', ':', '/', 0},
+	{'/', '!', '§', 0},
+	{'\'', 'ù', '%', 0},
+	{']', '$', '£', 0},
+	{'\\', '*', 'µ', 0},
+	{'e', 'e', 'E', '€'},
+	{' ', ' ', 0, 0},
+}
+
+var layouts = map[string][]layoutKey{
+	"us": append(usKeys, letterKeys(nil)...),
+	"gb": append(append(gbKeys, usKeys...), letterKeys(nil)...),
+	"de": append(deKeys, letterKeys(map[rune]rune{'y': 'z', 'z': 'y'})...),
+	"fr": append(frKeys, letterKeys(map[rune]rune{'a': 'q', 'q': 'a', 'z': 'w', 'w': 'z'})...),
+}
+
+// ParseLayout returns a translator for the named guest keyboard layout.
+func ParseLayout(name string) (*Layout, error) {
+	rows, ok := layouts[name]
+	if !ok {
+		return nil, fmt.Errorf("unsupported layout: `%v` (supported: us, gb, de, fr)", name)
+	}
+
+	l := &Layout{
+		name: name,
+		keys: make(map[uint32]keystroke),
+	}
+
+	add := func(r rune, k keystroke) {
+		if r == 0 {
+			return
+		}
+
+		// earlier rows win so layout-specific rows can precede shared ones
+		if _, ok := l.keys[charKeysym(r)]; !ok {
+			l.keys[charKeysym(r)] = k
+		}
+	}
+
+	for _, row := range rows {
+		base := charKeysym(row.base)
+
+		add(row.normal, keystroke{base: base})
+		add(row.shifted, keystroke{base: base, shift: true})
+		add(row.altgr, keystroke{base: base, altgr: true})
+	}
+
+	return l, nil
+}
+
+// Name returns the layout's name.
+func (l *Layout) Name() string {
+	return l.name
+}
+
+// Unknown returns how many keysyms were passed through untranslated.
+func (l *Layout) Unknown() int64 {
+	return atomic.LoadInt64(&l.unknown)
+}
+
+// Translate maps one key event to the events that type the same character in
+// the target layout. Recorded modifier presses are dropped -- each translated
+// character carries exactly the modifiers it needs. Non-character keysyms
+// pass through unchanged, as do characters the layout can't produce, which
+// bump the unknown counter.
+func (l *Layout) Translate(e *KeyEvent) []Event {
+	switch e.Key {
+	case keysym["Shift_L"], keysym["Shift_R"], keysym["ISO_Level3_Shift"]:
+		return nil
+	}
+
+	ks, ok := l.keys[e.Key]
+	if !ok {
+		// control and function keysyms live at 0xff00 and up and need no
+		// translation; anything else is a character we can't map
+		if e.Key < 0xff00 {
+			if atomic.AddInt64(&l.unknown, 1) == 1 {
+				log.Warn("layout %v: passing through unknown keysym %x", l.name, e.Key)
+			}
+		}
+
+		return []Event{e}
+	}
+
+	var res []Event
+
+	if e.DownFlag != 0 {
+		if ks.shift {
+			res = append(res, &KeyEvent{DownFlag: 1, Key: keysym["Shift_L"]})
+		}
+		if ks.altgr {
+			res = append(res, &KeyEvent{DownFlag: 1, Key: keysym["ISO_Level3_Shift"]})
+		}
+
+		res = append(res, &KeyEvent{DownFlag: 1, Key: ks.base})
+	} else {
+		res = append(res, &KeyEvent{Key: ks.base})
+
+		if ks.altgr {
+			res = append(res, &KeyEvent{Key: keysym["ISO_Level3_Shift"]})
+		}
+		if ks.shift {
+			res = append(res, &KeyEvent{Key: keysym["Shift_L"]})
+		}
+	}
+
+	return res
+}
+
+// TranslateEvents translates a synthesized event sequence (see TextEvents)
+// for the target layout. Non-key events pass through unchanged.
+func (l *Layout) TranslateEvents(events []Event) []Event {
+	var res []Event
+
+	for _, e := range events {
+		if ke, ok := e.(*KeyEvent); ok {
+			res = append(res, l.Translate(ke)...)
+		} else {
+			res = append(res, e)
+		}
+	}
+
+	return res
+}
+
+// charKeysym returns the keysym for a character: the code point for latin-1,
+// with special cases for the few others our layouts produce.
+func charKeysym(r rune) uint32 {
+	if r == '€' {
+		return keysym["EuroSign"]
+	}
+
+	if r < 0x100 {
+		return uint32(r)
+	}
+
+	return uint32(r) + 0x01000000
+}
@@ -0,0 +1,147 @@
+// Copyright 2019-2021 National Technology & Engineering Solutions of Sandia, LLC (NTESS).
+// Under the terms of Contract DE-NA0003525 with NTESS, the U.S. Government retains certain
+// rights in this software.
+
+package vnc
+
+import (
+	"testing"
+)
+
+// simulate types a translated event sequence against the named layout's
+// physical keys and returns the characters the guest would see.
+func simulate(t *testing.T, name string, events []Event) string {
+	byBase := map[uint32]layoutKey{}
+	for _, row := range layouts[name] {
+		if _, ok := byBase[charKeysym(row.base)]; !ok {
+			byBase[charKeysym(row.base)] = row
+		}
+	}
+
+	var shift, altgr bool
+	var out []rune
+
+	for _, e := range events {
+		ke, ok := e.(*KeyEvent)
+		if !ok {
+			t.Fatalf("unexpected event: %v", e)
+		}
+
+		switch ke.Key {
+		case keysym["Shift_L"], keysym["Shift_R"]:
+			shift = ke.DownFlag != 0
+		case keysym["ISO_Level3_Shift"]:
+			altgr = ke.DownFlag != 0
+		case keysym["Return"]:
+			if ke.DownFlag != 0 {
+				out = append(out, '\n')
+			}
+		default:
+			if ke.DownFlag == 0 {
+				continue
+			}
+
+			row, ok := byBase[ke.Key]
+			if !ok {
+				t.Fatalf("sent keysym %x not on a %v keyboard", ke.Key, name)
+			}
+
+			switch {
+			case altgr:
+				out = append(out, row.altgr)
+			case shift:
+				out = append(out, row.shifted)
+			default:
+				out = append(out, row.normal)
+			}
+		}
+	}
+
+	return string(out)
+}
+
+// TestLayoutRoundTrip synthesizes text as a US client would, translates it
+// for each supported guest layout, and checks that typing the translated
+// events on that layout's keyboard reproduces the text.
+func TestLayoutRoundTrip(t *testing.T) {
+	tests := []struct {
+		layout string
+		text   string
+	}{
+		{"us", "Hello, World! ls -la | grep \"foo\"\n"},
+		{"gb", "admin@host.co.uk #2 ~price £5"},
+		{"de", "zählen: Straße? (Müller) q@w 10%"},
+		{"fr", "année 1789; ça & ço! m,q.w"},
+	}
+
+	for _, tt := range tests {
+		l, err := ParseLayout(tt.layout)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		events, err := TextEvents(tt.text)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		got := simulate(t, tt.layout, l.TranslateEvents(events))
+		if got != tt.text {
+			t.Errorf("%v: typed %q, want %q", tt.layout, got, tt.text)
+		}
+
+		if l.Unknown() != 0 {
+			t.Errorf("%v: %v keysyms passed through untranslated", tt.layout, l.Unknown())
+		}
+	}
+}
+
+// TestLayoutMoved checks a few well-known moved keys directly.
+func TestLayoutMoved(t *testing.T) {
+	de, _ := ParseLayout("de")
+
+	// z sits at the us y position on a German keyboard
+	events := de.Translate(&KeyEvent{DownFlag: 1, Key: 'z'})
+	if key := events[0].(*KeyEvent).Key; key != 'y' {
+		t.Errorf("de z: got base %c, want y", key)
+	}
+
+	// @ needs AltGr+q
+	events = de.Translate(&KeyEvent{DownFlag: 1, Key: '@'})
+	if len(events) != 2 || events[0].(*KeyEvent).Key != keysym["ISO_Level3_Shift"] {
+		t.Errorf("de @: expected AltGr wrap, got %v", events)
+	}
+	if key := events[1].(*KeyEvent).Key; key != 'q' {
+		t.Errorf("de @: got base %c, want q", key)
+	}
+
+	fr, _ := ParseLayout("fr")
+
+	// a sits at the us q position on an AZERTY keyboard
+	events = fr.Translate(&KeyEvent{DownFlag: 1, Key: 'a'})
+	if key := events[0].(*KeyEvent).Key; key != 'q' {
+		t.Errorf("fr a: got base %c, want q", key)
+	}
+}
+
+// TestLayoutUnknown checks that untranslatable characters pass through and
+// are counted.
+func TestLayoutUnknown(t *testing.T) {
+	us, _ := ParseLayout("us")
+
+	e := &KeyEvent{DownFlag: 1, Key: charKeysym('€')}
+
+	events := us.Translate(e)
+	if len(events) != 1 || events[0] != Event(e) {
+		t.Errorf("expected pass-through, got %v", events)
+	}
+	if us.Unknown() != 1 {
+		t.Errorf("got %v unknown, want 1", us.Unknown())
+	}
+
+	// control keys pass through without counting
+	us.Translate(&KeyEvent{DownFlag: 1, Key: keysym["Return"]})
+	if us.Unknown() != 1 {
+		t.Errorf("control keys should not count as unknown")
+	}
+}
@@ -11,6 +11,7 @@ import (
 	"image"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -31,9 +32,21 @@ type playback struct {
 	done        chan bool        // teardown playback
 	screenshots chan *image.RGBA // screenshots of the VM
 
+	// layout optionally translates key events for the guest's keyboard
+	// layout, set before Start and not changed after
+	layout *Layout
+
+	// delay postpones the start of the playback, set before Start and not
+	// changed after; used to stagger playbacks into several VMs
+	delay time.Duration
+
 	sync.Mutex               // guards below
 	depth      int           // how nested we are in LoadFiles
-	duration   time.Duration // total playback duration
+	duration   time.Duration // remaining playback duration, in recorded time
+	total      time.Duration // total playback duration, in recorded time
+	rate       float64       // playback speed multiplier
+	skip       int           // events to inject without waiting (see Step)
+	seekTarget time.Duration // discard events before this position (see Seek)
 	e          string        // current event
 	state      Control       // playback state, only Play or Pause
 	closed     bool          // set after playback closed
@@ -41,6 +54,21 @@ type playback struct {
 	err        error         // error
 }
 
+// minWait floors scaled inter-event waits so that a large playback rate
+// paces events out rather than flooding them into the connection.
+const minWait = 100 * time.Microsecond
+
+// ParseRate parses a playback speed multiplier such as "4x" or "0.5x" (the
+// trailing "x" is optional).
+func ParseRate(s string) (float64, error) {
+	rate, err := strconv.ParseFloat(strings.TrimSuffix(s, "x"), 64)
+	if err != nil || rate <= 0 {
+		return 0, fmt.Errorf("invalid playback rate: `%v`", s)
+	}
+
+	return rate, nil
+}
+
 type signal struct {
 	kind Control
 	data interface{}
@@ -61,6 +89,7 @@ func newPlayback(id, rhost string) (*playback, error) {
 		done:        make(chan bool),
 		screenshots: make(chan *image.RGBA),
 		state:       Play,
+		rate:        1,
 	}, nil
 }
 
@@ -84,10 +113,13 @@ func (p *playback) Info() []string {
 		"playback kb",
 	}
 
+	position := p.total - p.duration
+
 	if p.state == Pause {
-		res = append(res, "PAUSED")
+		res = append(res, fmt.Sprintf("PAUSED %v/%v (%gx)", position, p.total, p.rate))
 	} else {
-		res = append(res, fmt.Sprintf("%v remaining", p.duration))
+		remaining := time.Duration(float64(p.duration) / p.rate)
+		res = append(res, fmt.Sprintf("%v/%v, %v remaining (%gx)", position, p.total, remaining, p.rate))
 	}
 
 	if p.file != nil {
@@ -117,6 +149,11 @@ func (p *playback) Start(filename string) error {
 
 	go p.writeEvents()
 	go func() {
+		if p.delay > 0 {
+			log.Info("delaying playback %v by %v", p.ID, p.delay)
+			time.Sleep(p.delay)
+		}
+
 		if err := p.playFile(nil, filename); err != nil {
 			log.Error("playback failed: %v", err)
 		}
@@ -161,15 +198,41 @@ func (p *playback) Start(filename string) error {
 	return nil
 }
 
-func (p *playback) Step() error {
+// Step injects the next n events immediately, without waiting out their
+// recorded delays.
+func (p *playback) Step(n int) error {
 	p.Lock()
 	defer p.Unlock()
 
+	if n < 1 {
+		return fmt.Errorf("invalid step count: %v", n)
+	}
+
 	if p.state != Play || p.closed {
 		return errors.New("playback not stepable")
 	}
 
-	p.signal <- signal{kind: Step}
+	p.signal <- signal{kind: Step, data: n}
+
+	return nil
+}
+
+// Seek fast-forwards to the given position from the start of the playback.
+// Events before the target are discarded rather than injected, except key
+// releases, which are still sent so that no key is left stuck down.
+func (p *playback) Seek(target time.Duration) error {
+	p.Lock()
+	defer p.Unlock()
+
+	if p.state != Play || p.closed {
+		return errors.New("playback not seekable")
+	}
+
+	if position := p.total - p.duration; target <= position {
+		return fmt.Errorf("can only seek forward (currently at %v)", position)
+	}
+
+	p.signal <- signal{kind: Seek, data: target}
 
 	return nil
 }
@@ -202,6 +265,54 @@ func (p *playback) Continue() error {
 	return nil
 }
 
+// SetRate adjusts the playback speed multiplier. Takes effect immediately
+// when playing; when paused, it applies on resume. Queued events are never
+// dropped by a rate change.
+func (p *playback) SetRate(rate float64) error {
+	if rate <= 0 {
+		return fmt.Errorf("invalid playback rate: %v", rate)
+	}
+
+	p.Lock()
+	defer p.Unlock()
+
+	if p.closed {
+		return errors.New("playback has already stopped")
+	}
+
+	p.rate = rate
+
+	if p.state == Play {
+		// interrupt the current wait so the new rate applies to it too
+		p.signal <- signal{kind: Rate}
+	}
+
+	return nil
+}
+
+// scaleWait converts a recorded inter-event duration to the wall time to
+// wait at the current rate, floored so events stay paced.
+func (p *playback) scaleWait(d time.Duration) time.Duration {
+	p.Lock()
+	defer p.Unlock()
+
+	wait := time.Duration(float64(d) / p.rate)
+	if d > 0 && wait < minWait {
+		wait = minWait
+	}
+
+	return wait
+}
+
+// scaleElapsed converts elapsed wall time back to recorded time at the
+// current rate.
+func (p *playback) scaleElapsed(d time.Duration) time.Duration {
+	p.Lock()
+	defer p.Unlock()
+
+	return time.Duration(float64(d) * p.rate)
+}
+
 func (p *playback) Stop() error {
 	p.Lock()
 	defer p.Unlock()
@@ -284,7 +395,12 @@ func (v *playback) playFile(parent *os.File, filename string) error {
 		v.resetFile(old)
 	}()
 
-	scanner := bufio.NewScanner(f)
+	r, err := recordingReader(f)
+	if err != nil {
+		return err
+	}
+
+	scanner := bufio.NewScanner(r)
 
 	for scanner.Scan() {
 		// Parse the event
@@ -317,70 +433,34 @@ func (v *playback) playFile(parent *os.File, filename string) error {
 			continue
 		}
 
-		for {
-			start := time.Now()
-
-			select {
-			case <-time.After(duration):
-				v.addDuration(-duration)
+		ok, err := v.advance(f, duration)
+		if err != nil {
+			return err
+		} else if !ok {
+			// signal channel closed -- bail
+			log.Info("abort playback of %v due to signal", f.Name())
+			return nil
+		}
 
-				goto Event
-			case sig, ok := <-v.signal:
-				if !ok {
-					// signal channel closed -- bail
-					log.Info("abort playback of %v due to signal", f.Name())
-					return nil
+		// while seeking, discard events before the target rather than
+		// injecting them, but still send key releases so that no key is left
+		// stuck down, and still follow nested files
+		if v.seeking() {
+			switch e := res.(type) {
+			case *KeyEvent:
+				if e.DownFlag == 0 {
+					v.out <- e
 				}
-
-				waited := start.Sub(time.Now())
-				v.addDuration(-waited)
-
-				// don't need to wait as long next time
-				duration -= waited
-
-				switch sig.kind {
-				case Pause:
-					sig, ok := <-v.signal
-					if !ok {
-						// signal channel closed -- bail
-						log.Info("abort playback of %v due to signal", f.Name())
-						return nil
-					}
-
-					switch sig.kind {
-					case Play:
-						// do nothing except keep playing
-					default:
-						log.Error("unexpected signal: %v", sig)
-					}
-				case Step:
-					// decrease by the remaining
-					v.addDuration(-duration)
-
-					goto Event
-				case LoadFile:
-					e := sig.data.(LoadFileEvent)
-
-					if err := v.playFile(f, e.File); err != nil {
-						return err
-					}
-				case WaitForIt:
-					e := sig.data.(*WaitForItEvent)
-
-					// TODO: what to do for duration?
-					if e2, err := v.waitForIt(e); err != nil {
-						return err
-					} else if e.Click {
-						v.out <- e2
-					}
-				default:
-					log.Error("unexpected signal: %v", sig)
+			case *LoadFileEvent:
+				if err := v.playFile(f, e.File); err != nil {
+					return err
 				}
 			}
+
+			continue
 		}
 
 		// waited so process the event
-	Event:
 		switch e := res.(type) {
 		case Event:
 			v.out <- e
@@ -401,6 +481,128 @@ func (v *playback) playFile(parent *os.File, filename string) error {
 	return nil
 }
 
+// advance waits out the delay for the next event, running the playback state
+// machine: pause/resume, rate changes, pending steps and seeks, and injected
+// pseudo events all land here. Returns false when the playback has been
+// stopped.
+func (v *playback) advance(f *os.File, duration time.Duration) (bool, error) {
+	// a pending step or seek consumes the event immediately
+	if v.skipWait() {
+		v.addDuration(-duration)
+		return true, nil
+	}
+
+	for {
+		start := time.Now()
+
+		select {
+		case <-time.After(v.scaleWait(duration)):
+			v.addDuration(-duration)
+
+			return true, nil
+		case sig, ok := <-v.signal:
+			if !ok {
+				return false, nil
+			}
+
+			// account for the recorded time we already waited out
+			waited := v.scaleElapsed(time.Since(start))
+			if waited > duration {
+				waited = duration
+			}
+			v.addDuration(-waited)
+
+			// don't need to wait as long next time
+			duration -= waited
+
+			switch sig.kind {
+			case Rate:
+				// nothing to do -- the next pass through the loop rescales
+				// the remaining wait
+			case Pause:
+				sig, ok := <-v.signal
+				if !ok {
+					return false, nil
+				}
+
+				switch sig.kind {
+				case Play:
+					// do nothing except keep playing
+				default:
+					log.Error("unexpected signal: %v", sig)
+				}
+			case Step:
+				// this event fires now, any remaining count skips the waits
+				// for the events after it
+				v.setSkip(sig.data.(int) - 1)
+				v.addDuration(-duration)
+
+				return true, nil
+			case Seek:
+				// discarding starts with this event
+				v.setSeek(sig.data.(time.Duration))
+				v.addDuration(-duration)
+
+				return true, nil
+			case LoadFile:
+				e := sig.data.(*LoadFileEvent)
+
+				if err := v.playFile(f, e.File); err != nil {
+					return false, err
+				}
+			case WaitForIt:
+				e := sig.data.(*WaitForItEvent)
+
+				// TODO: what to do for duration?
+				if e2, err := v.waitForIt(e); err != nil {
+					return false, err
+				} else if e.Click {
+					v.out <- e2
+				}
+			default:
+				log.Error("unexpected signal: %v", sig)
+			}
+		}
+	}
+}
+
+// skipWait reports whether the next event should fire without waiting, either
+// because a step consumed it or because we're seeking past it.
+func (v *playback) skipWait() bool {
+	v.Lock()
+	defer v.Unlock()
+
+	if v.skip > 0 {
+		v.skip--
+		return true
+	}
+
+	return v.seekTarget > v.total-v.duration
+}
+
+func (v *playback) setSkip(n int) {
+	v.Lock()
+	defer v.Unlock()
+
+	v.skip = n
+}
+
+func (v *playback) setSeek(target time.Duration) {
+	v.Lock()
+	defer v.Unlock()
+
+	v.seekTarget = target
+}
+
+// seeking reports whether the playback is still fast-forwarding to a seek
+// target.
+func (v *playback) seeking() bool {
+	v.Lock()
+	defer v.Unlock()
+
+	return v.seekTarget > v.total-v.duration
+}
+
 // waitForIt waits until the template image is displayed. If it is detected
 // within the timeout, returns a PointerEvent to click on the center of the
 // template image.
@@ -481,20 +683,40 @@ func (p *playback) addDuration(d time.Duration) {
 	defer p.Unlock()
 
 	p.duration += d
+
+	// positive durations are newly loaded files, which also grow the total;
+	// negative ones are playback progress
+	if d > 0 {
+		p.total += d
+	}
 }
 
 // writeEvents reads events from the out channel and write them to the vnc
-// connection. Closes the connection when it drains the channel.
+// connection, translating key events when a layout is set. Closes the
+// connection when it drains the channel.
 func (p *playback) writeEvents() {
 	defer p.Conn.Close()
 
 	for e := range p.out {
-		if err := e.Write(p.Conn); err != nil {
-			log.Error("unable to write vnc event: %v", err)
-			break
+		events := []Event{e}
+		if ke, ok := e.(*KeyEvent); ok && p.layout != nil {
+			events = p.layout.Translate(ke)
+		}
+
+		for _, e := range events {
+			if err := e.Write(p.Conn); err != nil {
+				log.Error("unable to write vnc event: %v", err)
+				goto done
+			}
 		}
 	}
 
+done:
+	if p.layout != nil && p.layout.Unknown() > 0 {
+		log.Info("playback %v: %v keysyms passed through untranslated by layout %v",
+			p.ID, p.layout.Unknown(), p.layout.Name())
+	}
+
 	// stop ourselves in a separate goroutine to avoid a deadlock
 	go p.Stop()
 
@@ -0,0 +1,81 @@
+// Copyright 2019-2021 National Technology & Engineering Solutions of Sandia, LLC (NTESS).
+// Under the terms of Contract DE-NA0003525 with NTESS, the U.S. Government retains certain
+// rights in this software.
+
+package vnc
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseRate(t *testing.T) {
+	tests := []struct {
+		s    string
+		want float64
+		err  bool
+	}{
+		{"4x", 4, false},
+		{"0.5x", 0.5, false},
+		{"1", 1, false},
+		{"0x", 0, true},
+		{"-2x", 0, true},
+		{"fast", 0, true},
+	}
+
+	for _, tt := range tests {
+		got, err := ParseRate(tt.s)
+		if (err != nil) != tt.err {
+			t.Errorf("%v: unexpected error state: %v", tt.s, err)
+		}
+		if got != tt.want {
+			t.Errorf("%v: got %v, want %v", tt.s, got, tt.want)
+		}
+	}
+}
+
+func TestScaleWait(t *testing.T) {
+	p := &playback{rate: 4}
+
+	if got := p.scaleWait(time.Second); got != 250*time.Millisecond {
+		t.Errorf("got %v, want 250ms", got)
+	}
+
+	// tiny waits are floored so events stay paced
+	if got := p.scaleWait(time.Nanosecond); got != minWait {
+		t.Errorf("got %v, want %v", got, minWait)
+	}
+
+	// zero stays zero
+	if got := p.scaleWait(0); got != 0 {
+		t.Errorf("got %v, want 0", got)
+	}
+}
+
+func TestSkipWait(t *testing.T) {
+	p := &playback{rate: 1}
+
+	// a pending step consumes waits one at a time
+	p.setSkip(2)
+	if !p.skipWait() || !p.skipWait() {
+		t.Errorf("pending steps should skip waits")
+	}
+	if p.skipWait() {
+		t.Errorf("exhausted steps should not skip waits")
+	}
+
+	// a seek target ahead of the current position skips waits until the
+	// position catches up
+	p.addDuration(10 * time.Second)
+	p.setSeek(4 * time.Second)
+
+	if !p.skipWait() || !p.seeking() {
+		t.Errorf("expected to be seeking at position 0")
+	}
+
+	p.addDuration(-5 * time.Second)
+
+	if p.skipWait() || p.seeking() {
+		t.Errorf("expected seek to finish at position 5s")
+	}
+}
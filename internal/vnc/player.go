@@ -7,6 +7,7 @@ package vnc
 import (
 	"fmt"
 	"sync"
+	"time"
 
 	log "github.com/sandia-minimega/minimega/v2/pkg/minilog"
 )
@@ -42,9 +43,21 @@ func (p *Player) Continue(id string) error {
 	})
 }
 
-func (p *Player) Step(id string) error {
+func (p *Player) Step(id string, n int) error {
 	return p.apply(id, func(p *playback) error {
-		return p.Step()
+		return p.Step(n)
+	})
+}
+
+func (p *Player) Seek(id string, target time.Duration) error {
+	return p.apply(id, func(p *playback) error {
+		return p.Seek(target)
+	})
+}
+
+func (p *Player) SetRate(id string, rate float64) error {
+	return p.apply(id, func(p *playback) error {
+		return p.SetRate(rate)
 	})
 }
 
@@ -97,27 +110,36 @@ func (p *Player) reap() {
 }
 
 // Creates a new VNC connection, the initial playback reader, and starts the
-// vnc playback
-func (p *Player) Playback(id, rhost, filename string) error {
+// vnc playback at the given speed multiplier. A non-nil layout translates key
+// events for the guest's keyboard layout. A non-zero delay postpones the
+// start of the playback, for staggering playbacks into several VMs.
+func (p *Player) Playback(id, rhost, filename string, rate float64, layout *Layout, delay time.Duration) error {
 	p.mu.Lock()
 	defer p.mu.Unlock()
 
 	// clear out any old playbacks
 	p.reap()
 
-	return p.playback(id, rhost, filename)
+	return p.playback(id, rhost, filename, rate, layout, delay)
 }
 
-func (p *Player) playback(id, rhost, filename string) error {
+func (p *Player) playback(id, rhost, filename string, rate float64, layout *Layout, delay time.Duration) error {
 	// Is this playback already running?
 	if _, ok := p.m[id]; ok {
 		return fmt.Errorf("kb playback %v already playing", id)
 	}
 
+	if rate <= 0 {
+		return fmt.Errorf("invalid playback rate: %v", rate)
+	}
+
 	pb, err := newPlayback(id, rhost)
 	if err != nil {
 		return err
 	}
+	pb.rate = rate
+	pb.layout = layout
+	pb.delay = delay
 
 	p.m[pb.ID] = pb
 
@@ -157,7 +179,7 @@ func (p *Player) Inject(id, rhost, s string) error {
 	case *LoadFileEvent:
 		// This is an injected LoadFile event without a running playback. This is
 		// equivalent to starting a new vnc playback.
-		return p.playback(id, rhost, e.File)
+		return p.playback(id, rhost, e.File, 1, nil, 0)
 	case *WaitForItEvent:
 		return fmt.Errorf("unhandled inject event for non-running playback: %T", e)
 	default:
@@ -165,6 +187,53 @@ func (p *Player) Inject(id, rhost, s string) error {
 	}
 }
 
+// injectInterval paces synthesized event sequences so that bursts of
+// injected input don't overrun the guest.
+const injectInterval = 10 * time.Millisecond
+
+// InjectEvents writes a synthesized event sequence to the VM, through the
+// active playback if there is one and over a fresh connection otherwise.
+func (p *Player) InjectEvents(id, rhost string, events []Event) error {
+	p.mu.Lock()
+	p.reap()
+	pb := p.m[id]
+	p.mu.Unlock()
+
+	log.Info("injecting %v events into %v", len(events), id)
+
+	if pb != nil {
+		for _, e := range events {
+			log.Debug("inject %v: %v", id, e)
+
+			if err := pb.InjectEvent(e); err != nil {
+				return err
+			}
+
+			time.Sleep(injectInterval)
+		}
+
+		return nil
+	}
+
+	conn, err := Dial(rhost)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	for _, e := range events {
+		log.Debug("inject %v: %v", id, e)
+
+		if err := e.Write(conn); err != nil {
+			return err
+		}
+
+		time.Sleep(injectInterval)
+	}
+
+	return nil
+}
+
 func (p *Player) Info() [][]string {
 	p.mu.RLock()
 	defer p.mu.RUnlock()
@@ -20,8 +20,9 @@ import (
 type Recorder struct {
 	mu sync.RWMutex // guards below
 
-	kb map[string]*kbRecorder
-	fb map[string]*fbRecorder
+	kb   map[string]*kbRecorder
+	fb   map[string]*fbRecorder
+	shim map[string]*shimFBRecorder
 }
 
 type recorder struct {
@@ -31,8 +32,15 @@ type recorder struct {
 	err   error
 	done  chan bool
 	start time.Time
+
+	mu sync.Mutex   // guards below
+	w  io.Writer    // recording output, the file or gz when compressing
+	gz *gzip.Writer // non-nil when compressing
 }
 
+// flushInterval bounds how much of a compressed recording a crash can lose.
+const flushInterval = 5 * time.Second
+
 type kbRecorder struct {
 	*recorder // embed
 
@@ -45,37 +53,94 @@ type fbRecorder struct {
 
 func NewRecorder() *Recorder {
 	return &Recorder{
-		kb: make(map[string]*kbRecorder),
-		fb: make(map[string]*fbRecorder),
+		kb:   make(map[string]*kbRecorder),
+		fb:   make(map[string]*fbRecorder),
+		shim: make(map[string]*shimFBRecorder),
 	}
 }
 
-func newRecorder(rhost, filename string) (*recorder, error) {
+func newRecorder(rhost, filename string, compress bool) (*recorder, error) {
 	c, err := Dial(rhost)
 	if err != nil {
 		return nil, err
 	}
 
-	f, err := os.Create(filename)
+	r, err := newFileRecorder(filename, compress)
 	if err != nil {
 		c.Close()
 		return nil, err
 	}
+	r.Conn = c
+
+	return r, nil
+}
+
+// newFileRecorder opens the recording output, optionally gzip-compressed with
+// periodic flushes so that a crash doesn't lose the whole session.
+func newFileRecorder(filename string, compress bool) (*recorder, error) {
+	f, err := os.Create(filename)
+	if err != nil {
+		return nil, err
+	}
 
-	return &recorder{
-		Conn:  c,
+	r := &recorder{
 		file:  f,
 		start: time.Now(),
 		done:  make(chan bool),
-	}, nil
+	}
+	r.w = f
+
+	if compress {
+		r.gz = gzip.NewWriter(f)
+		r.w = r.gz
+
+		go r.flusher()
+	}
+
+	return r, nil
+}
+
+// flusher periodically flushes the compressor so that the recording on disk
+// stays close to current.
+func (r *recorder) flusher() {
+	for {
+		select {
+		case <-r.done:
+			return
+		case <-time.After(flushInterval):
+			r.mu.Lock()
+			if r.gz != nil {
+				if err := r.gz.Flush(); err != nil {
+					log.Error("unable to flush recording: %v", err)
+				}
+			}
+			r.mu.Unlock()
+		}
+	}
 }
 
 func (r *recorder) Stop() error {
+	close(r.done)
+
+	r.mu.Lock()
+
+	if r.gz != nil {
+		if err := r.gz.Close(); err != nil {
+			r.mu.Unlock()
+			return err
+		}
+		r.gz = nil
+	}
+
 	if r.file != nil {
 		if err := r.file.Close(); err != nil {
+			r.mu.Unlock()
 			return err
 		}
 	}
+	r.w = nil
+
+	r.mu.Unlock()
 
 	if r.Conn != nil {
 		if err := r.Conn.Close(); err != nil {
@@ -86,7 +151,7 @@ func (r *recorder) Stop() error {
 	return nil
 }
 
-func (r *Recorder) RecordKB(id, rhost, filename string) error {
+func (r *Recorder) RecordKB(id, rhost, filename string, compress bool) error {
 	r.mu.Lock()
 	defer r.mu.Unlock()
 
@@ -95,7 +160,7 @@ func (r *Recorder) RecordKB(id, rhost, filename string) error {
 		return fmt.Errorf("kb recording for %v already running", id)
 	}
 
-	rc, err := newRecorder(rhost, filename)
+	rc, err := newRecorder(rhost, filename, compress)
 	if err != nil {
 		return err
 	}
@@ -118,7 +183,7 @@ func (r *Recorder) RecordFB(id, rhost, filename string) error {
 		return fmt.Errorf("fb recording for %v already running", id)
 	}
 
-	rc, err := newRecorder(rhost, filename)
+	rc, err := newRecorder(rhost, filename, false)
 	if err != nil {
 		return err
 	}
@@ -133,6 +198,28 @@ func (r *Recorder) RecordFB(id, rhost, filename string) error {
 	return nil
 }
 
+// RecordShimFB records the server-to-client traffic of the VM's proxied vnc
+// connections, capturing what the user actually saw. maxSize bounds the
+// recording file, zero for unbounded; when exceeded the file is rotated once
+// to filename.1.
+func (r *Recorder) RecordShimFB(id, filename string, maxSize int64) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	// is this vm already being recorded?
+	if _, ok := r.shim[id]; ok {
+		return fmt.Errorf("shimfb recording for %v already running", id)
+	}
+
+	shim, err := newShimFBRecorder(filename, maxSize)
+	if err != nil {
+		return err
+	}
+	r.shim[id] = shim
+
+	return nil
+}
+
 // Route records a message for the correct recording based on the VM
 func (r *Recorder) Route(id string, msg interface{}) {
 	r.mu.RLock()
@@ -141,6 +228,67 @@ func (r *Recorder) Route(id string, msg interface{}) {
 	if r, ok := r.kb[id]; ok {
 		r.Record(msg)
 	}
+
+	// the shim fb recorder tracks the client-negotiated pixel format so it
+	// can frame the server's messages
+	if r, ok := r.shim[id]; ok {
+		r.clientMessage(msg)
+	}
+}
+
+// RouteFB records server-to-client bytes for the correct recording based on
+// the VM. Drops them on the floor if the VM isn't being recorded.
+func (r *Recorder) RouteFB(id string, b []byte) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	if r, ok := r.shim[id]; ok {
+		r.route(b)
+	}
+}
+
+// fbTap adapts RouteFB to an io.Writer so that connectVNC can tee the
+// server-to-client stream through it. Writes never fail and never block.
+type fbTap struct {
+	r  *Recorder
+	id string
+}
+
+func (t *fbTap) Write(p []byte) (int, error) {
+	// the tee reuses its buffer so the recorder needs a copy
+	b := make([]byte, len(p))
+	copy(b, p)
+
+	t.r.RouteFB(t.id, b)
+
+	return len(p), nil
+}
+
+// FBTap returns a writer that records whatever is written through it for the
+// given VM, for teeing a proxied vnc connection.
+func (r *Recorder) FBTap(id string) io.Writer {
+	return &fbTap{r: r, id: id}
+}
+
+// Recording reports whether a recording of the given kind ("kb", "fb", or
+// "shimfb") is active for the VM.
+func (r *Recorder) Recording(kind, id string) bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	switch kind {
+	case "kb":
+		_, ok := r.kb[id]
+		return ok
+	case "fb":
+		_, ok := r.fb[id]
+		return ok
+	case "shimfb":
+		_, ok := r.shim[id]
+		return ok
+	}
+
+	return false
 }
 
 func (r *Recorder) StopKB(id string) error {
@@ -175,6 +323,22 @@ func (r *Recorder) StopFB(id string) error {
 	return fmt.Errorf("fb recording %v not found", id)
 }
 
+func (r *Recorder) StopShimFB(id string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if shim, ok := r.shim[id]; ok {
+		if err := shim.Stop(); err != nil {
+			return err
+		}
+
+		delete(r.shim, id)
+		return nil
+	}
+
+	return fmt.Errorf("shimfb recording %v not found", id)
+}
+
 // Clear stops all recordings
 func (r *Recorder) Clear() {
 	r.mu.Lock()
@@ -197,6 +361,15 @@ func (r *Recorder) Clear() {
 
 		delete(r.fb, k)
 	}
+
+	for k, shim := range r.shim {
+		log.Debug("stopping shimfb recording for %v", k)
+		if err := shim.Stop(); err != nil {
+			log.Error("%v", err)
+		}
+
+		delete(r.shim, k)
+	}
 }
 
 func (r *Recorder) Info() [][]string {
@@ -223,10 +396,20 @@ func (r *Recorder) Info() [][]string {
 		})
 	}
 
+	for id, shim := range r.shim {
+		res = append(res, []string{
+			id,
+			"record shimfb",
+			time.Since(shim.start).String(),
+			shim.name,
+		})
+	}
+
 	return res
 }
 
-// Record records a  client-to-server message in plaintext
+// Record records a client-to-server message in plaintext, through the
+// compressor when the recording is compressed
 func (kb *kbRecorder) Record(msg interface{}) {
 	delta := time.Now().Sub(kb.last).Nanoseconds()
 
@@ -237,7 +420,12 @@ func (kb *kbRecorder) Record(msg interface{}) {
 	case *ClientCutText:
 		// Don't record
 	case *KeyEvent, *PointerEvent:
-		fmt.Fprintf(kb.file, "%d:%s\n", delta, msg)
+		kb.mu.Lock()
+		if kb.w != nil {
+			fmt.Fprintf(kb.w, "%d:%s\n", delta, msg)
+		}
+		kb.mu.Unlock()
+
 		kb.last = time.Now()
 	default:
 		log.Info("unexpected  client-to-server message: %#v\n", msg)
@@ -0,0 +1,324 @@
+// Copyright 2019-2021 National Technology & Engineering Solutions of Sandia, LLC (NTESS).
+// Under the terms of Contract DE-NA0003525 with NTESS, the U.S. Government retains certain
+// rights in this software.
+
+package vnc
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sandia-minimega/minimega/v2/pkg/minilog"
+)
+
+// shimFBRecorder captures the server-to-client half of a proxied vnc
+// connection so that what the user actually saw can be reconstructed, unlike
+// the fb recorder which drives its own connection. Bytes are teed out of the
+// proxy by connectVNC and framed into timestamped chunks at message
+// boundaries (FramebufferUpdate, SetColourMapEntries, Bell, ServerCutText)
+// written fbs-style to a gzipped file. Encodings we can't size (anything
+// beyond Raw and the pseudo-encodings) switch the recorder to unframed
+// chunks rather than corrupting the recording; the proxy stream itself is
+// never touched.
+type shimFBRecorder struct {
+	in      chan []byte
+	done    chan bool
+	dropped int64 // atomic, bytes dropped because the recorder fell behind
+
+	mu sync.Mutex // guards below
+
+	file    *os.File
+	w       *gzip.Writer
+	name    string
+	maxSize int64 // rotate after this many uncompressed bytes, 0 for never
+	size    int64
+	start   time.Time
+	prev    time.Time
+
+	// bytesPerPixel tracks the client-negotiated pixel format, needed to
+	// size Raw rectangles. Updated from SetPixelFormat messages seen on the
+	// client-to-server side; defaults to the 32-bit format most clients use.
+	bytesPerPixel int
+
+	passthrough bool  // set once framing gives up
+	skipped     int64 // bytes discarded while hunting for a message boundary
+}
+
+// shimFBBuffer bounds how many chunks can be queued for the recorder before
+// the proxy starts dropping them; the proxy must never block on recording.
+const shimFBBuffer = 512
+
+func newShimFBRecorder(filename string, maxSize int64) (*shimFBRecorder, error) {
+	f, err := os.Create(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	r := &shimFBRecorder{
+		in:            make(chan []byte, shimFBBuffer),
+		done:          make(chan bool),
+		file:          f,
+		w:             gzip.NewWriter(f),
+		name:          filename,
+		maxSize:       maxSize,
+		start:         time.Now(),
+		prev:          time.Now(),
+		bytesPerPixel: 4,
+	}
+
+	go r.run()
+
+	return r, nil
+}
+
+// Stop flushes and closes the recording. The tee writer must no longer be in
+// use (the recorder lock in Route/RouteFB guarantees this).
+func (r *shimFBRecorder) Stop() error {
+	close(r.in)
+	<-r.done
+
+	return nil
+}
+
+// clientMessage updates framing state from a client-to-server message seen by
+// the proxy.
+func (r *shimFBRecorder) clientMessage(msg interface{}) {
+	if msg, ok := msg.(*SetPixelFormat); ok {
+		r.mu.Lock()
+		r.bytesPerPixel = int(msg.BitsPerPixel) / 8
+		r.mu.Unlock()
+	}
+}
+
+// route queues server-to-client bytes for recording, never blocking the
+// proxy. b must not be reused by the caller.
+func (r *shimFBRecorder) route(b []byte) {
+	select {
+	case r.in <- b:
+	default:
+		atomic.AddInt64(&r.dropped, int64(len(b)))
+	}
+}
+
+// fill blocks until buf holds at least n bytes, pulling from the proxy tee.
+// Returns false when the recording has been stopped.
+func (r *shimFBRecorder) fill(buf *bytes.Buffer, n int) bool {
+	for buf.Len() < n {
+		b, ok := <-r.in
+		if !ok {
+			return false
+		}
+
+		buf.Write(b)
+	}
+
+	return true
+}
+
+func (r *shimFBRecorder) run() {
+	defer close(r.done)
+
+	var pending bytes.Buffer
+
+	for {
+		if dropped := atomic.SwapInt64(&r.dropped, 0); dropped > 0 {
+			// the framer fell behind and the proxy dropped bytes -- framing
+			// state is lost, so fall back to unframed chunks
+			log.Warn("vnc fb recording to %v dropped %v bytes", r.name, dropped)
+			r.passthrough = true
+		}
+
+		if r.passthrough {
+			if pending.Len() > 0 {
+				r.write(pending.Bytes())
+				pending.Reset()
+			}
+
+			b, ok := <-r.in
+			if !ok {
+				break
+			}
+
+			r.write(b)
+			continue
+		}
+
+		msg, ok := r.next(&pending)
+		if !ok {
+			break
+		}
+
+		if msg != nil {
+			r.write(msg)
+		}
+	}
+
+	if total := atomic.LoadInt64(&r.skipped); total > 0 {
+		log.Info("vnc fb recording to %v skipped %v unframeable bytes", r.name, total)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if err := r.w.Close(); err != nil {
+		log.Error("unable to flush vnc fb recording: %v", err)
+	}
+	if err := r.file.Close(); err != nil {
+		log.Error("unable to close vnc fb recording: %v", err)
+	}
+}
+
+// next frames the next server-to-client message, returning its bytes. A nil
+// message with ok set means no message could be framed (bytes were skipped or
+// the recorder switched to passthrough).
+func (r *shimFBRecorder) next(pending *bytes.Buffer) ([]byte, bool) {
+	if !r.fill(pending, 1) {
+		return nil, false
+	}
+
+	var n int // total message length, once known
+
+	switch pending.Bytes()[0] {
+	case TypeFramebufferUpdate:
+		// type + padding + number-of-rectangles
+		if !r.fill(pending, 4) {
+			return nil, false
+		}
+
+		rects := int(binary.BigEndian.Uint16(pending.Bytes()[2:4]))
+
+		r.mu.Lock()
+		bytesPerPixel := r.bytesPerPixel
+		r.mu.Unlock()
+
+		n = 4
+		for i := 0; i < rects; i++ {
+			// rectangle header: x, y, width, height, encoding
+			if !r.fill(pending, n+12) {
+				return nil, false
+			}
+
+			hdr := pending.Bytes()[n : n+12]
+			width := int(binary.BigEndian.Uint16(hdr[4:6]))
+			height := int(binary.BigEndian.Uint16(hdr[6:8]))
+			encoding := int32(binary.BigEndian.Uint32(hdr[8:12]))
+
+			n += 12
+
+			switch encoding {
+			case RawEncoding:
+				n += width * height * bytesPerPixel
+			case DesktopSizePseudoEncoding:
+				// no payload
+			case CursorPseudoEncoding:
+				n += width*height*bytesPerPixel + ((width+7)/8)*height
+			default:
+				// we can't size this rectangle so we can't find the end of
+				// the message -- record the raw stream from here on out
+				log.Warn("vnc fb recording to %v: unframeable encoding %v", r.name, encoding)
+				r.passthrough = true
+				return nil, true
+			}
+		}
+	case TypeSetColorMapEntries:
+		// type + padding + first-color + number-of-colors
+		if !r.fill(pending, 6) {
+			return nil, false
+		}
+
+		colors := int(binary.BigEndian.Uint16(pending.Bytes()[4:6]))
+		n = 6 + 6*colors
+	case TypeBell:
+		n = 1
+	case TypeServerCutText:
+		// type + padding + length
+		if !r.fill(pending, 8) {
+			return nil, false
+		}
+
+		n = 8 + int(binary.BigEndian.Uint32(pending.Bytes()[4:8]))
+	default:
+		// mid-stream garbage, most likely handshake bytes from a connection
+		// that predates the recording -- drop a byte and hunt for a message
+		// boundary
+		pending.Next(1)
+		atomic.AddInt64(&r.skipped, 1)
+		return nil, true
+	}
+
+	if !r.fill(pending, n) {
+		return nil, false
+	}
+
+	msg := make([]byte, n)
+	copy(msg, pending.Bytes())
+	pending.Next(n)
+
+	return msg, true
+}
+
+// write appends a timestamped chunk to the recording, rotating the file first
+// if it has grown past maxSize.
+func (r *shimFBRecorder) write(b []byte) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.maxSize > 0 && r.size >= r.maxSize {
+		if err := r.rotate(); err != nil {
+			log.Error("unable to rotate vnc fb recording: %v", err)
+			return
+		}
+	}
+
+	offset := time.Now().Sub(r.prev).Nanoseconds()
+	header := fmt.Sprintf("%d %d\r\n", offset, len(b))
+
+	if _, err := io.WriteString(r.w, header); err != nil {
+		log.Error("unable to write vnc fb chunk header: %v", err)
+		return
+	}
+	if _, err := r.w.Write(b); err != nil {
+		log.Error("unable to write vnc fb chunk: %v", err)
+		return
+	}
+	if _, err := io.WriteString(r.w, "\r\n"); err != nil {
+		log.Error("unable to write vnc fb chunk trailer: %v", err)
+		return
+	}
+
+	r.prev = time.Now()
+	r.size += int64(len(header) + len(b) + 2)
+}
+
+// rotate closes the current file, moves it aside, and starts a fresh one.
+// Must be called with the recorder lock held.
+func (r *shimFBRecorder) rotate() error {
+	if err := r.w.Close(); err != nil {
+		return err
+	}
+	if err := r.file.Close(); err != nil {
+		return err
+	}
+
+	if err := os.Rename(r.name, r.name+".1"); err != nil {
+		return err
+	}
+
+	f, err := os.Create(r.name)
+	if err != nil {
+		return err
+	}
+
+	r.file = f
+	r.w = gzip.NewWriter(f)
+	r.size = 0
+
+	return nil
+}
@@ -0,0 +1,131 @@
+// Copyright 2019-2021 National Technology & Engineering Solutions of Sandia, LLC (NTESS).
+// Under the terms of Contract DE-NA0003525 with NTESS, the U.S. Government retains certain
+// rights in this software.
+
+package vnc
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// readChunks decompresses a shim fb recording and returns the framed chunks.
+func readChunks(t *testing.T, filename string) [][]byte {
+	f, err := os.Open(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	gr, err := gzip.NewReader(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var res [][]byte
+
+	r := bufio.NewReader(gr)
+	for {
+		header, err := r.ReadString('\n')
+		if err != nil {
+			break
+		}
+
+		var offset, n int
+		if _, err := fmt.Sscanf(header, "%d %d", &offset, &n); err != nil {
+			t.Fatalf("malformed chunk header: %q", header)
+		}
+
+		// chunk plus trailing \r\n
+		b := make([]byte, n+2)
+		if _, err := io.ReadFull(r, b); err != nil {
+			t.Fatal(err)
+		}
+
+		res = append(res, b[:n])
+	}
+
+	return res
+}
+
+func TestShimFBFraming(t *testing.T) {
+	dir, err := ioutil.TempDir("", "vnc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	fname := filepath.Join(dir, "test.fbs")
+
+	r, err := newShimFBRecorder(fname, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a FramebufferUpdate with one 2x2 raw rectangle at 32bpp
+	var update bytes.Buffer
+	update.Write([]byte{TypeFramebufferUpdate, 0})
+	binary.Write(&update, binary.BigEndian, uint16(1))             // rectangles
+	binary.Write(&update, binary.BigEndian, [4]uint16{0, 0, 2, 2}) // x, y, w, h
+	binary.Write(&update, binary.BigEndian, int32(RawEncoding))
+	update.Write(bytes.Repeat([]byte{0xab}, 2*2*4)) // pixels
+
+	// garbage resembling handshake bytes that precede the first message
+	r.route([]byte("RFB 003.008\n"))
+	r.route(update.Bytes())
+	r.route([]byte{TypeBell})
+
+	if err := r.Stop(); err != nil {
+		t.Fatal(err)
+	}
+
+	chunks := readChunks(t, fname)
+
+	if len(chunks) != 2 {
+		t.Fatalf("got %v chunks, want 2", len(chunks))
+	}
+	if !bytes.Equal(chunks[0], update.Bytes()) {
+		t.Errorf("framebuffer update not framed correctly: %v", chunks[0])
+	}
+	if !bytes.Equal(chunks[1], []byte{TypeBell}) {
+		t.Errorf("bell not framed correctly: %v", chunks[1])
+	}
+}
+
+func TestShimFBRotate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "vnc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	fname := filepath.Join(dir, "test.fbs")
+
+	// small cap so the second bell rotates the file
+	r, err := newShimFBRecorder(fname, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r.route([]byte{TypeBell})
+	r.route([]byte{TypeBell})
+
+	if err := r.Stop(); err != nil {
+		t.Fatal(err)
+	}
+
+	if chunks := readChunks(t, fname); len(chunks) != 1 {
+		t.Errorf("got %v chunks in current file, want 1", len(chunks))
+	}
+	if chunks := readChunks(t, fname+".1"); len(chunks) != 1 {
+		t.Errorf("got %v chunks in rotated file, want 1", len(chunks))
+	}
+}